@@ -169,7 +169,8 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	scanner.Buffer(scanBuf, maxBufferSize)
 	for scanner.Scan() {
 		var errorResponse struct {
-			Error string `json:"error,omitempty"`
+			Error      string          `json:"error,omitempty"`
+			Diagnostic *LoadDiagnostic `json:"diagnostic,omitempty"`
 		}
 
 		bts := scanner.Bytes()
@@ -177,6 +178,14 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return fmt.Errorf("unmarshal: %w", err)
 		}
 
+		if errorResponse.Diagnostic != nil {
+			return StatusError{
+				StatusCode:   response.StatusCode,
+				ErrorMessage: errorResponse.Error,
+				Diagnostic:   errorResponse.Diagnostic,
+			}
+		}
+
 		if errorResponse.Error != "" {
 			return fmt.Errorf(errorResponse.Error)
 		}
@@ -216,6 +225,25 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 	})
 }
 
+// GenerateBatchResponseFunc is a function that [Client.GenerateBatch] invokes
+// every time a response is received from the service. If this function returns
+// an error, [Client.GenerateBatch] will stop generating and return this error.
+type GenerateBatchResponseFunc func(GenerateBatchResponse) error
+
+// GenerateBatch generates responses for several prompts at the same time. fn
+// is called for each response; responses for different prompts are
+// interleaved and identified by their Index.
+func (c *Client) GenerateBatch(ctx context.Context, req *GenerateBatchRequest, fn GenerateBatchResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/generate/batch", req, func(bts []byte) error {
+		var resp GenerateBatchResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // ChatResponseFunc is a function that [Client.Chat] invokes every time
 // a response is received from the service. If this function returns an error,
 // [Client.Chat] will stop generating and return this error.
@@ -236,6 +264,25 @@ func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc
 	})
 }
 
+// ChatBatchResponseFunc is a function that [Client.ChatBatch] invokes every
+// time a response is received from the service. If this function returns an
+// error, [Client.ChatBatch] will stop generating and return this error.
+type ChatBatchResponseFunc func(ChatBatchResponse) error
+
+// ChatBatch responds to several chat requests at the same time. fn is called
+// for each response; responses for different requests are interleaved and
+// identified by their Index.
+func (c *Client) ChatBatch(ctx context.Context, req *ChatBatchRequest, fn ChatBatchResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/chat/batch", req, func(bts []byte) error {
+		var resp ChatBatchResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // PullProgressFunc is a function that [Client.Pull] invokes every time there
 // is progress with a "pull" request sent to the service. If this function
 // returns an error, [Client.Pull] will stop the process and return this error.
@@ -321,6 +368,21 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	return nil
 }
 
+// CreateAlias creates an alias which resolves to another model, replacing an
+// existing alias with the same name.
+func (c *Client) CreateAlias(ctx context.Context, req *AliasRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/aliases", req, nil)
+}
+
+// ListAliases lists the aliases and the models they resolve to.
+func (c *Client) ListAliases(ctx context.Context) (*ListAliasesResponse, error) {
+	var resp ListAliasesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/aliases", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -365,6 +427,200 @@ func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*Embedd
 	return &resp, nil
 }
 
+// Tokenize converts a batch of strings into token IDs using a model's tokenizer.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CountTokens counts the tokens in the content of a conversation, by role,
+// using the model's tokenizer.
+func (c *Client) CountTokens(ctx context.Context, model string, req *TokenCountRequest) (*TokenCountResponse, error) {
+	var resp TokenCountResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/tokens/count", model), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Capabilities reports what a model supports, such as images and tool calls.
+func (c *Client) Capabilities(ctx context.Context, model string) (*CapabilitiesResponse, error) {
+	var resp CapabilitiesResponse
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/models/%s/capabilities", url.PathEscape(model)), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FineTuneData describes the data a model was fine-tuned on, from its
+// metadata.
+func (c *Client) FineTuneData(ctx context.Context, model string) (*FineTuneDataResponse, error) {
+	var resp FineTuneDataResponse
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/models/%s/fine-tune-data", url.PathEscape(model)), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ContextWindow shows how the prompt of a chat would be laid out in the
+// context window of a model, by the tokens each of its components takes.
+func (c *Client) ContextWindow(ctx context.Context, model string, req *ChatRequest) (*ContextWindowResponse, error) {
+	var resp ContextWindowResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/context-window", url.PathEscape(model)), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PruneContext shortens a conversation to fit in a number of tokens by having
+// the model summarize its oldest messages.
+func (c *Client) PruneContext(ctx context.Context, model string, req *PruneContextRequest) (*PruneContextResponse, error) {
+	var resp PruneContextResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/prune-context", url.PathEscape(model)), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ContextStats reports the KV cache utilization of a loaded model.
+func (c *Client) ContextStats(ctx context.Context, model string) (*ContextStatsResponse, error) {
+	var resp ContextStatsResponse
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/models/%s/context-stats", model), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Benchmark measures the prompt evaluation and generation speed of a model.
+func (c *Client) Benchmark(ctx context.Context, req *BenchmarkRequest) (*BenchmarkResponse, error) {
+	var resp BenchmarkResponse
+	if err := c.do(ctx, http.MethodPost, "/api/benchmark", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Sweep generates a response to the same prompt for every combination of the
+// option values in req's grid.
+func (c *Client) Sweep(ctx context.Context, req *SweepRequest) (*SweepResponse, error) {
+	var resp SweepResponse
+	if err := c.do(ctx, http.MethodPost, "/api/sweep", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ValidateTemplate parses a template and reports which fields it references.
+func (c *Client) ValidateTemplate(ctx context.Context, req *TemplateValidateRequest) (*TemplateValidateResponse, error) {
+	var resp TemplateValidateResponse
+	if err := c.do(ctx, http.MethodPost, "/api/template/validate", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TestChatTemplate renders a template, or the model's template, with the
+// messages and tools in req without loading the model.
+func (c *Client) TestChatTemplate(ctx context.Context, model string, req *ChatTemplateTestRequest) (*ChatTemplateTestResponse, error) {
+	var resp ChatTemplateTestResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/chat-template/test", url.PathEscape(model)), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListChatExamples lists the few-shot examples stored for a model.
+func (c *Client) ListChatExamples(ctx context.Context, model string) (*ListChatExamplesResponse, error) {
+	var resp ListChatExamplesResponse
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/models/%s/chat-examples", url.PathEscape(model)), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateChatExample stores a few-shot example for a model and returns it
+// with its ID.
+func (c *Client) CreateChatExample(ctx context.Context, model string, req *ChatExampleRequest) (*ChatExample, error) {
+	var resp ChatExample
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/chat-examples", url.PathEscape(model)), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteChatExample removes a few-shot example from a model.
+func (c *Client) DeleteChatExample(ctx context.Context, model, id string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/models/%s/chat-examples/%s", url.PathEscape(model), url.PathEscape(id)), nil, nil)
+}
+
+// ExportChatCode returns code in the requested language which sends the chat
+// request.
+func (c *Client) ExportChatCode(ctx context.Context, req *ChatExportCodeRequest) (*ChatExportCodeResponse, error) {
+	var resp ChatExportCodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/chat/export/code", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListRequests lists in flight streaming generate and chat requests.
+func (c *Client) ListRequests(ctx context.Context) (*ListRequestsResponse, error) {
+	var resp ListRequestsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/requests", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Stop cancels an in flight streaming generate or chat request.
+func (c *Client) Stop(ctx context.Context, req *StopRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/stop", req, nil)
+}
+
+// CreateFragment registers a named prompt fragment which can be referenced
+// by chat requests.
+func (c *Client) CreateFragment(ctx context.Context, req *FragmentRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/fragments", req, nil)
+}
+
+// DeleteFragment removes a prompt fragment.
+func (c *Client) DeleteFragment(ctx context.Context, req *DeleteFragmentRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/fragments", req, nil)
+}
+
+// ListTemplates lists the templates in the server's template library.
+func (c *Client) ListTemplates(ctx context.Context) (*ListTemplatesResponse, error) {
+	var resp ListTemplatesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/templates", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ShowTemplate returns a template from the server's template library with its
+// source.
+func (c *Client) ShowTemplate(ctx context.Context, name string) (*ShowTemplateResponse, error) {
+	var resp ShowTemplateResponse
+	if err := c.do(ctx, http.MethodGet, "/api/templates/"+url.PathEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateTemplate adds a named template to the server's template library,
+// replacing any existing template with the same name.
+func (c *Client) CreateTemplate(ctx context.Context, req *TemplateRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/templates", req, nil)
+}
+
+// DeleteTemplate removes a template from the server's template library.
+func (c *Client) DeleteTemplate(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/templates/"+url.PathEscape(name), nil, nil)
+}
+
 // CreateBlob creates a blob from a file on the server. digest is the
 // expected SHA256 digest of the file, and r represents the file.
 func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) error {
@@ -1,15 +1,19 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // StatusError is an error with and HTTP status code.
@@ -17,6 +21,9 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// Diagnostic is set if the request failed because the model failed to load
+	Diagnostic *LoadDiagnostic `json:"diagnostic,omitempty"`
 }
 
 func (e StatusError) Error() string {
@@ -36,6 +43,52 @@ func (e StatusError) Error() string {
 // ImageData represents the raw binary data of an image file.
 type ImageData []byte
 
+// UnmarshalJSON decodes a base64 encoded image. The image may also be a
+// base64 data URL, e.g. data:image/jpeg;base64,...
+func (i *ImageData) UnmarshalJSON(b []byte) error {
+	bts, err := unmarshalBase64(b, "image")
+	if err != nil {
+		return err
+	}
+
+	*i = bts
+	return nil
+}
+
+// unmarshalBase64 decodes a JSON string holding base64 encoded data or a base64
+// data URL. kind names the data in errors
+func unmarshalBase64(b []byte, kind string) ([]byte, error) {
+	var s *string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+
+	if s == nil {
+		return nil, nil
+	}
+
+	data := *s
+	if rest, ok := strings.CutPrefix(data, "data:"); ok {
+		mediatype, payload, ok := strings.Cut(rest, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s data URL: missing ','", kind)
+		}
+
+		if !strings.HasSuffix(mediatype, ";base64") {
+			return nil, fmt.Errorf("invalid %s data URL: data must be base64 encoded", kind)
+		}
+
+		data = payload
+	}
+
+	bts, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s data: %w", kind, err)
+	}
+
+	return bts, nil
+}
+
 // GenerateRequest describes a request sent by [Client.Generate]. While you
 // have to specify the Model and Prompt fields, all the other fields have
 // reasonable defaults for basic uses.
@@ -47,6 +100,10 @@ type GenerateRequest struct {
 	// Prompt is the textual prompt to send to the model.
 	Prompt string `json:"prompt"`
 
+	// Suffix is the text after the response for fill-in-the-middle models.
+	// The model generates the text between Prompt and Suffix.
+	Suffix string `json:"suffix,omitempty"`
+
 	// System overrides the model's default system message/prompt.
 	System string `json:"system"`
 
@@ -57,6 +114,11 @@ type GenerateRequest struct {
 	// Generate call. It can be used to keep a short conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Tokens is an optional pre-tokenized prompt. The tokens are sent to the
+	// model as is, without applying the template. Tokens can't be combined
+	// with Prompt, Context or Images.
+	Tokens []int `json:"tokens,omitempty"`
+
 	// Stream specifies whether the response is streaming; it is true by default.
 	Stream *bool `json:"stream,omitempty"`
 
@@ -66,19 +128,61 @@ type GenerateRequest struct {
 	// Format specifies the format to return a response in.
 	Format string `json:"format"`
 
+	// Grammar is a grammar in llama.cpp's GBNF format which the response must
+	// follow, starting at its root rule. It can't be combined with Format.
+	Grammar string `json:"grammar,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Timeout limits how long the request may take, including loading the
+	// model. When it's exceeded, generation stops and the response ends with
+	// what was generated so far and a DoneReason of "timeout".
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Phases labels streamed responses with the phase of the request, so
+	// clients see progress while the prompt is processed rather than
+	// nothing until the first token. See [GenerateResponse.Phase].
+	Phases bool `json:"phases,omitempty"`
+
 	// Images is an optional list of base64-encoded images accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// Tools is an optional list of tools the model has access to. Tool calls
+	// are returned in [GenerateResponse.ToolCalls] when not streaming.
+	Tools []Tool `json:"tools,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
 }
 
+// GenerateBatchRequest describes a request sent by [Client.GenerateBatch].
+type GenerateBatchRequest struct {
+	// Model is the model name, as in [GenerateRequest].
+	Model string `json:"model"`
+
+	// Prompts are the prompts to generate responses for. They are generated
+	// at the same time and their responses are interleaved.
+	Prompts []string `json:"prompts"`
+
+	// System overrides the model's default system message/prompt for every
+	// prompt.
+	System string `json:"system"`
+
+	// Format specifies the format to return responses in.
+	Format string `json:"format"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
 // ChatRequest describes a request sent by [Client.Chat].
 type ChatRequest struct {
 	// Model is the model name, as in [GenerateRequest].
@@ -93,17 +197,107 @@ type ChatRequest struct {
 	// Format is the format to return the response in (e.g. "json").
 	Format string `json:"format"`
 
+	// Grammar is a GBNF grammar the response must follow, as in
+	// [GenerateRequest].
+	Grammar string `json:"grammar,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded into memory
 	// followin the request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Timeout limits how long the request may take, as in [GenerateRequest].
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Phases labels streamed responses with the phase of the request, as in
+	// [GenerateRequest].
+	Phases bool `json:"phases,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools []Tool `json:"tools,omitempty"`
 
+	// Documents is an optional list of documents the model grounds its
+	// response in, for models whose template supports them.
+	Documents []Document `json:"documents,omitempty"`
+
+	// System overrides the model's default system message when Messages
+	// doesn't start with a system message. If nil, the model's default is used;
+	// if set to the empty string, no system message is added.
+	System *string `json:"system,omitempty"`
+
+	// SystemRefs lists prompt fragments, registered with [Client.CreateFragment],
+	// which are added as system messages in order.
+	SystemRefs []string `json:"system_refs,omitempty"`
+
+	// Template is the name of a template, registered with
+	// [Client.CreateTemplate], which is used instead of the model's template.
+	Template string `json:"template,omitempty"`
+
+	// SessionID keeps the chat's history on the server between requests with
+	// the same ID, so only new messages need to be sent.
+	SessionID string `json:"session_id,omitempty"`
+
+	// ReasoningSteps separates the reasoning a model writes between <think>
+	// and </think> at the start of its response from the message content.
+	// Each step of the reasoning, separated by blank lines, is streamed as a
+	// response with Step set once it's complete.
+	ReasoningSteps bool `json:"reasoning_steps,omitempty"`
+
+	// TemperatureSchedule sets the temperature by the turn of the chat, the
+	// number of assistant messages before the response. The step with the
+	// latest Turn at or before the current turn overrides the temperature
+	// option.
+	TemperatureSchedule []TemperatureStep `json:"temperature_schedule,omitempty"`
+
+	// IncludeSystem returns the system prompt the template received, after
+	// fragments were added and messages were truncated, in
+	// [ChatResponse.SystemRendered].
+	IncludeSystem bool `json:"include_system,omitempty"`
+
+	// IncludeExamples adds the few-shot examples stored for the model with
+	// [Client.CreateChatExample] after the system messages at the start of
+	// Messages.
+	IncludeExamples bool `json:"include_examples,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
 
+// TemperatureStep is the temperature used from a turn of a chat in
+// [ChatRequest.TemperatureSchedule].
+type TemperatureStep struct {
+	Turn        int     `json:"turn"`
+	Temperature float32 `json:"temperature"`
+}
+
+// ChatBatchRequest describes a request sent by [Client.ChatBatch].
+type ChatBatchRequest struct {
+	// Requests are the chat requests to respond to. Their responses are
+	// always streamed, regardless of their Stream field, and are interleaved.
+	Requests []ChatRequest `json:"requests"`
+
+	// Parallel is the maximum number of requests whose prompts are assembled
+	// at the same time. It defaults to the number of CPUs.
+	Parallel int `json:"parallel,omitempty"`
+}
+
+// ChatExportCodeRequest is the request passed to [Client.ExportChatCode].
+type ChatExportCodeRequest struct {
+	ChatRequest
+
+	// Language is the language to export the chat request in: "curl",
+	// "python" or "go".
+	Language string `json:"language"`
+}
+
+// ChatExportCodeResponse is the response from [Client.ExportChatCode].
+type ChatExportCodeResponse struct {
+	Language string `json:"language"`
+
+	// Code sends the chat request. Only options which differ from their
+	// default value are included.
+	Code string `json:"code"`
+}
+
 // Message is a single message in a chat sequence. The message contains the
 // role ("system", "user", or "assistant"), the content and an optional list
 // of images.
@@ -112,6 +306,47 @@ type Message struct {
 	Content   string      `json:"content,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// ToolCallID is the ID of the tool call a tool message answers. Templates
+	// for formats which reference tool calls by ID, such as Mistral's v3
+	// format, render it with the tool result.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+
+	// ToolResults holds the content of the tool messages answering ToolCalls
+	// when they are merged into the assistant message. It is only set while
+	// rendering templates that use {{ .ToolResults }}.
+	ToolResults []string `json:"-"`
+
+	// Partial marks the final assistant message of a chat request as
+	// incomplete. The model continues this message instead of starting a
+	// new one and only the continuation is returned.
+	Partial bool `json:"partial,omitempty"`
+
+	// Citations are the spans of Content the model grounded in the request's
+	// Documents. They're only set on responses which aren't streamed.
+	Citations []Citation `json:"citations,omitempty"`
+}
+
+// Document is a document passed to a model in a [ChatRequest] which the
+// model can cite in its response.
+type Document struct {
+	// ID identifies the document in citations. It defaults to the document's
+	// index in the request.
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title,omitempty"`
+	Text  string `json:"text"`
+}
+
+// Citation is a span of a response's content which is grounded in one or
+// more documents.
+type Citation struct {
+	// Start and End are the byte offsets of the span in the content.
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+
+	// Documents are the IDs of the documents cited.
+	Documents []string `json:"documents"`
 }
 
 type ToolCall struct {
@@ -162,9 +397,64 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// Seed is the seed used to sample the response. It is only set on the
+	// final response.
+	Seed *int `json:"seed,omitempty"`
+
+	// TemplateVersion is the digest of the template used to build the prompt.
+	// It changes when the model's template changes. It is only set on the
+	// final response.
+	TemplateVersion string `json:"template_version,omitempty"`
+
+	// SystemRendered is the system prompt used to build the prompt when
+	// [ChatRequest.IncludeSystem] is set: the content of the system messages
+	// which were kept, joined by blank lines. It is only set on the final
+	// response.
+	SystemRendered string `json:"system_rendered,omitempty"`
+
+	// RequestID identifies a streaming request so it can be stopped with
+	// [Client.Stop]. It is only set on the first response.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Warnings describe options which were ignored or clamped, e.g.
+	// "num_gpu clamped to 33 (model has 33 layers)". They are only set on
+	// the first response.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Step is a completed reasoning step when [ChatRequest.ReasoningSteps] is
+	// set. Responses with a step have no message content.
+	Step *ReasoningStep `json:"step,omitempty"`
+
+	// Steps are the reasoning steps of a response which isn't streamed.
+	Steps []ReasoningStep `json:"steps,omitempty"`
+
+	// Phase and Progress are set when [ChatRequest.Phases] is set, as in
+	// [GenerateResponse].
+	Phase    string         `json:"phase,omitempty"`
+	Progress *PhaseProgress `json:"progress,omitempty"`
+
 	Metrics
 }
 
+// ReasoningStep is a step of the reasoning a model writes before its answer.
+type ReasoningStep struct {
+	// Index is the position of the step in the reasoning, starting at 0.
+	Index   int    `json:"index"`
+	Content string `json:"content"`
+}
+
+// PhaseProgress is the progress of a request through its current phase, in
+// tokens.
+type PhaseProgress struct {
+	// Completed is the number of tokens processed or generated so far.
+	Completed int `json:"completed"`
+
+	// Total is the number of tokens in the phase: the prompt's tokens while
+	// it's processed, and num_predict while generating. It's 0 if the number
+	// of tokens to generate isn't limited.
+	Total int `json:"total,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -172,6 +462,17 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// RunnerRSSPeak is the most resident memory, in bytes, of the whole runner
+	// process while handling the request. It includes memory used by the model
+	// and by requests handled alongside it. MemoryEstimateGPU is the VRAM, in
+	// bytes, the scheduler estimated for the model when it was loaded
+	RunnerRSSPeak     uint64 `json:"runner_rss_peak,omitempty"`
+	MemoryEstimateGPU uint64 `json:"memory_estimate_gpu,omitempty"`
+
+	// PromptTruncatedCount is the number of prompt tokens left out of a chat
+	// to fit the context window. It is only set on the final chat response
+	PromptTruncatedCount int `json:"prompt_truncated_count,omitempty"`
 }
 
 // Options specified in [GenerateRequest], if you add a new option here add it
@@ -197,6 +498,66 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+	StopTokens       []int    `json:"stop_tokens,omitempty"`
+
+	// LogitBias is added to the logits of token IDs when sampling, e.g.
+	// {"15043": -100} to suppress token 15043. Biases are clamped to
+	// [-100, 100]
+	LogitBias map[int]float32 `json:"logit_bias,omitempty"`
+
+	// RepeatSystemEvery repeats the system messages every n user turns in
+	// chat prompts. It is disabled when zero
+	RepeatSystemEvery int `json:"repeat_system_every,omitempty"`
+
+	// MinMessagesPerRole is the number of the latest messages of each role,
+	// e.g. {"assistant": 2}, which are kept when a chat is truncated to fit
+	// the context window
+	MinMessagesPerRole map[string]int `json:"min_messages_per_role,omitempty"`
+
+	// KeepSystem keeps system messages when a chat is truncated to fit the
+	// context window. If false, the oldest system messages are truncated when
+	// the latest message doesn't fit with them
+	KeepSystem bool `json:"keep_system,omitempty"`
+
+	// TruncateKeep truncates the latest message of a chat when it doesn't fit
+	// in the context window on its own, keeping its "head" or its "tail". The
+	// message is left as is when empty
+	TruncateKeep string `json:"truncate_keep,omitempty"`
+
+	// SummarizeTruncated has the model summarize the messages truncated from
+	// a chat to fit the context window. The summary is added as a system
+	// message in their place
+	SummarizeTruncated bool `json:"summarize_truncated,omitempty"`
+
+	// TrailingAssistant sets what happens when a chat ends with an assistant
+	// message which isn't partial: "error" rejects the chat, "ignore" drops
+	// the message and "prefill" continues it as if it were partial. The
+	// message is rendered as a complete turn when empty
+	TrailingAssistant string `json:"trailing_assistant,omitempty"`
+
+	// ResponseSchema is a JSON Schema the complete chat response must match.
+	// Responses which don't match are replaced with an error
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+
+	// TrimResponse removes whitespace, as defined by Unicode, from the start
+	// and end of complete responses: responses which aren't streamed, and the
+	// final response of a stream when response filters send the whole text
+	// with it. Streamed chunks are sent as generated
+	TrimResponse bool `json:"trim_response,omitempty"`
+
+	// ImageMaxSide scales images down to fit within ImageMaxSide x
+	// ImageMaxSide pixels and re-encodes them as JPEG before they're sent to
+	// the model. It is disabled when zero
+	ImageMaxSide int `json:"image_max_side,omitempty"`
+
+	// ImageQuality is the JPEG quality, from 1 to 100, of images re-encoded
+	// for ImageMaxSide. It defaults to 75
+	ImageQuality int `json:"image_quality,omitempty"`
+
+	// ImageErrors sets what happens to images which can't be decoded: "fail"
+	// rejects the request and "skip" leaves them out with a warning. Images
+	// are sent to the model without being checked when empty
+	ImageErrors string `json:"image_errors,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -213,6 +574,16 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// NumCtxFraction sets NumCtx to a fraction, between 0 and 1, of the
+	// context length the model was trained with. NumCtx takes precedence
+	// if both are set
+	NumCtxFraction float64 `json:"num_ctx_fraction,omitempty"`
+
+	// NumCache limits the KV cache of a loaded model, in tokens, across all
+	// of its parallel requests. NumCtx is reduced to fit and fewer requests
+	// are run in parallel. It is unlimited when zero
+	NumCache int `json:"num_cache,omitempty"`
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -237,6 +608,9 @@ type EmbedRequest struct {
 type EmbedResponse struct {
 	Model      string      `json:"model"`
 	Embeddings [][]float32 `json:"embeddings"`
+
+	// Warnings describe options which were ignored or clamped.
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // EmbeddingRequest is the request passed to [Client.Embeddings].
@@ -260,6 +634,233 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Input is the list of strings to tokenize.
+	Input []string `json:"input"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize]. Tokens holds one
+// list of token IDs per input, in the same order as the request.
+type TokenizeResponse struct {
+	Model  string  `json:"model"`
+	Tokens [][]int `json:"tokens"`
+}
+
+// StopRequest is the request passed to [Client.Stop].
+type StopRequest struct {
+	// RequestID is the request ID from the first response of a streaming
+	// generate or chat request.
+	RequestID string `json:"request_id"`
+}
+
+// ListRequestsResponse is the response from [Client.ListRequests].
+type ListRequestsResponse struct {
+	Requests []ActiveRequest `json:"requests"`
+}
+
+// ActiveRequest is a single streaming request in [ListRequestsResponse].
+type ActiveRequest struct {
+	// RequestID identifies the request so it can be stopped with
+	// [Client.Stop].
+	RequestID string `json:"request_id"`
+
+	Model string `json:"model"`
+
+	// Status is "queued" while the request waits for the model to be
+	// loaded and "running" once it has been.
+	Status string `json:"status"`
+
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+// TokenCountRequest is the request passed to [Client.CountTokens].
+type TokenCountRequest struct {
+	// Messages are the messages to count tokens for. Their content is
+	// tokenized as is, without rendering the model's chat template.
+	Messages []Message `json:"messages"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// TokenCountResponse is the response from [Client.CountTokens].
+type TokenCountResponse struct {
+	// Total is the number of tokens in all messages.
+	Total int `json:"total"`
+
+	// ByRole is the number of tokens in the messages of each role.
+	ByRole map[string]int `json:"by_role"`
+}
+
+// ContextWindowResponse is the response from [Client.ContextWindow].
+type ContextWindowResponse struct {
+	// TotalTokens is the number of tokens in the prompt of the chat,
+	// including its images.
+	TotalTokens int `json:"total_tokens"`
+
+	// NumCtx is the size of the context window the chat would be run with.
+	NumCtx int `json:"num_ctx"`
+
+	// Breakdown is the number of tokens each component of the chat takes.
+	// Only components which appear in the chat are listed, except history.
+	Breakdown []ContextWindowComponent `json:"breakdown"`
+}
+
+// ContextWindowComponent is the number of tokens a component of a chat takes
+// in its prompt.
+type ContextWindowComponent struct {
+	// Component is "system", "tool_definitions", "documents", "history" or
+	// "images".
+	Component string `json:"component"`
+
+	// Turns is the number of messages in the history.
+	Turns int `json:"turns,omitempty"`
+
+	// Count is the number of images.
+	Count int `json:"count,omitempty"`
+
+	Tokens int `json:"tokens"`
+}
+
+// PruneContextRequest is the request passed to [Client.PruneContext].
+type PruneContextRequest struct {
+	// Messages is the conversation to prune.
+	Messages []Message `json:"messages"`
+
+	// TargetTokens is the number of tokens the prompt of the pruned
+	// conversation should fit in.
+	TargetTokens int `json:"target_tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// PruneContextResponse is the response from [Client.PruneContext].
+type PruneContextResponse struct {
+	// Messages is the pruned conversation. The oldest messages are replaced
+	// by a system message summarizing them.
+	Messages []Message `json:"messages"`
+
+	// Tokens is the number of tokens in the prompt of the pruned
+	// conversation. It exceeds TargetTokens if the system messages and the
+	// latest message don't fit on their own.
+	Tokens int `json:"tokens"`
+}
+
+// BenchmarkRequest is the request passed to [Client.Benchmark].
+type BenchmarkRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// PromptTokens is the number of prompt tokens to evaluate. It defaults
+	// to 512.
+	PromptTokens int `json:"prompt_tokens,omitempty"`
+
+	// PredictTokens is the maximum number of tokens to generate. It defaults
+	// to 128.
+	PredictTokens int `json:"predict_tokens,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// BenchmarkResponse is the response from [Client.Benchmark].
+type BenchmarkResponse struct {
+	Model string `json:"model"`
+
+	PromptEvalCount       int           `json:"prompt_eval_count"`
+	PromptEvalDuration    time.Duration `json:"prompt_eval_duration"`
+	PromptTokensPerSecond float64       `json:"prompt_tokens_per_second"`
+
+	EvalCount       int           `json:"eval_count"`
+	EvalDuration    time.Duration `json:"eval_duration"`
+	TokensPerSecond float64       `json:"tokens_per_second"`
+
+	LoadDuration  time.Duration `json:"load_duration"`
+	TotalDuration time.Duration `json:"total_duration"`
+}
+
+// SweepRequest is the request passed to [Client.Sweep].
+type SweepRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the prompt generated for every combination of options.
+	Prompt string `json:"prompt"`
+
+	// System overrides the model's system message.
+	System string `json:"system,omitempty"`
+
+	// Format specifies the format to return the responses in.
+	Format string `json:"format,omitempty"`
+
+	// Grid lists the values to try for each option, e.g.
+	// {"temperature": [0.2, 0.8], "top_k": [10, 40]}. Every combination of
+	// the values is generated, up to 32 combinations.
+	Grid map[string][]interface{} `json:"grid"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options used for every combination. Grid
+	// values take precedence.
+	Options map[string]interface{} `json:"options"`
+}
+
+// SweepResponse is the response from [Client.Sweep].
+type SweepResponse struct {
+	Model string `json:"model"`
+
+	// Seed is the seed used for every combination, unless the grid sets it.
+	Seed int `json:"seed"`
+
+	// Results has a result for each combination of the grid's values, with
+	// the values of the last option in the grid, ordered by name, changing
+	// fastest.
+	Results []SweepResult `json:"results"`
+
+	TotalDuration time.Duration `json:"total_duration"`
+}
+
+// SweepResult is the response generated for one combination of a
+// [SweepRequest]'s grid.
+type SweepResult struct {
+	// Options are the grid's values for this combination.
+	Options map[string]interface{} `json:"options"`
+
+	Response   string `json:"response"`
+	DoneReason string `json:"done_reason,omitempty"`
+
+	// Error is set if generating this combination failed.
+	Error string `json:"error,omitempty"`
+
+	Metrics
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model     string `json:"model"`
@@ -316,6 +917,31 @@ type ShowResponse struct {
 type CopyRequest struct {
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
+
+	// Alias makes Destination an alias which resolves to Source instead of
+	// a copy of it.
+	Alias bool `json:"alias,omitempty"`
+}
+
+// AliasRequest is the request passed to [Client.CreateAlias].
+type AliasRequest struct {
+	// Alias is the name which resolves to Target.
+	Alias string `json:"alias"`
+
+	// Target is the model the alias resolves to. If it's an alias itself,
+	// the alias resolves to the model Target resolves to.
+	Target string `json:"target"`
+}
+
+// ListAliasesResponse is the response from [Client.ListAliases].
+type ListAliasesResponse struct {
+	Aliases []AliasResponse `json:"aliases"`
+}
+
+// AliasResponse is a single alias in [ListAliasesResponse].
+type AliasResponse struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
 }
 
 // PullRequest is the request passed to [Client.Pull].
@@ -337,6 +963,10 @@ type ProgressResponse struct {
 	Digest    string `json:"digest,omitempty"`
 	Total     int64  `json:"total,omitempty"`
 	Completed int64  `json:"completed,omitempty"`
+
+	// Transferred is the number of bytes sent over the network when pushing,
+	// which is less than Completed if the blob is compressed for upload
+	Transferred int64 `json:"transferred,omitempty"`
 }
 
 // PushRequest is the request passed to [Client.Push].
@@ -369,6 +999,9 @@ type ListModelResponse struct {
 	Size       int64        `json:"size"`
 	Digest     string       `json:"digest"`
 	Details    ModelDetails `json:"details,omitempty"`
+
+	// AliasOf is the name of the model an alias resolves to.
+	AliasOf string `json:"alias_of,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -380,6 +1013,16 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// SizeRAM is the size of the model in system memory
+	SizeRAM int64 `json:"size_ram"`
+
+	// GPULayers is the number of layers offloaded to GPUs
+	GPULayers int `json:"gpu_layers"`
+
+	// ContextLength is the context size allocated for the model, across all
+	// parallel requests
+	ContextLength int `json:"context_length"`
 }
 
 type RetrieveModelResponse struct {
@@ -417,9 +1060,279 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Seed is the seed used to sample the response. It is only set on the
+	// final response; sending it back as the seed option with the same prompt
+	// and options reproduces the response.
+	Seed *int `json:"seed,omitempty"`
+
+	// TemplateVersion is the digest of the template used to build the prompt.
+	// It changes when the model's template changes. It is only set on the
+	// final response and is empty for raw prompts.
+	TemplateVersion string `json:"template_version,omitempty"`
+
+	// RequestID identifies a streaming request so it can be stopped with
+	// [Client.Stop]. It is only set on the first response.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Warnings describe options which were ignored or clamped, e.g.
+	// "num_gpu clamped to 33 (model has 33 layers)". They are only set on
+	// the first response.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Phase is the phase of a streamed request when [GenerateRequest.Phases]
+	// is set: "prompt_eval" while the prompt is processed, then "generation"
+	// once the model generates its response. Responses in the prompt_eval
+	// phase have no content.
+	Phase string `json:"phase,omitempty"`
+
+	// Progress is the progress of the request through Phase.
+	Progress *PhaseProgress `json:"progress,omitempty"`
+
 	Metrics
 }
 
+// GenerateBatchResponse is a response streamed by [Client.GenerateBatch].
+type GenerateBatchResponse struct {
+	// Index is the position in [GenerateBatchRequest.Prompts] of the prompt
+	// the response belongs to.
+	Index int `json:"index"`
+
+	GenerateResponse
+}
+
+// ChatBatchResponse is a response streamed by [Client.ChatBatch].
+type ChatBatchResponse struct {
+	// Index is the position in [ChatBatchRequest.Requests] of the request
+	// the response belongs to.
+	Index int `json:"index"`
+
+	ChatResponse
+}
+
+// FragmentRequest is the request passed to [Client.CreateFragment].
+type FragmentRequest struct {
+	// Name is the name used to reference the fragment, e.g. in
+	// [ChatRequest.SystemRefs].
+	Name string `json:"name"`
+
+	// Model scopes the fragment to a model. If empty, the fragment is
+	// available to all models.
+	Model string `json:"model,omitempty"`
+
+	// Content is the text of the fragment.
+	Content string `json:"content"`
+}
+
+// DeleteFragmentRequest is the request passed to [Client.DeleteFragment].
+type DeleteFragmentRequest struct {
+	Name  string `json:"name"`
+	Model string `json:"model,omitempty"`
+}
+
+// ChatExample is a few-shot example stored for a model, which is added to
+// chats with [ChatRequest.IncludeExamples].
+type ChatExample struct {
+	// ID identifies the example so it can be deleted with
+	// [Client.DeleteChatExample].
+	ID string `json:"id"`
+
+	// Messages are the user and assistant messages of the example.
+	Messages []Message `json:"messages"`
+}
+
+// ChatExampleRequest is the request passed to [Client.CreateChatExample].
+type ChatExampleRequest struct {
+	Messages []Message `json:"messages"`
+}
+
+// ListChatExamplesResponse is the response from [Client.ListChatExamples].
+type ListChatExamplesResponse struct {
+	Examples []ChatExample `json:"examples"`
+}
+
+// TemplateRequest is the request passed to [Client.CreateTemplate].
+type TemplateRequest struct {
+	// Name is the name used to reference the template, e.g. in
+	// [ChatRequest.Template].
+	Name string `json:"name"`
+
+	// Template is the Go template source.
+	Template string `json:"template"`
+}
+
+// ListTemplatesResponse is the response from [Client.ListTemplates].
+type ListTemplatesResponse struct {
+	Templates []ListTemplateResponse `json:"templates"`
+}
+
+// ListTemplateResponse is a single template description in
+// [ListTemplatesResponse].
+type ListTemplateResponse struct {
+	Name       string    `json:"name"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Size       int64     `json:"size"`
+
+	// Digest identifies the version of the template. It changes whenever
+	// the template is updated.
+	Digest string `json:"digest"`
+}
+
+// ShowTemplateResponse is the response from [Client.ShowTemplate].
+type ShowTemplateResponse struct {
+	ListTemplateResponse
+
+	// Template is the Go template source.
+	Template string `json:"template"`
+}
+
+// LoadDiagnostic describes why a model failed to load. It's returned with the
+// error of requests which loaded the model, as "diagnostic".
+type LoadDiagnostic struct {
+	// Reason classifies the failure: "out_of_memory",
+	// "unsupported_architecture" or "corrupt_blob".
+	Reason string `json:"reason"`
+
+	// RequiredMemory and AvailableMemory are the memory, in bytes, the model
+	// needed and the memory which was available, if the model didn't fit.
+	RequiredMemory  uint64 `json:"required_memory,omitempty"`
+	AvailableMemory uint64 `json:"available_memory,omitempty"`
+
+	// Suggestion describes how the failure may be fixed.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// ContextStatsResponse is the response from [Client.ContextStats]. The counts
+// are summed over all loaded instances of the model.
+type ContextStatsResponse struct {
+	Model string `json:"model"`
+
+	// KVCacheUsedTokens is the number of tokens held in the KV cache.
+	KVCacheUsedTokens int `json:"kv_cache_used_tokens"`
+
+	// KVCacheTotalTokens is the number of tokens the KV cache can hold.
+	KVCacheTotalTokens int `json:"kv_cache_total_tokens"`
+
+	// ActiveSessions is the number of requests being processed.
+	ActiveSessions int `json:"active_sessions"`
+}
+
+// CapabilitiesResponse is the response from [Client.Capabilities]. It
+// describes what a model supports, from its layers and GGUF metadata.
+type CapabilitiesResponse struct {
+	Model string `json:"model"`
+
+	// SupportsImages is true if the model has a vision projector.
+	SupportsImages bool `json:"supports_images"`
+
+	// SupportsToolCalls is true if the model's template renders tools.
+	SupportsToolCalls bool `json:"supports_tool_calls"`
+
+	// PromptFormat is the name of the built-in template matching the chat
+	// template in the model's metadata, such as "llama3-instruct". It's
+	// empty if the model has no chat template or none of the built-in
+	// templates match.
+	PromptFormat string `json:"prompt_format"`
+
+	// MaxContextLength is the context length the model was trained with.
+	MaxContextLength int `json:"max_context_length"`
+
+	// ProjectorPaths are the paths of the model's vision projectors.
+	ProjectorPaths []string `json:"projector_paths"`
+}
+
+// FineTuneDataResponse is the response from [Client.FineTuneData]. It
+// describes the data a model was fine-tuned on, from its GGUF metadata. It
+// holds metadata only, not the data itself.
+type FineTuneDataResponse struct {
+	Model string `json:"model"`
+
+	// Dataset is the name of the dataset, from general.dataset.
+	Dataset string `json:"dataset"`
+
+	// Description describes the dataset, from general.dataset.description.
+	Description string `json:"description"`
+
+	// Source is where the dataset comes from, usually a URL, from
+	// general.dataset.source.
+	Source string `json:"source"`
+
+	// Links are the URLs on lines of the model's description,
+	// general.description, which mention data, e.g. "Fine-tuned on
+	// https://huggingface.co/datasets/...".
+	Links []string `json:"links"`
+}
+
+// TemplateLintResponse is the response from linting a model's template.
+type TemplateLintResponse struct {
+	Warnings []TemplateLintWarning `json:"warnings"`
+}
+
+// UpdateModelTemplateRequest is the request to replace a model's template.
+type UpdateModelTemplateRequest struct {
+	// Template is the new template.
+	Template string `json:"template"`
+}
+
+// TemplateValidateRequest is the request passed to [Client.ValidateTemplate].
+type TemplateValidateRequest struct {
+	// Template is the template to validate.
+	Template string `json:"template"`
+}
+
+// TemplateValidateResponse is the response from [Client.ValidateTemplate].
+type TemplateValidateResponse struct {
+	// Referenced lists the known fields, such as System or Tools, the
+	// template references.
+	Referenced []string `json:"referenced"`
+
+	// Unreferenced lists the known fields the template doesn't reference.
+	Unreferenced []string `json:"unreferenced"`
+
+	// ParseError is set if the template can't be parsed.
+	ParseError *TemplateParseError `json:"parse_error,omitempty"`
+}
+
+// ChatTemplateTestRequest is the request passed to [Client.TestChatTemplate].
+type ChatTemplateTestRequest struct {
+	// Template is the template to render. The model's template is rendered
+	// if it's empty.
+	Template string `json:"template"`
+
+	Messages []Message `json:"messages"`
+	Tools    []Tool    `json:"tools,omitempty"`
+}
+
+// ChatTemplateTestResponse is the response from [Client.TestChatTemplate].
+type ChatTemplateTestResponse struct {
+	// Rendered is the prompt the template renders for the messages and tools.
+	Rendered string `json:"rendered"`
+
+	// Errors lists why the template couldn't be parsed or rendered.
+	Errors []string `json:"errors"`
+
+	// Warnings lists likely mistakes in the template.
+	Warnings []TemplateLintWarning `json:"warnings"`
+}
+
+// TemplateParseError describes why a template can't be parsed.
+type TemplateParseError struct {
+	// Line is the line of the template where parsing failed.
+	Line int `json:"line"`
+
+	Message string `json:"message"`
+}
+
+// TemplateLintWarning describes a likely mistake in a template.
+type TemplateLintWarning struct {
+	// Rule identifies the mistake, e.g. "unterminated-user-turn".
+	Rule string `json:"rule"`
+
+	// Line is the line of the template where the mistake was found.
+	Line int `json:"line"`
+
+	Message string `json:"message"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -443,6 +1356,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
 	}
 
+	if m.PromptTruncatedCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt truncated:     %d token(s)\n", m.PromptTruncatedCount)
+	}
+
 	if m.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", m.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds())
@@ -508,6 +1425,12 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 					return fmt.Errorf("option %q must be of type float32", key)
 				}
 				field.SetFloat(val)
+			case reflect.Float64:
+				val, ok := val.(float64)
+				if !ok {
+					return fmt.Errorf("option %q must be of type float64", key)
+				}
+				field.SetFloat(val)
 			case reflect.String:
 				val, ok := val.(string)
 				if !ok {
@@ -515,21 +1438,88 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				}
 				field.SetString(val)
 			case reflect.Slice:
+				if field.Type() == reflect.TypeOf(json.RawMessage{}) {
+					bts, err := json.Marshal(val)
+					if err != nil {
+						return fmt.Errorf("option %q must be valid JSON", key)
+					}
+					field.SetBytes(bts)
+					continue
+				}
+
 				// JSON unmarshals to []interface{}, not []string
 				val, ok := val.([]interface{})
 				if !ok {
 					return fmt.Errorf("option %q must be of type array", key)
 				}
-				// convert []interface{} to []string
-				slice := make([]string, len(val))
-				for i, item := range val {
-					str, ok := item.(string)
-					if !ok {
-						return fmt.Errorf("option %q must be of an array of strings", key)
+
+				switch field.Type().Elem().Kind() {
+				case reflect.Int:
+					// convert []interface{} to []int
+					slice := make([]int, len(val))
+					for i, item := range val {
+						switch t := item.(type) {
+						case int64:
+							slice[i] = int(t)
+						case float64:
+							slice[i] = int(t)
+						default:
+							return fmt.Errorf("option %q must be of an array of integers", key)
+						}
+					}
+					field.Set(reflect.ValueOf(slice))
+				default:
+					// convert []interface{} to []string
+					slice := make([]string, len(val))
+					for i, item := range val {
+						str, ok := item.(string)
+						if !ok {
+							return fmt.Errorf("option %q must be of an array of strings", key)
+						}
+						slice[i] = str
+					}
+					field.Set(reflect.ValueOf(slice))
+				}
+			case reflect.Map:
+				// JSON unmarshals to map[string]interface{}, not map[string]int
+				val, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+
+				if field.Type() == reflect.TypeOf(map[int]float32{}) {
+					m := make(map[int]float32, len(val))
+					for k, v := range val {
+						id, err := strconv.Atoi(k)
+						if err != nil || id < 0 {
+							return fmt.Errorf("option %q must be keyed by token IDs", key)
+						}
+
+						switch t := v.(type) {
+						case int64:
+							m[id] = float32(t)
+						case float64:
+							m[id] = float32(t)
+						default:
+							return fmt.Errorf("option %q must be an object of numbers", key)
+						}
+					}
+					field.Set(reflect.ValueOf(m))
+					continue
+				}
+
+				m := make(map[string]int, len(val))
+				for k, v := range val {
+					switch t := v.(type) {
+					case int64:
+						m[k] = int(t)
+					case float64:
+						m[k] = int(t)
+					default:
+						return fmt.Errorf("option %q must be an object of integers", key)
 					}
-					slice[i] = str
 				}
-				field.Set(reflect.ValueOf(slice))
+				field.Set(reflect.ValueOf(m))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -572,6 +1562,7 @@ func DefaultOptions() Options {
 		MirostatTau:      5.0,
 		MirostatEta:      0.1,
 		PenalizeNewline:  true,
+		KeepSystem:       true,
 		Seed:             -1,
 
 		Runner: Runner{
@@ -661,6 +1652,13 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 					}
 
 					out[key] = float32(floatVal)
+				case reflect.Float64:
+					floatVal, err := strconv.ParseFloat(vals[0], 64)
+					if err != nil {
+						return nil, fmt.Errorf("invalid float value %s", vals)
+					}
+
+					out[key] = floatVal
 				case reflect.Int:
 					intVal, err := strconv.ParseInt(vals[0], 10, 64)
 					if err != nil {
@@ -678,7 +1676,32 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
+					if field.Type() == reflect.TypeOf(json.RawMessage{}) {
+						var v any
+						if err := json.Unmarshal([]byte(vals[0]), &v); err != nil {
+							return nil, fmt.Errorf("invalid JSON value %s", vals)
+						}
+
+						out[key] = v
+						break
+					}
+
+					if field.Type().Elem().Kind() == reflect.Int {
+						ints := make([]int, len(vals))
+						for i, val := range vals {
+							intVal, err := strconv.ParseInt(val, 10, 64)
+							if err != nil {
+								return nil, fmt.Errorf("invalid int value %s", vals)
+							}
+
+							ints[i] = int(intVal)
+						}
+
+						out[key] = ints
+						break
+					}
+
+					// TODO: only string and int slices are supported right now
 					out[key] = vals
 				case reflect.Pointer:
 					var b bool
@@ -700,3 +1723,78 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 
 	return out, nil
 }
+
+// LoadOptions reads generation options, e.g. {"temperature": 0.2, "num_ctx": 8192},
+// from the JSON or YAML file at path. Files ending in .yaml or .yml are read as
+// YAML, others as JSON. Unknown options and values of the wrong type are errors
+func LoadOptions(path string) (map[string]interface{}, error) {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v map[string]interface{}
+		if err := yaml.Unmarshal(bts, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		// values are converted to their JSON types, e.g. integers to float64,
+		// so they're the same as options in a request
+		if bts, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		fallthrough
+	default:
+		if err := json.Unmarshal(bts, &opts); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Options{})) {
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+			names[name] = true
+		}
+	}
+
+	for key := range opts {
+		if !names[key] {
+			return nil, fmt.Errorf("%s: unknown option %q", path, key)
+		}
+	}
+
+	var o Options
+	if err := o.FromMap(opts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// an empty file has no options
+	if opts == nil {
+		opts = make(map[string]interface{})
+	}
+
+	return opts, nil
+}
+
+// MergeOptions returns the options in base with those in overrides, e.g. the
+// options of a request, taking precedence
+func MergeOptions(base, overrides map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range overrides {
+		merged[k] = v
+	}
+
+	return merged
+}
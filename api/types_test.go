@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -209,6 +211,52 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestStopTokensParsingFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  []int
+		err  error
+	}{
+		{
+			name: "Undefined",
+			req:  `{ }`,
+			exp:  nil,
+		},
+		{
+			name: "Tokens",
+			req:  `{ "stop_tokens": [128001, 128009] }`,
+			exp:  []int{128001, 128009},
+		},
+		{
+			name: "Strings",
+			req:  `{ "stop_tokens": ["<|eot_id|>"] }`,
+			err:  fmt.Errorf(`option "stop_tokens" must be of an array of integers`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]interface{}
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			require.Equal(t, test.err, err)
+			assert.Equal(t, test.exp, opts.StopTokens)
+		})
+	}
+}
+
+func TestStopTokensFormatParams(t *testing.T) {
+	resp, err := FormatParams(map[string][]string{"stop_tokens": {"128001", "128009"}})
+	require.NoError(t, err)
+	assert.Equal(t, []int{128001, 128009}, resp["stop_tokens"])
+
+	_, err = FormatParams(map[string][]string{"stop_tokens": {"<|eot_id|>"}})
+	require.Equal(t, fmt.Errorf("invalid int value [<|eot_id|>]"), err)
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -231,3 +279,162 @@ func TestMessage_UnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestImageData_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ImageData
+		err      bool
+	}{
+		{"base64", `"aW1hZ2U="`, ImageData("image"), false},
+		{"data url", `"data:image/jpeg;base64,aW1hZ2U="`, ImageData("image"), false},
+		{"data url without media type", `"data:;base64,aW1hZ2U="`, ImageData("image"), false},
+		{"null", `null`, nil, false},
+		{"data url not base64", `"data:image/png,image"`, nil, true},
+		{"data url without data", `"data:image/png;base64"`, nil, true},
+		{"invalid base64", `"data:image/png;base64,!!!"`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var img ImageData
+			err := json.Unmarshal([]byte(test.input), &img)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, img)
+		})
+	}
+
+	t.Run("request", func(t *testing.T) {
+		var req ChatRequest
+		err := json.Unmarshal([]byte(`{"messages": [{"role": "user", "images": ["aW1hZ2U=", "data:image/png;base64,aW1hZ2U="]}]}`), &req)
+		require.NoError(t, err)
+		assert.Equal(t, []ImageData{ImageData("image"), ImageData("image")}, req.Messages[0].Images)
+	})
+}
+
+func TestNumCtxFractionFormatParams(t *testing.T) {
+	resp, err := FormatParams(map[string][]string{"num_ctx_fraction": {"0.5"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"num_ctx_fraction": 0.5}, resp)
+
+	var opts Options
+	require.NoError(t, opts.FromMap(resp))
+	assert.InDelta(t, 0.5, opts.NumCtxFraction, 0)
+
+	_, err = FormatParams(map[string][]string{"num_ctx_fraction": {"half"}})
+	require.Error(t, err)
+}
+
+func TestResponseSchemaParsing(t *testing.T) {
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{ "response_schema": { "type": "object", "required": ["name"] } }`), &oMap))
+
+	var opts Options
+	require.NoError(t, opts.FromMap(oMap))
+	assert.JSONEq(t, `{"type":"object","required":["name"]}`, string(opts.ResponseSchema))
+
+	resp, err := FormatParams(map[string][]string{"response_schema": {`{"type":"array"}`}})
+	require.NoError(t, err)
+
+	opts = Options{}
+	require.NoError(t, opts.FromMap(resp))
+	assert.JSONEq(t, `{"type":"array"}`, string(opts.ResponseSchema))
+
+	_, err = FormatParams(map[string][]string{"response_schema": {"{"}})
+	require.Error(t, err)
+}
+
+func TestMinMessagesPerRoleParsingFromJSON(t *testing.T) {
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{ "min_messages_per_role": { "assistant": 2, "user": 1 } }`), &oMap))
+
+	var opts Options
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[string]int{"assistant": 2, "user": 1}, opts.MinMessagesPerRole)
+
+	require.NoError(t, json.Unmarshal([]byte(`{ "min_messages_per_role": { "assistant": "two" } }`), &oMap))
+	require.Equal(t, fmt.Errorf(`option "min_messages_per_role" must be an object of integers`), opts.FromMap(oMap))
+}
+
+func TestLoadOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected map[string]any
+		err      bool
+	}{
+		{"json", "options.json", `{"temperature": 0.2, "num_ctx": 8192, "stop": ["\n\n"]}`, map[string]any{"temperature": 0.2, "num_ctx": float64(8192), "stop": []any{"\n\n"}}, false},
+		{"yaml", "options.yaml", "temperature: 0.2\nnum_ctx: 8192\nstop:\n  - \"\\n\\n\"\n", map[string]any{"temperature": 0.2, "num_ctx": float64(8192), "stop": []any{"\n\n"}}, false},
+		{"yml", "options.YML", "min_messages_per_role:\n  user: 1\n", map[string]any{"min_messages_per_role": map[string]any{"user": float64(1)}}, false},
+		{"empty", "options.yaml", "", map[string]any{}, false},
+		{"unknown option", "options.json", `{"temprature": 0.2}`, nil, true},
+		{"wrong type", "options.yaml", "num_ctx: large\n", nil, true},
+		{"invalid json", "options.json", `{"temperature": `, nil, true},
+		{"invalid yaml", "options.yaml", "temperature: [0.2\n", nil, true},
+		{"yaml in json file", "options.json", "temperature: 0.2\n", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			require.NoError(t, os.WriteFile(path, []byte(test.content), 0o644))
+
+			opts, err := LoadOptions(path)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, opts)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := LoadOptions(filepath.Join(t.TempDir(), "options.json"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestMergeOptions(t *testing.T) {
+	file := map[string]any{"temperature": 0.2, "num_ctx": float64(8192)}
+	request := map[string]any{"temperature": 0.9, "seed": float64(42)}
+
+	assert.Equal(t, map[string]any{"temperature": 0.9, "num_ctx": float64(8192), "seed": float64(42)}, MergeOptions(file, request))
+	assert.Equal(t, file, MergeOptions(file, nil))
+	assert.Equal(t, request, MergeOptions(nil, request))
+	assert.Nil(t, MergeOptions(nil, nil))
+
+	// neither input is modified
+	assert.Equal(t, map[string]any{"temperature": 0.2, "num_ctx": float64(8192)}, file)
+}
+
+func TestLogitBiasParsingFromJSON(t *testing.T) {
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{ "logit_bias": { "15043": -100, "29871": 2.5 } }`), &oMap))
+
+	var opts Options
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[int]float32{15043: -100, 29871: 2.5}, opts.LogitBias)
+
+	bts, err := json.Marshal(Options{LogitBias: opts.LogitBias})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"logit_bias": {"15043": -100, "29871": 2.5}}`, string(bts))
+
+	for _, invalid := range []string{
+		`{ "logit_bias": { "hello": 1 } }`,
+		`{ "logit_bias": { "-1": 1 } }`,
+		`{ "logit_bias": { "15043": "up" } }`,
+		`{ "logit_bias": [15043] }`,
+	} {
+		require.NoError(t, json.Unmarshal([]byte(invalid), &oMap))
+		require.Error(t, (&Options{}).FromMap(oMap), invalid)
+	}
+}
@@ -2,11 +2,13 @@ package cmd
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -82,16 +84,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
 		case "model", "adapter":
-			path := modelfile.Commands[i].Args
-			if path == "~" {
-				path = home
-			} else if strings.HasPrefix(path, "~/") {
-				path = filepath.Join(home, path[2:])
-			}
-
-			if !filepath.IsAbs(path) {
-				path = filepath.Join(filepath.Dir(filename), path)
-			}
+			path := expandPath(modelfile.Commands[i].Args, filepath.Dir(filename), home)
 
 			fi, err := os.Stat(path)
 			if errors.Is(err, os.ErrNotExist) && modelfile.Commands[i].Name == "model" {
@@ -118,6 +111,10 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 
 			modelfile.Commands[i].Args = "@" + digest
+		case "system":
+			if err := readSystemFile(&modelfile.Commands[i], filepath.Dir(filename), home); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -155,6 +152,42 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// expandPath resolves a path from a Modelfile. A leading ~ is expanded to home
+// and relative paths are relative to dir, the directory containing the Modelfile.
+func expandPath(path, dir, home string) string {
+	if path == "~" {
+		path = home
+	} else if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(home, path[2:])
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	return path
+}
+
+// readSystemFile replaces a SYSTEM command of the form "SYSTEM @file:<path>" with
+// the contents of the file at path. Other SYSTEM commands, including system
+// messages which merely start with @, are left unchanged.
+func readSystemFile(c *parser.Command, dir, home string) error {
+	path, ok := strings.CutPrefix(c.Args, "@file:")
+	if !ok {
+		return nil
+	}
+
+	bts, err := os.ReadFile(expandPath(path, dir, home))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("system prompt file %s does not exist", path)
+	} else if err != nil {
+		return err
+	}
+
+	c.Args = strings.TrimSpace(string(bts))
+	return nil
+}
+
 func tempZipFiles(path string) (string, error) {
 	tempfile, err := os.CreateTemp("", "ollama-tf")
 	if err != nil {
@@ -301,6 +334,17 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 	}
 	opts.Format = format
 
+	optionsFile, err := cmd.Flags().GetString("options-file")
+	if err != nil {
+		return err
+	}
+	if optionsFile != "" {
+		// options set with /set parameter are added to these
+		if opts.Options, err = api.LoadOptions(optionsFile); err != nil {
+			return err
+		}
+	}
+
 	keepAlive, err := cmd.Flags().GetString("keepalive")
 	if err != nil {
 		return err
@@ -313,9 +357,39 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 		opts.KeepAlive = &api.Duration{Duration: d}
 	}
 
+	conversation, err := cmd.Flags().GetString("conversation")
+	if err != nil {
+		return err
+	}
+
+	var messages []api.Message
+	if conversation != "" {
+		if len(args) > 1 {
+			return errors.New("a prompt can't be used with --conversation")
+		}
+
+		f, err := os.Open(conversation)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		messages, err = readConversation(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", conversation, err)
+		}
+
+		if len(messages) == 0 {
+			return fmt.Errorf("%s: no messages in conversation", conversation)
+		}
+
+		opts.WordWrap = false
+		interactive = false
+	}
+
 	prompts := args[1:]
 	// prepend stdin to the prompt if provided
-	if !term.IsTerminal(int(os.Stdin.Fd())) {
+	if conversation == "" && !term.IsTerminal(int(os.Stdin.Fd())) {
 		in, err := io.ReadAll(os.Stdin)
 		if err != nil {
 			return err
@@ -364,12 +438,58 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 	opts.ParentModel = info.Details.ParentModel
 	opts.Messages = append(opts.Messages, info.Messages...)
 
+	if conversation != "" {
+		opts.Messages = append(opts.Messages, messages...)
+		_, err := chat(cmd, opts)
+		return err
+	}
+
 	if interactive {
 		return generateInteractive(cmd, opts)
 	}
 	return generate(cmd, opts)
 }
 
+// readConversation reads newline delimited JSON messages from r. Blank lines
+// are skipped
+func readConversation(r io.Reader) ([]api.Message, error) {
+	var messages []api.Message
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			// failed requests written by the server to OLLAMA_DLQ_PATH are
+			// replayed with their messages
+			var deadLetter struct {
+				Request *api.ChatRequest `json:"request"`
+			}
+			if json.Unmarshal(line, &deadLetter) == nil && deadLetter.Request != nil {
+				messages = append(messages, deadLetter.Request.Messages...)
+			} else {
+				var m api.Message
+				if err := json.Unmarshal(line, &m); err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+
+				if m.Role == "" {
+					return nil, fmt.Errorf("line %d: message is missing a role", n)
+				}
+
+				messages = append(messages, m)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return messages, nil
+		}
+	}
+}
+
 func errFromUnknownKey(unknownKeyErr error) error {
 	// find SSH public key in the error message
 	sshKeyPattern := `ssh-\w+ [^\s"]+`
@@ -771,10 +891,21 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	req := api.CopyRequest{Source: args[0], Destination: args[1]}
+	alias, err := cmd.Flags().GetBool("alias")
+	if err != nil {
+		return err
+	}
+
+	req := api.CopyRequest{Source: args[0], Destination: args[1], Alias: alias}
 	if err := client.Copy(cmd.Context(), &req); err != nil {
 		return err
 	}
+
+	if alias {
+		fmt.Printf("aliased '%s' to '%s'\n", args[1], args[0])
+		return nil
+	}
+
 	fmt.Printf("copied '%s' to '%s'\n", args[0], args[1])
 	return nil
 }
@@ -1252,6 +1383,8 @@ func NewCLI() *cobra.Command {
 	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
 	runCmd.Flags().String("format", "", "Response format (e.g. json)")
+	runCmd.Flags().String("conversation", "", "Newline delimited JSON file of messages to send to the model")
+	runCmd.Flags().String("options-file", "", "JSON or YAML file of model options (e.g. temperature, num_ctx)")
 	serveCmd := &cobra.Command{
 		Use:     "serve",
 		Aliases: []string{"start"},
@@ -1303,6 +1436,8 @@ func NewCLI() *cobra.Command {
 		RunE:    CopyHandler,
 	}
 
+	copyCmd.Flags().Bool("alias", false, "Make DESTINATION an alias of SOURCE instead of a copy")
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
 		Short:   "Remove a model",
@@ -1333,15 +1468,26 @@ func NewCLI() *cobra.Command {
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
+				envVars["OLLAMA_DEDUP"],
+				envVars["OLLAMA_DETERMINISTIC"],
+				envVars["OLLAMA_DLQ_PATH"],
 				envVars["OLLAMA_HOST"],
 				envVars["OLLAMA_KEEP_ALIVE"],
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
+				envVars["OLLAMA_METRICS_ADDR"],
 				envVars["OLLAMA_MODELS"],
 				envVars["OLLAMA_NUM_PARALLEL"],
+				envVars["OLLAMA_NUM_PARALLEL_EMBED"],
 				envVars["OLLAMA_NOPRUNE"],
 				envVars["OLLAMA_ORIGINS"],
+				envVars["OLLAMA_PRELOAD_MODELS"],
+				envVars["OLLAMA_PRELOAD_CONCURRENCY"],
+				envVars["OLLAMA_RESPONSE_FILTERS"],
+				envVars["OLLAMA_SHUTDOWN_TIMEOUT"],
+				envVars["OLLAMA_TEMPLATES"],
 				envVars["OLLAMA_TMPDIR"],
+				envVars["OLLAMA_WEBHOOK_SECRET"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_MAX_VRAM"],
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/parser"
+)
+
+func TestReadSystemFile(t *testing.T) {
+	dir := t.TempDir()
+	home := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "system.txt"), []byte("You are Mario.\nBe helpful.\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(home, "system.txt"), []byte("You are Luigi."), 0o644))
+
+	cases := []struct {
+		args   string
+		expect string
+	}{
+		{"You are Mario.", "You are Mario."},
+		{"@file:system.txt", "You are Mario.\nBe helpful."},
+		{"@file:" + filepath.Join(dir, "system.txt"), "You are Mario.\nBe helpful."},
+		{"@file:~/system.txt", "You are Luigi."},
+		// only the explicit @file: form reads a file
+		{"@system.txt", "@system.txt"},
+		{"@mario answers every question", "@mario answers every question"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.args, func(t *testing.T) {
+			c := parser.Command{Name: "system", Args: tt.args}
+			require.NoError(t, readSystemFile(&c, dir, home))
+			assert.Equal(t, tt.expect, c.Args)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		c := parser.Command{Name: "system", Args: "@file:missing.txt"}
+		err := readSystemFile(&c, dir, home)
+		require.ErrorContains(t, err, "system prompt file missing.txt does not exist")
+	})
+}
+
+func TestReadConversation(t *testing.T) {
+	t.Run("messages", func(t *testing.T) {
+		in := `{"role": "system", "content": "You are Mario."}
+
+{"role": "user", "content": "Hello!"}
+{"role": "assistant", "content": "It's-a me!"}
+{"role": "user", "content": "Who?"}`
+
+		messages, err := readConversation(strings.NewReader(in))
+		require.NoError(t, err)
+		assert.Equal(t, []api.Message{
+			{Role: "system", Content: "You are Mario."},
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "It's-a me!"},
+			{Role: "user", Content: "Who?"},
+		}, messages)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		in := `{"request": {"model": "mario", "messages": [{"role": "user", "content": "Hello!"}, {"role": "assistant", "content": "It's-a me!"}]}, "error": "llama runner process has terminated: signal: aborted", "failed_at": "2024-06-01T12:00:00Z"}
+{"role": "user", "content": "Who?"}`
+
+		messages, err := readConversation(strings.NewReader(in))
+		require.NoError(t, err)
+		assert.Equal(t, []api.Message{
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "It's-a me!"},
+			{Role: "user", Content: "Who?"},
+		}, messages)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		in := "{\"role\": \"user\", \"content\": \"Hello!\"}\n{\"role\": \"user\",\n"
+		_, err := readConversation(strings.NewReader(in))
+		require.ErrorContains(t, err, "line 2:")
+	})
+
+	t.Run("missing role", func(t *testing.T) {
+		in := "\n\n{\"content\": \"Hello!\"}\n"
+		_, err := readConversation(strings.NewReader(in))
+		require.ErrorContains(t, err, "line 3: message is missing a role")
+	})
+}
@@ -0,0 +1,178 @@
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// QuantizationConfig is the quantization_config of a pre-quantized HuggingFace model
+type QuantizationConfig struct {
+	QuantMethod string `json:"quant_method"`
+	Bits        int    `json:"bits"`
+	GroupSize   int    `json:"group_size"`
+	Version     string `json:"version"`
+	ZeroPoint   bool   `json:"zero_point"`
+}
+
+// IsAWQ reports whether the model was quantized with AutoAWQ
+func (q *QuantizationConfig) IsAWQ() bool {
+	return q != nil && strings.EqualFold(q.QuantMethod, "awq")
+}
+
+func (q *QuantizationConfig) checkAWQ() error {
+	if q.Bits != 4 {
+		return fmt.Errorf("unsupported AWQ model: %d bit weights are not supported", q.Bits)
+	}
+
+	if q.Version != "" && !strings.EqualFold(q.Version, "gemm") {
+		return fmt.Errorf("unsupported AWQ model: version %q is not supported", q.Version)
+	}
+
+	if q.GroupSize <= 0 {
+		return fmt.Errorf("unsupported AWQ model: group size %d is not supported", q.GroupSize)
+	}
+
+	return nil
+}
+
+// awqReverseOrder undoes the order AutoAWQ packs eight 4-bit values into an int32
+var awqReverseOrder = [8]int{0, 4, 1, 5, 2, 6, 3, 7}
+
+// awqTensor is a linear layer quantized with AutoAWQ. The layer is stored as three
+// tensors: qweight and qzeros pack eight 4-bit values into each int32 and scales
+// holds one scale per group of input features
+type awqTensor struct {
+	in, out, groupSize int
+
+	qweight, qzeros, scales struct {
+		offset, size int64
+	}
+}
+
+// newAWQTensor looks up the AWQ tensors named prefix in headers and returns a
+// tensor named name which is dequantized to F16 when written
+func (m *SafetensorFormat) newAWQTensor(fn, name, prefix string, headers map[string]safetensorMetadata, pad func(int64) int64, offset uint64, params *Params) (llm.Tensor, error) {
+	if err := params.Quantization.checkAWQ(); err != nil {
+		return llm.Tensor{}, err
+	}
+
+	var awq awqTensor
+	for _, tt := range []struct {
+		suffix string
+		dtype  string
+		dst    *struct{ offset, size int64 }
+	}{
+		{"qweight", "I32", &awq.qweight},
+		{"qzeros", "I32", &awq.qzeros},
+		{"scales", "F16", &awq.scales},
+	} {
+		value, ok := headers[prefix+"."+tt.suffix]
+		if !ok {
+			return llm.Tensor{}, fmt.Errorf("%s: missing %s tensor", prefix, tt.suffix)
+		}
+
+		if value.Type != tt.dtype || len(value.Shape) != 2 {
+			return llm.Tensor{}, fmt.Errorf("%s: unexpected %s tensor %s%v", prefix, tt.suffix, value.Type, value.Shape)
+		}
+
+		tt.dst.offset = pad(value.Offsets[0])
+		tt.dst.size = pad(value.Offsets[1]) - pad(value.Offsets[0])
+	}
+
+	qweight := headers[prefix+".qweight"]
+	awq.in = int(qweight.Shape[0])
+	awq.out = int(qweight.Shape[1]) * 8
+	awq.groupSize = params.Quantization.GroupSize
+
+	if awq.in%awq.groupSize != 0 {
+		return llm.Tensor{}, fmt.Errorf("%s: %d input features are not a multiple of group size %d", prefix, awq.in, awq.groupSize)
+	}
+
+	groups := uint64(awq.in / awq.groupSize)
+	if scales := headers[prefix+".scales"]; scales.Shape[0] != groups || scales.Shape[1] != uint64(awq.out) {
+		return llm.Tensor{}, fmt.Errorf("%s: unexpected scales shape %v", prefix, scales.Shape)
+	}
+
+	if qzeros := headers[prefix+".qzeros"]; qzeros.Shape[0] != groups || qzeros.Shape[1] != qweight.Shape[1] {
+		return llm.Tensor{}, fmt.Errorf("%s: unexpected qzeros shape %v", prefix, qzeros.Shape)
+	}
+
+	t := llm.Tensor{
+		Name:   name,
+		Kind:   1,
+		Offset: offset,
+		// weights are stored transposed, as [in_features, out_features]
+		Shape: []uint64{uint64(awq.out), uint64(awq.in)},
+	}
+
+	t.WriterTo = safetensorWriterTo{
+		t:        &t,
+		params:   params,
+		bo:       params.ByteOrder,
+		filename: fn,
+		dtype:    "AWQ",
+		awq:      &awq,
+	}
+
+	return t, nil
+}
+
+// dequantize reads the AWQ tensors from r and returns the weights as
+// [out_features, in_features]
+func (awq *awqTensor) dequantize(r io.ReadSeeker, bo binary.ByteOrder) ([]float32, error) {
+	read := func(offset, size int64, data any) error {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		return binary.Read(io.LimitReader(r, size), bo, data)
+	}
+
+	qweight := make([]int32, awq.in*awq.out/8)
+	if err := read(awq.qweight.offset, awq.qweight.size, qweight); err != nil {
+		return nil, err
+	}
+
+	groups := awq.in / awq.groupSize
+	qzeros := make([]int32, groups*awq.out/8)
+	if err := read(awq.qzeros.offset, awq.qzeros.size, qzeros); err != nil {
+		return nil, err
+	}
+
+	u16s := make([]uint16, groups*awq.out)
+	if err := read(awq.scales.offset, awq.scales.size, u16s); err != nil {
+		return nil, err
+	}
+
+	scales := make([]float32, len(u16s))
+	for i := range u16s {
+		scales[i] = float16.Frombits(u16s[i]).Float32()
+	}
+
+	return dequantizeAWQ(qweight, qzeros, scales, awq.in, awq.out, awq.groupSize), nil
+}
+
+// dequantizeAWQ unpacks 4-bit AWQ weights. qweight is [in, out/8], qzeros is
+// [in/groupSize, out/8] and scales is [in/groupSize, out]. The result is [out, in]
+func dequantizeAWQ(qweight, qzeros []int32, scales []float32, in, out, groupSize int) []float32 {
+	unpack := func(packed []int32, row, col int) float32 {
+		v := uint32(packed[row*out/8+col/8])
+		return float32((v >> (4 * awqReverseOrder[col%8])) & 0xf)
+	}
+
+	f32s := make([]float32, in*out)
+	for i := range in {
+		g := i / groupSize
+		for o := range out {
+			f32s[o*in+i] = (unpack(qweight, i, o) - unpack(qzeros, g, o)) * scales[g*out+o]
+		}
+	}
+
+	return f32s
+}
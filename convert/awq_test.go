@@ -0,0 +1,170 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/x448/float16"
+)
+
+// packAWQ packs 4-bit values in rows of out values the way AutoAWQ does
+func packAWQ(values [][]int) []int32 {
+	var packed []int32
+	for _, row := range values {
+		for i := 0; i < len(row); i += 8 {
+			var v uint32
+			for j, k := range awqReverseOrder {
+				v |= uint32(row[i+j]) << (4 * k)
+			}
+
+			packed = append(packed, int32(v))
+		}
+	}
+
+	return packed
+}
+
+func TestDequantizeAWQ(t *testing.T) {
+	// 4 input features, 8 output features, group size 2
+	weights := [][]int{
+		{0, 1, 2, 3, 4, 5, 6, 7},
+		{8, 9, 10, 11, 12, 13, 14, 15},
+		{15, 14, 13, 12, 11, 10, 9, 8},
+		{7, 6, 5, 4, 3, 2, 1, 0},
+	}
+
+	zeros := [][]int{
+		{8, 8, 8, 8, 8, 8, 8, 8},
+		{0, 1, 2, 3, 4, 5, 6, 7},
+	}
+
+	scales := []float32{
+		1, 1, 1, 1, 1, 1, 1, 1,
+		0.5, 0.5, 0.5, 0.5, 2, 2, 2, 2,
+	}
+
+	f32s := dequantizeAWQ(packAWQ(weights), packAWQ(zeros), scales, 4, 8, 2)
+
+	var expect []float32
+	for o := range 8 {
+		for i := range 4 {
+			g := i / 2
+			expect = append(expect, float32(weights[i][o]-zeros[g][o])*scales[g*8+o])
+		}
+	}
+
+	if diff := cmp.Diff(f32s, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestSafetensorsAWQ(t *testing.T) {
+	dir := t.TempDir()
+
+	weights := [][]int{
+		{0, 1, 2, 3, 4, 5, 6, 7},
+		{8, 9, 10, 11, 12, 13, 14, 15},
+	}
+
+	qweight := packAWQ(weights)
+	qzeros := packAWQ([][]int{{8, 8, 8, 8, 8, 8, 8, 8}})
+	scales := make([]uint16, 8)
+	for i := range scales {
+		scales[i] = float16.Fromfloat32(0.5).Bits()
+	}
+
+	var data bytes.Buffer
+	headers := make(map[string]safetensorMetadata)
+	for _, tt := range []struct {
+		name  string
+		dtype string
+		shape []uint64
+		data  any
+	}{
+		{"model.layers.0.self_attn.o_proj.qweight", "I32", []uint64{2, 1}, qweight},
+		{"model.layers.0.self_attn.o_proj.qzeros", "I32", []uint64{1, 1}, qzeros},
+		{"model.layers.0.self_attn.o_proj.scales", "F16", []uint64{1, 8}, scales},
+	} {
+		start := int64(data.Len())
+		if err := binary.Write(&data, binary.LittleEndian, tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		headers[tt.name] = safetensorMetadata{Type: tt.dtype, Shape: tt.shape, Offsets: []int64{start, int64(data.Len())}}
+	}
+
+	bts, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f bytes.Buffer
+	if err := binary.Write(&f, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(bts)
+	f.Write(data.Bytes())
+
+	if err := os.WriteFile(filepath.Join(dir, "model.safetensors"), f.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := Params{
+		Quantization: &QuantizationConfig{QuantMethod: "awq", Bits: 4, GroupSize: 2, Version: "gemm", ZeroPoint: true},
+		ByteOrder:    binary.LittleEndian,
+	}
+
+	var m SafetensorFormat
+	tensors, err := m.GetTensors(dir, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tensors) != 1 {
+		t.Fatalf("expected 1 tensor, got %d", len(tensors))
+	}
+
+	if tensors[0].Name != "blk.0.attn_output.weight" {
+		t.Errorf("expected name blk.0.attn_output.weight, got %s", tensors[0].Name)
+	}
+
+	if diff := cmp.Diff(tensors[0].Shape, []uint64{8, 2}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	var b bytes.Buffer
+	if _, err := tensors[0].WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	f16s := make([]uint16, 16)
+	if err := binary.Read(&b, binary.LittleEndian, f16s); err != nil {
+		t.Fatal(err)
+	}
+
+	var got, expect []float32
+	for o := range 8 {
+		for i := range 2 {
+			got = append(got, float16.Frombits(f16s[o*2+i]).Float32())
+			expect = append(expect, float32(weights[i][o]-8)*0.5)
+		}
+	}
+
+	if diff := cmp.Diff(got, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	t.Run("unsupported bits", func(t *testing.T) {
+		params := params
+		params.Quantization = &QuantizationConfig{QuantMethod: "awq", Bits: 8, GroupSize: 2}
+		if _, err := m.GetTensors(dir, &params); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
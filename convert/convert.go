@@ -47,6 +47,8 @@ type Params struct {
 	Experts     int `json:"num_local_experts"`
 	ExpertsUsed int `json:"num_experts_per_tok"`
 
+	Quantization *QuantizationConfig `json:"quantization_config"`
+
 	PreTokenizer string
 
 	ByteOrder
@@ -29,6 +29,9 @@ type safetensorWriterTo struct {
 
 	offset, size int64
 	repacker     func(string, []float32, []uint64) ([]float32, error)
+
+	// awq is set for linear layers quantized with AutoAWQ
+	awq *awqTensor
 }
 
 type safetensorMetadata struct {
@@ -91,10 +94,37 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 
 	slices.Sort(keys)
 
+	pad := func(s int64) int64 {
+		return 8 + n + s
+	}
+
 	var tensors []llm.Tensor
 	for _, key := range keys {
 		value := headers[key]
 
+		if params.Quantization.IsAWQ() {
+			if strings.HasSuffix(key, ".qzeros") || strings.HasSuffix(key, ".scales") {
+				// read with the corresponding qweight
+				continue
+			}
+
+			if prefix, ok := strings.CutSuffix(key, ".qweight"); ok {
+				name, err := m.GetLayerName(prefix + ".weight")
+				if err != nil {
+					return nil, 0, err
+				}
+
+				t, err := m.newAWQTensor(fn, name, prefix, headers, pad, offset, params)
+				if err != nil {
+					return nil, 0, err
+				}
+
+				offset += t.Size()
+				tensors = append(tensors, t)
+				continue
+			}
+		}
+
 		var kind uint32
 		switch len(value.Shape) {
 		case 0:
@@ -112,10 +142,6 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 		shape := make([]uint64, len(value.Shape))
 		copy(shape, value.Shape)
 
-		pad := func(s int64) int64 {
-			return 8 + n + s
-		}
-
 		t := llm.Tensor{
 			Name:   name,
 			Kind:   kind,
@@ -210,6 +236,11 @@ func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
 
 	var f32s []float32
 	switch r.dtype {
+	case "AWQ":
+		f32s, err = r.awq.dequantize(f, r.bo)
+		if err != nil {
+			return 0, err
+		}
 	case "F32":
 		f32s = make([]float32, r.size/4)
 		if err = binary.Read(f, r.bo, f32s); err != nil {
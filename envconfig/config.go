@@ -1,6 +1,7 @@
 package envconfig
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -31,6 +32,12 @@ var (
 	AllowOrigins []string
 	// Set via OLLAMA_DEBUG in the environment
 	Debug bool
+	// Set via OLLAMA_DEDUP in the environment
+	Dedup bool
+	// Set via OLLAMA_DETERMINISTIC in the environment
+	Deterministic bool
+	// Set via OLLAMA_DLQ_PATH in the environment
+	DLQPath string
 	// Experimental flash attention
 	FlashAttention bool
 	// Set via OLLAMA_HOST in the environment
@@ -45,6 +52,8 @@ var (
 	MaxQueuedRequests int
 	// Set via OLLAMA_MAX_VRAM in the environment
 	MaxVRAM uint64
+	// Set via OLLAMA_METRICS_ADDR in the environment
+	MetricsAddr string
 	// Set via OLLAMA_MODELS in the environment
 	ModelsDir string
 	// Set via OLLAMA_NOHISTORY in the environment
@@ -53,12 +62,26 @@ var (
 	NoPrune bool
 	// Set via OLLAMA_NUM_PARALLEL in the environment
 	NumParallel int
+	// Set via OLLAMA_NUM_PARALLEL_EMBED in the environment
+	NumParallelEmbed int
+	// Set via OLLAMA_PRELOAD_MODELS in the environment
+	PreloadModels []string
+	// Set via OLLAMA_PRELOAD_CONCURRENCY in the environment
+	PreloadConcurrency int
+	// Set via OLLAMA_RESPONSE_FILTERS in the environment
+	ResponseFilters string
 	// Set via OLLAMA_RUNNERS_DIR in the environment
 	RunnersDir string
 	// Set via OLLAMA_SCHED_SPREAD in the environment
 	SchedSpread bool
+	// Set via OLLAMA_SHUTDOWN_TIMEOUT in the environment
+	ShutdownTimeout time.Duration
+	// Set via OLLAMA_TEMPLATES in the environment
+	TemplatesDir string
 	// Set via OLLAMA_TMPDIR in the environment
 	TmpDir string
+	// Set via OLLAMA_WEBHOOK_SECRET in the environment
+	WebhookSecret string
 	// Set via OLLAMA_INTEL_GPU in the environment
 	IntelGpu bool
 
@@ -82,22 +105,34 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug, "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
-		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention, "Enabled flash attention"},
-		"OLLAMA_HOST":              {"OLLAMA_HOST", Host, "IP Address for the ollama server (default 127.0.0.1:11434)"},
-		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive, "The duration that models stay loaded in memory (default \"5m\")"},
-		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary, "Set LLM library to bypass autodetection"},
-		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners, "Maximum number of loaded models per GPU"},
-		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueuedRequests, "Maximum number of queued requests"},
-		"OLLAMA_MAX_VRAM":          {"OLLAMA_MAX_VRAM", MaxVRAM, "Maximum VRAM"},
-		"OLLAMA_MODELS":            {"OLLAMA_MODELS", ModelsDir, "The path to the models directory"},
-		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory, "Do not preserve readline history"},
-		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune, "Do not prune model blobs on startup"},
-		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel, "Maximum number of parallel requests"},
-		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowOrigins, "A comma separated list of allowed origins"},
-		"OLLAMA_RUNNERS_DIR":       {"OLLAMA_RUNNERS_DIR", RunnersDir, "Location for runners"},
-		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread, "Always schedule model across all GPUs"},
-		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir, "Location for temporary files"},
+		"OLLAMA_DEBUG":               {"OLLAMA_DEBUG", Debug, "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_DEDUP":               {"OLLAMA_DEDUP", Dedup, "Run identical concurrent requests once and stream the result to each"},
+		"OLLAMA_DETERMINISTIC":       {"OLLAMA_DETERMINISTIC", Deterministic, "Sample with a fixed seed so identical requests get identical responses. For test suites only: anyone can reproduce any response, so never use it in production or for generating secrets"},
+		"OLLAMA_DLQ_PATH":            {"OLLAMA_DLQ_PATH", DLQPath, "The directory to write chat requests which fail during generation to"},
+		"OLLAMA_FLASH_ATTENTION":     {"OLLAMA_FLASH_ATTENTION", FlashAttention, "Enabled flash attention"},
+		"OLLAMA_HOST":                {"OLLAMA_HOST", Host, "IP Address for the ollama server (default 127.0.0.1:11434)"},
+		"OLLAMA_KEEP_ALIVE":          {"OLLAMA_KEEP_ALIVE", KeepAlive, "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_LLM_LIBRARY":         {"OLLAMA_LLM_LIBRARY", LLMLibrary, "Set LLM library to bypass autodetection"},
+		"OLLAMA_MAX_LOADED_MODELS":   {"OLLAMA_MAX_LOADED_MODELS", MaxRunners, "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_QUEUE":           {"OLLAMA_MAX_QUEUE", MaxQueuedRequests, "Maximum number of queued requests"},
+		"OLLAMA_MAX_VRAM":            {"OLLAMA_MAX_VRAM", MaxVRAM, "Maximum VRAM"},
+		"OLLAMA_METRICS_ADDR":        {"OLLAMA_METRICS_ADDR", MetricsAddr, "The address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9090"},
+		"OLLAMA_MODELS":              {"OLLAMA_MODELS", ModelsDir, "The path to the models directory"},
+		"OLLAMA_NOHISTORY":           {"OLLAMA_NOHISTORY", NoHistory, "Do not preserve readline history"},
+		"OLLAMA_NOPRUNE":             {"OLLAMA_NOPRUNE", NoPrune, "Do not prune model blobs on startup"},
+		"OLLAMA_NUM_PARALLEL":        {"OLLAMA_NUM_PARALLEL", NumParallel, "Maximum number of parallel requests"},
+		"OLLAMA_NUM_PARALLEL_EMBED":  {"OLLAMA_NUM_PARALLEL_EMBED", NumParallelEmbed, "Maximum number of parallel embedding requests, limited separately from other requests and capped at OLLAMA_NUM_PARALLEL (default shares OLLAMA_NUM_PARALLEL)"},
+		"OLLAMA_ORIGINS":             {"OLLAMA_ORIGINS", AllowOrigins, "A comma separated list of allowed origins"},
+		"OLLAMA_PRELOAD_MODELS":      {"OLLAMA_PRELOAD_MODELS", PreloadModels, "A comma separated list of models to load on startup"},
+		"OLLAMA_PRELOAD_CONCURRENCY": {"OLLAMA_PRELOAD_CONCURRENCY", PreloadConcurrency, "Maximum number of models to load at once on startup (default 2)"},
+		"OLLAMA_RESPONSE_FILTERS":    {"OLLAMA_RESPONSE_FILTERS", ResponseFilters, "The path to a JSON file of filters applied to generate and chat responses"},
+		"OLLAMA_RUNNERS_DIR":         {"OLLAMA_RUNNERS_DIR", RunnersDir, "Location for runners"},
+		"OLLAMA_SCHED_SPREAD":        {"OLLAMA_SCHED_SPREAD", SchedSpread, "Always schedule model across all GPUs"},
+		"OLLAMA_SHUTDOWN_TIMEOUT":    {"OLLAMA_SHUTDOWN_TIMEOUT", ShutdownTimeout, "How long to wait for in flight requests to finish on shutdown (default 30s)"},
+		"OLLAMA_TEMPLATES":           {"OLLAMA_TEMPLATES", TemplatesDir, "The path to the prompt template library"},
+		"OLLAMA_TMPDIR":              {"OLLAMA_TMPDIR", TmpDir, "Location for temporary files"},
+		// the secret itself isn't listed since the values are logged
+		"OLLAMA_WEBHOOK_SECRET": {"OLLAMA_WEBHOOK_SECRET", WebhookSecret != "", "The secret chat requests must be signed with in an X-Webhook-Signature header"},
 	}
 	if runtime.GOOS != "darwin" {
 		ret["CUDA_VISIBLE_DEVICES"] = EnvVar{"CUDA_VISIBLE_DEVICES", CudaVisibleDevices, "Set which NVIDIA devices are visible"}
@@ -124,22 +159,103 @@ var defaultAllowOrigins = []string{
 	"0.0.0.0",
 }
 
+// rcFileName is the name of the per-project settings file. See [findRC].
+const rcFileName = ".ollamarc"
+
+// rcValues holds settings read from the nearest .ollamarc file. Values found
+// there take precedence over the process environment.
+var rcValues map[string]string
+
+// lookupEnv returns the value of key from the nearest .ollamarc file, falling
+// back to the process environment
+func lookupEnv(key string) (string, bool) {
+	if v, ok := rcValues[key]; ok {
+		return v, true
+	}
+
+	return os.LookupEnv(key)
+}
+
 // Clean quotes and spaces from the value
 func clean(key string) string {
-	return strings.Trim(os.Getenv(key), "\"' ")
+	v, _ := lookupEnv(key)
+	return strings.Trim(v, "\"' ")
+}
+
+// findRC walks up the directory tree from dir looking for a .ollamarc file.
+// The search stops once the user's home directory or the filesystem root has
+// been checked. An empty string is returned if no file is found.
+func findRC(dir string) string {
+	home, _ := os.UserHomeDir()
+	for {
+		p := filepath.Join(dir, rcFileName)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p
+		}
+
+		parent := filepath.Dir(dir)
+		if dir == home || parent == dir {
+			return ""
+		}
+
+		dir = parent
+	}
+}
+
+// loadRC parses a .ollamarc file. Each non-empty line not starting with # is
+// a KEY=VALUE pair using the same names as the environment variables.
+func loadRC(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vals := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", p, n)
+		}
+
+		vals[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return vals, scanner.Err()
 }
 
 func init() {
 	// default values
-	NumParallel = 0 // Autoselect
-	MaxRunners = 0  // Autoselect
+	NumParallel = 0      // Autoselect
+	NumParallelEmbed = 0 // Shares the NumParallel limit
+	MaxRunners = 0       // Autoselect
 	MaxQueuedRequests = 512
 	KeepAlive = 5 * time.Minute
+	PreloadConcurrency = 2
+	ShutdownTimeout = 30 * time.Second
 
 	LoadConfig()
 }
 
 func LoadConfig() {
+	rcValues = nil
+	if cwd, err := os.Getwd(); err == nil {
+		if p := findRC(cwd); p != "" {
+			vals, err := loadRC(p)
+			if err != nil {
+				slog.Error("invalid settings file, ignoring", "path", p, "error", err)
+			} else {
+				rcValues = vals
+			}
+		}
+	}
+
 	if debug := clean("OLLAMA_DEBUG"); debug != "" {
 		d, err := strconv.ParseBool(debug)
 		if err == nil {
@@ -215,6 +331,15 @@ func LoadConfig() {
 		}
 	}
 
+	if onpe := clean("OLLAMA_NUM_PARALLEL_EMBED"); onpe != "" {
+		val, err := strconv.Atoi(onpe)
+		if err != nil || val < 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_NUM_PARALLEL_EMBED", onpe, "error", err)
+		} else {
+			NumParallelEmbed = val
+		}
+	}
+
 	if nohistory := clean("OLLAMA_NOHISTORY"); nohistory != "" {
 		NoHistory = true
 	}
@@ -228,6 +353,29 @@ func LoadConfig() {
 		}
 	}
 
+	if dedup := clean("OLLAMA_DEDUP"); dedup != "" {
+		d, err := strconv.ParseBool(dedup)
+		if err == nil {
+			Dedup = d
+		} else {
+			Dedup = true
+		}
+	}
+
+	if deterministic := clean("OLLAMA_DETERMINISTIC"); deterministic != "" {
+		d, err := strconv.ParseBool(deterministic)
+		if err == nil {
+			Deterministic = d
+		} else {
+			Deterministic = true
+		}
+	}
+
+	ResponseFilters = clean("OLLAMA_RESPONSE_FILTERS")
+	DLQPath = clean("OLLAMA_DLQ_PATH")
+	MetricsAddr = clean("OLLAMA_METRICS_ADDR")
+	WebhookSecret = clean("OLLAMA_WEBHOOK_SECRET")
+
 	if noprune := clean("OLLAMA_NOPRUNE"); noprune != "" {
 		NoPrune = true
 	}
@@ -260,7 +408,7 @@ func LoadConfig() {
 		}
 	}
 
-	if onp := os.Getenv("OLLAMA_MAX_QUEUE"); onp != "" {
+	if onp, _ := lookupEnv("OLLAMA_MAX_QUEUE"); onp != "" {
 		p, err := strconv.Atoi(onp)
 		if err != nil || p <= 0 {
 			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_QUEUE", onp, "error", err)
@@ -269,6 +417,31 @@ func LoadConfig() {
 		}
 	}
 
+	PreloadModels = nil
+	for _, name := range strings.Split(clean("OLLAMA_PRELOAD_MODELS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			PreloadModels = append(PreloadModels, name)
+		}
+	}
+
+	if pc := clean("OLLAMA_PRELOAD_CONCURRENCY"); pc != "" {
+		p, err := strconv.Atoi(pc)
+		if err != nil || p <= 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_PRELOAD_CONCURRENCY", pc, "error", err)
+		} else {
+			PreloadConcurrency = p
+		}
+	}
+
+	if st := clean("OLLAMA_SHUTDOWN_TIMEOUT"); st != "" {
+		d, err := parseDuration(st)
+		if err != nil || d < 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_SHUTDOWN_TIMEOUT", st, "error", err)
+		} else {
+			ShutdownTimeout = d
+		}
+	}
+
 	ka := clean("OLLAMA_KEEP_ALIVE")
 	if ka != "" {
 		loadKeepAlive(ka)
@@ -280,6 +453,11 @@ func LoadConfig() {
 		slog.Error("invalid setting", "OLLAMA_MODELS", ModelsDir, "error", err)
 	}
 
+	TemplatesDir, err = getTemplatesDir()
+	if err != nil {
+		slog.Error("invalid setting", "OLLAMA_TEMPLATES", TemplatesDir, "error", err)
+	}
+
 	Host, err = getOllamaHost()
 	if err != nil {
 		slog.Error("invalid setting", "OLLAMA_HOST", Host, "error", err, "using default port", Host.Port)
@@ -297,7 +475,7 @@ func LoadConfig() {
 }
 
 func getModelsDir() (string, error) {
-	if models, exists := os.LookupEnv("OLLAMA_MODELS"); exists {
+	if models, exists := lookupEnv("OLLAMA_MODELS"); exists {
 		return models, nil
 	}
 	home, err := os.UserHomeDir()
@@ -307,10 +485,21 @@ func getModelsDir() (string, error) {
 	return filepath.Join(home, ".ollama", "models"), nil
 }
 
+func getTemplatesDir() (string, error) {
+	if templates, exists := lookupEnv("OLLAMA_TEMPLATES"); exists {
+		return templates, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ollama", "templates"), nil
+}
+
 func getOllamaHost() (*OllamaHost, error) {
 	defaultPort := "11434"
 
-	hostVar := os.Getenv("OLLAMA_HOST")
+	hostVar, _ := lookupEnv("OLLAMA_HOST")
 	hostVar = strings.TrimSpace(strings.Trim(strings.TrimSpace(hostVar), "\"'"))
 
 	scheme, hostport, ok := strings.Cut(hostVar, "://")
@@ -371,3 +560,12 @@ func loadKeepAlive(ka string) {
 		}
 	}
 }
+
+// parseDuration parses a duration such as "30s" or a number of seconds
+func parseDuration(s string) (time.Duration, error) {
+	if v, err := strconv.Atoi(s); err == nil {
+		return time.Duration(v) * time.Second, nil
+	}
+
+	return time.ParseDuration(s)
+}
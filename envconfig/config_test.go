@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -22,6 +24,18 @@ func TestConfig(t *testing.T) {
 	t.Setenv("OLLAMA_DEBUG", "1")
 	LoadConfig()
 	require.True(t, Debug)
+	t.Setenv("OLLAMA_DEDUP", "1")
+	LoadConfig()
+	require.True(t, Dedup)
+	t.Setenv("OLLAMA_DEDUP", "false")
+	LoadConfig()
+	require.False(t, Dedup)
+	t.Setenv("OLLAMA_DETERMINISTIC", "true")
+	LoadConfig()
+	require.True(t, Deterministic)
+	t.Setenv("OLLAMA_DETERMINISTIC", "0")
+	LoadConfig()
+	require.False(t, Deterministic)
 	t.Setenv("OLLAMA_FLASH_ATTENTION", "1")
 	LoadConfig()
 	require.True(t, FlashAttention)
@@ -40,6 +54,33 @@ func TestConfig(t *testing.T) {
 	t.Setenv("OLLAMA_KEEP_ALIVE", "-1")
 	LoadConfig()
 	require.Equal(t, time.Duration(math.MaxInt64), KeepAlive)
+	t.Setenv("OLLAMA_PRELOAD_MODELS", "llama3, ,mistral:7b")
+	LoadConfig()
+	require.Equal(t, []string{"llama3", "mistral:7b"}, PreloadModels)
+	t.Setenv("OLLAMA_PRELOAD_MODELS", "")
+	LoadConfig()
+	require.Empty(t, PreloadModels)
+	t.Setenv("OLLAMA_PRELOAD_CONCURRENCY", "4")
+	LoadConfig()
+	require.Equal(t, 4, PreloadConcurrency)
+	t.Setenv("OLLAMA_PRELOAD_CONCURRENCY", "0")
+	LoadConfig()
+	require.Equal(t, 4, PreloadConcurrency)
+	t.Setenv("OLLAMA_NUM_PARALLEL_EMBED", "8")
+	LoadConfig()
+	require.Equal(t, 8, NumParallelEmbed)
+	t.Setenv("OLLAMA_NUM_PARALLEL_EMBED", "-1")
+	LoadConfig()
+	require.Equal(t, 8, NumParallelEmbed)
+	t.Setenv("OLLAMA_SHUTDOWN_TIMEOUT", "10")
+	LoadConfig()
+	require.Equal(t, 10*time.Second, ShutdownTimeout)
+	t.Setenv("OLLAMA_SHUTDOWN_TIMEOUT", "2m")
+	LoadConfig()
+	require.Equal(t, 2*time.Minute, ShutdownTimeout)
+	t.Setenv("OLLAMA_SHUTDOWN_TIMEOUT", "-1s")
+	LoadConfig()
+	require.Equal(t, 2*time.Minute, ShutdownTimeout)
 }
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -86,3 +127,74 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestRCFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OLLAMA_HOST", "1.2.3.4")
+	t.Setenv("OLLAMA_NUM_PARALLEL", "")
+
+	project := filepath.Join(home, "project")
+	nested := filepath.Join(project, "a", "b")
+	require.NoError(t, os.MkdirAll(nested, 0o755))
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.Chdir(cwd))
+		LoadConfig()
+	})
+
+	t.Run("no file", func(t *testing.T) {
+		require.NoError(t, os.Chdir(nested))
+		LoadConfig()
+		assert.Equal(t, "1.2.3.4", Host.Host)
+	})
+
+	t.Run("parent directory", func(t *testing.T) {
+		rc := "# project settings\n\nOLLAMA_HOST=example.com:1234\nOLLAMA_NUM_PARALLEL = 3\n"
+		require.NoError(t, os.WriteFile(filepath.Join(project, rcFileName), []byte(rc), 0o644))
+		t.Cleanup(func() { os.Remove(filepath.Join(project, rcFileName)) })
+
+		require.NoError(t, os.Chdir(nested))
+		LoadConfig()
+		assert.Equal(t, "example.com", Host.Host)
+		assert.Equal(t, "1234", Host.Port)
+		assert.Equal(t, 3, NumParallel)
+	})
+
+	t.Run("closest file wins", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(project, rcFileName), []byte("OLLAMA_HOST=example.com"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(nested, rcFileName), []byte("OLLAMA_HOST=nested.example.com"), 0o644))
+		t.Cleanup(func() {
+			os.Remove(filepath.Join(project, rcFileName))
+			os.Remove(filepath.Join(nested, rcFileName))
+		})
+
+		require.NoError(t, os.Chdir(nested))
+		LoadConfig()
+		assert.Equal(t, "nested.example.com", Host.Host)
+	})
+
+	t.Run("stops at home", func(t *testing.T) {
+		// the parent of a t.TempDir is also owned by the test
+		outside := filepath.Join(filepath.Dir(home), rcFileName)
+		require.NoError(t, os.WriteFile(outside, []byte("OLLAMA_HOST=outside.example.com"), 0o644))
+		t.Cleanup(func() { os.Remove(outside) })
+
+		assert.Empty(t, findRC(nested))
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(project, rcFileName), []byte("OLLAMA_HOST"), 0o644))
+		t.Cleanup(func() { os.Remove(filepath.Join(project, rcFileName)) })
+
+		_, err := loadRC(filepath.Join(project, rcFileName))
+		require.Error(t, err)
+
+		require.NoError(t, os.Chdir(nested))
+		LoadConfig()
+		assert.Equal(t, "1.2.3.4", Host.Host)
+	})
+}
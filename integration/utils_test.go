@@ -5,6 +5,10 @@ package integration
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -341,3 +345,35 @@ func GenerateRequests() ([]api.GenerateRequest, [][]string) {
 			[]string{"nitrogen", "oxygen", "carbon", "dioxide"},
 		}
 }
+
+// WebhookTestClient sends requests signed as a webhook would deliver them to
+// a server run with OLLAMA_WEBHOOK_SECRET
+type WebhookTestClient struct {
+	// Endpoint is the host:port of the server
+	Endpoint string
+	Secret   string
+}
+
+// Sign returns the X-Webhook-Signature header of a request with body
+func (c WebhookTestClient) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post sends req as JSON to path with a signature of the body
+func (c WebhookTestClient) Post(ctx context.Context, path string, req any) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Signature", c.Sign(body))
+	return http.DefaultClient.Do(request)
+}
@@ -0,0 +1,51 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	secret := os.Getenv("OLLAMA_WEBHOOK_SECRET")
+	if secret == "" {
+		t.Skip("OLLAMA_WEBHOOK_SECRET isn't set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	client, endpoint, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+	require.NoError(t, PullIfMissing(ctx, client, "orca-mini"))
+
+	stream := false
+	req := api.ChatRequest{
+		Model:    "orca-mini",
+		Messages: []api.Message{{Role: "user", Content: "why is the sky blue?"}},
+		Stream:   &stream,
+	}
+
+	resp, err := WebhookTestClient{Endpoint: endpoint, Secret: secret}.Post(ctx, "/api/chat", req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var chat api.ChatResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&chat))
+	require.NotEmpty(t, chat.Message.Content)
+
+	// the same request signed with another secret is rejected
+	resp, err = WebhookTestClient{Endpoint: endpoint, Secret: "not the secret"}.Post(ctx, "/api/chat", req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
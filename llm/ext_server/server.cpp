@@ -93,6 +93,7 @@ struct slot_params {
     int32_t  n_predict = -1; // new tokens to predict
 
     std::vector<std::string> antiprompt;
+    std::vector<llama_token> stop_tokens; // stop when any of these tokens is sampled
 
     json input_prefix;
     json input_suffix;
@@ -564,6 +565,15 @@ struct llama_server_context
         slot->sparams.penalty_repeat    = json_value(data, "repeat_penalty",    default_sparams.penalty_repeat);
         slot->sparams.penalty_freq      = json_value(data, "frequency_penalty", default_sparams.penalty_freq);
         slot->sparams.penalty_present   = json_value(data, "presence_penalty",  default_sparams.penalty_present);
+
+        // a negative repeat_last_n penalizes the whole context, which also caps the window, and 0
+        // disables the penalty. the sampler only remembers the last n_prev tokens so keep enough
+        // of them to cover the window
+        if (slot->sparams.penalty_last_n < 0 || slot->sparams.penalty_last_n > slot->n_ctx)
+        {
+            slot->sparams.penalty_last_n = slot->n_ctx;
+        }
+        slot->sparams.n_prev = std::max(default_sparams.n_prev, slot->sparams.penalty_last_n);
         slot->sparams.mirostat          = json_value(data, "mirostat",          default_sparams.mirostat);
         slot->sparams.mirostat_tau      = json_value(data, "mirostat_tau",      default_sparams.mirostat_tau);
         slot->sparams.mirostat_eta      = json_value(data, "mirostat_eta",      default_sparams.mirostat_eta);
@@ -700,6 +710,25 @@ struct llama_server_context
             }
         }
 
+        slot->params.stop_tokens.clear();
+
+        const auto &stop_tokens = data.find("stop_tokens");
+        if (stop_tokens != data.end() && stop_tokens->is_array())
+        {
+            const int n_vocab = llama_n_vocab(model);
+            for (const auto &tok : *stop_tokens)
+            {
+                if (tok.is_number_integer() && tok >= 0 && tok < n_vocab)
+                {
+                    slot->params.stop_tokens.push_back(tok.get<llama_token>());
+                }
+                else
+                {
+                    LOG_WARNING("ignoring invalid stop token", {{"token", tok}});
+                }
+            }
+        }
+
         const auto &samplers_sequence = data.find("samplers");
         if (samplers_sequence != data.end() && samplers_sequence->is_array())
         {
@@ -908,9 +937,20 @@ struct llama_server_context
         const std::string token_str = llama_token_to_piece(ctx, result.tok);
         slot.sampled = result.tok;
 
-        // search stop word and delete it
-        slot.generated_text += token_str;
-        slot.has_next_token = true;
+        // stop tokens end generation and are not included in the response
+        const bool is_stop_token = std::find(slot.params.stop_tokens.begin(), slot.params.stop_tokens.end(), result.tok) != slot.params.stop_tokens.end();
+        if (is_stop_token)
+        {
+            slot.stopped_word   = true;
+            slot.stopping_word  = token_str;
+            LOG_VERBOSE("stop token found", {{"token", result.tok}});
+        }
+        else
+        {
+            // search stop word and delete it
+            slot.generated_text += token_str;
+        }
+        slot.has_next_token = !is_stop_token;
 
         if (slot.ctx_sampling->params.use_penalty_prompt_tokens && result.tok != -1)
         {
@@ -984,7 +1024,7 @@ struct llama_server_context
 
         slot.add_token_string(result);
 
-        if (incomplete)
+        if (incomplete && !is_stop_token)
         {
             slot.has_next_token = true;
         }
@@ -1086,6 +1126,7 @@ struct llama_server_context
             {"mirostat_eta",      slot.sparams.mirostat_eta},
             {"penalize_nl",       slot.sparams.penalize_nl},
             {"stop",              slot.params.antiprompt},
+            {"stop_tokens",       slot.params.stop_tokens},
             {"n_predict",         slot.params.n_predict},
             {"n_keep",            params.n_keep},
             {"ignore_eos",        ignore_eos},
@@ -2806,9 +2847,11 @@ int main(int argc, char **argv) {
                 int n_processing_slots = result.result_json["processing"];
 
                 json health = {
-                        {"status",           "ok"},
-                        {"slots_idle",       n_idle_slots},
-                        {"slots_processing", n_processing_slots}};
+                        {"status",              "ok"},
+                        {"slots_idle",          n_idle_slots},
+                        {"slots_processing",    n_processing_slots},
+                        {"kv_cache_used_cells", result.result_json["kv_cache_used_cells"]},
+                        {"n_ctx",               params.n_ctx}};
                 res.status = 200; // HTTP OK
                 if (sparams.slots_endpoint && req.has_param("include_slots")) {
                     health["slots"] = result.result_json["slots"];
@@ -107,6 +107,15 @@ func (kv KV) ContextLength() uint64 {
 	return kv.u64(fmt.Sprintf("%s.context_length", kv.Architecture()))
 }
 
+// VocabSize returns the number of tokens in the vocabulary or 0 if it is unknown
+func (kv KV) VocabSize() uint64 {
+	if tokens, ok := kv["tokenizer.ggml.tokens"].(*array); ok {
+		return uint64(tokens.size)
+	}
+
+	return 0
+}
+
 func (kv KV) ChatTemplate() string {
 	s, _ := kv["tokenizer.chat_template"].(string)
 	return s
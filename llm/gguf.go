@@ -502,6 +502,10 @@ var ggufKVOrder = map[string][]string{
 	"llama": {
 		"general.architecture",
 		"general.name",
+		"general.description",
+		"general.dataset",
+		"general.dataset.description",
+		"general.dataset.source",
 		"llama.vocab_size",
 		"llama.context_length",
 		"llama.embedding_length",
@@ -0,0 +1,369 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GrammarError is returned by ValidateGrammar when a grammar isn't valid GBNF
+type GrammarError struct {
+	// Line and Column are where the error was found, starting at 1. They're 0
+	// if the error isn't at a single position, e.g. if there's no root rule
+	Line, Column int
+
+	Reason string
+}
+
+func (e *GrammarError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("invalid grammar: %s", e.Reason)
+	}
+
+	return fmt.Sprintf("invalid grammar: line %d, column %d: %s", e.Line, e.Column, e.Reason)
+}
+
+// ValidateGrammar checks that grammar is valid GBNF, the grammar format of
+// llama.cpp, before it's sent to the runner: that it parses, that every rule it
+// refers to is defined and that it has a root rule
+func ValidateGrammar(grammar string) error {
+	p := grammarParser{src: []rune(grammar), defined: make(map[string]bool)}
+	if err := p.parse(); err != nil {
+		return err
+	}
+
+	for _, ref := range p.refs {
+		if !p.defined[ref.name] {
+			return p.errorAt(ref.pos, "undefined rule %q", ref.name)
+		}
+	}
+
+	if !p.defined["root"] {
+		return &GrammarError{Reason: "missing root rule"}
+	}
+
+	return nil
+}
+
+type grammarRef struct {
+	name string
+	pos  int
+}
+
+// grammarParser follows the parser in llama.cpp's grammar-parser.cpp, without
+// building the rules
+type grammarParser struct {
+	src []rune
+	pos int
+
+	defined map[string]bool
+	refs    []grammarRef
+}
+
+func (p *grammarParser) errorAt(pos int, format string, args ...any) error {
+	line, column := 1, 1
+	for _, r := range p.src[:pos] {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+
+	return &GrammarError{Line: line, Column: column, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (p *grammarParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *grammarParser) peek(offset int) rune {
+	if p.pos+offset >= len(p.src) {
+		return 0
+	}
+
+	return p.src[p.pos+offset]
+}
+
+func isGrammarWordChar(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-'
+}
+
+// space skips spaces and comments, and newlines if newlines is set
+func (p *grammarParser) space(newlines bool) {
+	for !p.eof() {
+		switch r := p.peek(0); {
+		case r == ' ' || r == '\t':
+			p.pos++
+		case r == '#':
+			for !p.eof() && p.peek(0) != '\n' && p.peek(0) != '\r' {
+				p.pos++
+			}
+		case (r == '\n' || r == '\r') && newlines:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *grammarParser) name() string {
+	start := p.pos
+	for !p.eof() && isGrammarWordChar(p.peek(0)) {
+		p.pos++
+	}
+
+	return string(p.src[start:p.pos])
+}
+
+func (p *grammarParser) parse() error {
+	p.space(true)
+	for !p.eof() {
+		if err := p.rule(); err != nil {
+			return err
+		}
+
+		p.space(true)
+	}
+
+	return nil
+}
+
+// rule parses name ::= alternates, ending at a newline
+func (p *grammarParser) rule() error {
+	start := p.pos
+	name := p.name()
+	if name == "" {
+		return p.errorAt(start, "expected a rule name, got %q", p.peek(0))
+	}
+
+	p.space(false)
+	if !strings.HasPrefix(string(p.src[p.pos:min(p.pos+3, len(p.src))]), "::=") {
+		return p.errorAt(p.pos, "expected ::= after rule name %q", name)
+	}
+
+	p.pos += 3
+	p.space(true)
+	if err := p.alternates(false); err != nil {
+		return err
+	}
+
+	switch {
+	case p.eof():
+	case p.peek(0) == '\r' && p.peek(1) == '\n':
+		p.pos += 2
+	case p.peek(0) == '\n' || p.peek(0) == '\r':
+		p.pos++
+	default:
+		return p.errorAt(p.pos, "expected a newline or the end of the grammar, got %q", p.peek(0))
+	}
+
+	p.defined[name] = true
+	return nil
+}
+
+// alternates parses sequences separated by |. nested alternates, in
+// parentheses, may span lines
+func (p *grammarParser) alternates(nested bool) error {
+	if err := p.sequence(nested); err != nil {
+		return err
+	}
+
+	for !p.eof() && p.peek(0) == '|' {
+		p.pos++
+		p.space(true)
+		if err := p.sequence(nested); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *grammarParser) sequence(nested bool) error {
+	var items int
+	for !p.eof() {
+		start := p.pos
+		switch r := p.peek(0); {
+		case r == '"':
+			if err := p.literal(); err != nil {
+				return err
+			}
+		case r == '[':
+			if err := p.class(); err != nil {
+				return err
+			}
+		case isGrammarWordChar(r):
+			p.refs = append(p.refs, grammarRef{name: p.name(), pos: start})
+		case r == '(':
+			p.pos++
+			p.space(true)
+			if err := p.alternates(true); err != nil {
+				return err
+			}
+
+			if p.eof() || p.peek(0) != ')' {
+				return p.errorAt(start, "unclosed (")
+			}
+
+			p.pos++
+		case r == '.':
+			p.pos++
+		case r == '*' || r == '+' || r == '?':
+			if items == 0 {
+				return p.errorAt(start, "expected an item before %q", r)
+			}
+
+			p.pos++
+		case r == '{':
+			if items == 0 {
+				return p.errorAt(start, "expected an item before %q", r)
+			}
+
+			if err := p.repetition(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		items++
+		p.space(nested)
+	}
+
+	return nil
+}
+
+// literal parses a string in double quotes
+func (p *grammarParser) literal() error {
+	start := p.pos
+	p.pos++
+	for {
+		if p.eof() {
+			return p.errorAt(start, "unterminated string")
+		}
+
+		if p.peek(0) == '"' {
+			p.pos++
+			return nil
+		}
+
+		if err := p.char(); err != nil {
+			return err
+		}
+	}
+}
+
+// class parses a character class in square brackets, such as [^a-z_]
+func (p *grammarParser) class() error {
+	start := p.pos
+	p.pos++
+	if p.peek(0) == '^' {
+		p.pos++
+	}
+
+	for {
+		if p.eof() {
+			return p.errorAt(start, "unterminated character class")
+		}
+
+		if p.peek(0) == ']' {
+			p.pos++
+			return nil
+		}
+
+		if err := p.char(); err != nil {
+			return err
+		}
+
+		if p.peek(0) == '-' && p.peek(1) != ']' && p.peek(1) != 0 {
+			p.pos++
+			if err := p.char(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// char parses a character of a literal or class, which may be escaped
+func (p *grammarParser) char() error {
+	if p.peek(0) != '\\' {
+		p.pos++
+		return nil
+	}
+
+	start := p.pos
+	p.pos++
+
+	var digits int
+	switch r := p.peek(0); r {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case 't', 'r', 'n', '\\', '"', '[', ']':
+		p.pos++
+		return nil
+	case 0:
+		return p.errorAt(start, "unterminated escape")
+	default:
+		return p.errorAt(start, "unknown escape \\%c", r)
+	}
+
+	p.pos++
+	for range digits {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", p.peek(0)) {
+			return p.errorAt(start, "expected %d hex digits after \\%c", digits, p.src[start+1])
+		}
+
+		p.pos++
+	}
+
+	return nil
+}
+
+// repetition parses {m}, {m,} or {m,n}
+func (p *grammarParser) repetition() error {
+	start := p.pos
+	p.pos++
+	p.space(true)
+
+	number := func() (int, bool) {
+		var n int
+		var ok bool
+		for !p.eof() && '0' <= p.peek(0) && p.peek(0) <= '9' {
+			n = n*10 + int(p.peek(0)-'0')
+			ok = true
+			p.pos++
+		}
+
+		p.space(true)
+		return n, ok
+	}
+
+	lo, ok := number()
+	if !ok {
+		return p.errorAt(start, "expected a number after {")
+	}
+
+	hi := lo
+	if p.peek(0) == ',' {
+		p.pos++
+		p.space(true)
+		if hi, ok = number(); !ok {
+			hi = -1
+		}
+	}
+
+	if p.eof() || p.peek(0) != '}' {
+		return p.errorAt(start, "unclosed {")
+	}
+
+	p.pos++
+	if hi >= 0 && hi < lo {
+		return p.errorAt(start, "maximum repetitions %d is less than the minimum %d", hi, lo)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateGrammar(t *testing.T) {
+	valid := map[string]string{
+		"json":            jsonGrammar,
+		"verbs":           `root ::= ("start" | "stop" | "restart") " " [a-z]+`,
+		"rules":           "root ::= greeting \" \" name\r\ngreeting ::= \"hi\" | \"hello\" # a comment\nname ::= [A-Z] [a-z]*\n",
+		"repetition":      `root ::= [0-9]{3} "-" [0-9]{2,} "-" [0-9]{1,4} .?`,
+		"escapes":         `root ::= "\x41é\t\"" [\[\]\\^-]`,
+		"nested":          "root ::= (\n  \"a\" |\n  \"b\"\n)+",
+		"empty alternate": `root ::= "a" | `,
+	}
+
+	for name, grammar := range valid {
+		t.Run(name, func(t *testing.T) {
+			if err := ValidateGrammar(grammar); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name    string
+		grammar string
+		expect  GrammarError
+	}{
+		{"no root", `answer ::= "yes" | "no"`, GrammarError{Reason: "missing root rule"}},
+		{"undefined rule", "root ::= verb\nnoun ::= \"x\"", GrammarError{Line: 1, Column: 10, Reason: `undefined rule "verb"`}},
+		{"missing ::=", "root ::= \"a\"\nverb = \"b\"", GrammarError{Line: 2, Column: 6, Reason: `expected ::= after rule name "verb"`}},
+		{"unterminated string", `root ::= "abc`, GrammarError{Line: 1, Column: 10, Reason: "unterminated string"}},
+		{"unterminated class", `root ::= [a-z`, GrammarError{Line: 1, Column: 10, Reason: "unterminated character class"}},
+		{"unclosed group", `root ::= ("a" | "b"`, GrammarError{Line: 1, Column: 10, Reason: "unclosed ("}},
+		{"unknown escape", `root ::= "\q"`, GrammarError{Line: 1, Column: 11, Reason: `unknown escape \q`}},
+		{"short hex", `root ::= "\x4"`, GrammarError{Line: 1, Column: 11, Reason: `expected 2 hex digits after \x`}},
+		{"dangling operator", `root ::= * "a"`, GrammarError{Line: 1, Column: 10, Reason: `expected an item before '*'`}},
+		{"bad repetition", `root ::= "a"{3,1}`, GrammarError{Line: 1, Column: 13, Reason: "maximum repetitions 1 is less than the minimum 3"}},
+		{"trailing text", `root ::= "a" )`, GrammarError{Line: 1, Column: 14, Reason: `expected a newline or the end of the grammar, got ')'`}},
+	}
+
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateGrammar(tt.grammar)
+
+			var gerr *GrammarError
+			if !errors.As(err, &gerr) {
+				t.Fatalf("expected a grammar error, got %v", err)
+			}
+
+			if *gerr != tt.expect {
+				t.Errorf("expected %+v, got %+v", tt.expect, *gerr)
+			}
+		})
+	}
+}
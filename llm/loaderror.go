@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// Reasons a model fails to load, reported in LoadError
+const (
+	LoadFailureOutOfMemory             = "out_of_memory"
+	LoadFailureUnsupportedArchitecture = "unsupported_architecture"
+	LoadFailureCorruptBlob             = "corrupt_blob"
+)
+
+// LoadError is returned when a model fails to load. Its diagnostic classifies
+// the failure and suggests how to fix it
+type LoadError struct {
+	api.LoadDiagnostic
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// memoryLoadError is returned when a model needs more memory than is available
+func memoryLoadError(required, available uint64, err error) *LoadError {
+	return &LoadError{
+		LoadDiagnostic: api.LoadDiagnostic{
+			Reason:          LoadFailureOutOfMemory,
+			RequiredMemory:  required,
+			AvailableMemory: available,
+			Suggestion:      "reduce num_ctx or num_parallel, offload fewer layers with num_gpu, or use a smaller quantization of the model",
+		},
+		Err: err,
+	}
+}
+
+// corruptLoadError is returned when a model file can't be decoded, e.g.
+// because it's truncated
+func corruptLoadError(err error) *LoadError {
+	return &LoadError{
+		LoadDiagnostic: api.LoadDiagnostic{
+			Reason:     LoadFailureCorruptBlob,
+			Suggestion: "the model file is damaged or incomplete, pull or create the model again",
+		},
+		Err: err,
+	}
+}
+
+// runnerLoadError classifies err, returned when the runner exited while
+// loading a model onto gpus, by the last error message the runner logged. It
+// returns err as is if the message doesn't match a known failure
+func runnerLoadError(msg string, estimate MemoryEstimate, gpus gpu.GpuInfoList, err error) error {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "out of memory"),
+		strings.Contains(lower, "cudamalloc failed"),
+		strings.Contains(lower, "failed to allocate"):
+		required := estimate.VRAMSize
+		if required == 0 {
+			required = estimate.TotalSize
+		}
+
+		var available uint64
+		for _, g := range gpus {
+			available += g.FreeMemory
+		}
+
+		return memoryLoadError(required, available, err)
+	case strings.Contains(lower, "unknown model"):
+		return &LoadError{
+			LoadDiagnostic: api.LoadDiagnostic{
+				Reason:     LoadFailureUnsupportedArchitecture,
+				Suggestion: "upgrade Ollama to a version which supports the model's architecture",
+			},
+			Err: err,
+		}
+	case strings.Contains(lower, "corrupted or incomplete"),
+		strings.Contains(lower, "not within the file bounds"),
+		strings.Contains(lower, "invalid magic"):
+		return corruptLoadError(err)
+	}
+
+	return err
+}
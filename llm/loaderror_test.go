@@ -0,0 +1,100 @@
+package llm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+func TestRunnerLoadError(t *testing.T) {
+	estimate := MemoryEstimate{VRAMSize: 6 << 30, TotalSize: 8 << 30}
+	gpus := make(gpu.GpuInfoList, 2)
+	gpus[0].FreeMemory = 3 << 30
+	gpus[1].FreeMemory = 1 << 30
+	errExit := errors.New("llama runner process has terminated: exit status 1")
+
+	cases := []struct {
+		name   string
+		msg    string
+		expect *api.LoadDiagnostic
+	}{
+		{
+			name: "out of memory",
+			msg:  "cudaMalloc failed: out of memory",
+			expect: &api.LoadDiagnostic{
+				Reason:          LoadFailureOutOfMemory,
+				RequiredMemory:  6 << 30,
+				AvailableMemory: 4 << 30,
+				Suggestion:      "reduce num_ctx or num_parallel, offload fewer layers with num_gpu, or use a smaller quantization of the model",
+			},
+		},
+		{
+			name: "unsupported architecture",
+			msg:  "error loading model: error loading model architecture: unknown model architecture: 'mamba3'",
+			expect: &api.LoadDiagnostic{
+				Reason:     LoadFailureUnsupportedArchitecture,
+				Suggestion: "upgrade Ollama to a version which supports the model's architecture",
+			},
+		},
+		{
+			name: "corrupt blob",
+			msg:  "error loading model: tensor 'blk.0.ffn_down.weight' data is not within the file bounds, model is corrupted or incomplete",
+			expect: &api.LoadDiagnostic{
+				Reason:     LoadFailureCorruptBlob,
+				Suggestion: "the model file is damaged or incomplete, pull or create the model again",
+			},
+		},
+		{
+			name: "unknown",
+			msg:  "error: unexpected failure",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runnerLoadError(tt.msg, estimate, gpus, errExit)
+			if !errors.Is(err, errExit) {
+				t.Errorf("expected %v to wrap %v", err, errExit)
+			}
+
+			var loadErr *LoadError
+			if !errors.As(err, &loadErr) {
+				if tt.expect != nil {
+					t.Fatalf("expected a load error, got %v", err)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(tt.expect, &loadErr.LoadDiagnostic); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadModelCorrupt(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	// a GGUF header which ends before its key values
+	if err := os.WriteFile(p, []byte("GGUF\x03\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadModel(p, 0)
+
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) || loadErr.Reason != LoadFailureCorruptBlob {
+		t.Errorf("expected a corrupt blob error, got %v", err)
+	}
+
+	// missing files aren't corrupt
+	_, err = LoadModel(filepath.Join(t.TempDir(), "missing.gguf"), 0)
+	if !errors.Is(err, os.ErrNotExist) || errors.As(err, &loadErr) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processRSS returns the resident memory of process pid in bytes
+func processRSS(pid int) (uint64, error) {
+	bts, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(bts))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm format: %q", bts)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return pages * uint64(os.Getpagesize()), nil
+}
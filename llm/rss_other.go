@@ -0,0 +1,10 @@
+//go:build !linux
+
+package llm
+
+import "errors"
+
+// processRSS returns the resident memory of process pid in bytes
+func processRSS(pid int) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
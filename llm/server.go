@@ -17,8 +17,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/semaphore"
@@ -40,6 +42,8 @@ type LlamaServer interface {
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	GPULayers() int // Layers offloaded to GPUs
+	ContextStats(ctx context.Context) (ContextStats, error)
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -52,12 +56,18 @@ type llmServer struct {
 
 	estimate    MemoryEstimate
 	totalLayers uint64
+	vocabSize   uint64
+	numParallel int
 	// gpuCount     int
 	gpus         gpu.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
 	loadDuration time.Duration   // Record how long it took the model to load
 	loadProgress float32
 
 	sem *semaphore.Weighted
+
+	// embedSem limits embedding requests. It's sem unless OLLAMA_NUM_PARALLEL_EMBED
+	// is set, so embeddings can be limited separately from completions
+	embedSem *semaphore.Weighted
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -77,7 +87,11 @@ func LoadModel(model string, maxArraySize int) (*GGML, error) {
 	defer f.Close()
 
 	ggml, _, err := DecodeGGML(f, maxArraySize)
-	return ggml, err
+	if err != nil {
+		return nil, corruptLoadError(err)
+	}
+
+	return ggml, nil
 }
 
 // NewLlamaServer will run a server for the given GPUs
@@ -130,7 +144,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		available := systemFreeMemory + systemSwapFreeMemory
 		if systemMemoryRequired > available {
 			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "available", available, "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory))
-			return nil, fmt.Errorf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(systemMemoryRequired), format.HumanBytes2(available))
+			return nil, memoryLoadError(systemMemoryRequired, available, fmt.Errorf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(systemMemoryRequired), format.HumanBytes2(available)))
 		}
 	}
 
@@ -331,14 +345,18 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			}
 		}
 
+		sem := semaphore.NewWeighted(int64(numParallel))
 		s := &llmServer{
 			port:        port,
 			cmd:         exec.Command(server, finalParams...),
 			status:      NewStatusWriter(os.Stderr),
 			options:     opts,
 			estimate:    estimate,
-			sem:         semaphore.NewWeighted(int64(numParallel)),
+			sem:         sem,
+			embedSem:    embedSemaphore(sem, numParallel),
 			totalLayers: ggml.KV().BlockCount() + 1,
+			vocabSize:   ggml.KV().VocabSize(),
+			numParallel: numParallel,
 			gpus:        gpus,
 			done:        make(chan error, 1),
 		}
@@ -471,11 +489,13 @@ func (s ServerStatus) ToString() string {
 }
 
 type ServerStatusResp struct {
-	Status          string  `json:"status"`
-	SlotsIdle       int     `json:"slots_idle"`
-	SlotsProcessing int     `json:"slots_processing"`
-	Error           string  `json:"error"`
-	Progress        float32 `json:"progress"`
+	Status           string  `json:"status"`
+	SlotsIdle        int     `json:"slots_idle"`
+	SlotsProcessing  int     `json:"slots_processing"`
+	KVCacheUsedCells int     `json:"kv_cache_used_cells"`
+	NumCtx           int     `json:"n_ctx"`
+	Error            string  `json:"error"`
+	Progress         float32 `json:"progress"`
 }
 
 func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
@@ -553,6 +573,42 @@ func (s *llmServer) getServerStatusRetry(ctx context.Context) (ServerStatus, err
 	}
 }
 
+// ContextStats reports how much of a runner's KV cache is in use
+type ContextStats struct {
+	KVCacheUsedTokens  int
+	KVCacheTotalTokens int
+	ActiveSessions     int
+}
+
+func (s *llmServer) ContextStats(ctx context.Context) (ContextStats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/health", s.port), nil)
+	if err != nil {
+		return ContextStats{}, fmt.Errorf("error creating GET request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ContextStats{}, fmt.Errorf("health resp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var status ServerStatusResp
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return ContextStats{}, fmt.Errorf("health unmarshal encode response: %w", err)
+	}
+
+	switch status.Status {
+	case "ok", "no slot available":
+		return ContextStats{
+			KVCacheUsedTokens:  status.KVCacheUsedCells,
+			KVCacheTotalTokens: status.NumCtx,
+			ActiveSessions:     status.SlotsProcessing,
+		}, nil
+	default:
+		return ContextStats{}, fmt.Errorf("server not ready: %s", status.Status)
+	}
+}
+
 func (s *llmServer) Ping(ctx context.Context) error {
 	_, err := s.getServerStatus(ctx)
 	if err != nil {
@@ -583,9 +639,9 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 				msg = s.status.LastErrMsg
 			}
 			if strings.Contains(msg, "unknown model") {
-				return fmt.Errorf("this model is not supported by your version of Ollama. You may need to upgrade")
+				return runnerLoadError(msg, s.estimate, s.gpus, fmt.Errorf("this model is not supported by your version of Ollama. You may need to upgrade"))
 			}
-			return fmt.Errorf("llama runner process has terminated: %v %s", err, msg)
+			return runnerLoadError(msg, s.estimate, s.gpus, fmt.Errorf("llama runner process has terminated: %v %s", err, msg))
 		default:
 		}
 		if time.Now().After(stallTimer) {
@@ -601,7 +657,7 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			if s.status != nil && s.status.LastErrMsg != "" {
 				msg = s.status.LastErrMsg
 			}
-			return fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
+			return runnerLoadError(msg, s.estimate, s.gpus, fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg))
 		}
 		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
 		defer cancel()
@@ -684,8 +740,13 @@ type completion struct {
 }
 
 type CompletionRequest struct {
-	Prompt  string
-	Format  string
+	Prompt string
+	Tokens []int // Tokens, if set, is used instead of Prompt
+	Format string
+
+	// Grammar, if set, is a GBNF grammar which constrains the response
+	Grammar string
+
 	Images  []ImageData
 	Options *api.Options
 }
@@ -698,15 +759,75 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration
 	EvalCount          int
 	EvalDuration       time.Duration
+
+	// RunnerRSSPeak and MemoryEstimateGPU are set on the final response to the
+	// runner process's peak resident memory while handling the request and the
+	// VRAM, in bytes, estimated for the model when it was loaded. Neither is
+	// measured per request
+	RunnerRSSPeak     uint64
+	MemoryEstimateGPU uint64
+}
+
+// sampleMemory samples the runner's resident memory until the returned
+// function is called, which returns the most memory seen. Memory is sampled
+// rather than read from the runner since the operating system only tracks
+// the peak over the life of the process
+func (s *llmServer) sampleMemory() func() uint64 {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return func() uint64 { return 0 }
+	}
+
+	pid := s.cmd.Process.Pid
+
+	var peak uint64
+	sample := func() {
+		if rss, err := processRSS(pid); err == nil && rss > peak {
+			peak = rss
+		}
+	}
+
+	sample()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+
+	return sync.OnceValue(func() uint64 {
+		close(done)
+		wg.Wait()
+		sample()
+		return peak
+	})
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	if err := ValidateTokens(req.Options.StopTokens, s.vocabSize); err != nil {
+		return fmt.Errorf("stop_tokens: %w", err)
+	}
+
 	if err := s.sem.Acquire(ctx, 1); err != nil {
 		slog.Error("Failed to acquire semaphore", "error", err)
 		return err
 	}
 	defer s.sem.Release(1)
 
+	if err := ValidateTokens(req.Tokens, s.vocabSize); err != nil {
+		return err
+	}
+
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
 		req.Options.NumPredict = 10 * s.options.NumCtx
@@ -723,7 +844,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"top_p":             req.Options.TopP,
 		"tfs_z":             req.Options.TFSZ,
 		"typical_p":         req.Options.TypicalP,
-		"repeat_last_n":     req.Options.RepeatLastN,
+		"repeat_last_n":     repeatLastN(req.Options.RepeatLastN, s.options.NumCtx/max(s.numParallel, 1)),
 		"repeat_penalty":    req.Options.RepeatPenalty,
 		"presence_penalty":  req.Options.PresencePenalty,
 		"frequency_penalty": req.Options.FrequencyPenalty,
@@ -733,10 +854,31 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"penalize_nl":       req.Options.PenalizeNewline,
 		"seed":              req.Options.Seed,
 		"stop":              req.Options.Stop,
+		"stop_tokens":       req.Options.StopTokens,
 		"image_data":        req.Images,
 		"cache_prompt":      true,
 	}
 
+	if len(req.Tokens) > 0 {
+		request["prompt"] = req.Tokens
+	}
+
+	// the runner takes logit biases as [token, bias] pairs
+	if len(req.Options.LogitBias) > 0 {
+		ids := make([]int, 0, len(req.Options.LogitBias))
+		for id := range req.Options.LogitBias {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+
+		bias := make([][2]any, len(ids))
+		for i, id := range ids {
+			bias[i] = [2]any{id, req.Options.LogitBias[id]}
+		}
+
+		request["logit_bias"] = bias
+	}
+
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
 	if err != nil {
@@ -745,7 +887,9 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	if req.Format == "json" {
+	if req.Grammar != "" {
+		request["grammar"] = req.Grammar
+	} else if req.Format == "json" {
 		request["grammar"] = jsonGrammar
 		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
 			slog.Warn("Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
@@ -761,6 +905,9 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("failed to marshal data: %v", err)
 	}
 
+	stopSampling := s.sampleMemory()
+	defer stopSampling()
+
 	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", s.port)
 	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, buffer)
 	if err != nil {
@@ -845,6 +992,8 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 					PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
 					EvalCount:          c.Timings.PredictedN,
 					EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
+					RunnerRSSPeak:      stopSampling(),
+					MemoryEstimateGPU:  s.estimate.VRAMSize,
 				})
 				return nil
 			}
@@ -867,6 +1016,45 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	return nil
 }
 
+// embedSemaphore returns the semaphore which limits embedding requests. They
+// share sem with completions unless OLLAMA_NUM_PARALLEL_EMBED is set, in which
+// case the limit is capped at numParallel, the runner's slots
+func embedSemaphore(sem *semaphore.Weighted, numParallel int) *semaphore.Weighted {
+	if envconfig.NumParallelEmbed > 0 {
+		return semaphore.NewWeighted(int64(min(envconfig.NumParallelEmbed, numParallel)))
+	}
+
+	return sem
+}
+
+// repeatLastN returns the number of tokens the runner looks back over to
+// penalize repeats for a repeat_last_n of n, in a slot of numCtx tokens. A
+// negative n covers the whole context and n is capped to it, since the sampler
+// keeps a history of as many tokens
+func repeatLastN(n, numCtx int) int {
+	if n < 0 || n > numCtx {
+		return numCtx
+	}
+
+	return n
+}
+
+// ValidateTokens checks that every token is in the model's vocabulary.
+// A vocabSize of 0 means the vocabulary size is unknown and only negative IDs
+// are rejected.
+func ValidateTokens(tokens []int, vocabSize uint64) error {
+	for _, token := range tokens {
+		switch {
+		case token < 0:
+			return fmt.Errorf("invalid token %d: token IDs must not be negative", token)
+		case vocabSize > 0 && uint64(token) >= vocabSize:
+			return fmt.Errorf("invalid token %d: the vocabulary has %d tokens", token, vocabSize)
+		}
+	}
+
+	return nil
+}
+
 type EmbedRequest struct {
 	Content []string `json:"content"`
 }
@@ -876,11 +1064,11 @@ type EmbedResponse struct {
 }
 
 func (s *llmServer) Embed(ctx context.Context, input []string) ([][]float32, error) {
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	if err := s.embedSem.Acquire(ctx, 1); err != nil {
 		slog.Error("Failed to acquire semaphore", "error", err)
 		return nil, err
 	}
-	defer s.sem.Release(1)
+	defer s.embedSem.Release(1)
 
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
@@ -1055,6 +1243,18 @@ func (s *llmServer) EstimatedTotal() uint64 {
 	return s.estimate.TotalSize
 }
 
+func (s *llmServer) GPULayers() int {
+	if len(s.gpus) == 0 || s.gpus[0].Library == "cpu" {
+		return 0
+	}
+
+	if s.options.NumGPU < 0 {
+		return s.estimate.Layers
+	}
+
+	return min(s.options.NumGPU, int(s.totalLayers))
+}
+
 func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	for i, gpu := range s.gpus {
 		if gpu.ID == gpuID {
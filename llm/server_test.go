@@ -0,0 +1,314 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestValidateTokens(t *testing.T) {
+	cases := []struct {
+		name      string
+		tokens    []int
+		vocabSize uint64
+		valid     bool
+	}{
+		{"none", nil, 32000, true},
+		{"in vocabulary", []int{0, 2, 31999}, 32000, true},
+		{"negative", []int{2, -1}, 32000, false},
+		{"out of vocabulary", []int{32000}, 32000, false},
+		{"unknown vocabulary", []int{128009}, 0, true},
+		{"negative unknown vocabulary", []int{-1}, 0, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTokens(tt.tokens, tt.vocabSize)
+			if tt.valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !tt.valid && err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+// newTestLlmServer returns an llmServer talking to a fake runner which reports
+// itself healthy and passes completion requests to completion
+func newTestLlmServer(t *testing.T, completion http.HandlerFunc) *llmServer {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/completion", completion)
+	return newTestLlmServerMux(t, mux)
+}
+
+// newTestLlmServerMux is like newTestLlmServer but serves the runner endpoints
+// from mux
+func newTestLlmServerMux(t *testing.T, mux *http.ServeMux) *llmServer {
+	t.Helper()
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": "ok"}`)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &llmServer{
+		port:     port,
+		cmd:      &exec.Cmd{},
+		options:  api.Options{Runner: api.Runner{NumCtx: 2048}},
+		sem:      semaphore.NewWeighted(1),
+		embedSem: semaphore.NewWeighted(1),
+	}
+}
+
+func TestCompletionRepeatLastN(t *testing.T) {
+	var request map[string]any
+	s := newTestLlmServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+
+		fmt.Fprintln(w, `data: {"content": "", "stop": true}`)
+	})
+
+	// each of the 2 slots has 1024 tokens of context
+	s.numParallel = 2
+
+	cases := []struct {
+		n, expect int
+	}{
+		{-1, 1024},
+		{0, 0},
+		{64, 64},
+		{256, 256},
+		{1024, 1024},
+		{1025, 1024},
+	}
+
+	for _, tt := range cases {
+		t.Run(strconv.Itoa(tt.n), func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.RepeatLastN = tt.n
+			if err := s.Completion(context.TODO(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := request["repeat_last_n"]; got != float64(tt.expect) {
+				t.Errorf("expected repeat_last_n %d, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestCompletionGrammar(t *testing.T) {
+	var request map[string]any
+	s := newTestLlmServer(t, func(w http.ResponseWriter, r *http.Request) {
+		request = nil
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+
+		fmt.Fprintln(w, `data: {"content": "", "stop": true}`)
+	})
+
+	cases := []struct {
+		name   string
+		req    CompletionRequest
+		expect any
+	}{
+		{"none", CompletionRequest{}, nil},
+		{"json", CompletionRequest{Format: "json"}, jsonGrammar},
+		{"grammar", CompletionRequest{Grammar: `root ::= "yes" | "no"`}, `root ::= "yes" | "no"`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			tt.req.Prompt, tt.req.Options = "json?", &opts
+			if err := s.Completion(context.TODO(), tt.req, func(CompletionResponse) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := request["grammar"]; got != tt.expect {
+				t.Errorf("expected grammar %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestCompletionMemoryUsage(t *testing.T) {
+	if _, err := processRSS(os.Getpid()); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("process memory is not supported on this platform")
+	}
+
+	s := newTestLlmServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `data: {"content": "Hi!", "stop": true}`)
+	})
+
+	// sample this process in place of a runner
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.cmd.Process = p
+	s.estimate.VRAMSize = 1 << 30
+
+	var final CompletionResponse
+	opts := api.DefaultOptions()
+	if err := s.Completion(context.TODO(), CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+		if r.Done {
+			final = r
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if final.RunnerRSSPeak == 0 {
+		t.Error("expected the runner's peak RSS")
+	}
+
+	if final.MemoryEstimateGPU != 1<<30 {
+		t.Errorf("expected VRAM estimate %d, got %d", 1<<30, final.MemoryEstimateGPU)
+	}
+}
+
+func TestParallelLimits(t *testing.T) {
+	var completions, embeds, maxCompletions, maxEmbeds atomic.Int32
+	release := make(chan struct{})
+
+	track := func(n, peak *atomic.Int32) {
+		v := n.Add(1)
+		for {
+			p := peak.Load()
+			if v <= p || peak.CompareAndSwap(p, v) {
+				break
+			}
+		}
+
+		<-release
+		n.Add(-1)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		track(&completions, &maxCompletions)
+		fmt.Fprintln(w, `data: {"content": "", "stop": true}`)
+	})
+	mux.HandleFunc("/embedding", func(w http.ResponseWriter, r *http.Request) {
+		track(&embeds, &maxEmbeds)
+		fmt.Fprint(w, `{"embedding": [[0.1]]}`)
+	})
+
+	s := newTestLlmServerMux(t, mux)
+	s.sem = semaphore.NewWeighted(3)
+	s.embedSem = semaphore.NewWeighted(2)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			opts := api.DefaultOptions()
+			if err := s.Completion(context.TODO(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := s.Embed(context.TODO(), []string{"hi"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// both limits should fill up independently of each other
+	deadline := time.Now().Add(5 * time.Second)
+	for completions.Load() < 3 || embeds.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 completions and 2 embeds in flight, got %d and %d", completions.Load(), embeds.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := maxCompletions.Load(); n != 3 {
+		t.Errorf("expected at most 3 concurrent completions, got %d", n)
+	}
+
+	if n := maxEmbeds.Load(); n != 2 {
+		t.Errorf("expected at most 2 concurrent embeds, got %d", n)
+	}
+}
+
+func TestEmbedSemaphore(t *testing.T) {
+	sem := semaphore.NewWeighted(2)
+
+	t.Run("unset", func(t *testing.T) {
+		envconfig.NumParallelEmbed = 0
+		if embedSemaphore(sem, 2) != sem {
+			t.Error("expected embeddings to share the request semaphore")
+		}
+	})
+
+	cases := []struct {
+		name   string
+		embed  int
+		expect int64
+	}{
+		{"set", 1, 1},
+		// the runner only has numParallel slots
+		{"capped", 3, 2},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			envconfig.NumParallelEmbed = tt.embed
+			t.Cleanup(func() { envconfig.NumParallelEmbed = 0 })
+
+			embedSem := embedSemaphore(sem, 2)
+			if embedSem == sem {
+				t.Fatal("expected a separate semaphore for embeddings")
+			}
+
+			if !embedSem.TryAcquire(tt.expect) {
+				t.Errorf("expected room for %d embeddings", tt.expect)
+			}
+
+			if embedSem.TryAcquire(1) {
+				t.Errorf("expected room for only %d embeddings", tt.expect)
+			}
+		})
+	}
+}
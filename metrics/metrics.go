@@ -0,0 +1,201 @@
+// Package metrics exposes server metrics in the Prometheus text exposition
+// format. Metrics are registered when they're created and written by Handler
+// in the order they were registered
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the upper bounds, in seconds, of histogram buckets suited to
+// timing operations which take milliseconds to seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+var (
+	mu      sync.Mutex
+	metrics []metric
+)
+
+// register adds m to the metrics written by Handler, replacing a metric with
+// the same name
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if i := slices.IndexFunc(metrics, func(r metric) bool { return r.name() == m.name() }); i >= 0 {
+		metrics[i] = m
+		return
+	}
+
+	metrics = append(metrics, m)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Counter is a count which only goes up, such as the number of times an event
+// happened
+type Counter struct {
+	n, help string
+	v       atomic.Uint64
+}
+
+// NewCounter registers a counter. A counter created with the same name as an
+// earlier one replaces it
+func NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	register(c)
+	return c
+}
+
+// Add adds n, which must not be negative, to the counter
+func (c *Counter) Add(n int) {
+	if n > 0 {
+		c.v.Add(uint64(n))
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) name() string {
+	return c.n
+}
+
+func (c *Counter) write(w io.Writer) error {
+	if err := writeHeader(w, c.n, c.help, "counter"); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s %d\n", c.n, c.Value())
+	return err
+}
+
+// GaugeFunc is a value which goes up and down, read from a function whenever
+// metrics are collected
+type GaugeFunc struct {
+	n, help string
+	fn      func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn. A gauge
+// created with the same name as an earlier one replaces it
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{n: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.n
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	if err := writeHeader(w, g.n, g.help, "gauge"); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s\n", g.n, formatFloat(g.fn()))
+	return err
+}
+
+// Histogram counts observations, such as durations, in buckets by their
+// value
+type Histogram struct {
+	n, help string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with buckets, the sorted upper bounds of
+// its buckets. A bucket for all values is added after them. A histogram
+// created with the same name as an earlier one replaces it
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{n: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) name() string {
+	return h.n
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	counts, sum, count := slices.Clone(h.counts), h.sum, h.count
+	h.mu.Unlock()
+
+	if err := writeHeader(w, h.n, h.help, "histogram"); err != nil {
+		return err
+	}
+
+	// bucket counts are cumulative
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += counts[i]
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.n, formatFloat(le), cumulative); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", h.n, count, h.n, formatFloat(sum), h.n, count)
+	return err
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		registered := slices.Clone(metrics)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range registered {
+			if err := m.write(w); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	counter := NewCounter("test_events_total", "Events seen by the test")
+	counter.Add(2)
+	counter.Add(-1)
+	counter.Add(3)
+
+	used := 42.0
+	NewGaugeFunc("test_tokens_used", "Tokens used by the test", func() float64 { return used })
+
+	histogram := NewHistogram("test_duration_seconds", "Durations seen by the test", []float64{.1, 1})
+	for _, v := range []float64{.05, .1, .5, 2} {
+		histogram.Observe(v)
+	}
+
+	// a metric with the same name replaces the earlier one
+	NewGaugeFunc("test_tokens_used", "Tokens used by the test", func() float64 { return used * 2 })
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	expect := `# HELP test_events_total Events seen by the test
+# TYPE test_events_total counter
+test_events_total 5
+# HELP test_tokens_used Tokens used by the test
+# TYPE test_tokens_used gauge
+test_tokens_used 84
+# HELP test_duration_seconds Durations seen by the test
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 2
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="+Inf"} 4
+test_duration_seconds_sum 2.65
+test_duration_seconds_count 4
+`
+	if got := w.Body.String(); got != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, got)
+	}
+}
@@ -687,6 +687,10 @@ func CompletionsMiddleware() gin.HandlerFunc {
 
 		c.Request.Body = io.NopCloser(&b)
 
+		// the writer reframes the handler's NDJSON, which it wouldn't get
+		// if the client's Accept header asked the handler for events
+		c.Request.Header.Del("Accept")
+
 		w := &CompleteWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
 			stream:     req.Stream,
@@ -727,6 +731,10 @@ func ChatMiddleware() gin.HandlerFunc {
 
 		c.Request.Body = io.NopCloser(&b)
 
+		// the writer reframes the handler's NDJSON, which it wouldn't get
+		// if the client's Accept header asked the handler for events
+		c.Request.Header.Del("Accept")
+
 		w := &ChatWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
 			stream:     req.Stream,
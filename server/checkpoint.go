@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/version"
+)
+
+// runnerCheckpoint records the models which were loaded when the server shut down
+// so they can be loaded again when it restarts. The runners' memory can't be
+// saved so models are reloaded from disk with the same options
+type runnerCheckpoint struct {
+	Version   string            `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Models    []checkpointModel `json:"models"`
+}
+
+type checkpointModel struct {
+	Name   string     `json:"name"`
+	Digest string     `json:"digest"`
+	Runner api.Runner `json:"runner"`
+	// KeepAlive is how long the model had left to stay loaded when the
+	// checkpoint was created
+	KeepAlive time.Duration `json:"keep_alive"`
+}
+
+func checkpointPath() string {
+	return filepath.Join(envconfig.ModelsDir, "runners.json")
+}
+
+// writeCheckpoint saves the models currently loaded by the scheduler
+func (s *Scheduler) writeCheckpoint() error {
+	checkpoint := runnerCheckpoint{Version: version.Version, CreatedAt: time.Now()}
+
+	s.loadedMu.Lock()
+	for _, runner := range s.loaded {
+		if runner.model == nil || runner.Options == nil {
+			continue
+		}
+
+		// runners which are in use haven't started expiring
+		runner.refMu.Lock()
+		keepAlive := runner.sessionDuration
+		if !runner.expiresAt.IsZero() && runner.refCount == 0 {
+			keepAlive = time.Until(runner.expiresAt)
+		}
+		runner.refMu.Unlock()
+
+		if keepAlive <= 0 {
+			continue
+		}
+
+		// the loaded context is shared by all parallel requests
+		opts := runner.Options.Runner
+		opts.NumCtx /= max(runner.numParallel, 1)
+
+		checkpoint.Models = append(checkpoint.Models, checkpointModel{
+			Name:      runner.model.Name,
+			Digest:    runner.model.Digest,
+			Runner:    opts,
+			KeepAlive: keepAlive,
+		})
+	}
+	s.loadedMu.Unlock()
+
+	if len(checkpoint.Models) == 0 {
+		return nil
+	}
+
+	bts, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(checkpointPath(), bts, 0o644)
+}
+
+// restoreCheckpoint loads the models saved by writeCheckpoint. The checkpoint is
+// removed once read. Models are skipped if the checkpoint was written by another
+// version of the server, if the model has changed since, or if its keep alive
+// has expired
+func (s *Scheduler) restoreCheckpoint(ctx context.Context) error {
+	bts, err := os.ReadFile(checkpointPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Remove(checkpointPath()); err != nil {
+		return err
+	}
+
+	var checkpoint runnerCheckpoint
+	if err := json.Unmarshal(bts, &checkpoint); err != nil {
+		return err
+	}
+
+	if checkpoint.Version != version.Version {
+		slog.Info("skipping runner checkpoint from a different version", "version", checkpoint.Version)
+		return nil
+	}
+
+	for _, m := range checkpoint.Models {
+		keepAlive := m.KeepAlive - time.Since(checkpoint.CreatedAt)
+		if keepAlive <= 0 {
+			continue
+		}
+
+		model, err := GetModel(m.Name)
+		if err != nil {
+			slog.Info("skipping checkpointed model", "model", m.Name, "error", err)
+			continue
+		}
+
+		if model.Digest != m.Digest {
+			slog.Info("skipping checkpointed model which has changed", "model", m.Name)
+			continue
+		}
+
+		opts, _, err := modelOptions(model, nil)
+		if err != nil {
+			slog.Info("skipping checkpointed model", "model", m.Name, "error", err)
+			continue
+		}
+
+		opts.Runner = m.Runner
+
+		slog.Info("restoring checkpointed model", "model", m.Name)
+		reqCtx, cancel := context.WithCancel(ctx)
+		successCh, errCh := s.GetRunner(reqCtx, model, opts, &api.Duration{Duration: keepAlive})
+		select {
+		case <-successCh:
+		case err := <-errCh:
+			slog.Warn("failed to restore checkpointed model", "model", m.Name, "error", err)
+		case <-ctx.Done():
+		}
+
+		// release the runner so it expires with its keep alive
+		cancel()
+	}
+
+	return nil
+}
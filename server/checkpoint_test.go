@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/version"
+)
+
+func TestRunnerCheckpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	var loaded []*LlmRequest
+	s.sched.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+		loaded = append(loaded, req)
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	model, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 4096 * 2
+	opts.NumGPU = 10
+
+	s.sched.loadedMu.Lock()
+	s.sched.loaded[model.ModelPath] = &runnerRef{
+		model:           model,
+		modelPath:       model.ModelPath,
+		numParallel:     2,
+		Options:         &opts,
+		sessionDuration: time.Hour,
+		expiresAt:       time.Now().Add(time.Hour),
+	}
+	s.sched.loadedMu.Unlock()
+
+	if err := s.sched.writeCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.sched.loadedMu.Lock()
+	s.sched.loaded = make(map[string]*runnerRef)
+	s.sched.loadedMu.Unlock()
+
+	bts, err := os.ReadFile(checkpointPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checkpoint runnerCheckpoint
+	if err := json.Unmarshal(bts, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(t *testing.T, checkpoint runnerCheckpoint) {
+		t.Helper()
+
+		bts, err := json.Marshal(checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(checkpointPath(), bts, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		loaded = nil
+		if err := s.sched.restoreCheckpoint(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(loaded) != 1 {
+			t.Fatalf("expected 1 model to be loaded, got %d", len(loaded))
+		}
+
+		if loaded[0].model.Name != model.Name {
+			t.Errorf("expected model %q, got %q", model.Name, loaded[0].model.Name)
+		}
+
+		if loaded[0].origNumCtx != 4096 {
+			t.Errorf("expected num_ctx 4096, got %d", loaded[0].origNumCtx)
+		}
+
+		if loaded[0].opts.NumGPU != 10 {
+			t.Errorf("expected num_gpu 10, got %d", loaded[0].opts.NumGPU)
+		}
+
+		if _, err := os.Stat(checkpointPath()); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected checkpoint to be removed, got %v", err)
+		}
+	})
+
+	t.Run("no checkpoint", func(t *testing.T) {
+		loaded = nil
+		if err := s.sched.restoreCheckpoint(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(loaded) != 0 {
+			t.Errorf("expected no models to be loaded, got %d", len(loaded))
+		}
+	})
+
+	cases := map[string]func(*runnerCheckpoint){
+		"different version": func(c *runnerCheckpoint) { c.Version = version.Version + "-other" },
+		"different digest":  func(c *runnerCheckpoint) { c.Models[0].Digest = "sha256:0000" },
+		"expired":           func(c *runnerCheckpoint) { c.CreatedAt = c.CreatedAt.Add(-2 * time.Hour) },
+		"missing model":     func(c *runnerCheckpoint) { c.Models[0].Name = "missing" },
+	}
+
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := checkpoint
+			c.Models = append([]checkpointModel(nil), checkpoint.Models...)
+			fn(&c)
+			write(t, c)
+
+			loaded = nil
+			if err := s.sched.restoreCheckpoint(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(loaded) != 0 {
+				t.Errorf("expected no models to be loaded, got %d", len(loaded))
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+// contextWindow lays out the prompt of msgs, rendered with m's template like
+// a chat, by the tokens each component of the chat takes. Each component is
+// measured by the tokens the prompt loses without it, so template tokens
+// which belong to no component, such as the markers around each message, are
+// counted as history. The components add up to the tokens of the prompt
+func contextWindow(ctx context.Context, m *Model, tokenize tokenizeFunc, msgs []api.Message, tools []api.Tool, docs []api.Document) (api.ContextWindowResponse, error) {
+	// templates which use .ToolResults render a tool call and its results as a single turn
+	if slices.Contains(m.Template.Vars(), "toolresults") {
+		msgs = CoalesceToolRounds(msgs)
+	}
+
+	count := func(msgs []api.Message, tools []api.Tool, docs []api.Document) (int, error) {
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{Messages: msgs, Tools: tools, Documents: docs, IsFirstTurn: isFirstTurn(msgs)}); err != nil {
+			return 0, newTemplateExecutionError(m, err)
+		}
+
+		s, err := tokenize(ctx, b.String())
+		if err != nil {
+			return 0, err
+		}
+
+		return len(s), nil
+	}
+
+	total, err := count(msgs, tools, docs)
+	if err != nil {
+		return api.ContextWindowResponse{}, err
+	}
+
+	var resp api.ContextWindowResponse
+	history := total
+
+	// add lists c with the tokens the prompt loses when it's rendered from msgs,
+	// tools and docs, which leave c out, plus the tokens c embeds in the prompt
+	add := func(c api.ContextWindowComponent, embedded int, msgs []api.Message, tools []api.Tool, docs []api.Document) error {
+		n, err := count(msgs, tools, docs)
+		if err != nil {
+			return err
+		}
+
+		c.Tokens = total - n + embedded
+		resp.Breakdown = append(resp.Breakdown, c)
+		history -= total - n
+		return nil
+	}
+
+	var system, rest, withoutImages []api.Message
+	var images int
+	for _, msg := range msgs {
+		if msg.Role == "system" {
+			system = append(system, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+
+		images += len(msg.Images)
+
+		// images are rendered as [img-n] tags
+		withoutImages = append(withoutImages, msg)
+		withoutImages[len(withoutImages)-1].Images = nil
+	}
+
+	if len(system) > 0 {
+		if err := add(api.ContextWindowComponent{Component: "system"}, 0, rest, tools, docs); err != nil {
+			return api.ContextWindowResponse{}, err
+		}
+	}
+
+	if len(tools) > 0 {
+		if err := add(api.ContextWindowComponent{Component: "tool_definitions"}, 0, msgs, nil, docs); err != nil {
+			return api.ContextWindowResponse{}, err
+		}
+	}
+
+	if len(docs) > 0 {
+		if err := add(api.ContextWindowComponent{Component: "documents"}, 0, msgs, tools, nil); err != nil {
+			return api.ContextWindowResponse{}, err
+		}
+	}
+
+	// images are also embedded in the prompt for models with a projector, at
+	// the size chatPrompt counts them
+	var embeddedImages int
+	if m.ProjectorPaths != nil {
+		embeddedImages = 768 * images
+	}
+
+	// history is listed before images, which are part of its messages
+	i := len(resp.Breakdown)
+	if images > 0 {
+		if err := add(api.ContextWindowComponent{Component: "images", Count: images}, embeddedImages, withoutImages, tools, docs); err != nil {
+			return api.ContextWindowResponse{}, err
+		}
+	}
+
+	resp.Breakdown = slices.Insert(resp.Breakdown, i, api.ContextWindowComponent{Component: "history", Turns: len(rest), Tokens: history})
+	resp.TotalTokens = total + embeddedImages
+	return resp, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+func TestContextWindow(t *testing.T) {
+	tmpl, err := template.Parse(`{{- if .Tools }}tools: {{ range .Tools }}{{ .Function.Name }} {{ end }}{{ end }}{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tool api.Tool
+	tool.Type = "function"
+	tool.Function.Name = "get_weather"
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "one two three", Images: []api.ImageData{[]byte("a"), []byte("b")}},
+		{Role: "assistant", Content: "four five"},
+		{Role: "user", Content: "six"},
+	}
+
+	cases := []struct {
+		name      string
+		projector []string
+		msgs      []api.Message
+		tools     []api.Tool
+		expect    api.ContextWindowResponse
+	}{
+		{
+			name:  "tools",
+			msgs:  msgs,
+			tools: []api.Tool{tool},
+			expect: api.ContextWindowResponse{
+				TotalTokens: 16,
+				Breakdown: []api.ContextWindowComponent{
+					{Component: "system", Tokens: 3},
+					{Component: "tool_definitions", Tokens: 2},
+					{Component: "history", Turns: 3, Tokens: 9},
+					{Component: "images", Count: 2, Tokens: 2},
+				},
+			},
+		},
+		{
+			name:      "projector",
+			projector: []string{"projector"},
+			msgs:      msgs,
+			expect: api.ContextWindowResponse{
+				TotalTokens: 14 + 2*768,
+				Breakdown: []api.ContextWindowComponent{
+					{Component: "system", Tokens: 3},
+					{Component: "history", Turns: 3, Tokens: 9},
+					{Component: "images", Count: 2, Tokens: 2 + 2*768},
+				},
+			},
+		},
+		{
+			name: "history only",
+			msgs: msgs[3:],
+			expect: api.ContextWindowResponse{
+				TotalTokens: 2,
+				Breakdown: []api.ContextWindowComponent{
+					{Component: "history", Turns: 1, Tokens: 2},
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl, ProjectorPaths: tt.projector}
+			resp, err := contextWindow(context.TODO(), &model, tokenize, tt.msgs, tt.tools, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, resp); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// deadLetter is a chat request which failed while the model was generating its
+// response, e.g. because the runner crashed. It's written as a single line of
+// NDJSON so it can be replayed with ollama run --conversation
+type deadLetter struct {
+	Request api.ChatRequest `json:"request"`
+
+	// Error is the error the request failed with
+	Error string `json:"error"`
+
+	// RequestID is the ID the request was listed with in /api/requests, if
+	// it was streamed
+	RequestID string `json:"request_id,omitempty"`
+
+	ReceivedAt time.Time `json:"received_at"`
+	FailedAt   time.Time `json:"failed_at"`
+
+	// Replay is a command which sends the request's messages again
+	Replay string `json:"replay"`
+}
+
+// writeDeadLetter writes l to a new file in dir, which is created if it
+// doesn't exist, and returns the file's path
+func writeDeadLetter(dir string, l deadLetter) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, l.FailedAt.UTC().Format("20060102T150405Z")+"-*.ndjson")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		path = f.Name()
+	}
+
+	l.Replay = fmt.Sprintf("ollama run %s --conversation %s", l.Request.Model, path)
+	if err := json.NewEncoder(f).Encode(l); err != nil {
+		return "", err
+	}
+
+	return path, f.Close()
+}
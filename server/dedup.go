@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// completionGroup runs identical concurrent completions once and streams the
+// responses to every caller. The zero value is ready to use
+type completionGroup struct {
+	mu    sync.Mutex
+	calls map[string]*completionCall
+}
+
+type completionCall struct {
+	mu        sync.Mutex
+	responses []llm.CompletionResponse
+	done      bool
+	err       error
+
+	// updated is closed, and replaced, when responses or done change
+	updated chan struct{}
+
+	// callers is the number of callers still reading responses. The
+	// completion is canceled if they all leave
+	callers int
+	cancel  context.CancelFunc
+
+	// seed is the seed the completion was run with
+	seed int
+}
+
+// completionKey returns a hash identifying identical completion requests for
+// model m. seed is the seed as requested, before a random seed is resolved
+func completionKey(m *Model, req llm.CompletionRequest, seed int) (string, error) {
+	opts := *req.Options
+	opts.Seed = seed
+
+	bts, err := json.Marshal(struct {
+		Model      string
+		Adapters   []string
+		Projectors []string
+		Prompt     string
+		Tokens     []int
+		Images     []llm.ImageData
+		Format     string
+		Grammar    string
+		Options    any
+	}{m.ModelPath, m.AdapterPaths, m.ProjectorPaths, req.Prompt, req.Tokens, req.Images, req.Format, req.Grammar, opts})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(bts)), nil
+}
+
+// do calls run unless a completion with the same key is already running, in
+// which case its responses, including those already generated, are passed to
+// fn instead. run isn't canceled until every caller's ctx is done. seed is set
+// to the seed of the completion which was joined
+func (g *completionGroup) do(ctx context.Context, key string, seed *int, run func(context.Context, func(llm.CompletionResponse)) error, fn func(llm.CompletionResponse)) error {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*completionCall)
+	}
+
+	call, ok := g.calls[key]
+	if ok {
+		call.mu.Lock()
+		call.callers++
+		*seed = call.seed
+		call.mu.Unlock()
+	} else {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &completionCall{updated: make(chan struct{}), callers: 1, cancel: cancel, seed: *seed}
+		g.calls[key] = call
+
+		go func() {
+			defer cancel()
+
+			err := run(runCtx, func(r llm.CompletionResponse) {
+				call.mu.Lock()
+				call.responses = append(call.responses, r)
+				close(call.updated)
+				call.updated = make(chan struct{})
+				call.mu.Unlock()
+			})
+
+			// later requests start a new completion
+			g.mu.Lock()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+
+			call.mu.Lock()
+			call.done = true
+			call.err = err
+			close(call.updated)
+			call.mu.Unlock()
+		}()
+	}
+	g.mu.Unlock()
+
+	var n int
+	for {
+		call.mu.Lock()
+		responses := call.responses[n:]
+		done, err, updated := call.done, call.err, call.updated
+		call.mu.Unlock()
+
+		for _, r := range responses {
+			fn(r)
+		}
+		n += len(responses)
+
+		if done {
+			return err
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			g.mu.Lock()
+			call.mu.Lock()
+			call.callers--
+			if call.callers == 0 {
+				call.cancel()
+				if g.calls[key] == call {
+					delete(g.calls, key)
+				}
+			}
+			call.mu.Unlock()
+			g.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
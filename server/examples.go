@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+var errInvalidChatExample = errors.New("invalid chat example")
+
+// chatExamples maps a full model name to the few-shot examples stored for it
+type chatExamples map[string][]api.ChatExample
+
+// chatExamplesMu guards the chat examples file
+var chatExamplesMu sync.Mutex
+
+func chatExamplesPath() string {
+	return filepath.Join(envconfig.ModelsDir, "examples.json")
+}
+
+func readChatExamples() (chatExamples, error) {
+	bts, err := os.ReadFile(chatExamplesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return chatExamples{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var e chatExamples
+	if err := json.Unmarshal(bts, &e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// chatExamplesScope returns the key of the examples stored for name
+func chatExamplesScope(name string) (string, error) {
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return "", errors.New("invalid model name")
+	}
+
+	return n.String(), nil
+}
+
+// ListChatExamples returns the few-shot examples stored for a model, oldest first
+func ListChatExamples(modelName string) ([]api.ChatExample, error) {
+	scope, err := chatExamplesScope(modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	chatExamplesMu.Lock()
+	e, err := readChatExamples()
+	chatExamplesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return e[scope], nil
+}
+
+// chatExampleMessages returns the messages of the few-shot examples stored for
+// a model, in the order they were added
+func chatExampleMessages(modelName string) ([]api.Message, error) {
+	examples, err := ListChatExamples(modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []api.Message
+	for _, example := range examples {
+		msgs = append(msgs, example.Messages...)
+	}
+
+	return msgs, nil
+}
+
+// AddChatExample stores a few-shot example for a model and returns it with its
+// ID. The example's messages must be user and assistant messages
+func AddChatExample(modelName string, msgs []api.Message) (api.ChatExample, error) {
+	scope, err := chatExamplesScope(modelName)
+	if err != nil {
+		return api.ChatExample{}, err
+	}
+
+	if len(msgs) == 0 {
+		return api.ChatExample{}, fmt.Errorf("%w: messages are required", errInvalidChatExample)
+	}
+
+	for i, msg := range msgs {
+		role := strings.ToLower(msg.Role)
+		if role != "user" && role != "assistant" {
+			return api.ChatExample{}, fmt.Errorf("%w: message %d: role must be user or assistant, got %q", errInvalidChatExample, i, msg.Role)
+		}
+
+		msgs[i].Role = role
+	}
+
+	chatExamplesMu.Lock()
+	defer chatExamplesMu.Unlock()
+
+	e, err := readChatExamples()
+	if err != nil {
+		return api.ChatExample{}, err
+	}
+
+	example := api.ChatExample{ID: uuid.New().String(), Messages: msgs}
+	e[scope] = append(e[scope], example)
+	return example, writeJSONFile(chatExamplesPath(), e)
+}
+
+// DeleteChatExample removes a few-shot example from a model. It returns
+// os.ErrNotExist if the model has no example with the ID
+func DeleteChatExample(modelName, id string) error {
+	scope, err := chatExamplesScope(modelName)
+	if err != nil {
+		return err
+	}
+
+	chatExamplesMu.Lock()
+	defer chatExamplesMu.Unlock()
+
+	e, err := readChatExamples()
+	if err != nil {
+		return err
+	}
+
+	n := len(e[scope])
+	e[scope] = slices.DeleteFunc(e[scope], func(example api.ChatExample) bool { return example.ID == id })
+	if len(e[scope]) == n {
+		return os.ErrNotExist
+	}
+
+	if len(e[scope]) == 0 {
+		delete(e, scope)
+	}
+
+	return writeJSONFile(chatExamplesPath(), e)
+}
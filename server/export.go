@@ -0,0 +1,557 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+var (
+	errUnsupportedLanguage = errors.New("language must be one of curl, python or go")
+	errUnsupportedByClient = errors.New("not supported by the client library")
+)
+
+// exportRequest is the body of an exported chat request. Its fields are in the
+// order they're written in exported code and are omitted when they're unset
+type exportRequest struct {
+	Model               string                `json:"model"`
+	Messages            []api.Message         `json:"messages"`
+	Tools               []api.Tool            `json:"tools,omitempty"`
+	Documents           []api.Document        `json:"documents,omitempty"`
+	Format              string                `json:"format,omitempty"`
+	Grammar             string                `json:"grammar,omitempty"`
+	Options             map[string]any        `json:"options,omitempty"`
+	KeepAlive           *api.Duration         `json:"keep_alive,omitempty"`
+	Timeout             *api.Duration         `json:"timeout,omitempty"`
+	Stream              *bool                 `json:"stream,omitempty"`
+	System              *string               `json:"system,omitempty"`
+	SystemRefs          []string              `json:"system_refs,omitempty"`
+	Template            string                `json:"template,omitempty"`
+	SessionID           string                `json:"session_id,omitempty"`
+	Phases              bool                  `json:"phases,omitempty"`
+	ReasoningSteps      bool                  `json:"reasoning_steps,omitempty"`
+	TemperatureSchedule []api.TemperatureStep `json:"temperature_schedule,omitempty"`
+	IncludeSystem       bool                  `json:"include_system,omitempty"`
+	IncludeExamples     bool                  `json:"include_examples,omitempty"`
+}
+
+func newExportRequest(req api.ChatRequest) (*exportRequest, error) {
+	options, err := nonDefaultOptions(req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	r := exportRequest{
+		Model:               req.Model,
+		Messages:            req.Messages,
+		Tools:               req.Tools,
+		Documents:           req.Documents,
+		Format:              req.Format,
+		Grammar:             req.Grammar,
+		Options:             options,
+		KeepAlive:           req.KeepAlive,
+		Timeout:             req.Timeout,
+		System:              req.System,
+		SystemRefs:          req.SystemRefs,
+		Template:            req.Template,
+		SessionID:           req.SessionID,
+		Phases:              req.Phases,
+		ReasoningSteps:      req.ReasoningSteps,
+		TemperatureSchedule: req.TemperatureSchedule,
+		IncludeSystem:       req.IncludeSystem,
+		IncludeExamples:     req.IncludeExamples,
+	}
+
+	if r.Messages == nil {
+		r.Messages = []api.Message{}
+	}
+
+	// streaming is the default
+	if req.Stream != nil && !*req.Stream {
+		r.Stream = req.Stream
+	}
+
+	// negative durations are stored as the maximum duration but must be sent as -1
+	if r.KeepAlive != nil && (r.KeepAlive.Duration < 0 || r.KeepAlive.Duration == math.MaxInt64) {
+		r.KeepAlive = &api.Duration{Duration: -1}
+	}
+
+	// requests without a positive timeout don't time out
+	if r.Timeout != nil && (r.Timeout.Duration <= 0 || r.Timeout.Duration == math.MaxInt64) {
+		r.Timeout = nil
+	}
+
+	return &r, nil
+}
+
+// nonDefaultOptions returns the options which differ from their default value
+func nonDefaultOptions(options map[string]any) (map[string]any, error) {
+	bts, err := json.Marshal(api.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	var defaults map[string]any
+	if err := json.Unmarshal(bts, &defaults); err != nil {
+		return nil, err
+	}
+
+	nonDefault := make(map[string]any)
+	for k, v := range options {
+		if d, ok := defaults[k]; !ok || !reflect.DeepEqual(d, v) {
+			nonDefault[k] = v
+		}
+	}
+
+	return nonDefault, nil
+}
+
+// exportCode returns code for language which sends req to the server at host
+func exportCode(language string, req api.ChatRequest, host string) (string, error) {
+	r, err := newExportRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	switch language {
+	case "curl":
+		return exportCurl(r, host)
+	case "python":
+		return exportPython(r)
+	case "go":
+		return exportGo(r)
+	default:
+		return "", errUnsupportedLanguage
+	}
+}
+
+func exportCurl(r *exportRequest, host string) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return "", err
+	}
+
+	// the body is single quoted for the shell so single quotes in it must be escaped
+	body := strings.ReplaceAll(strings.TrimSpace(b.String()), "'", `'\''`)
+	return fmt.Sprintf("curl %s/api/chat -d '%s'\n", host, body), nil
+}
+
+func exportPython(r *exportRequest) (string, error) {
+	var unsupported []string
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"system", r.System != nil},
+		{"system_refs", len(r.SystemRefs) > 0},
+		{"template", r.Template != ""},
+		{"documents", len(r.Documents) > 0},
+		{"grammar", r.Grammar != ""},
+		{"timeout", r.Timeout != nil},
+		{"session_id", r.SessionID != ""},
+		{"phases", r.Phases},
+		{"reasoning_steps", r.ReasoningSteps},
+		{"temperature_schedule", len(r.TemperatureSchedule) > 0},
+		{"include_system", r.IncludeSystem},
+		{"include_examples", r.IncludeExamples},
+	} {
+		if field.set {
+			unsupported = append(unsupported, field.name)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return "", fmt.Errorf("%s: %w", strings.Join(unsupported, ", "), errUnsupportedByClient)
+	}
+
+	var b strings.Builder
+	b.WriteString("from ollama import chat\n\n")
+
+	stream := r.Stream == nil
+	if stream {
+		b.WriteString("stream = chat(\n")
+	} else {
+		b.WriteString("response = chat(\n")
+	}
+
+	fmt.Fprintf(&b, "    model=%s,\n", strconv.Quote(r.Model))
+	b.WriteString("    messages=[\n")
+	for _, msg := range r.Messages {
+		fields := []string{`"role": ` + strconv.Quote(msg.Role), `"content": ` + strconv.Quote(msg.Content)}
+		if len(msg.Images) > 0 {
+			fields = append(fields, `"images": `+pythonValue(msg.Images))
+		}
+
+		if len(msg.ToolCalls) > 0 {
+			fields = append(fields, `"tool_calls": `+pythonValue(msg.ToolCalls))
+		}
+
+		if msg.ToolCallID != "" {
+			fields = append(fields, `"tool_call_id": `+strconv.Quote(msg.ToolCallID))
+		}
+
+		if msg.Partial {
+			fields = append(fields, `"partial": True`)
+		}
+
+		fmt.Fprintf(&b, "        {%s},\n", strings.Join(fields, ", "))
+	}
+	b.WriteString("    ],\n")
+
+	if len(r.Tools) > 0 {
+		fmt.Fprintf(&b, "    tools=%s,\n", pythonValue(r.Tools))
+	}
+
+	if r.Format != "" {
+		fmt.Fprintf(&b, "    format=%s,\n", strconv.Quote(r.Format))
+	}
+
+	if len(r.Options) > 0 {
+		fmt.Fprintf(&b, "    options=%s,\n", pythonValue(r.Options))
+	}
+
+	if r.KeepAlive != nil {
+		fmt.Fprintf(&b, "    keep_alive=%s,\n", pythonValue(r.KeepAlive))
+	}
+
+	if stream {
+		b.WriteString("    stream=True,\n")
+		b.WriteString(")\n\n")
+		b.WriteString("for chunk in stream:\n")
+		b.WriteString("    print(chunk[\"message\"][\"content\"], end=\"\", flush=True)\n")
+	} else {
+		b.WriteString(")\n\n")
+		b.WriteString("print(response[\"message\"][\"content\"])\n")
+	}
+
+	return b.String(), nil
+}
+
+// pythonValue returns v, which must be JSON encodable, as a Python literal
+func pythonValue(v any) string {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return "None"
+	}
+
+	var generic any
+	if err := json.Unmarshal(bts, &generic); err != nil {
+		return "None"
+	}
+
+	return literal(generic, func(v any) string {
+		switch v := v.(type) {
+		case nil:
+			return "None"
+		case bool:
+			if v {
+				return "True"
+			}
+			return "False"
+		case []any:
+			return "[%s]"
+		case map[string]any:
+			return "{%s}"
+		}
+
+		return ""
+	})
+}
+
+// goValue returns v, a value decoded from JSON, as a Go literal
+func goValue(v any) string {
+	return literal(v, func(v any) string {
+		switch v := v.(type) {
+		case nil:
+			return "nil"
+		case bool:
+			return strconv.FormatBool(v)
+		case []any:
+			if !slices.ContainsFunc(v, func(e any) bool { _, ok := e.(string); return !ok }) {
+				return "[]string{%s}"
+			}
+			return "[]any{%s}"
+		case map[string]any:
+			return "map[string]any{%s}"
+		}
+
+		return ""
+	})
+}
+
+// literal formats a value decoded from JSON. syntax returns the literal for nil
+// and booleans, and the format for slices and maps, which are the only values
+// which differ between languages. strings are double quoted, which both Go and
+// Python accept
+func literal(v any, syntax func(any) string) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		elems := make([]string, len(v))
+		for i, e := range v {
+			elems[i] = literal(e, syntax)
+		}
+
+		return fmt.Sprintf(syntax(v), strings.Join(elems, ", "))
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		elems := make([]string, len(keys))
+		for i, k := range keys {
+			elems[i] = strconv.Quote(k) + ": " + literal(v[k], syntax)
+		}
+
+		return fmt.Sprintf(syntax(v), strings.Join(elems, ", "))
+	default:
+		return syntax(v)
+	}
+}
+
+func exportGo(r *exportRequest) (string, error) {
+	imports := []string{"context", "fmt", "log", "github.com/ollama/ollama/api"}
+
+	var body strings.Builder
+	body.WriteString("client, err := api.ClientFromEnvironment()\nif err != nil {\nlog.Fatal(err)\n}\n\n")
+
+	// messages with anything but a role and content, and tools, are verbose as Go
+	// literals so they're decoded from JSON instead
+	messages := "[]api.Message{\n"
+	if slices.ContainsFunc(r.Messages, func(m api.Message) bool {
+		return len(m.Images) > 0 || len(m.ToolCalls) > 0 || m.ToolCallID != "" || m.Partial || len(m.Citations) > 0
+	}) {
+		if err := goUnmarshal(&body, "messages", "[]api.Message", r.Messages); err != nil {
+			return "", err
+		}
+
+		messages = "messages"
+	} else {
+		for _, msg := range r.Messages {
+			messages += fmt.Sprintf("{Role: %s, Content: %s},\n", strconv.Quote(msg.Role), strconv.Quote(msg.Content))
+		}
+
+		messages += "}"
+	}
+
+	if len(r.Tools) > 0 {
+		if err := goUnmarshal(&body, "tools", "[]api.Tool", r.Tools); err != nil {
+			return "", err
+		}
+	}
+
+	if len(r.Documents) > 0 {
+		if err := goUnmarshal(&body, "documents", "[]api.Document", r.Documents); err != nil {
+			return "", err
+		}
+	}
+
+	if messages == "messages" || len(r.Tools) > 0 || len(r.Documents) > 0 {
+		imports = append(imports, "encoding/json")
+	}
+
+	if r.Stream != nil {
+		body.WriteString("stream := false\n")
+	}
+
+	if r.System != nil {
+		fmt.Fprintf(&body, "system := %s\n", strconv.Quote(*r.System))
+	}
+
+	body.WriteString("req := &api.ChatRequest{\n")
+	fmt.Fprintf(&body, "Model: %s,\n", strconv.Quote(r.Model))
+	fmt.Fprintf(&body, "Messages: %s,\n", messages)
+
+	if len(r.Tools) > 0 {
+		body.WriteString("Tools: tools,\n")
+	}
+
+	if len(r.Documents) > 0 {
+		body.WriteString("Documents: documents,\n")
+	}
+
+	if r.Format != "" {
+		fmt.Fprintf(&body, "Format: %s,\n", strconv.Quote(r.Format))
+	}
+
+	if r.Grammar != "" {
+		fmt.Fprintf(&body, "Grammar: %s,\n", strconv.Quote(r.Grammar))
+	}
+
+	if len(r.Options) > 0 {
+		keys := make([]string, 0, len(r.Options))
+		for k := range r.Options {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		body.WriteString("Options: map[string]any{\n")
+		for _, k := range keys {
+			fmt.Fprintf(&body, "%s: %s,\n", strconv.Quote(k), goValue(r.Options[k]))
+		}
+		body.WriteString("},\n")
+	}
+
+	if r.KeepAlive != nil {
+		d := goDuration(r.KeepAlive.Duration)
+		if strings.Contains(d, "time.") {
+			imports = append(imports, "time")
+		}
+
+		fmt.Fprintf(&body, "KeepAlive: &api.Duration{Duration: %s},\n", d)
+	}
+
+	if r.Timeout != nil {
+		d := goDuration(r.Timeout.Duration)
+		if strings.Contains(d, "time.") && !slices.Contains(imports, "time") {
+			imports = append(imports, "time")
+		}
+
+		fmt.Fprintf(&body, "Timeout: &api.Duration{Duration: %s},\n", d)
+	}
+
+	if r.Stream != nil {
+		body.WriteString("Stream: &stream,\n")
+	}
+
+	if r.System != nil {
+		body.WriteString("System: &system,\n")
+	}
+
+	if len(r.SystemRefs) > 0 {
+		refs := make([]string, len(r.SystemRefs))
+		for i, ref := range r.SystemRefs {
+			refs[i] = strconv.Quote(ref)
+		}
+
+		fmt.Fprintf(&body, "SystemRefs: []string{%s},\n", strings.Join(refs, ", "))
+	}
+
+	if r.Template != "" {
+		fmt.Fprintf(&body, "Template: %s,\n", strconv.Quote(r.Template))
+	}
+
+	if r.SessionID != "" {
+		fmt.Fprintf(&body, "SessionID: %s,\n", strconv.Quote(r.SessionID))
+	}
+
+	if r.Phases {
+		body.WriteString("Phases: true,\n")
+	}
+
+	if r.ReasoningSteps {
+		body.WriteString("ReasoningSteps: true,\n")
+	}
+
+	if len(r.TemperatureSchedule) > 0 {
+		steps := make([]string, len(r.TemperatureSchedule))
+		for i, step := range r.TemperatureSchedule {
+			steps[i] = fmt.Sprintf("{Turn: %d, Temperature: %s}", step.Turn, strconv.FormatFloat(float64(step.Temperature), 'f', -1, 32))
+		}
+
+		fmt.Fprintf(&body, "TemperatureSchedule: []api.TemperatureStep{%s},\n", strings.Join(steps, ", "))
+	}
+
+	if r.IncludeSystem {
+		body.WriteString("IncludeSystem: true,\n")
+	}
+
+	if r.IncludeExamples {
+		body.WriteString("IncludeExamples: true,\n")
+	}
+
+	body.WriteString("}\n\n")
+	body.WriteString("if err := client.Chat(context.Background(), req, func(resp api.ChatResponse) error {\nfmt.Print(resp.Message.Content)\nreturn nil\n}); err != nil {\nlog.Fatal(err)\n}\n\nfmt.Println()\n")
+
+	// standard library imports are grouped before the ollama import
+	slices.SortFunc(imports, func(a, b string) int {
+		if strings.Contains(a, ".") != strings.Contains(b, ".") {
+			if strings.Contains(a, ".") {
+				return 1
+			}
+			return -1
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	var b strings.Builder
+	b.WriteString("package main\n\nimport (\n")
+	for i, imp := range imports {
+		if i > 0 && strings.Contains(imp, ".") && !strings.Contains(imports[i-1], ".") {
+			b.WriteString("\n")
+		}
+
+		fmt.Fprintf(&b, "%s\n", strconv.Quote(imp))
+	}
+	b.WriteString(")\n\nfunc main() {\n")
+	b.WriteString(body.String())
+	b.WriteString("}\n")
+
+	src, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return "", err
+	}
+
+	return string(src), nil
+}
+
+// goUnmarshal writes Go code declaring name, of type typ, decoded from the JSON
+// encoding of v
+func goUnmarshal(b *strings.Builder, name, typ string, v any) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s := string(bts)
+	if strings.Contains(s, "`") {
+		s = strconv.Quote(s)
+	} else {
+		s = "`" + s + "`"
+	}
+
+	fmt.Fprintf(b, "var %s %s\nif err := json.Unmarshal([]byte(%s), &%s); err != nil {\nlog.Fatal(err)\n}\n\n", name, typ, s, name)
+	return nil
+}
+
+// goDuration returns d as a Go expression, e.g. 10 * time.Minute
+func goDuration(d time.Duration) string {
+	if d <= 0 {
+		return strconv.FormatInt(int64(d), 10)
+	}
+
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	} {
+		if d%unit.d == 0 {
+			return fmt.Sprintf("%d * %s", d/unit.d, unit.name)
+		}
+	}
+
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
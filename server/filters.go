@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ResponseFilter transforms the complete text of a response
+type ResponseFilter interface {
+	Apply(text string) (string, error)
+}
+
+// ResponseProcessor applies its filters, in order, to the complete text of
+// generate and chat responses. A nil ResponseProcessor returns text as is
+type ResponseProcessor struct {
+	Filters []ResponseFilter
+}
+
+func (p *ResponseProcessor) Apply(text string) (string, error) {
+	if p == nil {
+		return text, nil
+	}
+
+	for i, f := range p.Filters {
+		var err error
+		if text, err = f.Apply(text); err != nil {
+			return "", fmt.Errorf("response filter %d: %w", i, err)
+		}
+	}
+
+	return text, nil
+}
+
+var thinkingTagsRegex = regexp.MustCompile(`(?s)<think>.*?(</think>|$)`)
+
+// StripThinkingTagsFilter removes reasoning between <think> and </think>,
+// including reasoning which wasn't finished
+type StripThinkingTagsFilter struct{}
+
+func (StripThinkingTagsFilter) Apply(text string) (string, error) {
+	if !strings.Contains(text, "<think>") {
+		return text, nil
+	}
+
+	return strings.TrimSpace(thinkingTagsRegex.ReplaceAllString(text, "")), nil
+}
+
+// MarkdownCodeFenceFilter closes a Markdown code block which the response
+// left open, e.g. because it stopped at num_predict
+type MarkdownCodeFenceFilter struct{}
+
+func (MarkdownCodeFenceFilter) Apply(text string) (string, error) {
+	var open bool
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			open = !open
+		}
+	}
+
+	if !open {
+		return text, nil
+	}
+
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	return text + "```", nil
+}
+
+// RegexReplacementFilter replaces matches of Pattern with Replacement, which
+// may refer to submatches as in [regexp.Regexp.ReplaceAllString]
+type RegexReplacementFilter struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func (f RegexReplacementFilter) Apply(text string) (string, error) {
+	return f.Pattern.ReplaceAllString(text, f.Replacement), nil
+}
+
+// responseFilterConfig is a filter in the file loaded by LoadResponseProcessor
+type responseFilterConfig struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// LoadResponseProcessor reads the filters of a ResponseProcessor from the JSON
+// file at path, e.g.
+//
+//	{"filters": [{"type": "strip_thinking_tags"}, {"type": "regex_replacement", "pattern": "(?i)darn", "replacement": "****"}]}
+//
+// It returns nil if path is empty or the file has no filters
+func LoadResponseProcessor(path string) (*ResponseProcessor, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Filters []responseFilterConfig `json:"filters"`
+	}
+	if err := json.Unmarshal(bts, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var p ResponseProcessor
+	for i, c := range config.Filters {
+		switch c.Type {
+		case "strip_thinking_tags":
+			p.Filters = append(p.Filters, StripThinkingTagsFilter{})
+		case "markdown_code_fence":
+			p.Filters = append(p.Filters, MarkdownCodeFenceFilter{})
+		case "regex_replacement":
+			re, err := regexp.Compile(c.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: filter %d: %w", path, i, err)
+			}
+
+			p.Filters = append(p.Filters, RegexReplacementFilter{Pattern: re, Replacement: c.Replacement})
+		default:
+			return nil, fmt.Errorf("%s: filter %d: unknown type %q", path, i, c.Type)
+		}
+	}
+
+	if len(p.Filters) == 0 {
+		return nil, nil
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestResponseFilters(t *testing.T) {
+	cases := []struct {
+		name   string
+		filter ResponseFilter
+		text   string
+		expect string
+	}{
+		{"strip thinking", StripThinkingTagsFilter{}, "<think>\nThe user wants a greeting.\n</think>\n\nHello!", "Hello!"},
+		{"strip unfinished thinking", StripThinkingTagsFilter{}, "Hello! <think>Maybe more", "Hello!"},
+		{"no thinking", StripThinkingTagsFilter{}, "  Hello!  ", "  Hello!  "},
+		{"open fence", MarkdownCodeFenceFilter{}, "Here:\n```go\nfmt.Println()", "Here:\n```go\nfmt.Println()\n```"},
+		{"open fence newline", MarkdownCodeFenceFilter{}, "```\nls\n", "```\nls\n```"},
+		{"closed fence", MarkdownCodeFenceFilter{}, "```\nls\n```\nDone.", "```\nls\n```\nDone."},
+		{"regex", RegexReplacementFilter{Pattern: regexp.MustCompile(`(?i)\bdarn\b`), Replacement: "****"}, "Darn, darned darn.", "****, darned ****."},
+		{"regex submatch", RegexReplacementFilter{Pattern: regexp.MustCompile(`(\w+)@example\.com`), Replacement: "$1@…"}, "Mail ada@example.com", "Mail ada@…"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.filter.Apply(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestLoadResponseProcessor(t *testing.T) {
+	load := func(t *testing.T, config string) (*ResponseProcessor, error) {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "filters.json")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return LoadResponseProcessor(path)
+	}
+
+	t.Run("pipeline", func(t *testing.T) {
+		p, err := load(t, `{"filters": [
+			{"type": "strip_thinking_tags"},
+			{"type": "regex_replacement", "pattern": "(?i)darn", "replacement": "****"},
+			{"type": "markdown_code_fence"}
+		]}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := p.Apply("<think>Darn.</think>Darn, it's:\n```\nls")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expect := "****, it's:\n```\nls\n```"; got != expect {
+			t.Errorf("expected %q, got %q", expect, got)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if p, err := LoadResponseProcessor(""); p != nil || err != nil {
+			t.Errorf("expected no processor, got %v, %v", p, err)
+		}
+
+		if p, err := load(t, `{"filters": []}`); p != nil || err != nil {
+			t.Errorf("expected no processor, got %v, %v", p, err)
+		}
+
+		// a nil processor returns text as is
+		var p *ResponseProcessor
+		if got, err := p.Apply("Hello!"); got != "Hello!" || err != nil {
+			t.Errorf("expected text as is, got %q, %v", got, err)
+		}
+	})
+
+	for name, config := range map[string]string{
+		"unknown type":  `{"filters": [{"type": "uppercase"}]}`,
+		"invalid regex": `{"filters": [{"type": "regex_replacement", "pattern": "("}]}`,
+		"invalid json":  `{"filters": `,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := load(t, config); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := LoadResponseProcessor(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
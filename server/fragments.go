@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+var errUnknownFragment = errors.New("unknown prompt fragment")
+
+// fragments maps a scope to the prompt fragments registered in that scope. the
+// empty scope holds global fragments, other scopes are full model names
+type fragments map[string]map[string]string
+
+// fragmentsMu guards the fragments file
+var fragmentsMu sync.Mutex
+
+func fragmentsPath() string {
+	return filepath.Join(envconfig.ModelsDir, "fragments.json")
+}
+
+func readFragments() (fragments, error) {
+	bts, err := os.ReadFile(fragmentsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return fragments{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f fragments
+	if err := json.Unmarshal(bts, &f); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func writeFragments(f fragments) error {
+	return writeJSONFile(fragmentsPath(), f)
+}
+
+// writeJSONFile replaces the file at path with v encoded as JSON. the file is
+// written to a temporary file first so readers never see a partial file
+func writeJSONFile(path string, v any) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(bts); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// fragmentScope returns the scope for fragments registered for name. an empty
+// name is the global scope
+func fragmentScope(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return "", errors.New("invalid model name")
+	}
+
+	return n.String(), nil
+}
+
+// SetFragment registers a prompt fragment for a model or, if the model is empty,
+// for all models. An existing fragment with the same name is replaced
+func SetFragment(modelName, name, content string) error {
+	scope, err := fragmentScope(modelName)
+	if err != nil {
+		return err
+	}
+
+	fragmentsMu.Lock()
+	defer fragmentsMu.Unlock()
+
+	f, err := readFragments()
+	if err != nil {
+		return err
+	}
+
+	if f[scope] == nil {
+		f[scope] = make(map[string]string)
+	}
+
+	f[scope][name] = content
+	return writeFragments(f)
+}
+
+// DeleteFragment removes a prompt fragment. It returns os.ErrNotExist if the
+// fragment isn't registered
+func DeleteFragment(modelName, name string) error {
+	scope, err := fragmentScope(modelName)
+	if err != nil {
+		return err
+	}
+
+	fragmentsMu.Lock()
+	defer fragmentsMu.Unlock()
+
+	f, err := readFragments()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := f[scope][name]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(f[scope], name)
+	if len(f[scope]) == 0 {
+		delete(f, scope)
+	}
+
+	return writeFragments(f)
+}
+
+// expandSystemRefs returns a system message for each fragment in refs, in order.
+// fragments registered for the model take precedence over global fragments
+func expandSystemRefs(modelName string, refs []string) ([]api.Message, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	scope, err := fragmentScope(modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	fragmentsMu.Lock()
+	f, err := readFragments()
+	fragmentsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]api.Message, len(refs))
+	for i, ref := range refs {
+		content, ok := f[scope][ref]
+		if !ok {
+			content, ok = f[""][ref]
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("%w %q", errUnknownFragment, ref)
+		}
+
+		msgs[i] = api.Message{Role: "system", Content: content}
+	}
+
+	return msgs, nil
+}
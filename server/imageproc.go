@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	"github.com/ollama/ollama/api"
+)
+
+var errInvalidImage = errors.New("invalid image")
+
+// resizeImage scales an image down to fit within maxSide x maxSide pixels and
+// re-encodes it as a JPEG with the given quality. JPEGs which already fit are
+// returned as is. data is returned unchanged if maxSide isn't positive
+func resizeImage(data []byte, maxSide, quality int) ([]byte, error) {
+	if maxSide <= 0 {
+		return data, nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidImage, err)
+	}
+
+	if format == "jpeg" && config.Width <= maxSide && config.Height <= maxSide {
+		return data, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidImage, err)
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if width > maxSide || height > maxSide {
+		if width > height {
+			width, height = maxSide, max(1, height*maxSide/width)
+		} else {
+			width, height = max(1, width*maxSide/height), maxSide
+		}
+	}
+
+	// JPEGs have no alpha channel so transparent areas are drawn over white
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, dst, &jpeg.Options{Quality: cmp.Or(quality, jpeg.DefaultQuality)}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// checkImage decodes data to check it's a readable image if policy, an
+// [api.Options.ImageErrors], is set. Images aren't checked otherwise
+func checkImage(data []byte, policy string) error {
+	if policy == "" {
+		return nil
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidImage, err)
+	}
+
+	return nil
+}
+
+// checkImages applies policy, an [api.Options.ImageErrors], to the images of
+// msgs. Skipped images are removed along with the [img] placeholder they would
+// replace, so the remaining images are numbered contiguously when the prompt is
+// built. It returns a warning for each skipped image
+func checkImages(msgs []api.Message, policy string) ([]api.Message, []string, error) {
+	if policy == "" {
+		return msgs, nil, nil
+	}
+
+	var warnings []string
+	msgs = slices.Clone(msgs)
+	for i, msg := range msgs {
+		var images []api.ImageData
+		var content strings.Builder
+		rest := msg.Content
+		for j, data := range msg.Images {
+			// the placeholder for image j is the next one left in the content
+			before, after, placeholder := strings.Cut(rest, "[img]")
+
+			err := checkImage(data, policy)
+			if err != nil && policy == "fail" {
+				return nil, nil, fmt.Errorf("message %d: image %d: %w", i, j, err)
+			} else if err != nil {
+				slog.Warn("skipping image", "message", i, "image", j, "error", err)
+				warnings = append(warnings, fmt.Sprintf("message %d: image %d skipped: %v", i, j, err))
+			} else {
+				images = append(images, data)
+			}
+
+			if !placeholder {
+				continue
+			}
+
+			content.WriteString(before)
+			if err == nil {
+				content.WriteString("[img]")
+			}
+
+			rest = after
+		}
+
+		content.WriteString(rest)
+		msgs[i].Images = images
+		msgs[i].Content = content.String()
+	}
+
+	return msgs, warnings, nil
+}
@@ -34,13 +34,18 @@ import (
 	"github.com/ollama/ollama/version"
 )
 
-var errCapabilityCompletion = errors.New("completion")
+var (
+	errCapabilityCompletion = errors.New("completion")
+	errCapabilityInsert     = errors.New("insert")
+)
 
 type Capability string
 
 const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
+	CapabilityInsert     = Capability("insert")
+	CapabilityDocuments  = Capability("documents")
 )
 
 type registryOptions struct {
@@ -65,6 +70,11 @@ type Model struct {
 	Messages       []Message
 
 	Template *template.Template
+	// TemplateDigest is the digest of the template layer, if the model has one
+	TemplateDigest string
+	// ToolTemplate renders generate prompts which include tools. It is the
+	// model's template if that template uses tools, otherwise nil
+	ToolTemplate *template.Template
 }
 
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
@@ -95,6 +105,14 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 			if !slices.Contains(m.Template.Vars(), "tools") {
 				errs = append(errs, errors.New("tools"))
 			}
+		case CapabilityInsert:
+			if !slices.Contains(m.Template.Vars(), "suffix") {
+				errs = append(errs, errCapabilityInsert)
+			}
+		case CapabilityDocuments:
+			if !slices.Contains(m.Template.Vars(), "documents") {
+				errs = append(errs, errors.New("documents"))
+			}
 		default:
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
@@ -225,6 +243,17 @@ func GetManifest(mp ModelPath) (*Manifest, string, error) {
 		return nil, "", err
 	}
 
+	// aliases resolve to the manifest of their target
+	var alias aliasManifest
+	if err := json.Unmarshal(bts, &alias); err == nil && alias.Alias != "" {
+		resolved, err := ParseNamedManifest(model.ParseName(mp.GetFullTagname()))
+		if err != nil {
+			return nil, "", err
+		}
+
+		return resolved, resolved.digest, nil
+	}
+
 	return manifest, shaStr, nil
 }
 
@@ -286,6 +315,8 @@ func GetModel(name string) (*Model, error) {
 			if err != nil {
 				return nil, err
 			}
+
+			model.TemplateDigest = layer.Digest
 		case "application/vnd.ollama.image.system":
 			bts, err := os.ReadFile(filename)
 			if err != nil {
@@ -323,6 +354,10 @@ func GetModel(name string) (*Model, error) {
 		}
 	}
 
+	if slices.Contains(model.Template.Vars(), "tools") {
+		model.ToolTemplate = model.Template
+	}
+
 	return model, nil
 }
 
@@ -430,9 +465,12 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 					}
 
 					ft := baseLayer.GGML.KV().FileType()
-					if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
-						return errors.New("quantization is only supported for F16 and F32 models")
-					} else if want != ft {
+					// models already of the wanted type, e.g. converted from AWQ, are kept as they are
+					if want != ft {
+						if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
+							return errors.New("quantization is only supported for F16 and F32 models")
+						}
+
 						fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantization)})
 
 						blob, err := GetBlobsPath(baseLayer.Digest)
@@ -649,6 +687,13 @@ func CopyModel(src, dst model.Name) error {
 		return nil
 	}
 
+	// a copy of an alias is a copy of the model it resolves to
+	if m, err := ParseNamedManifest(src); err != nil {
+		return err
+	} else if m.alias.IsValid() {
+		return WriteManifest(dst, m.Config, m.Layers)
+	}
+
 	manifests, err := GetManifestPath()
 	if err != nil {
 		return err
@@ -676,6 +721,84 @@ func CopyModel(src, dst model.Name) error {
 	return err
 }
 
+// errUpdateAlias is returned when updating the template of an alias, which
+// would otherwise replace the alias with a copy of the model it resolves to
+var errUpdateAlias = errors.New("model is an alias")
+
+// UpdateTemplate replaces the template of the named model. Loaded runners
+// aren't affected since the template is only used to render prompts, which
+// reads the model's manifest for each request
+func UpdateTemplate(name model.Name, tmpl string) error {
+	if !name.IsFullyQualified() {
+		return model.Unqualified(name)
+	}
+
+	manifest, err := ParseNamedManifest(name)
+	if err != nil {
+		return err
+	}
+
+	if manifest.alias.IsValid() {
+		return fmt.Errorf("%w of %s, update the template of %[2]s instead", errUpdateAlias, manifest.alias.DisplayShortest())
+	}
+
+	layer, err := NewLayer(strings.NewReader(tmpl), "application/vnd.ollama.image.template")
+	if err != nil {
+		return err
+	}
+
+	var old *Layer
+	layers := slices.Clone(manifest.Layers)
+	if i := slices.IndexFunc(layers, func(l *Layer) bool { return l.MediaType == layer.MediaType }); i >= 0 {
+		old = layers[i]
+		layers[i] = layer
+	} else {
+		layers = append(layers, layer)
+	}
+
+	f, err := manifest.Config.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var config ConfigV2
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return err
+	}
+
+	config.RootFS.DiffIDs = make([]string, len(layers))
+	for i, layer := range layers {
+		config.RootFS.DiffIDs[i] = layer.Digest
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(config); err != nil {
+		return err
+	}
+
+	configLayer, err := NewLayer(&b, "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		return err
+	}
+
+	if err := WriteManifest(name, configLayer, layers); err != nil {
+		return err
+	}
+
+	if !envconfig.NoPrune {
+		for _, l := range []*Layer{old, manifest.Config} {
+			if l != nil && l.Digest != layer.Digest && l.Digest != configLayer.Digest {
+				if err := l.Remove(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]struct{}) error {
 	fp, err := GetManifestPath()
 	if err != nil {
@@ -9,6 +9,8 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/ollama/ollama/types/model"
 )
@@ -22,8 +24,24 @@ type Manifest struct {
 	filepath string
 	fi       os.FileInfo
 	digest   string
+
+	// alias is the name of the model an alias resolves to. It's only valid if
+	// the manifest was read through an alias
+	alias model.Name
+}
+
+// aliasManifest is the manifest of an alias, which resolves to the manifest
+// of the model named by Alias instead of listing layers of its own
+type aliasManifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Alias         string `json:"alias"`
 }
 
+const aliasMediaType = "application/vnd.ollama.alias.v1+json"
+
+var errCircularAlias = errors.New("circular alias")
+
 func (m *Manifest) Size() (size int64) {
 	for _, layer := range append(m.Layers, m.Config) {
 		size += layer.Size
@@ -57,43 +75,133 @@ func (m *Manifest) RemoveLayers() error {
 	return nil
 }
 
+// ParseNamedManifest reads the manifest of n. If n is an alias, the manifest
+// of the model it resolves to is returned, but removing it removes the alias
 func ParseNamedManifest(n model.Name) (*Manifest, error) {
+	m, alias, err := parseManifestFile(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if alias == "" {
+		return m, nil
+	}
+
+	target := model.ParseName(alias)
+	if !target.IsValid() {
+		return nil, fmt.Errorf("alias %s: invalid model name %q", n.DisplayShortest(), alias)
+	}
+
+	resolved, next, err := parseManifestFile(target)
+	if err != nil {
+		return nil, fmt.Errorf("alias %s: %w", n.DisplayShortest(), err)
+	}
+
+	if next != "" {
+		return nil, fmt.Errorf("alias %s: %s is an alias", n.DisplayShortest(), target.DisplayShortest())
+	}
+
+	resolved.filepath, resolved.fi = m.filepath, m.fi
+	resolved.alias = target
+	return resolved, nil
+}
+
+// parseManifestFile reads the manifest file of n. If it's the manifest of an
+// alias, the name of the model it resolves to is returned instead of layers
+func parseManifestFile(n model.Name) (_ *Manifest, alias string, _ error) {
 	if !n.IsFullyQualified() {
-		return nil, model.Unqualified(n)
+		return nil, "", model.Unqualified(n)
 	}
 
 	manifests, err := GetManifestPath()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	p := filepath.Join(manifests, n.Filepath())
 
-	var m Manifest
+	var m struct {
+		Manifest
+		Alias string `json:"alias"`
+	}
 	f, err := os.Open(p)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer f.Close()
 
 	fi, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	sha256sum := sha256.New()
 	if err := json.NewDecoder(io.TeeReader(f, sha256sum)).Decode(&m); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	m.filepath = p
 	m.fi = fi
 	m.digest = fmt.Sprintf("%x", sha256sum.Sum(nil))
 
-	return &m, nil
+	return &m.Manifest, m.Alias, nil
 }
 
 func WriteManifest(name model.Name, config *Layer, layers []*Layer) error {
+	return writeManifestFile(name, Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Config:        config,
+		Layers:        layers,
+	})
+}
+
+// WriteAlias writes the manifest of an alias named name which resolves to the
+// manifest of target. If target is itself an alias, name resolves to the model
+// target resolves to
+func WriteAlias(name, target model.Name) error {
+	m, err := ParseNamedManifest(target)
+	if err != nil {
+		return err
+	}
+
+	if m.alias.IsValid() {
+		target = m.alias
+	}
+
+	if name.Filepath() == target.Filepath() {
+		return fmt.Errorf("%w: %s would resolve to itself", errCircularAlias, name.DisplayShortest())
+	}
+
+	return writeManifestFile(name, aliasManifest{
+		SchemaVersion: 2,
+		MediaType:     aliasMediaType,
+		Alias:         target.String(),
+	})
+}
+
+// Aliases returns the names of the aliases which resolve to the manifest of n
+func Aliases(n model.Name) ([]model.Name, error) {
+	ms, err := Manifests()
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []model.Name
+	for alias, m := range ms {
+		if m.alias.IsValid() && m.alias.Filepath() == n.Filepath() {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	slices.SortFunc(aliases, func(a, b model.Name) int {
+		return strings.Compare(a.DisplayShortest(), b.DisplayShortest())
+	})
+
+	return aliases, nil
+}
+
+func writeManifestFile(name model.Name, m any) error {
 	manifests, err := GetManifestPath()
 	if err != nil {
 		return err
@@ -104,20 +212,31 @@ func WriteManifest(name model.Name, config *Layer, layers []*Layer) error {
 		return err
 	}
 
-	f, err := os.Create(p)
+	// write to a temporary file first so concurrent readers never see a
+	// partially written manifest. it's created outside of the manifest tree
+	// so it isn't mistaken for a manifest
+	f, err := os.CreateTemp(manifests, ".manifest")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
-	m := Manifest{
-		SchemaVersion: 2,
-		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
-		Config:        config,
-		Layers:        layers,
+	// CreateTemp makes the file readable only by its owner
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
 	}
 
-	return json.NewEncoder(f).Encode(m)
+	return os.Rename(f.Name(), p)
 }
 
 func Manifests() (map[model.Name]*Manifest, error) {
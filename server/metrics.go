@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/ollama/ollama/metrics"
+)
+
+var (
+	promptAssemblyDuration  = metrics.NewHistogram("prompt_assembly_duration_seconds", "Time taken to build chat prompts, including truncating messages to fit the context window", metrics.DefBuckets)
+	promptMessagesTruncated = metrics.NewCounter("prompt_messages_truncated_total", "Chat messages left out of prompts to fit the context window")
+	promptImagesDropped     = metrics.NewCounter("prompt_images_dropped_total", "Images left out of prompts with the chat messages they belong to")
+)
+
+// kvCacheTokensUsed returns the number of tokens held in the KV caches of
+// every loaded runner. Runners which can't report their KV cache, e.g.
+// because they're still loading, aren't counted
+func (s *Scheduler) kvCacheTokensUsed(ctx context.Context) int {
+	s.loadedMu.Lock()
+	var runners []*runnerRef
+	for _, runner := range s.loaded {
+		if runner.llama != nil {
+			runners = append(runners, runner)
+		}
+	}
+	s.loadedMu.Unlock()
+
+	var used int
+	for _, runner := range runners {
+		stats, err := runner.llama.ContextStats(ctx)
+		if err != nil {
+			continue
+		}
+
+		used += stats.KVCacheUsedTokens
+	}
+
+	return used
+}
+
+// registerSchedulerMetrics adds metrics read from the runners of s
+func registerSchedulerMetrics(s *Scheduler) {
+	metrics.NewGaugeFunc("kv_cache_tokens_used", "Tokens held in the KV caches of loaded models", func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return float64(s.kvCacheTokensUsed(ctx))
+	})
+}
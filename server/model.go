@@ -12,7 +12,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"text/template/parse"
 
@@ -183,6 +185,30 @@ func parseFromZipFile(_ context.Context, file *os.File, digest string, fn func(a
 		return nil, err
 	}
 
+	if params.Quantization.IsAWQ() {
+		// AWQ weights are dequantized during conversion. requantize them to
+		// the closest equivalent so the model stays 4 bit
+		fn(api.ProgressResponse{Status: "quantizing AWQ model to Q4_K_M"})
+
+		want, err := llm.ParseFileType("Q4_K_M")
+		if err != nil {
+			return nil, err
+		}
+
+		quantized, err := os.CreateTemp(tempDir, "q4_K_M")
+		if err != nil {
+			return nil, err
+		}
+		defer quantized.Close()
+		defer os.Remove(quantized.Name())
+
+		if err := llm.Quantize(temp.Name(), quantized.Name(), want); err != nil {
+			return nil, err
+		}
+
+		temp = quantized
+	}
+
 	if _, err := temp.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
@@ -315,6 +341,7 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	if err := tmpl.Execute(&b, map[string][]map[string]any{
 		"ToolCalls": {
 			{
+				"ID": "@@id@@",
 				"Function": map[string]any{
 					"Name":      "@@name@@",
 					"Arguments": "@@arguments@@",
@@ -331,42 +358,35 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 		return nil, false
 	}
 
-	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
+	// find the keys that correspond to the name, arguments and, for formats
+	// which reference tool calls by ID, id fields
+	var name, arguments, id string
 	for k, v := range kv {
 		switch v {
 		case "@@name@@":
 			name = k
 		case "@@arguments@@":
 			arguments = k
+		case "@@id@@":
+			id = k
 		}
 	}
 
+	// decode the first JSON list of objects, skipping over any text before
+	// it such as a [TOOL_CALLS] token
 	var sm []map[string]any
-	decoder := json.NewDecoder(strings.NewReader(s))
-	for {
-		// incrementally decode the JSON into a list of JSON objects
-		// skipping over any invalid tokens
-		if err := decoder.Decode(&sm); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
-			if errors.As(err, new(*json.SyntaxError)) {
-				r := decoder.Buffered()
-				if _, err := r.Read(make([]byte, decoder.InputOffset()+1)); err != nil {
-					break
-				}
-
-				decoder = json.NewDecoder(r)
-				continue
-			}
+	for i := strings.IndexByte(s, '['); i >= 0; {
+		if err := json.NewDecoder(strings.NewReader(s[i:])).Decode(&sm); err == nil {
+			break
+		}
 
-			return nil, false
+		sm = nil
+		j := strings.IndexByte(s[i+1:], '[')
+		if j < 0 {
+			break
 		}
 
-		// break as soon as a valid object is decoded
-		break
+		i += j + 1
 	}
 
 	var toolCalls []api.ToolCall
@@ -382,6 +402,11 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 				call.Function.Name = v.(string)
 			case arguments:
 				call.Function.Arguments = v.(map[string]any)
+			case id:
+				// keep the model's ID so tool results can reference it
+				if v, ok := v.(string); ok && v != "" {
+					call.ID = v
+				}
 			}
 		}
 
@@ -394,3 +419,47 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 
 	return nil, false
 }
+
+// citationRegex matches grounding markup such as Command-R's <co: 0,1>text</co: 0,1>
+var citationRegex = regexp.MustCompile(`(?s)<co:\s*([^>]*)>(.*?)</co:\s*[^>]*>`)
+
+// parseCitations removes grounding markup from the model's response s and
+// returns the cited spans. If s contains a "Grounded answer:" section, as
+// Command-R writes when asked to ground its answer, only that section is
+// returned. Citations reference documents in docs by ID or by index
+func parseCitations(s string, docs []api.Document) (string, []api.Citation) {
+	if i := strings.LastIndex(s, "Grounded answer:"); i >= 0 {
+		s = strings.TrimSpace(s[i+len("Grounded answer:"):])
+	}
+
+	var b strings.Builder
+	var citations []api.Citation
+	var last int
+	for _, match := range citationRegex.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(s[last:match[0]])
+		last = match[1]
+
+		text := s[match[4]:match[5]]
+		citation := api.Citation{Start: b.Len(), End: b.Len() + len(text), Text: text}
+		for _, id := range strings.Split(s[match[2]:match[3]], ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+
+			if !slices.ContainsFunc(docs, func(d api.Document) bool { return d.ID == id }) {
+				if n, err := strconv.Atoi(id); err == nil && n >= 0 && n < len(docs) {
+					id = docs[n].ID
+				}
+			}
+
+			citation.Documents = append(citation.Documents, id)
+		}
+
+		b.WriteString(text)
+		citations = append(citations, citation)
+	}
+
+	b.WriteString(s[last:])
+	return b.String(), citations
+}
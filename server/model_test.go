@@ -136,11 +136,13 @@ func TestExecuteWithTools(t *testing.T) {
 	cases := []struct {
 		model  string
 		output string
+		// ids are the tool call IDs in output, for formats which include them
+		ids []string
 	}{
-		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`},
+		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, nil},
 		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]
 
-The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`},
+The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`, nil},
 		{"command-r-plus", "Action: ```json" + `
 [
     {
@@ -158,8 +160,20 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
         }
     }
 ]
-` + "```"},
-		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`},
+` + "```", nil},
+		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, nil},
+		{"mistral-v3", `[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}, "id": "a1b2c3d4e"}, {"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}, "id": "f5g6h7i8j"}]`, []string{"a1b2c3d4e", "f5g6h7i8j"}},
+		{"command-r", "Action: ```json" + `
+[
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {"format": "fahrenheit", "location": "San Francisco, CA"}
+    },
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {"format": "celsius", "location": "Toronto, Canada"}
+    }
+]` + "```", nil},
 	}
 
 	var tools []api.Tool
@@ -221,7 +235,15 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
 				}
 
 				for i := range actual {
-					// ID is randomly generated so clear it for comparison
+					if tt.ids != nil {
+						if actual[i].ID != tt.ids[i] {
+							t.Errorf("expected id %q, got %q", tt.ids[i], actual[i].ID)
+						}
+					} else if actual[i].ID == "" {
+						t.Error("expected a generated id")
+					}
+
+					// IDs are compared above so clear them for comparison
 					actual[i].ID = ""
 				}
 
@@ -232,3 +254,92 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
 		})
 	}
 }
+
+func TestExecuteWithDocuments(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	tmpl, err := template.Parse(readFile(t, p, "command-r.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var docs []api.Document
+	if err := json.Unmarshal(readFile(t, p, "documents.json").Bytes(), &docs); err != nil {
+		t.Fatal(err)
+	}
+
+	var actual bytes.Buffer
+	if err := tmpl.Execute(&actual, template.Values{
+		Messages:  []api.Message{{Role: "user", Content: "Which penguins are the tallest?"}},
+		Documents: chatDocuments(docs),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(actual.String(), readFile(t, p, "command-r-documents.out").String()); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestParseCitations(t *testing.T) {
+	docs := chatDocuments([]api.Document{{Text: "Emperor penguins are the tallest."}, {ID: "habitats", Text: "Emperor penguins only live in Antarctica."}})
+
+	cases := []struct {
+		name      string
+		output    string
+		content   string
+		citations []api.Citation
+	}{
+		{
+			name:    "no citations",
+			output:  "Emperor penguins are the tallest.",
+			content: "Emperor penguins are the tallest.",
+		},
+		{
+			name: "grounded answer",
+			output: `Relevant Documents: 0,1
+Cited Documents: 0,1
+Answer: The tallest penguins are emperor penguins, which only live in Antarctica.
+Grounded answer: The tallest penguins are <co: 0>emperor penguins</co: 0>, which <co: 1>only live in Antarctica</co: 1>.`,
+			content: "The tallest penguins are emperor penguins, which only live in Antarctica.",
+			citations: []api.Citation{
+				{Start: 25, End: 41, Text: "emperor penguins", Documents: []string{"0"}},
+				{Start: 49, End: 72, Text: "only live in Antarctica", Documents: []string{"habitats"}},
+			},
+		},
+		{
+			name:    "multiple documents",
+			output:  "<co: 0, habitats>Emperor penguins</co: 0, habitats> are the tallest.",
+			content: "Emperor penguins are the tallest.",
+			citations: []api.Citation{
+				{Start: 0, End: 16, Text: "Emperor penguins", Documents: []string{"0", "habitats"}},
+			},
+		},
+		{
+			name:    "unknown document",
+			output:  "<co: 7>Emperor penguins</co: 7> are the tallest.",
+			content: "Emperor penguins are the tallest.",
+			citations: []api.Citation{
+				{Start: 0, End: 16, Text: "Emperor penguins", Documents: []string{"7"}},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			content, citations := parseCitations(tt.output, docs)
+			if content != tt.content {
+				t.Errorf("expected content %q, got %q", tt.content, content)
+			}
+
+			if diff := cmp.Diff(citations, tt.citations); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			for _, c := range citations {
+				if content[c.Start:c.End] != c.Text {
+					t.Errorf("expected %q at %d:%d, got %q", c.Text, c.Start, c.End, content[c.Start:c.End])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ollama/ollama/api"
+)
+
+// chatRequestPart is the name of the part of a multipart chat request which
+// holds the chat request
+const chatRequestPart = "request"
+
+// bindChatMultipart decodes a chat request sent as multipart/form-data, which
+// saves encoding large images as base64. The request part holds the chat
+// request as JSON, except that the images of each message are the names of
+// the parts holding them. Parts may be in any order and one part may be used
+// for several images
+func bindChatMultipart(r *http.Request, req *api.ChatRequest) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	parts := make(map[string][]byte)
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		b, err := io.ReadAll(p)
+		if err != nil {
+			return err
+		}
+
+		parts[p.FormName()] = b
+	}
+
+	body, ok := parts[chatRequestPart]
+	if !ok {
+		return fmt.Errorf("missing %q part", chatRequestPart)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return fmt.Errorf("%s part: %w", chatRequestPart, err)
+	}
+
+	// the part names are taken out of the messages so the rest of the request
+	// decodes like a JSON body
+	var msgs []map[string]json.RawMessage
+	if b, ok := raw["messages"]; ok {
+		if err := json.Unmarshal(b, &msgs); err != nil {
+			return fmt.Errorf("%s part: messages: %w", chatRequestPart, err)
+		}
+	}
+
+	names := make([][]string, len(msgs))
+	for i, msg := range msgs {
+		if b, ok := msg["images"]; ok {
+			if err := json.Unmarshal(b, &names[i]); err != nil {
+				return fmt.Errorf("message %d: images must be the names of parts: %w", i, err)
+			}
+
+			delete(msg, "images")
+		}
+	}
+
+	if msgs != nil {
+		if raw["messages"], err = json.Marshal(msgs); err != nil {
+			return err
+		}
+	}
+
+	if body, err = json.Marshal(raw); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, req); err != nil {
+		return fmt.Errorf("%s part: %w", chatRequestPart, err)
+	}
+
+	for i := range names {
+		for _, name := range names[i] {
+			data, ok := parts[name]
+			if !ok {
+				return fmt.Errorf("message %d: image part %q not found", i, name)
+			}
+
+			req.Messages[i].Images = append(req.Messages[i].Images, data)
+		}
+	}
+
+	return nil
+}
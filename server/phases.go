@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+const (
+	phasePromptEval = "prompt_eval"
+	phaseGeneration = "generation"
+)
+
+// phaseTracker follows a streamed completion from processing its prompt to
+// generating its response, for requests with phases set. The runner doesn't
+// report progress while it processes the prompt, so the prompt_eval phase
+// completes at once when the first response arrives
+type phaseTracker struct {
+	promptTokens int
+	numPredict   int
+
+	generating bool
+	generated  int
+}
+
+// promptEval returns the progress of the prompt_eval phase
+func (p *phaseTracker) promptEval() *api.PhaseProgress {
+	var completed int
+	if p.generating {
+		completed = p.promptTokens
+	}
+
+	return &api.PhaseProgress{Completed: completed, Total: p.promptTokens}
+}
+
+// generation counts the token of the runner's response cr and returns the
+// progress of the generation phase. started reports whether cr is the first
+// response, i.e. the runner just finished processing the prompt
+func (p *phaseTracker) generation(cr llm.CompletionResponse) (progress *api.PhaseProgress, started bool) {
+	started = !p.generating
+	p.generating = true
+
+	if cr.Done {
+		p.generated = max(p.generated, cr.EvalCount)
+	} else {
+		p.generated++
+	}
+
+	return &api.PhaseProgress{Completed: p.generated, Total: max(p.numPredict, 0)}, started
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// preloadModels loads the named models, at most concurrency at once, and
+// returns the models which loaded and those which didn't. A model which fails
+// to load doesn't stop the others from loading
+func (s *Scheduler) preloadModels(ctx context.Context, names []string, concurrency int) (loaded, failed []string) {
+	sem := semaphore.NewWeighted(int64(max(concurrency, 1)))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+
+			err := s.preloadModel(ctx, name)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Warn("failed to preload model", "model", name, "error", err)
+				failed = append(failed, name)
+				return
+			}
+
+			loaded = append(loaded, name)
+		}()
+	}
+
+	wg.Wait()
+	return loaded, failed
+}
+
+func (s *Scheduler) preloadModel(ctx context.Context, name string) error {
+	model, err := GetModel(name)
+	if err != nil {
+		return err
+	}
+
+	opts, _, err := modelOptions(model, nil)
+	if err != nil {
+		return err
+	}
+
+	// release the runner once it's loaded so it expires with the default keep alive
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	successCh, errCh := s.GetRunner(ctx, model, opts, nil)
+	select {
+	case <-successCh:
+		return nil
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestPreloadModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		if req.model.ShortName == "broken:latest" {
+			req.errCh <- errors.New("failed to load")
+			return
+		}
+
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "first", "")
+	createMockModel(t, &s, "second", "")
+	createMockModel(t, &s, "broken", "")
+
+	loaded, failed := s.sched.preloadModels(ctx, []string{"first", "missing", "broken", "second"}, 2)
+
+	slices.Sort(loaded)
+	if !slices.Equal(loaded, []string{"first", "second"}) {
+		t.Errorf("expected first and second to be loaded, got %v", loaded)
+	}
+
+	slices.Sort(failed)
+	if !slices.Equal(failed, []string{"broken", "missing"}) {
+		t.Errorf("expected broken and missing to fail, got %v", failed)
+	}
+}
@@ -2,8 +2,18 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	gotemplate "text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
@@ -12,42 +22,355 @@ import (
 
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
+// SummarizeFunc summarizes the messages truncated from a chat by chatPrompt. It
+// returns a single system message which replaces them
+type SummarizeFunc func(ctx context.Context, msgs []api.Message) (api.Message, error)
+
+var (
+	errImagePlaceholders = errors.New("more [img] placeholders than images")
+	errUnknownRole       = errors.New("unknown role")
+	errSummaryRole       = errors.New("summary must be a system message")
+	errNoMessages        = errors.New("no messages")
+)
+
+// ErrContextConstraintImpossible is returned by chatPrompt when the messages kept to satisfy
+// min_messages_per_role don't fit in the context window
+var ErrContextConstraintImpossible = errors.New("min_messages_per_role can't be satisfied within the context window")
+
+// TemplateExecutionError is returned by chatPrompt when a model's template fails while rendering
+// the prompt, e.g. on a nil field access
+type TemplateExecutionError struct {
+	// Template is the name of the template that failed. It is the model name unless the error
+	// occurred in a template defined with {{ define }}
+	Template string
+
+	// Line is the line in the template where the error occurred
+	Line int
+
+	// Node is the template action that failed, e.g. .Messages.Foo
+	Node string
+
+	// Reason describes why the action failed
+	Reason string
+
+	Err error
+}
+
+func (e *TemplateExecutionError) Error() string {
+	return fmt.Sprintf("template %s: line %d: executing <%s>: %s", e.Template, e.Line, e.Node, e.Reason)
+}
+
+func (e *TemplateExecutionError) Unwrap() error {
+	return e.Err
+}
+
+// newTemplateExecutionError wraps err in a TemplateExecutionError if it's an execution error from
+// the template of model m. other errors are returned as is
+func newTemplateExecutionError(m *Model, err error) error {
+	var execErr gotemplate.ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	e := TemplateExecutionError{Template: execErr.Name, Reason: execErr.Err.Error(), Err: err}
+	if e.Template == "" {
+		e.Template = cmp.Or(m.ShortName, m.Name)
+	}
+
+	// execution errors are formatted as
+	// template: NAME:LINE:COL: executing "NAME" at <NODE>: REASON
+	msg := execErr.Err.Error()
+	if location, rest, ok := strings.Cut(strings.TrimPrefix(msg, "template: "), ": executing "); ok {
+		if parts := strings.Split(location, ":"); len(parts) >= 2 {
+			e.Line, _ = strconv.Atoi(parts[len(parts)-2])
+		}
+
+		if _, rest, ok := strings.Cut(rest, " at <"); ok {
+			if node, reason, ok := strings.Cut(rest, ">: "); ok {
+				e.Node = node
+				e.Reason = reason
+			}
+		}
+	}
+
+	return &e
+}
+
+// TokenizeError is returned by chatPrompt when a message can't be tokenized
+type TokenizeError struct {
+	// Index is the position of the message in the messages passed to chatPrompt
+	Index int
+
+	// Role is the role of the message
+	Role string
+
+	Err error
+}
+
+func (e *TokenizeError) Error() string {
+	return fmt.Sprintf("message %d (%s): tokenize: %v", e.Index, e.Role, e.Err)
+}
+
+func (e *TokenizeError) Unwrap() error {
+	return e.Err
+}
+
+// roles are the message roles templates understand
+var roles = []string{"system", "user", "assistant", "tool"}
+
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
-	var system []api.Message
-	// always include the last message
-	n := len(msgs) - 1
-	// in reverse, find all messages that fit into context window
-	for i := n - 1; i >= 0; i-- {
-		system = make([]api.Message, 0)
-		for j := range i {
-			if msgs[j].Role == "system" {
-				system = append(system, msgs[j])
+// latest message, truncated if opts.TruncateKeep is set and it doesn't fit on its own, and 2) system messages, unless
+// opts.KeepSystem is false and the latest message doesn't fit with them. It also returns the system prompt
+// as the template received it, i.e. the content of the system messages which were kept, and the number
+// of tokens truncated, i.e. the difference between the tokens of the prompt with every message and the
+// prompt returned. If summarize is set, the messages which don't fit are replaced by their summary
+// instead and only tokens truncated from the summarized messages are counted
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, docs []api.Document, summarize SummarizeFunc) (prompt string, images []llm.ImageData, systemPrompt string, truncatedTokens int, _ error) {
+	defer func(start time.Time) {
+		promptAssemblyDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	return buildChatPrompt(ctx, m, tokenize, opts, msgs, tools, docs, summarize)
+}
+
+// buildChatPrompt builds the prompt returned by chatPrompt. It builds the prompt again with the summary
+// of the messages which don't fit when summarize is set
+func buildChatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, docs []api.Document, summarize SummarizeFunc) (prompt string, images []llm.ImageData, systemPrompt string, truncatedTokens int, _ error) {
+	if len(msgs) == 0 {
+		return "", nil, "", 0, errNoMessages
+	}
+
+	msgs = slices.Clone(msgs)
+	for i, msg := range msgs {
+		role := strings.ToLower(msg.Role)
+		if !slices.Contains(roles, role) {
+			return "", nil, "", 0, fmt.Errorf("message %d: %w %q: must be one of %s", i, errUnknownRole, msg.Role, strings.Join(roles, ", "))
+		}
+
+		msgs[i].Role = role
+
+		// each [img] placeholder is replaced left to right by the message's images in order
+		if n := strings.Count(msg.Content, "[img]"); n > len(msg.Images) {
+			return "", nil, "", 0, fmt.Errorf("message %d: %w: found %d placeholders for %d images", i, errImagePlaceholders, n, len(msg.Images))
+		}
+	}
+
+	// index maps msgs back to their position in the messages passed in
+	index := make([]int, len(msgs))
+	for i := range index {
+		index[i] = i
+	}
+
+	// templates which use .ToolResults render a tool call and its results as a single turn
+	if slices.Contains(m.Template.Vars(), "toolresults") {
+		index = index[:0]
+		for i := 0; i < len(msgs); i++ {
+			index = append(index, i)
+			if msgs[i].Role == "assistant" && len(msgs[i].ToolCalls) > 0 {
+				for i+1 < len(msgs) && msgs[i+1].Role == "tool" {
+					i++
+				}
+			}
+		}
+
+		msgs = CoalesceToolRounds(msgs)
+	}
+
+	// the latest messages of each role in min_messages_per_role are kept regardless of where
+	// the messages are truncated
+	required := make(map[int]bool)
+	for role, count := range opts.MinMessagesPerRole {
+		role = strings.ToLower(role)
+		for i := len(msgs) - 2; i >= 0 && count > 0; i-- {
+			if msgs[i].Role == role {
+				required[i] = true
+				count--
 			}
 		}
+	}
+
+	// dropped are the system messages truncated when opts.KeepSystem is false
+	dropped := make(map[int]bool)
+
+	// kept returns the messages used when messages before i are truncated: the system
+	// messages and required messages before i followed by the messages from i
+	kept := func(i int) (system, rest []api.Message) {
+		for j, msg := range msgs[:i] {
+			switch {
+			case msg.Role == "system":
+				if !dropped[j] {
+					system = append(system, msg)
+				}
+			case required[j]:
+				rest = append(rest, msg)
+			}
+		}
+
+		return system, append(rest, msgs[i:]...)
+	}
+
+	// tokenizeError finds the message kept when messages before i are truncated which
+	// caused err while tokenizing the prompt. err is returned as is if the failure
+	// can't be attributed to a single message, e.g. if the tokenizer isn't working
+	tokenizeError := func(i int, err error) error {
+		if ctx.Err() != nil {
+			return err
+		}
+
+		if _, err := tokenize(ctx, ""); err != nil {
+			return err
+		}
 
+		for j, msg := range msgs {
+			if j < i && (msg.Role != "system" || dropped[j]) && !required[j] {
+				continue
+			}
+
+			if _, terr := tokenize(ctx, msg.Content); terr != nil {
+				return &TokenizeError{Index: index[j], Role: msg.Role, Err: terr}
+			}
+
+			// tool results follow the assistant message they were merged into
+			for k, result := range msg.ToolResults {
+				if _, terr := tokenize(ctx, result); terr != nil {
+					return &TokenizeError{Index: index[j] + 1 + k, Role: "tool", Err: terr}
+				}
+			}
+		}
+
+		return err
+	}
+
+	// count returns the number of tokens in the prompt of msgs, the messages
+	// kept when messages before i are truncated
+	count := func(i int, msgs []api.Message) (int, error) {
 		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools}); err != nil {
-			return "", nil, err
+		if err := m.Template.Execute(&b, template.Values{Messages: msgs, Tools: tools, Documents: docs, IsFirstTurn: isFirstTurn(msgs)}); err != nil {
+			return 0, newTemplateExecutionError(m, err)
 		}
 
 		s, err := tokenize(ctx, b.String())
 		if err != nil {
-			return "", nil, err
+			return 0, tokenizeError(i, err)
 		}
 
 		c := len(s)
 		if m.ProjectorPaths != nil {
-			for _, m := range msgs[i:] {
+			for _, m := range msgs {
 				// images are represented as 768 sized embeddings
 				// TODO: get embedding length from project metadata
 				c += 768 * len(m.Images)
 			}
 		}
 
-		if c > opts.NumCtx {
+		return c, nil
+	}
+
+	fits := func(i int) (bool, error) {
+		system, rest := kept(i)
+		c, err := count(i, repeatSystem(system, rest, opts.RepeatSystemEvery))
+		if err != nil {
+			return false, err
+		}
+
+		return c <= opts.NumCtx, nil
+	}
+
+	// always include the last message
+	n := len(msgs) - 1
+
+	// without opts.KeepSystem, the oldest system messages before the last message are
+	// truncated while it doesn't fit with them. no other messages would fit either
+	if !opts.KeepSystem {
+		for j := 0; j < n; j++ {
+			if msgs[j].Role != "system" {
+				continue
+			}
+
+			if ok, err := fits(n); err != nil {
+				return "", nil, "", 0, err
+			} else if ok {
+				break
+			}
+
+			slog.Debug("truncating system message which exceeds context length", "index", index[j])
+			dropped[j] = true
+		}
+	}
+
+	// truncated is set if the content of the last message was truncated, in
+	// which case untruncated is its original content
+	var truncated bool
+	var untruncated string
+
+	// with opts.TruncateKeep, the last message is truncated to the longest head or tail of its
+	// content which fits. it's left as is if nothing fits, e.g. because of its images
+	if opts.TruncateKeep != "" {
+		if ok, err := fits(n); err != nil {
+			return "", nil, "", 0, err
+		} else if !ok {
+			content := []rune(msgs[n].Content)
+			truncate := func(k int) string {
+				if opts.TruncateKeep == "tail" {
+					return strings.TrimLeftFunc(string(content[len(content)-k:]), unicode.IsSpace)
+				}
+
+				return strings.TrimRightFunc(string(content[:k]), unicode.IsSpace)
+			}
+
+			// binary search for the longest truncation which fits
+			lo, hi := -1, len(content)
+			for lo+1 < hi {
+				mid := lo + (hi-lo)/2
+				msgs[n].Content = truncate(mid)
+				ok, err := fits(n)
+				if err != nil {
+					return "", nil, "", 0, err
+				}
+
+				if ok {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+
+			if lo >= 0 {
+				slog.Debug("truncating message which exceeds context length", "index", index[n], "keep", opts.TruncateKeep, "length", len(content), "truncated", lo)
+				msgs[n].Content = truncate(lo)
+				truncated, untruncated = true, string(content)
+			} else {
+				msgs[n].Content = string(content)
+			}
+		}
+	}
+
+	if len(required) > 0 && n > 0 {
+		if ok, err := fits(n); err != nil {
+			return "", nil, "", 0, err
+		} else if !ok {
+			return "", nil, "", 0, ErrContextConstraintImpossible
+		}
+	}
+
+	// most chats fit entirely, in which case only the whole chat is tokenized
+	if n > 0 {
+		if ok, err := fits(0); err != nil {
+			return "", nil, "", 0, err
+		} else if ok {
+			n = 0
+		}
+	}
+
+	// in reverse, find all messages that fit into context window
+	for i := n - 1; i >= 0; i-- {
+		ok, err := fits(i)
+		if err != nil {
+			return "", nil, "", 0, err
+		}
+
+		if !ok {
 			slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[i:]))
 			break
 		} else {
@@ -55,20 +378,200 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		}
 	}
 
+	// the summary is a system message, so it's kept when the prompt is built again
+	// and later summaries only cover messages after it
+	if summarize != nil {
+		var evicted []api.Message
+		var at int
+		summarized := make([]api.Message, 0, len(msgs))
+		for j, msg := range msgs[:n] {
+			switch {
+			case dropped[j]:
+				// system messages which don't fit with the latest message stay truncated
+			case msg.Role == "system" || required[j]:
+				summarized = append(summarized, msg)
+			default:
+				// the summary takes the place of the first message it replaces
+				if len(evicted) == 0 {
+					at = len(summarized)
+					summarized = append(summarized, api.Message{})
+				}
+
+				evicted = append(evicted, msg)
+			}
+		}
+
+		if len(evicted) > 0 {
+			slog.Debug("summarizing input messages which exceed context length", "summarized", len(evicted))
+			summary, err := summarize(ctx, evicted)
+			if err != nil {
+				return "", nil, "", 0, fmt.Errorf("summarize: %w", err)
+			}
+
+			if summary.Role != "system" {
+				return "", nil, "", 0, fmt.Errorf("%w, got %q", errSummaryRole, summary.Role)
+			}
+
+			summarized[at] = summary
+			return buildChatPrompt(ctx, m, tokenize, opts, append(summarized, msgs[n:]...), tools, docs, summarize)
+		}
+	}
+
 	// truncate any messages that do not fit into the context window
+	system, rest := kept(n)
+	if omitted := len(msgs) - len(system) - len(rest); omitted > 0 || truncated {
+		promptMessagesTruncated.Add(omitted)
+		promptImagesDropped.Add(countImages(msgs) - countImages(system) - countImages(rest))
+
+		// the prompt ends with the last message, followed by the template's
+		// turn markers, so that's where a cut sentence shows
+		if fragment, ok := midSentenceEnd(msgs[len(msgs)-1].Content); ok {
+			slog.Warn("prompt may end mid-sentence after truncation", "MessagesDropped", omitted, "PromptEndFragment", fragment)
+		}
+
+		all := slices.Clone(msgs)
+		if truncated {
+			all[len(all)-1].Content = untruncated
+		}
+
+		total, err := count(0, repeatSystem(nil, all, opts.RepeatSystemEvery))
+		if err != nil {
+			return "", nil, "", 0, err
+		}
+
+		c, err := count(n, repeatSystem(system, rest, opts.RepeatSystemEvery))
+		if err != nil {
+			return "", nil, "", 0, err
+		}
+
+		truncatedTokens = max(total-c, 0)
+	}
+
+	var systemContent []string
+	for _, msg := range slices.Concat(system, rest) {
+		if msg.Role == "system" {
+			systemContent = append(systemContent, msg.Content)
+		}
+	}
+
+	msgs = repeatSystem(system, rest, opts.RepeatSystemEvery)
+
+	// the first turn is decided by the messages which are kept, so truncating
+	// the earlier responses renders the prompt as a first turn again
 	var b bytes.Buffer
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[n:]...), Tools: tools}); err != nil {
-		return "", nil, err
+	if err := m.Template.Execute(&b, template.Values{Messages: msgs, Tools: tools, Documents: docs, IsFirstTurn: isFirstTurn(msgs)}); err != nil {
+		return "", nil, "", 0, newTemplateExecutionError(m, err)
 	}
 
-	for _, m := range msgs[n:] {
+	// images are numbered in the order of the rendered messages, including those of system
+	// messages which are kept
+	for _, m := range msgs {
 		for _, i := range m.Images {
+			// resized images are copies so the messages passed in aren't modified
+			data, err := resizeImage(i, opts.ImageMaxSide, opts.ImageQuality)
+			if err != nil {
+				return "", nil, "", 0, err
+			}
+
 			images = append(images, llm.ImageData{
 				ID:   len(images),
-				Data: i,
+				Data: data,
 			})
 		}
 	}
 
-	return b.String(), images, nil
+	return b.String(), images, strings.Join(systemContent, "\n\n"), truncatedTokens, nil
+}
+
+// promptEndFragmentLength is the number of characters at the end of the prompt
+// logged when it may end mid-sentence
+const promptEndFragmentLength = 32
+
+// midSentenceEnd reports whether s doesn't end with punctuation which ends a
+// sentence, ignoring trailing whitespace, quotes and brackets. It returns the
+// end of s to show where it stops. Empty content ends no sentence
+func midSentenceEnd(s string) (fragment string, ok bool) {
+	s = strings.TrimRightFunc(s, unicode.IsSpace)
+	if s == "" {
+		return "", false
+	}
+
+	end := strings.TrimRight(s, `"')]}”’»`)
+	if r, _ := utf8.DecodeLastRuneInString(end); strings.ContainsRune(".!?…。！？", r) {
+		return "", false
+	}
+
+	if runes := []rune(s); len(runes) > promptEndFragmentLength {
+		s = string(runes[len(runes)-promptEndFragmentLength:])
+	}
+
+	return s, true
+}
+
+// countImages returns the number of images in msgs
+func countImages(msgs []api.Message) int {
+	var n int
+	for _, msg := range msgs {
+		n += len(msg.Images)
+	}
+
+	return n
+}
+
+// isFirstTurn reports whether msgs include no assistant messages, i.e. the
+// model is about to give its first response
+func isFirstTurn(msgs []api.Message) bool {
+	return !slices.ContainsFunc(msgs, func(m api.Message) bool {
+		return m.Role == "assistant"
+	})
+}
+
+// repeatSystem returns the system messages followed by msgs. If every is positive, the system
+// messages seen so far are repeated before every nth user message so they stay close to the end
+// of long conversations
+func repeatSystem(system, msgs []api.Message, every int) []api.Message {
+	if every <= 0 {
+		return append(system, msgs...)
+	}
+
+	out := slices.Clone(system)
+	seen := slices.Clone(system)
+
+	var turns int
+	for _, msg := range msgs {
+		switch msg.Role {
+		case "system":
+			seen = append(seen, msg)
+		case "user":
+			if turns > 0 && turns%every == 0 {
+				out = append(out, seen...)
+			}
+
+			turns++
+		}
+
+		out = append(out, msg)
+	}
+
+	return out
+}
+
+// CoalesceToolRounds merges each assistant message with tool calls and the tool messages that
+// immediately follow it into a single assistant message. The content of the tool messages is
+// moved to the assistant message's ToolResults, in order. Other messages are returned as is
+func CoalesceToolRounds(msgs []api.Message) []api.Message {
+	coalesced := make([]api.Message, 0, len(msgs))
+	for i := 0; i < len(msgs); i++ {
+		msg := msgs[i]
+		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
+			for i+1 < len(msgs) && msgs[i+1].Role == "tool" {
+				msg.ToolResults = append(msg.ToolResults, msgs[i+1].Content)
+				i++
+			}
+		}
+
+		coalesced = append(coalesced, msg)
+	}
+
+	return coalesced
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+const benchmarkTemplate = `{{- range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`
+
+// benchmarkMessages returns a system message followed by n alternating user and assistant
+// messages. If images is set, each user message has an image
+func benchmarkMessages(n int, images bool) []api.Message {
+	msgs := []api.Message{{Role: "system", Content: "You are a helpful assistant."}}
+	for i := range n {
+		if i%2 == 0 {
+			msg := api.Message{Role: "user", Content: fmt.Sprintf("Question %d: why is the sky blue? Please explain in detail.", i)}
+			if images {
+				msg.Images = []api.ImageData{[]byte("image")}
+			}
+
+			msgs = append(msgs, msg)
+		} else {
+			msgs = append(msgs, api.Message{Role: "assistant", Content: fmt.Sprintf("Answer %d: the sky is blue because of Rayleigh scattering of sunlight.", i)})
+		}
+	}
+
+	return msgs
+}
+
+func benchmarkChatPrompt(b *testing.B, msgs []api.Message, projectors []string) {
+	tmpl, err := template.Parse(benchmarkTemplate)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	m := Model{Template: tmpl, ProjectorPaths: projectors}
+
+	// a context window large enough to fit every message so the whole conversation is rendered
+	opts := api.Options{Runner: api.Runner{NumCtx: 1 << 20}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, _, _, _, err := chatPrompt(context.TODO(), &m, tokenize, &opts, msgs, nil, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChatPromptSmall(b *testing.B) {
+	benchmarkChatPrompt(b, benchmarkMessages(10, false), nil)
+}
+
+func BenchmarkChatPromptLarge(b *testing.B) {
+	benchmarkChatPrompt(b, benchmarkMessages(200, false), nil)
+}
+
+func BenchmarkChatPromptImages(b *testing.B) {
+	benchmarkChatPrompt(b, benchmarkMessages(200, true), []string{"vision"})
+}
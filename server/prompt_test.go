@@ -3,10 +3,18 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/template"
 )
@@ -23,12 +31,14 @@ func TestChatPrompt(t *testing.T) {
 	type expect struct {
 		prompt string
 		images [][]byte
+		error  error
 	}
 
 	cases := []struct {
-		name  string
-		limit int
-		msgs  []api.Message
+		name       string
+		limit      int
+		dropSystem bool
+		msgs       []api.Message
 		expect
 	}{
 		{
@@ -117,6 +127,212 @@ func TestChatPrompt(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:  "message with multiple image tags",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "Compare [img] with [img], please.", Images: []api.ImageData{[]byte("something"), []byte("somethingelse")}},
+			},
+			expect: expect{
+				prompt: "Compare [img-0] with [img-1], please. ",
+				images: [][]byte{
+					[]byte("something"),
+					[]byte("somethingelse"),
+				},
+			},
+		},
+		{
+			name:  "message with image tags after earlier images",
+			limit: 4096,
+			msgs: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!", Images: []api.ImageData{[]byte("something")}},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "This [img] and that [img].", Images: []api.ImageData{[]byte("somethingelse"), []byte("anotherthing")}},
+			},
+			expect: expect{
+				prompt: "[img-0] You're a test, Harry! I-I'm a what? This [img-1] and that [img-2]. ",
+				images: [][]byte{
+					[]byte("something"),
+					[]byte("somethingelse"),
+					[]byte("anotherthing"),
+				},
+			},
+		},
+		{
+			name:  "message with more image tags than images",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "Compare [img] with [img], please.", Images: []api.ImageData{[]byte("something")}},
+			},
+			expect: expect{
+				error: errImagePlaceholders,
+			},
+		},
+		{
+			name:  "empty content with image",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("something")}},
+			},
+			expect: expect{
+				prompt: "[img-0] ",
+				images: [][]byte{[]byte("something")},
+			},
+		},
+		{
+			name:  "empty content with images",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("something"), []byte("somethingelse")}},
+			},
+			expect: expect{
+				prompt: "[img-0] [img-1] ",
+				images: [][]byte{
+					[]byte("something"),
+					[]byte("somethingelse"),
+				},
+			},
+		},
+		{
+			name:  "empty content with image after text",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "What's in this image?"},
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("something")}},
+				{Role: "assistant", Content: "A cat."},
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("somethingelse")}},
+			},
+			expect: expect{
+				prompt: "What's in this image?\n\n[img-0] A cat. [img-1] ",
+				images: [][]byte{
+					[]byte("something"),
+					[]byte("somethingelse"),
+				},
+			},
+		},
+		{
+			name:  "empty content with truncated image",
+			limit: 2,
+			msgs: []api.Message{
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("something")}},
+				{Role: "assistant", Content: "A cat."},
+				{Role: "user", Content: "", Images: []api.ImageData{[]byte("somethingelse")}},
+			},
+			expect: expect{
+				prompt: "[img-0] ",
+				images: [][]byte{[]byte("somethingelse")},
+			},
+		},
+		{
+			name:  "system only",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived."},
+			},
+			expect: expect{
+				prompt: "You are the Test Who Lived. ",
+			},
+		},
+		{
+			name:  "system only truncated",
+			limit: 1,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived."},
+				{Role: "system", Content: "You are a wizard, Harry."},
+			},
+			expect: expect{
+				prompt: "You are the Test Who Lived.\n\nYou are a wizard, Harry. ",
+			},
+		},
+		{
+			name:  "large system kept",
+			limit: 64,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived.", Images: []api.ImageData{[]byte("scar")}},
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt: "[img-0] You are the Test Who Lived. A test. And a thumping good one at that, I'd wager. ",
+				images: [][]byte{
+					[]byte("scar"),
+				},
+			},
+		},
+		{
+			name:       "large system truncated",
+			limit:      64,
+			dropSystem: true,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived.", Images: []api.ImageData{[]byte("scar")}},
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt: "You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. ",
+			},
+		},
+		{
+			name:       "oldest system truncated",
+			limit:      64,
+			dropSystem: true,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived.", Images: []api.ImageData{[]byte("scar")}},
+				{Role: "system", Content: "You are a wizard, Harry."},
+				{Role: "user", Content: "You're a test, Harry!", Images: []api.ImageData{[]byte("wand")}},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt: "You are a wizard, Harry. I-I'm a what? A test. And a thumping good one at that, I'd wager. ",
+			},
+		},
+		{
+			name:       "system fits",
+			limit:      2048,
+			dropSystem: true,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived.", Images: []api.ImageData{[]byte("scar")}},
+				{Role: "user", Content: "You're a test, Harry!"},
+			},
+			expect: expect{
+				prompt: "[img-0] You are the Test Who Lived. You're a test, Harry! ",
+				images: [][]byte{
+					[]byte("scar"),
+				},
+			},
+		},
+		{
+			name:  "unknown role",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "function", Content: "You're a test, Harry!"},
+			},
+			expect: expect{
+				error: errUnknownRole,
+			},
+		},
+		{
+			name:  "no messages",
+			limit: 2048,
+			expect: expect{
+				error: errNoMessages,
+			},
+		},
+		{
+			name:  "mixed case roles",
+			limit: 64,
+			msgs: []api.Message{
+				{Role: "User", Content: "You're a test, Harry!"},
+				{Role: "ASSISTANT", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt: "You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. ",
+			},
+		},
 		{
 			name:  "messages with interleaved images",
 			limit: 2048,
@@ -178,6 +394,17 @@ func TestChatPrompt(t *testing.T) {
 				prompt: "You're a test, Harry! I-I'm a what? You are the Test Who Lived. A test. And a thumping good one at that, I'd wager. ",
 			},
 		},
+		{
+			name:  "partial assistant message",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a", Partial: true},
+			},
+			expect: expect{
+				prompt: "You're a test, Harry! I-I'm a",
+			},
+		},
 	}
 
 	tmpl, err := template.Parse(`
@@ -191,10 +418,12 @@ func TestChatPrompt(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
-			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
-			prompt, images, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil)
-			if err != nil {
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, KeepSystem: !tt.dropSystem}
+			prompt, images, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil, nil, nil)
+			if tt.error == nil && err != nil {
 				t.Fatal(err)
+			} else if tt.error != nil && !errors.Is(err, tt.error) {
+				t.Fatalf("expected err '%q', got '%q'", tt.error, err)
 			}
 
 			if tt.prompt != prompt {
@@ -221,3 +450,984 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptRepeatSystem(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "S"},
+		{Role: "user", Content: "u1"},
+		{Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "u2"},
+		{Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"},
+		{Role: "assistant", Content: "a3"},
+		{Role: "user", Content: "u4"},
+	}
+
+	cases := []struct {
+		name  string
+		limit int
+		every int
+		msgs  []api.Message
+		want  string
+	}{
+		{
+			name:  "disabled",
+			limit: 2048,
+			msgs:  msgs,
+			want:  "system: S user: u1 assistant: a1 user: u2 assistant: a2 user: u3 assistant: a3 user: u4 ",
+		},
+		{
+			name:  "every turn",
+			limit: 2048,
+			every: 1,
+			msgs:  msgs,
+			want:  "system: S user: u1 assistant: a1 system: S user: u2 assistant: a2 system: S user: u3 assistant: a3 system: S user: u4 ",
+		},
+		{
+			name:  "every two turns",
+			limit: 2048,
+			every: 2,
+			msgs:  msgs,
+			want:  "system: S user: u1 assistant: a1 user: u2 assistant: a2 system: S user: u3 assistant: a3 user: u4 ",
+		},
+		{
+			name:  "no system",
+			limit: 2048,
+			every: 1,
+			msgs:  msgs[1:],
+			want:  "user: u1 assistant: a1 user: u2 assistant: a2 user: u3 assistant: a3 user: u4 ",
+		},
+		{
+			// the repeated system message doesn't fit so the first turn is truncated
+			name:  "truncate",
+			limit: 17,
+			every: 2,
+			msgs:  msgs,
+			want:  "system: S assistant: a1 user: u2 assistant: a2 user: u3 assistant: a3 system: S user: u4 ",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, RepeatSystemEvery: tt.every, KeepSystem: true}
+			prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptMinMessagesPerRole(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "zero"},
+		{Role: "user", Content: "one"},
+		{Role: "assistant", Content: "two"},
+		{Role: "user", Content: "three"},
+		{Role: "assistant", Content: "four"},
+		{Role: "user", Content: "five"},
+		{Role: "assistant", Content: "six"},
+		{Role: "user", Content: "seven"},
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		min    map[string]int
+		expect string
+		error  error
+	}{
+		{
+			name:   "no minimum",
+			limit:  8,
+			expect: "system: zero user: five assistant: six user: seven ",
+		},
+		{
+			name:   "assistant minimum",
+			limit:  8,
+			min:    map[string]int{"assistant": 2},
+			expect: "system: zero assistant: four\n\nsix user: seven ",
+		},
+		{
+			name:   "case insensitive",
+			limit:  8,
+			min:    map[string]int{"Assistant": 2},
+			expect: "system: zero assistant: four\n\nsix user: seven ",
+		},
+		{
+			name:   "minimum satisfied by latest messages",
+			limit:  8,
+			min:    map[string]int{"user": 1, "assistant": 1},
+			expect: "system: zero user: five assistant: six user: seven ",
+		},
+		{
+			name:   "more than available",
+			limit:  2048,
+			min:    map[string]int{"assistant": 10},
+			expect: "system: zero user: one assistant: two user: three assistant: four user: five assistant: six user: seven ",
+		},
+		{
+			name:  "impossible",
+			limit: 6,
+			min:   map[string]int{"assistant": 3},
+			error: ErrContextConstraintImpossible,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, MinMessagesPerRole: tt.min, KeepSystem: true}
+			prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+			if !errors.Is(err, tt.error) {
+				t.Fatalf("expected error %v, got %v", tt.error, err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptTruncateKeep(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "zero"},
+		{Role: "user", Content: "one"},
+		{Role: "assistant", Content: "two"},
+		{Role: "user", Content: "a b c d e f g h"},
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		keep   string
+		expect string
+	}{
+		{
+			name:   "head",
+			limit:  6,
+			keep:   "head",
+			expect: "system: zero user: a b c ",
+		},
+		{
+			name:   "tail",
+			limit:  6,
+			keep:   "tail",
+			expect: "system: zero user: f g h ",
+		},
+		{
+			name:   "fits",
+			limit:  2048,
+			keep:   "head",
+			expect: "system: zero user: one assistant: two user: a b c d e f g h ",
+		},
+		{
+			name:   "disabled",
+			limit:  6,
+			expect: "system: zero user: a b c d e f g h ",
+		},
+		{
+			name:   "nothing fits",
+			limit:  2,
+			keep:   "tail",
+			expect: "system: zero user: a b c d e f g h ",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, KeepSystem: true, TruncateKeep: tt.keep}
+			prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	if msgs[3].Content != "a b c d e f g h" {
+		t.Errorf("expected the messages passed in not to be modified, got %q", msgs[3].Content)
+	}
+}
+
+func TestMidSentenceEnd(t *testing.T) {
+	cases := []struct {
+		content  string
+		fragment string
+		ok       bool
+	}{
+		{"The sky is blue.", "", false},
+		{"Is the sky blue?  \n", "", false},
+		{`He said "stop!"`, "", false},
+		{"(see above.)", "", false},
+		{"空は青い。", "", false},
+		{"", "", false},
+		{"a b c", "a b c", true},
+		{"The quick brown fox jumps over the lazy dog and", " fox jumps over the lazy dog and", true},
+		{"Rayleigh scattering of sunlight in the atmos ", "ttering of sunlight in the atmos", true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.content, func(t *testing.T) {
+			fragment, ok := midSentenceEnd(tt.content)
+			if ok != tt.ok || fragment != tt.fragment {
+				t.Errorf("expected %q, %v, got %q, %v", tt.fragment, tt.ok, fragment, ok)
+			}
+		})
+	}
+}
+
+func TestChatPromptTemplateExecutionError(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		expect   TemplateExecutionError
+	}{
+		{
+			name:     "missing field",
+			template: "{{- range .Messages }}\n{{ .Foo.Bar }}{{ end }}",
+			expect:   TemplateExecutionError{Template: "test", Line: 2, Node: ".Foo.Bar"},
+		},
+		{
+			name:     "index out of range",
+			template: "{{ index .Messages 5 }}",
+			expect:   TemplateExecutionError{Template: "test", Line: 1, Node: "index .Messages 5"},
+		},
+		{
+			name:     "defined template",
+			template: `{{ define "turn" }}{{ .Foo }}{{ end }}{{ range .Messages }}{{ template "turn" . }}{{ end }}`,
+			expect:   TemplateExecutionError{Template: "turn", Line: 1, Node: ".Foo"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			model := Model{Template: tmpl, ShortName: "test"}
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+			_, _, _, _, err = chatPrompt(context.TODO(), &model, tokenize, &opts, []api.Message{{Role: "user", Content: "Hello!"}}, nil, nil, nil)
+
+			var execErr *TemplateExecutionError
+			if !errors.As(err, &execErr) {
+				t.Fatalf("expected TemplateExecutionError, got %v", err)
+			}
+
+			if execErr.Reason == "" {
+				t.Error("expected reason")
+			}
+
+			if diff := cmp.Diff(*execErr, tt.expect, cmpopts.IgnoreFields(TemplateExecutionError{}, "Reason", "Err")); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptTokenizeError(t *testing.T) {
+	errInvalidToken := errors.New("invalid token")
+
+	// failOn returns a tokenizer which fails on any text containing bad
+	failOn := func(bad string) tokenizeFunc {
+		return func(ctx context.Context, s string) ([]int, error) {
+			if strings.Contains(s, bad) {
+				return nil, errInvalidToken
+			}
+
+			return tokenize(ctx, s)
+		}
+	}
+
+	var call api.ToolCall
+	call.Function.Name = "get_weather"
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a weather bot."},
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		{Role: "tool", Content: "15 degrees <bad-tool>"},
+		{Role: "assistant", Content: "It's 15 degrees. <bad-assistant>"},
+		{Role: "user", Content: "Thanks!"},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		tokenize tokenizeFunc
+		expect   *TokenizeError
+	}{
+		{
+			name:     "assistant",
+			template: "{{ range .Messages }}{{ .Content }} {{ end }}",
+			tokenize: failOn("<bad-assistant>"),
+			expect:   &TokenizeError{Index: 4, Role: "assistant"},
+		},
+		{
+			name:     "tool",
+			template: "{{ range .Messages }}{{ .Content }} {{ end }}",
+			tokenize: failOn("<bad-tool>"),
+			expect:   &TokenizeError{Index: 3, Role: "tool"},
+		},
+		{
+			name:     "tool results",
+			template: "{{ range .Messages }}{{ .Content }} {{ range .ToolResults }}{{ . }} {{ end }}{{ end }}",
+			tokenize: failOn("<bad-tool>"),
+			expect:   &TokenizeError{Index: 3, Role: "tool"},
+		},
+		{
+			name:     "template text",
+			template: "<bad-template> {{ range .Messages }}{{ .Content }} {{ end }}",
+			tokenize: failOn("<bad-template>"),
+		},
+		{
+			name:     "broken tokenizer",
+			template: "{{ range .Messages }}{{ .Content }} {{ end }}",
+			tokenize: func(context.Context, string) ([]int, error) { return nil, errInvalidToken },
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+			_, _, _, _, err = chatPrompt(context.TODO(), &model, tt.tokenize, &opts, msgs, nil, nil, nil)
+			if !errors.Is(err, errInvalidToken) {
+				t.Fatalf("expected invalid token error, got %v", err)
+			}
+
+			var tokenizeErr *TokenizeError
+			if tt.expect == nil {
+				if errors.As(err, &tokenizeErr) {
+					t.Fatalf("expected error not to identify a message, got %v", err)
+				}
+				return
+			}
+
+			if !errors.As(err, &tokenizeErr) {
+				t.Fatalf("expected TokenizeError, got %v", err)
+			}
+
+			if diff := cmp.Diff(tokenizeErr, tt.expect, cmpopts.IgnoreFields(TokenizeError{}, "Err")); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptHasTools(t *testing.T) {
+	tmpl, err := template.Parse(`{{- if .HasTools }}tools: {{ json .Tools }} {{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tool api.Tool
+	tool.Type = "function"
+	tool.Function.Name = "get_weather"
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+	msgs := []api.Message{{Role: "user", Content: "What's the weather?"}}
+
+	prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(prompt, "What's the weather?"); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	prompt, _, _, _, err = chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, []api.Tool{tool}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(prompt, `tools: [{"type":"function","function":{"name":"get_weather"`) {
+		t.Errorf("expected tool instructions, got %q", prompt)
+	}
+}
+
+func TestChatPromptIsFirstTurn(t *testing.T) {
+	tmpl, err := template.Parse(`{{- if .IsFirstTurn }}example: Q A {{ end }}{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		msgs   []api.Message
+		expect string
+	}{
+		{
+			name:   "first turn",
+			limit:  2048,
+			msgs:   []api.Message{{Role: "user", Content: "one"}},
+			expect: "example: Q A user: one ",
+		},
+		{
+			name:  "after response",
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "one"},
+				{Role: "assistant", Content: "two"},
+				{Role: "user", Content: "three"},
+			},
+			expect: "user: one assistant: two user: three ",
+		},
+		{
+			name:  "response truncated",
+			limit: 5,
+			msgs: []api.Message{
+				{Role: "user", Content: "one"},
+				{Role: "assistant", Content: "two three four five six"},
+				{Role: "user", Content: "seven."},
+			},
+			expect: "example: Q A user: seven. ",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSystem(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are the Test Who Lived."},
+		{Role: "user", Content: "one"},
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "two"},
+	}
+
+	cases := []struct {
+		name       string
+		limit      int
+		keepSystem bool
+		expect     string
+	}{
+		{"fits", 2048, true, "You are the Test Who Lived.\n\nYou are a wizard."},
+		{"truncated messages", 14, true, "You are the Test Who Lived.\n\nYou are a wizard."},
+		{"truncated system", 7, false, "You are a wizard."},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, KeepSystem: tt.keepSystem}
+			_, _, system, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(system, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+	if _, _, system, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs[3:], nil, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if system != "" {
+		t.Errorf("expected no system prompt, got %q", system)
+	}
+}
+
+func TestChatPromptTruncatedTokens(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the prompt of every message is 13 tokens
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five"},
+		{Role: "user", Content: "six seven"},
+	}
+
+	cases := []struct {
+		name         string
+		limit        int
+		keepSystem   bool
+		truncateKeep string
+		expect       int
+	}{
+		{"fits", 2048, true, "", 0},
+		{"truncated message", 9, true, "", 4},
+		{"truncated messages", 6, true, "", 7},
+		{"truncated system", 3, false, "", 10},
+		{"truncated content", 5, true, "head", 8},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, KeepSystem: tt.keepSystem, TruncateKeep: tt.truncateKeep}
+			prompt, _, _, truncated, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if truncated != tt.expect {
+				t.Errorf("expected %d truncated tokens, got %d", tt.expect, truncated)
+			}
+
+			if kept, _ := tokenize(context.TODO(), prompt); len(kept)+truncated != 13 {
+				t.Errorf("expected the %d kept and %d truncated tokens to add up to 13: %q", len(kept), truncated, prompt)
+			}
+		})
+	}
+}
+
+func TestChatPromptMetrics(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "one two three", Images: []api.ImageData{[]byte("something")}},
+		{Role: "assistant", Content: "four five"},
+		{Role: "user", Content: "six seven"},
+	}
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 3}}
+
+	truncated, dropped := promptMessagesTruncated.Value(), promptImagesDropped.Value()
+	if _, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := promptMessagesTruncated.Value() - truncated; n != 2 {
+		t.Errorf("expected 2 truncated messages, got %d", n)
+	}
+
+	if n := promptImagesDropped.Value() - dropped; n != 1 {
+		t.Errorf("expected 1 dropped image, got %d", n)
+	}
+}
+
+func TestChatPromptSummarize(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+		{Role: "user", Content: "seven eight nine"},
+	}
+
+	var summarized [][]api.Message
+	summarize := func(_ context.Context, msgs []api.Message) (api.Message, error) {
+		summarized = append(summarized, msgs)
+		return api.Message{Role: "system", Content: fmt.Sprintf("%d summarized.", len(msgs))}, nil
+	}
+
+	cases := []struct {
+		name       string
+		limit      int
+		expect     string
+		summarized [][]api.Message
+	}{
+		{
+			name:   "fits",
+			limit:  2048,
+			expect: "system: Be brief. user: one two three assistant: four five six user: seven eight nine ",
+		},
+		{
+			name:       "summarized",
+			limit:      13,
+			expect:     "system: Be brief.\n\n1 summarized. assistant: four five six user: seven eight nine ",
+			summarized: [][]api.Message{msgs[1:2]},
+		},
+		{
+			name:       "summarized together",
+			limit:      9,
+			expect:     "system: Be brief.\n\n2 summarized. user: seven eight nine ",
+			summarized: [][]api.Message{msgs[1:3]},
+		},
+		{
+			// the first summary doesn't fit with the messages after it
+			name:       "summarized again",
+			limit:      12,
+			expect:     "system: Be brief.\n\n1 summarized.\n\n1 summarized. user: seven eight nine ",
+			summarized: [][]api.Message{msgs[1:2], msgs[2:3]},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			summarized = nil
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, KeepSystem: true}
+			prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, summarize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(summarized, tt.summarized); diff != "" {
+				t.Errorf("summarized mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 12}, KeepSystem: true}
+		_, _, _, _, err := chatPrompt(ctx, &model, tokenize, &opts, msgs, nil, nil, func(ctx context.Context, _ []api.Message) (api.Message, error) {
+			return api.Message{}, ctx.Err()
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("not system", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 12}, KeepSystem: true}
+		_, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, func(context.Context, []api.Message) (api.Message, error) {
+			return api.Message{Role: "user", Content: "Summary."}, nil
+		})
+		if !errors.Is(err, errSummaryRole) {
+			t.Errorf("expected %v, got %v", errSummaryRole, err)
+		}
+	})
+}
+
+func TestChatPromptConcurrent(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
+
+	const n = 50
+	msgs := make([][]api.Message, n)
+	expect := make([]string, n)
+	for i := range n {
+		msgs[i] = []api.Message{
+			{Role: "system", Content: "You are the Test Who Lived."},
+			{Role: "user", Content: fmt.Sprintf("Test %d?", i)},
+			{Role: "assistant", Content: strings.Repeat("yes ", i)},
+			{Role: "user", Content: "And this?", Images: []api.ImageData{[]byte(fmt.Sprintf("image %d", i))}},
+		}
+
+		// odd chats have a smaller context window, which truncates the longer ones
+		opts := api.Options{Runner: api.Runner{NumCtx: 2048 - i%2*1248}, KeepSystem: true}
+		prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs[i], nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect[i] = prompt
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	prompts := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048 - i%2*1248}, KeepSystem: true}
+			prompts[i], _, _, _, errs[i] = chatPrompt(context.TODO(), &model, tokenize, &opts, msgs[i], nil, nil, nil)
+		}()
+	}
+	wg.Wait()
+
+	for i := range n {
+		if errs[i] != nil {
+			t.Errorf("chat %d: %v", i, errs[i])
+		} else if prompts[i] != expect[i] {
+			t.Errorf("chat %d: expected %q, got %q", i, expect[i], prompts[i])
+		}
+	}
+}
+
+func TestChatPromptResizeImages(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(t *testing.T, width, height int, encode func(io.Writer, image.Image) error) []byte {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := encode(&b, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes()
+	}
+
+	jpg := func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) }
+
+	model := Model{Template: tmpl}
+
+	cases := []struct {
+		name          string
+		image         []byte
+		maxSide       int
+		width, height int
+		unchanged     bool
+		error         error
+	}{
+		{name: "disabled", image: encode(t, 200, 100, png.Encode), unchanged: true},
+		{name: "landscape", image: encode(t, 200, 100, png.Encode), maxSide: 50, width: 50, height: 25},
+		{name: "portrait", image: encode(t, 100, 200, jpg), maxSide: 50, width: 25, height: 50},
+		{name: "small png", image: encode(t, 20, 10, png.Encode), maxSide: 50, width: 20, height: 10},
+		{name: "small jpeg", image: encode(t, 20, 10, jpg), maxSide: 50, unchanged: true},
+		{name: "invalid", image: []byte("image"), maxSide: 50, error: errInvalidImage},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}, ImageMaxSide: tt.maxSide}
+			original := bytes.Clone(tt.image)
+			msgs := []api.Message{{Role: "user", Content: "What's in this image?", Images: []api.ImageData{tt.image}}}
+
+			_, images, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+			if !errors.Is(err, tt.error) {
+				t.Fatalf("expected error %v, got %v", tt.error, err)
+			} else if err != nil {
+				return
+			}
+
+			if !bytes.Equal(msgs[0].Images[0], original) {
+				t.Error("expected message image to be unchanged")
+			}
+
+			if tt.unchanged {
+				if !bytes.Equal(images[0].Data, original) {
+					t.Error("expected image to be unchanged")
+				}
+				return
+			}
+
+			config, format, err := image.DecodeConfig(bytes.NewReader(images[0].Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if format != "jpeg" || config.Width != tt.width || config.Height != tt.height {
+				t.Errorf("expected %dx%d jpeg, got %dx%d %s", tt.width, tt.height, config.Width, config.Height, format)
+			}
+		})
+	}
+}
+
+func TestCheckImages(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ .Content }}|{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := Model{Template: tmpl}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := b.Bytes()
+	truncated := valid[:len(valid)/2]
+	corrupt := []byte("not an image")
+
+	msgs := []api.Message{
+		{Role: "user", Content: "a [img] b [img] c", Images: []api.ImageData{corrupt, valid}},
+		{Role: "assistant", Content: "ok"},
+		{Role: "user", Content: "[img] d [img]", Images: []api.ImageData{valid, truncated}},
+	}
+
+	cases := []struct {
+		name     string
+		policy   string
+		prompt   string
+		images   [][]byte
+		warnings int
+		error    error
+	}{
+		{name: "unset", prompt: "a [img-0] b [img-1] c|ok|[img-2] d [img-3]|", images: [][]byte{corrupt, valid, valid, truncated}},
+		{name: "skip", policy: "skip", prompt: "a  b [img-0] c|ok|[img-1] d |", images: [][]byte{valid, valid}, warnings: 2},
+		{name: "fail", policy: "fail", error: errInvalidImage},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			checked, warnings, err := checkImages(msgs, tt.policy)
+			if !errors.Is(err, tt.error) {
+				t.Fatalf("expected error %v, got %v", tt.error, err)
+			} else if err != nil {
+				return
+			}
+
+			if len(warnings) != tt.warnings {
+				t.Errorf("expected %d warnings, got %v", tt.warnings, warnings)
+			}
+
+			if len(msgs[0].Images) != 2 || msgs[0].Content != "a [img] b [img] c" {
+				t.Error("expected messages to be unchanged")
+			}
+
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+			prompt, images, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, checked, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if prompt != tt.prompt {
+				t.Errorf("expected prompt %q, got %q", tt.prompt, prompt)
+			}
+
+			if len(images) != len(tt.images) {
+				t.Fatalf("expected %d images, got %d", len(tt.images), len(images))
+			}
+
+			for i, image := range images {
+				if image.ID != i || !bytes.Equal(image.Data, tt.images[i]) {
+					t.Errorf("image %d: expected ID %d and matching data, got ID %d", i, i, image.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalesceToolRounds(t *testing.T) {
+	var call api.ToolCall
+	call.Function.Name = "get_weather"
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's the weather in Paris and London?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call, call}},
+		{Role: "tool", Content: "15 degrees"},
+		{Role: "tool", Content: "12 degrees"},
+		{Role: "assistant", Content: "It's 15 degrees in Paris and 12 degrees in London."},
+		{Role: "tool", Content: "unexpected"},
+	}
+
+	expect := []api.Message{
+		{Role: "user", Content: "What's the weather in Paris and London?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call, call}, ToolResults: []string{"15 degrees", "12 degrees"}},
+		{Role: "assistant", Content: "It's 15 degrees in Paris and 12 degrees in London."},
+		{Role: "tool", Content: "unexpected"},
+	}
+
+	if diff := cmp.Diff(CoalesceToolRounds(msgs), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	t.Run("chat prompt", func(t *testing.T) {
+		msgs := []api.Message{
+			{Role: "user", Content: "What's the weather in Paris and London?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{call, call}},
+			{Role: "tool", Content: "15 degrees"},
+			{Role: "tool", Content: "12 degrees"},
+			{Role: "user", Content: "Thanks!"},
+		}
+
+		cases := []struct {
+			name     string
+			template string
+			expect   string
+		}{
+			{
+				name:     "coalesced",
+				template: `{{- range .Messages }}[{{ .Role }}]{{ .Content }}{{ range .ToolCalls }}<call>{{ .Function.Name }}{{ end }}{{ range .ToolResults }}<result>{{ . }}{{ end }}{{ end }}`,
+				expect:   "[user]What's the weather in Paris and London?[assistant]<call>get_weather<call>get_weather<result>15 degrees<result>12 degrees[user]Thanks!",
+			},
+			{
+				name:     "separate",
+				template: `{{- range .Messages }}[{{ .Role }}]{{ .Content }}{{ range .ToolCalls }}<call>{{ .Function.Name }}{{ end }}{{ end }}`,
+				expect:   "[user]What's the weather in Paris and London?[assistant]<call>get_weather<call>get_weather[tool]15 degrees\n\n12 degrees[user]Thanks!",
+			},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				tmpl, err := template.Parse(tt.template)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				model := Model{Template: tmpl}
+				opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+				prompt, _, _, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
+}
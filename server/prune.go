@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// pruneSummaryPrompt asks the model to summarize part of a conversation. The
+// transcript of the messages follows it
+const pruneSummaryPrompt = "Summarize the following conversation in a few sentences. Keep names, facts, decisions and open questions that later messages may rely on. Reply with the summary only.\n\n"
+
+// pruneSummaryPrefix starts the content of the message replacing summarized messages
+const pruneSummaryPrefix = "Summary of the earlier conversation:\n"
+
+// pruneContext shortens msgs until their prompt is at most target tokens by
+// having the model summarize the oldest messages, half of the remaining ones
+// at a time. The summary replaces the messages as a system message and is
+// summarized again with the next batch. System messages and the latest
+// message are kept as is, so the prompt may still exceed target. It returns
+// the pruned messages and the number of tokens in their prompt
+func pruneContext(ctx context.Context, m *Model, r llm.LlamaServer, opts *api.Options, msgs []api.Message, target int) ([]api.Message, int, error) {
+	msgs = slices.Clone(msgs)
+
+	count := func(msgs []api.Message) (int, error) {
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{Messages: msgs, IsFirstTurn: isFirstTurn(msgs)}); err != nil {
+			return 0, newTemplateExecutionError(m, err)
+		}
+
+		tokens, err := r.Tokenize(ctx, b.String())
+		if err != nil {
+			return 0, err
+		}
+
+		return len(tokens), nil
+	}
+
+	// summary is the index of the summary in msgs
+	summary := -1
+	for {
+		n, err := count(msgs)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if n <= target {
+			return msgs, n, nil
+		}
+
+		// the previous summary and the messages after it can be summarized
+		var batch []int
+		for i, msg := range msgs[:len(msgs)-1] {
+			if i == summary || msg.Role != "system" {
+				batch = append(batch, i)
+			}
+		}
+
+		if len(batch) == 0 || len(batch) == 1 && batch[0] == summary {
+			return msgs, n, nil
+		}
+
+		// the batch includes at least one message besides the previous summary
+		batch = batch[:max((len(batch)+1)/2, min(2, len(batch)))]
+
+		var transcript strings.Builder
+		for _, i := range batch {
+			fmt.Fprintf(&transcript, "%s: %s\n\n", msgs[i].Role, msgs[i].Content)
+		}
+
+		content, err := pruneSummarize(ctx, m, r, opts, transcript.String(), target)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		pruned := slices.Clone(msgs[:batch[0]])
+		pruned = append(pruned, api.Message{Role: "system", Content: pruneSummaryPrefix + content})
+		for i := batch[0] + 1; i < len(msgs); i++ {
+			if !slices.Contains(batch, i) {
+				pruned = append(pruned, msgs[i])
+			}
+		}
+
+		msgs, summary = pruned, batch[0]
+	}
+}
+
+// summarizer returns a SummarizeFunc which has the model of runner r summarize
+// messages like pruneContext, in at most an eighth of the context window
+func summarizer(m *Model, r llm.LlamaServer, opts *api.Options) SummarizeFunc {
+	return func(ctx context.Context, msgs []api.Message) (api.Message, error) {
+		var transcript strings.Builder
+		for _, msg := range msgs {
+			fmt.Fprintf(&transcript, "%s: %s\n\n", msg.Role, msg.Content)
+		}
+
+		content, err := pruneSummarize(ctx, m, r, opts, transcript.String(), opts.NumCtx/4)
+		if err != nil {
+			return api.Message{}, err
+		}
+
+		return api.Message{Role: "system", Content: pruneSummaryPrefix + content}, nil
+	}
+}
+
+// pruneSummarize has the model summarize transcript in at most half of target tokens
+func pruneSummarize(ctx context.Context, m *Model, r llm.LlamaServer, opts *api.Options, transcript string, target int) (string, error) {
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: []api.Message{{Role: "user", Content: pruneSummaryPrompt + transcript}}}); err != nil {
+		return "", newTemplateExecutionError(m, err)
+	}
+
+	// the runner may modify the options so the summary gets a copy
+	summaryOpts := *opts
+	summaryOpts.NumPredict = max(target/2, 1)
+	resolveSeed(&summaryOpts)
+
+	var sb strings.Builder
+	if err := r.Completion(ctx, llm.CompletionRequest{
+		Prompt:  b.String(),
+		Options: &summaryOpts,
+	}, func(cr llm.CompletionResponse) {
+		sb.WriteString(cr.Content)
+	}); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
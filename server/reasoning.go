@@ -0,0 +1,93 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	reasoningStart = "<think>"
+	reasoningEnd   = "</think>"
+)
+
+type reasoningState int
+
+const (
+	reasoningPending reasoningState = iota
+	reasoningStarted
+	reasoningDone
+)
+
+// reasoningParser separates the reasoning at the start of a response, between
+// reasoningStart and reasoningEnd, from the rest of the response and splits it
+// into steps separated by blank lines. Responses which don't start with
+// reasoningStart are passed through as is
+type reasoningParser struct {
+	state reasoningState
+	buf   string
+	steps int
+}
+
+// add adds the next chunk s of the response and returns the reasoning steps it
+// completed and the content after the reasoning. done flushes any incomplete
+// step at the end of the response
+func (p *reasoningParser) add(s string, done bool) (steps []api.ReasoningStep, content string) {
+	switch p.state {
+	case reasoningDone:
+		return nil, s
+	case reasoningPending:
+		p.buf += s
+		trimmed := strings.TrimLeft(p.buf, " \t\r\n")
+		switch {
+		case strings.HasPrefix(trimmed, reasoningStart):
+			p.state = reasoningStarted
+			p.buf = trimmed[len(reasoningStart):]
+		case strings.HasPrefix(reasoningStart, trimmed) && !done:
+			// wait for the rest of the tag
+			return nil, ""
+		default:
+			p.state = reasoningDone
+			content, p.buf = p.buf, ""
+			return nil, content
+		}
+	default:
+		p.buf += s
+	}
+
+	reasoning, rest, ended := strings.Cut(p.buf, reasoningEnd)
+	for {
+		step, after, ok := strings.Cut(reasoning, "\n\n")
+		if !ok {
+			break
+		}
+
+		steps = p.appendStep(steps, step)
+		reasoning = after
+	}
+
+	if ended {
+		p.state = reasoningDone
+		p.buf = ""
+		return p.appendStep(steps, reasoning), strings.TrimLeft(rest, " \t\r\n")
+	}
+
+	p.buf = reasoning
+	if done {
+		steps = p.appendStep(steps, p.buf)
+		p.buf = ""
+	}
+
+	return steps, ""
+}
+
+func (p *reasoningParser) appendStep(steps []api.ReasoningStep, s string) []api.ReasoningStep {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return steps
+	}
+
+	steps = append(steps, api.ReasoningStep{Index: p.steps, Content: s})
+	p.steps++
+	return steps
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestReasoningParser(t *testing.T) {
+	cases := []struct {
+		name    string
+		chunks  []string
+		steps   []api.ReasoningStep
+		content string
+	}{
+		{
+			name:    "steps",
+			chunks:  []string{"<think>First, add 2 and 2.\n\nThen check the sum.</think>\n\nThe answer is 4."},
+			steps:   []api.ReasoningStep{{Index: 0, Content: "First, add 2 and 2."}, {Index: 1, Content: "Then check the sum."}},
+			content: "The answer is 4.",
+		},
+		{
+			name:    "split tags",
+			chunks:  []string{"\n<th", "ink>First", ", add 2 and 2.\n", "\nThen check", " the sum.</th", "ink>The answer", " is 4."},
+			steps:   []api.ReasoningStep{{Index: 0, Content: "First, add 2 and 2."}, {Index: 1, Content: "Then check the sum."}},
+			content: "The answer is 4.",
+		},
+		{
+			name:    "empty steps",
+			chunks:  []string{"<think>\n\n\n\nOnly step\n\n</think>Done"},
+			steps:   []api.ReasoningStep{{Index: 0, Content: "Only step"}},
+			content: "Done",
+		},
+		{
+			name:    "no reasoning",
+			chunks:  []string{"The answer", " is <think>4</think>."},
+			content: "The answer is <think>4</think>.",
+		},
+		{
+			name:    "partial tag",
+			chunks:  []string{"<thi"},
+			content: "<thi",
+		},
+		{
+			name:   "unterminated",
+			chunks: []string{"<think>First, add 2 and 2.\n\nThen"},
+			steps:  []api.ReasoningStep{{Index: 0, Content: "First, add 2 and 2."}, {Index: 1, Content: "Then"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var p reasoningParser
+			var steps []api.ReasoningStep
+			var content string
+			for i, chunk := range tt.chunks {
+				s, c := p.add(chunk, i == len(tt.chunks)-1)
+				steps = append(steps, s...)
+				content += c
+			}
+
+			if diff := cmp.Diff(tt.steps, steps); diff != "" {
+				t.Errorf("steps mismatch (-want +got):\n%s", diff)
+			}
+
+			if content != tt.content {
+				t.Errorf("expected content %q, got %q", tt.content, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ollama/ollama/api"
+)
+
+// activeRequests tracks in flight streaming requests so they can be listed
+// with /api/requests and stopped with /api/stop. The zero value is ready to use
+type activeRequests struct {
+	mu       sync.Mutex
+	requests map[string]*activeRequest
+}
+
+type activeRequest struct {
+	model       string
+	submittedAt time.Time
+	running     bool
+	cancel      context.CancelFunc
+}
+
+// add returns a context derived from ctx which is canceled when the request
+// is stopped and the ID to stop it with. The request is queued until start is
+// called. done must be called once the request has finished
+func (r *activeRequests) add(ctx context.Context, model string) (context.Context, string, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	id := uuid.New().String()
+
+	r.mu.Lock()
+	if r.requests == nil {
+		r.requests = make(map[string]*activeRequest)
+	}
+	r.requests[id] = &activeRequest{model: model, submittedAt: time.Now(), cancel: cancel}
+	r.mu.Unlock()
+
+	return ctx, id, func() {
+		r.mu.Lock()
+		delete(r.requests, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// start marks the request with the given ID as running, i.e. it has a runner
+func (r *activeRequests) start(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req, ok := r.requests[id]; ok {
+		req.running = true
+	}
+}
+
+// list returns the active requests, oldest first
+func (r *activeRequests) list() []api.ActiveRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reqs := make([]api.ActiveRequest, 0, len(r.requests))
+	for id, req := range r.requests {
+		status := "queued"
+		if req.running {
+			status = "running"
+		}
+
+		reqs = append(reqs, api.ActiveRequest{
+			RequestID:   id,
+			Model:       req.model,
+			Status:      status,
+			SubmittedAt: req.submittedAt,
+		})
+	}
+
+	slices.SortFunc(reqs, func(a, b api.ActiveRequest) int {
+		return a.SubmittedAt.Compare(b.SubmittedAt)
+	})
+
+	return reqs
+}
+
+// stop cancels the request with the given ID. It reports false if the request
+// is unknown or has already finished
+func (r *activeRequests) stop(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	req, ok := r.requests[id]
+	if !ok {
+		return false
+	}
+
+	delete(r.requests, id)
+	req.cancel()
+	return true
+}
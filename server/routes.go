@@ -4,30 +4,40 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/metrics"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/template"
@@ -39,8 +49,14 @@ import (
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr        net.Addr
+	sched       *Scheduler
+	requests    activeRequests
+	completions completionGroup
+	sessions    sessionStore
+
+	// processor filters the text of generate and chat responses
+	processor *ResponseProcessor
 }
 
 func init() {
@@ -57,38 +73,183 @@ func init() {
 
 var errRequired = errors.New("is required")
 
-func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
+var errStopTokens = errors.New("stop_tokens")
+
+// modelOptions resolves the options of a request for model from the defaults,
+// the model's options and requestOpts. It returns warnings describing options
+// which were ignored or clamped
+func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, []string, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
-		return api.Options{}, err
+		return api.Options{}, nil, err
 	}
 
 	if err := opts.FromMap(requestOpts); err != nil {
-		return api.Options{}, err
+		return api.Options{}, nil, err
+	}
+
+	var warnings []string
+	requested := func(key string) bool {
+		_, ok := requestOpts[key]
+		return ok
+	}
+
+	keys := make([]string, 0, len(requestOpts))
+	for key := range requestOpts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if !optionNames()[key] {
+			warnings = append(warnings, fmt.Sprintf("unknown option %q ignored", key))
+		}
+	}
+
+	var kv llm.KV
+	kvData := func() (llm.KV, error) {
+		if kv == nil {
+			var err error
+			if kv, err = getKVData(model.ModelPath, false); err != nil {
+				return nil, err
+			}
+		}
+
+		return kv, nil
+	}
+
+	if opts.NumCtxFraction != 0 {
+		if opts.NumCtxFraction < 0 || opts.NumCtxFraction > 1 {
+			return api.Options{}, nil, fmt.Errorf("num_ctx_fraction must be between 0 and 1, got %v", opts.NumCtxFraction)
+		}
+
+		_, modelNumCtx := model.Options["num_ctx"]
+		if !modelNumCtx && !requested("num_ctx") {
+			kv, err := kvData()
+			if err != nil {
+				return api.Options{}, nil, err
+			}
+
+			opts.NumCtx = int(math.Round(float64(kv.ContextLength()) * opts.NumCtxFraction))
+		} else if requested("num_ctx_fraction") {
+			warnings = append(warnings, fmt.Sprintf("num_ctx_fraction ignored because num_ctx is set to %d", opts.NumCtx))
+		}
+	}
+
+	if opts.NumCache < 0 {
+		return api.Options{}, nil, fmt.Errorf("num_cache must not be negative, got %d", opts.NumCache)
+	} else if opts.NumCache > 0 && opts.NumCtx > opts.NumCache {
+		if requested("num_ctx") || requested("num_ctx_fraction") {
+			warnings = append(warnings, fmt.Sprintf("num_ctx clamped to %d (num_cache is %d)", opts.NumCache, opts.NumCache))
+		}
+
+		opts.NumCtx = opts.NumCache
+	}
+
+	if opts.TruncateKeep != "" && opts.TruncateKeep != "head" && opts.TruncateKeep != "tail" {
+		return api.Options{}, nil, fmt.Errorf("truncate_keep must be \"head\" or \"tail\", got %q", opts.TruncateKeep)
+	}
+
+	if !slices.Contains([]string{"", "error", "ignore", "prefill"}, opts.TrailingAssistant) {
+		return api.Options{}, nil, fmt.Errorf("trailing_assistant must be \"error\", \"ignore\" or \"prefill\", got %q", opts.TrailingAssistant)
+	}
+
+	if !slices.Contains([]string{"", "fail", "skip"}, opts.ImageErrors) {
+		return api.Options{}, nil, fmt.Errorf("image_errors must be \"fail\" or \"skip\", got %q", opts.ImageErrors)
+	}
+
+	if int64(opts.Seed) > maxSeed {
+		return api.Options{}, nil, fmt.Errorf("seed must be at most %d, got %d", maxSeed, opts.Seed)
+	}
+
+	if opts.NumGPU > 0 {
+		kv, err := kvData()
+		if err != nil {
+			return api.Options{}, nil, err
+		}
+
+		// the output layer is offloaded in addition to the repeating layers
+		if layers := int(kv.BlockCount()) + 1; opts.NumGPU > layers {
+			warnings = append(warnings, fmt.Sprintf("num_gpu clamped to %d (model has %d layers)", layers, layers))
+			opts.NumGPU = layers
+		}
+	}
+
+	ids := make([]int, 0, len(opts.LogitBias))
+	for id := range opts.LogitBias {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if bias := opts.LogitBias[id]; bias < -100 || bias > 100 {
+			clamped := min(max(bias, -100), 100)
+			warnings = append(warnings, fmt.Sprintf("logit_bias for token %d clamped to %v", id, clamped))
+			opts.LogitBias[id] = clamped
+		}
+	}
+
+	switch opts.Mirostat {
+	case 0:
+		for _, key := range []string{"mirostat_tau", "mirostat_eta"} {
+			if requested(key) {
+				warnings = append(warnings, fmt.Sprintf("%s ignored because mirostat is disabled", key))
+			}
+		}
+	case 1, 2:
+	default:
+		warnings = append(warnings, fmt.Sprintf("mirostat %d ignored (must be 0, 1 or 2)", opts.Mirostat))
+		opts.Mirostat = 0
 	}
 
-	return opts, nil
+	return opts, warnings, nil
 }
 
+// optionNames are the JSON names of the fields of api.Options
+var optionNames = sync.OnceValue(func() map[string]bool {
+	names := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(api.Options{})) {
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+			names[name] = true
+		}
+	}
+
+	return names
+})
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
-// It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// It returns the allocated runner, model instance, consolidated options and warnings about ignored or clamped
+// options if successful and error otherwise.
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, []string, error) {
 	if name == "" {
-		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
+		return nil, nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
 
 	model, err := GetModel(name)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	if err := model.CheckCapabilities(caps...); err != nil {
-		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
+		return nil, nil, nil, nil, fmt.Errorf("%s %w", name, err)
 	}
 
-	opts, err := modelOptions(model, requestOpts)
+	opts, warnings, err := modelOptions(model, requestOpts)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
+	}
+
+	// stop tokens are checked before a runner slot is taken so invalid ones
+	// aren't mistaken for a runner failure
+	if len(opts.StopTokens) > 0 {
+		kv, err := getKVData(model.ModelPath, false)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		if err := llm.ValidateTokens(opts.StopTokens, kv.VocabSize()); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%w: %w", errStopTokens, err)
+		}
 	}
 
 	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
@@ -96,10 +257,50 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 	select {
 	case runner = <-runnerCh:
 	case err = <-errCh:
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
+	case <-ctx.Done():
+		// canceled requests which are still queued are dropped by the
+		// scheduler without a response
+		return nil, nil, nil, nil, ctx.Err()
+	}
+
+	return runner.llama, model, &opts, warnings, nil
+}
+
+// withTimeout returns a context derived from ctx which is canceled once
+// timeout has passed. Without a positive timeout it's only canceled by cancel
+func withTimeout(ctx context.Context, timeout *api.Duration) (context.Context, context.CancelFunc) {
+	if timeout == nil || timeout.Duration <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout.Duration)
+}
+
+// timedOut reports whether err was caused by the timeout of ctx
+func timedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// maxSeed is the largest seed the runner samples with. Its sampler seeds are 32
+// bit and the largest, 0xFFFFFFFF, picks a random seed, so larger seeds would
+// be truncated or not reproduce the response
+const maxSeed int64 = math.MaxUint32 - 1
+
+// deterministicSeed replaces random seeds when OLLAMA_DETERMINISTIC is set
+const deterministicSeed = 42
+
+// resolveSeed replaces a random seed (-1) in opts with a concrete one so it can
+// be returned to the client. Replaying a request with the returned seed and the
+// same prompt and options reproduces its output.
+func resolveSeed(opts *api.Options) int {
+	if opts.Seed < 0 && envconfig.Deterministic {
+		opts.Seed = deterministicSeed
+	} else if opts.Seed < 0 {
+		opts.Seed = rand.Intn(math.MaxInt32)
 	}
 
-	return runner.llama, model, &opts, nil
+	return opts.Seed
 }
 
 func (s *Server) GenerateHandler(c *gin.Context) {
@@ -116,40 +317,138 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	if req.Format != "" && req.Format != "json" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
 		return
+	} else if req.Format != "" && req.Grammar != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format and grammar can't both be set"})
+		return
 	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
 		return
 	}
 
+	if len(req.Tokens) > 0 && (req.Prompt != "" || req.Context != nil || len(req.Images) > 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tokens cannot be combined with prompt, context or images"})
+		return
+	}
+
+	if req.Tools != nil && (req.Raw || len(req.Tokens) > 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tools cannot be combined with raw or tokens"})
+		return
+	}
+
+	if req.Suffix != "" && (req.Raw || len(req.Tokens) > 0 || req.Tools != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "suffix cannot be combined with raw, tokens or tools"})
+		return
+	}
+
+	if req.Grammar != "" {
+		if err := llm.ValidateGrammar(req.Grammar); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	caps := []Capability{CapabilityCompletion}
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	if req.Tools != nil {
+		caps = append(caps, CapabilityTools)
+	}
+
+	if req.Suffix != "" {
+		caps = append(caps, CapabilityInsert)
+	}
+
+	// streaming requests can be listed with /api/requests and stopped by ID
+	// with /api/stop, including while they wait for the model to load
+	ctx := c.Request.Context()
+	var requestID string
+	if req.Stream == nil || *req.Stream {
+		var done func()
+		ctx, requestID, done = s.requests.add(ctx, req.Model)
+		defer done()
+	}
+
+	// the runner is released once the timeout cancels ctx
+	ctx, cancel := withTimeout(ctx, req.Timeout)
+	defer cancel()
+
+	r, m, opts, warnings, err := s.scheduleRunner(ctx, req.Model, caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
+	} else if errors.Is(err, errCapabilityInsert) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support insert", req.Model)})
+		return
+	} else if timedOut(ctx, err) {
+		c.JSON(http.StatusOK, api.GenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Done:       true,
+			DoneReason: "timeout",
+		})
+		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
 	checkpointLoaded := time.Now()
+	s.requests.start(requestID)
+	requestedSeed := opts.Seed
+	seed := resolveSeed(opts)
 
-	if req.Prompt == "" {
+	if len(req.Tokens) > 0 {
+		kvData, err := getKVData(m.ModelPath, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := llm.ValidateTokens(req.Tokens, kvData.VocabSize()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else if req.Prompt == "" {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Done:       true,
 			DoneReason: "load",
+			Warnings:   warnings,
 		})
 		return
 	}
 
-	images := make([]llm.ImageData, len(req.Images))
+	// skipped images aren't numbered so the remaining images keep contiguous IDs
+	images := make([]llm.ImageData, 0, len(req.Images))
 	for i := range req.Images {
-		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
+		if err := checkImage(req.Images[i], opts.ImageErrors); errors.Is(err, errInvalidImage) && opts.ImageErrors == "skip" {
+			slog.Warn("skipping image", "image", i, "error", err)
+			warnings = append(warnings, fmt.Sprintf("image %d skipped: %v", i, err))
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("image %d: %v", i, err)})
+			return
+		}
+
+		data, err := resizeImage(req.Images[i], opts.ImageMaxSide, opts.ImageQuality)
+		if errors.Is(err, errInvalidImage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("image %d: %v", i, err)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		images = append(images, llm.ImageData{ID: len(images), Data: data})
 	}
 
+	// pre-tokenized prompts are sent as is
+	raw := req.Raw || len(req.Tokens) > 0
+
+	var tmplVersion string
 	prompt := req.Prompt
-	if !req.Raw {
+	if !raw {
+		tmplVersion = templateVersion(m, req.Template)
+
 		var msgs []api.Message
 		if req.System != "" {
 			msgs = append(msgs, api.Message{Role: "system", Content: req.System})
@@ -164,6 +463,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		msgs = append(msgs, api.Message{Role: "user", Content: req.Prompt})
 
 		tmpl := m.Template
+		if req.Tools != nil {
+			tmpl = m.ToolTemplate
+		}
+
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
 			if err != nil {
@@ -183,7 +486,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			b.WriteString(s)
 		}
 
-		if err := tmpl.Execute(&b, template.Values{Messages: msgs}); err != nil {
+		// a request with context continues an earlier response
+		values := template.Values{Messages: msgs, Tools: req.Tools, IsFirstTurn: req.Context == nil}
+		if req.Suffix != "" {
+			values = template.Values{Prompt: req.Prompt, Suffix: req.Suffix}
+		}
+
+		if err := tmpl.Execute(&b, values); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -193,21 +502,91 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	slog.Debug("generate request", "prompt", prompt, "images", images)
 
+	var phases *phaseTracker
+	if req.Phases && (req.Stream == nil || *req.Stream) {
+		promptTokens := len(req.Tokens)
+		if promptTokens == 0 {
+			tokens, err := r.Tokenize(c.Request.Context(), prompt)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			promptTokens = len(tokens)
+		}
+
+		phases = &phaseTracker{promptTokens: promptTokens, numPredict: opts.NumPredict}
+	}
+
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
-		var sb strings.Builder
+		var sb, filtered strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(cr llm.CompletionResponse) {
+		first := true
+
+		// phaseResponse is a response without content in the prompt_eval phase
+		phaseResponse := func() api.GenerateResponse {
+			res := api.GenerateResponse{
+				Model:     req.Model,
+				CreatedAt: time.Now().UTC(),
+				Phase:     phasePromptEval,
+				Progress:  phases.promptEval(),
+			}
+
+			if first {
+				res.RequestID = requestID
+				res.Warnings = warnings
+				first = false
+			}
+
+			return res
+		}
+
+		if phases != nil {
+			ch <- phaseResponse()
+		}
+
+		fn := func(cr llm.CompletionResponse) {
+			var progress *api.PhaseProgress
+			if phases != nil {
+				var started bool
+				if progress, started = phases.generation(cr); started {
+					ch <- phaseResponse()
+				}
+			}
+
+			if _, err := sb.WriteString(cr.Content); err != nil {
+				ch <- gin.H{"error": err.Error()}
+			}
+
+			// filters apply to the complete response, which is sent with the
+			// final response
+			response := cr.Content
+			if s.processor != nil {
+				filtered.WriteString(cr.Content)
+				if !cr.Done && !first {
+					return
+				}
+
+				response = ""
+				if cr.Done {
+					var err error
+					if response, err = s.processor.Apply(filtered.String()); err != nil {
+						ch <- gin.H{"error": err.Error()}
+						return
+					}
+
+					if opts.TrimResponse {
+						response = strings.TrimSpace(response)
+					}
+				}
+			}
+
 			res := api.GenerateResponse{
 				Model:      req.Model,
 				CreatedAt:  time.Now().UTC(),
-				Response:   cr.Content,
+				Response:   response,
 				Done:       cr.Done,
 				DoneReason: cr.DoneReason,
 				Metrics: api.Metrics{
@@ -215,18 +594,28 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 					PromptEvalDuration: cr.PromptEvalDuration,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					RunnerRSSPeak:      cr.RunnerRSSPeak,
+					MemoryEstimateGPU:  cr.MemoryEstimateGPU,
 				},
 			}
 
-			if _, err := sb.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+			if progress != nil {
+				res.Phase, res.Progress = phaseGeneration, progress
+			}
+
+			if first {
+				res.RequestID = requestID
+				res.Warnings = warnings
+				first = false
 			}
 
 			if cr.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				res.Seed = &seed
+				res.TemplateVersion = tmplVersion
 
-				if !req.Raw {
+				if !raw {
 					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
@@ -237,7 +626,20 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			ch <- res
-		}); err != nil {
+		}
+
+		err := s.completion(ctx, m, r, llm.CompletionRequest{
+			Prompt:  prompt,
+			Tokens:  req.Tokens,
+			Images:  images,
+			Format:  req.Format,
+			Grammar: req.Grammar,
+			Options: opts,
+		}, requestedSeed, &seed, fn)
+		if timedOut(ctx, err) {
+			// the response ends with what was generated before the timeout
+			fn(llm.CompletionResponse{Done: true, DoneReason: "timeout"})
+		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
@@ -265,6 +667,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		if opts.TrimResponse {
+			r.Response = strings.TrimSpace(r.Response)
+		}
+
+		r.Warnings = warnings
 		if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
 			r.ToolCalls = toolCalls
 			r.Response = ""
@@ -274,76 +681,449 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if wantsEventStream(c) {
+		streamEventResponse(c, ch)
+		return
+	}
+
 	streamResponse(c, ch)
 }
 
-func (s *Server) EmbedHandler(c *gin.Context) {
-	var req api.EmbedRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
-		return
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// completion runs req on runner r of model m. With OLLAMA_DEDUP set, identical
+// concurrent requests share a single completion; requestedSeed is the seed
+// before a random seed was resolved and seed is set to the seed the shared
+// completion was run with
+func (s *Server) completion(ctx context.Context, m *Model, r llm.LlamaServer, req llm.CompletionRequest, requestedSeed int, seed *int, fn func(llm.CompletionResponse)) error {
+	if !envconfig.Dedup {
+		return r.Completion(ctx, req, fn)
 	}
 
-	truncate := true
-
-	if req.Truncate != nil && !*req.Truncate {
-		truncate = false
+	key, err := completionKey(m, req, requestedSeed)
+	if err != nil {
+		return err
 	}
 
-	var input []string
+	return s.completions.do(ctx, key, seed, func(ctx context.Context, fn func(llm.CompletionResponse)) error {
+		return r.Completion(ctx, req, fn)
+	}, fn)
+}
 
-	switch i := req.Input.(type) {
-	case string:
-		if len(i) > 0 {
-			input = append(input, i)
-		}
-	case []any:
-		for _, v := range i {
-			if _, ok := v.(string); !ok {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
-				return
-			}
-			input = append(input, v.(string))
-		}
-	default:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+func (s *Server) GenerateBatchHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.GenerateBatchRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if len(input) == 0 {
-		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+	if req.Format != "" && req.Format != "json" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
+		return
+	} else if len(req.Prompts) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompts are required"})
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
-	if err != nil {
+	ctx, requestID, done := s.requests.add(c.Request.Context(), req.Model)
+	defer done()
+
+	r, m, opts, warnings, err := s.scheduleRunner(ctx, req.Model, []Capability{CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
-	kvData, err := getKVData(m.ModelPath, false)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	checkpointLoaded := time.Now()
+	s.requests.start(requestID)
+	seed := resolveSeed(opts)
 
-	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
-		if err != nil {
+	system := cmp.Or(req.System, m.System)
+	prompts := make([]string, len(req.Prompts))
+	for i, prompt := range req.Prompts {
+		var msgs []api.Message
+		if system != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: system})
+		}
+
+		msgs = append(msgs, api.Message{Role: "user", Content: prompt})
+
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{Messages: msgs, IsFirstTurn: true}); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
-		if len(tokens) > ctxLen {
-			if !truncate {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
-				return
+		prompts[i] = b.String()
+	}
+
+	// the prompts are sent to the runner at the same time so they're batched
+	// together, up to the runner's number of parallel requests
+	ch := make(chan any)
+	var wg sync.WaitGroup
+	for i, prompt := range prompts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			send := func(v any) {
+				select {
+				case ch <- v:
+				case <-ctx.Done():
+				}
+			}
+
+			// the runner may modify the options so each prompt gets a copy
+			opts := *opts
+			first := true
+			var filtered strings.Builder
+			if err := r.Completion(ctx, llm.CompletionRequest{
+				Prompt:  prompt,
+				Format:  req.Format,
+				Options: &opts,
+			}, func(cr llm.CompletionResponse) {
+				// filters apply to the complete response, which is sent with
+				// the final response
+				if s.processor != nil {
+					filtered.WriteString(cr.Content)
+					if !cr.Done && !first {
+						return
+					}
+
+					cr.Content = ""
+					if cr.Done {
+						var err error
+						if cr.Content, err = s.processor.Apply(filtered.String()); err != nil {
+							send(gin.H{"index": i, "error": err.Error()})
+							return
+						}
+					}
+				}
+
+				res := api.GenerateBatchResponse{
+					Index: i,
+					GenerateResponse: api.GenerateResponse{
+						Model:      req.Model,
+						CreatedAt:  time.Now().UTC(),
+						Response:   cr.Content,
+						Done:       cr.Done,
+						DoneReason: cr.DoneReason,
+						RequestID:  requestID,
+						Metrics: api.Metrics{
+							PromptEvalCount:    cr.PromptEvalCount,
+							PromptEvalDuration: cr.PromptEvalDuration,
+							EvalCount:          cr.EvalCount,
+							EvalDuration:       cr.EvalDuration,
+							RunnerRSSPeak:      cr.RunnerRSSPeak,
+							MemoryEstimateGPU:  cr.MemoryEstimateGPU,
+						},
+					},
+				}
+
+				if first {
+					res.Warnings = warnings
+					first = false
+				}
+
+				if cr.Done {
+					res.TotalDuration = time.Since(checkpointStart)
+					res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+					res.Seed = &seed
+				}
+
+				send(res)
+			}); err != nil {
+				send(gin.H{"index": i, "error": err.Error()})
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) ChatBatchHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.ChatBatchRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Requests) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "requests are required"})
+		return
+	} else if req.Parallel < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "parallel must not be negative"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	ch := make(chan any)
+	send := func(v any) {
+		select {
+		case ch <- v:
+		case <-ctx.Done():
+		}
+	}
+
+	indices := make(chan int)
+	go func() {
+		defer close(indices)
+		for i := range req.Requests {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// prompts are assembled by a bounded pool of workers while completions,
+	// once started, run at the same time so the runner can batch them
+	var wg sync.WaitGroup
+	for range min(cmp.Or(req.Parallel, runtime.NumCPU()), len(req.Requests)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				s.chatBatchItem(ctx, i, req.Requests[i], checkpointStart, &wg, send)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	streamResponse(c, ch)
+}
+
+// chatBatchItem assembles the prompt of req, the request at index i of a chat
+// batch, with its own options and starts its completion. Responses and errors
+// are sent with send. wg is done once the completion has finished
+func (s *Server) chatBatchItem(ctx context.Context, i int, req api.ChatRequest, checkpointStart time.Time, wg *sync.WaitGroup, send func(any)) {
+	ctx, requestID, release := s.requests.add(ctx, req.Model)
+
+	// the runner is released once the timeout cancels ctx
+	ctx, cancel := withTimeout(ctx, req.Timeout)
+	done := func() {
+		cancel()
+		release()
+	}
+
+	// responses are told apart by the index of their request
+	sendBatch := send
+	send = func(v any) {
+		switch t := v.(type) {
+		case api.ChatResponse:
+			v = api.ChatBatchResponse{Index: i, ChatResponse: t}
+		case gin.H:
+			t["index"] = i
+		}
+
+		sendBatch(v)
+	}
+
+	fail := func(err error) {
+		done()
+		send(gin.H{"error": err.Error()})
+	}
+
+	// responses are interleaved, so they can't continue a session or be
+	// split into phases and reasoning steps
+	switch {
+	case req.SessionID != "":
+		fail(errors.New("session_id isn't supported in batch requests"))
+		return
+	case req.Phases:
+		fail(errors.New("phases isn't supported in batch requests"))
+		return
+	case req.ReasoningSteps:
+		fail(errors.New("reasoning_steps isn't supported in batch requests"))
+		return
+	}
+
+	// each request is truncated to its own context window
+	run, err := s.prepareChat(ctx, req, requestID, checkpointStart)
+	if timedOut(ctx, err) {
+		done()
+		send(chatTimeout(req.Model, requestID))
+		return
+	} else if errors.Is(err, os.ErrNotExist) {
+		fail(fmt.Errorf("model %q not found, try pulling it first", req.Model))
+		return
+	} else if err != nil {
+		fail(err)
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		done()
+		send(run.loadResponse())
+		return
+	}
+
+	// streamed responses are trimmed as they're sent
+	stream := req.Stream == nil || *req.Stream
+	run.trimStream = stream
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer done()
+
+		if stream {
+			s.completeChat(ctx, run, send)
+			return
+		}
+
+		var cc chatCollector
+		s.completeChat(ctx, run, cc.add)
+		_, res := cc.result(run)
+		send(res)
+	}()
+}
+
+func (s *Server) ChatExportCodeHandler(c *gin.Context) {
+	var req api.ChatExportCodeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	// the exported code sends requests to the address this request was sent to
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	host := scheme + "://" + cmp.Or(c.Request.Host, "localhost:11434")
+	code, err := exportCode(req.Language, req.ChatRequest, host)
+	if errors.Is(err, errUnsupportedLanguage) || errors.Is(err, errUnsupportedByClient) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ChatExportCodeResponse{Language: req.Language, Code: code})
+}
+
+func (s *Server) ListRequestsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ListRequestsResponse{Requests: s.requests.list()})
+}
+
+func (s *Server) StopHandler(c *gin.Context) {
+	var req api.StopRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.RequestID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "request_id is required"})
+		return
+	}
+
+	if !s.requests.stop(req.RequestID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("request '%s' not found", req.RequestID)})
+		return
+	}
+}
+
+func (s *Server) EmbedHandler(c *gin.Context) {
+	var req api.EmbedRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	truncate := true
+
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
+	}
+
+	var input []string
+
+	switch i := req.Input.(type) {
+	case string:
+		if len(i) > 0 {
+			input = append(input, i)
+		}
+	case []any:
+		for _, v := range i {
+			if _, ok := v.(string); !ok {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+				return
+			}
+			input = append(input, v.(string))
+		}
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+		return
+	}
+
+	if len(input) == 0 {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+		return
+	}
+
+	r, m, opts, warnings, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	kvData, err := getKVData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for i, s := range input {
+		tokens, err := r.Tokenize(c.Request.Context(), s)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+		if len(tokens) > ctxLen {
+			if !truncate {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				return
 			}
 
 			tokens = tokens[:ctxLen]
@@ -371,6 +1151,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	resp := api.EmbedResponse{
 		Model:      req.Model,
 		Embeddings: embeddings,
+		Warnings:   warnings,
 	}
 	c.JSON(http.StatusOK, resp)
 }
@@ -402,7 +1183,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	r, _, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -434,8 +1215,25 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-func (s *Server) PullModelHandler(c *gin.Context) {
-	var req api.PullRequest
+// maxTokenizeBatch is the maximum number of inputs accepted by a single tokenize request
+const maxTokenizeBatch = 1024
+
+// templateVersion returns the digest of the template used to build a prompt,
+// either the model's template or a template override from the request
+func templateVersion(m *Model, override string) string {
+	if override != "" {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(override)))
+	}
+
+	if m.TemplateDigest != "" {
+		return m.TemplateDigest
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(m.Template.String())))
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
@@ -446,46 +1244,42 @@ func (s *Server) PullModelHandler(c *gin.Context) {
 		return
 	}
 
-	name := model.ParseName(cmp.Or(req.Model, req.Name))
-	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+	if len(req.Input) > maxTokenizeBatch {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input exceeds maximum batch size of %d", maxTokenizeBatch)})
 		return
 	}
 
-	if err := checkNameExists(name); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if len(req.Input) == 0 {
+		c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: [][]int{}})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
-		}
+	r, _, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
+	tokens := make([][]int, len(req.Input))
+	for i, s := range req.Input {
+		t, err := r.Tokenize(c.Request.Context(), s)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		if t == nil {
+			t = []int{}
 		}
-	}()
 
-	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
-		return
+		tokens[i] = t
 	}
 
-	streamResponse(c, ch)
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens})
 }
 
-func (s *Server) PushModelHandler(c *gin.Context) {
-	var req api.PushRequest
+func (s *Server) TokenCountHandler(c *gin.Context) {
+	var req api.TokenCountRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
@@ -496,161 +1290,275 @@ func (s *Server) PushModelHandler(c *gin.Context) {
 		return
 	}
 
-	var model string
-	if req.Model != "" {
-		model = req.Model
-	} else if req.Name != "" {
-		model = req.Name
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	for i, msg := range req.Messages {
+		if role := strings.ToLower(msg.Role); !slices.Contains(roles, role) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message %d: %s %q: must be one of %s", i, errUnknownRole, msg.Role, strings.Join(roles, ", "))})
+			return
+		}
+	}
+
+	resp := api.TokenCountResponse{ByRole: make(map[string]int)}
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusOK, resp)
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
-		}
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	r, _, _, _, err := s.scheduleRunner(c.Request.Context(), name, []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, name, err)
+		return
+	}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
+	for _, msg := range req.Messages {
+		tokens, err := r.Tokenize(c.Request.Context(), msg.Content)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
+		resp.Total += len(tokens)
+		resp.ByRole[strings.ToLower(msg.Role)] += len(tokens)
+	}
 
-		if err := PushModel(ctx, model, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
-		}
-	}()
+	c.JSON(http.StatusOK, resp)
+}
 
-	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
+func (s *Server) PruneContextHandler(c *gin.Context) {
+	var req api.PruneContextRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	streamResponse(c, ch)
-}
-
-func checkNameExists(name model.Name) error {
-	names, err := Manifests()
-	if err != nil {
-		return err
+	if len(req.Messages) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "messages are required"})
+		return
+	} else if req.TargetTokens <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "target_tokens must be positive"})
+		return
 	}
 
-	for n := range names {
-		if strings.EqualFold(n.Filepath(), name.Filepath()) && n != name {
-			return fmt.Errorf("a model with that name already exists")
+	for i, msg := range req.Messages {
+		if role := strings.ToLower(msg.Role); !slices.Contains(roles, role) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message %d: %s %q: must be one of %s", i, errUnknownRole, msg.Role, strings.Join(roles, ", "))})
+			return
 		}
-	}
 
-	return nil
-}
+		req.Messages[i].Role = strings.ToLower(msg.Role)
+	}
 
-func (s *Server) CreateModelHandler(c *gin.Context) {
-	var r api.CreateRequest
-	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	r, m, opts, _, err := s.scheduleRunner(c.Request.Context(), name, []Capability{CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", name)})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		handleScheduleError(c, name, err)
 		return
 	}
 
-	name := model.ParseName(cmp.Or(r.Model, r.Name))
-	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+	msgs, tokens, err := pruneContext(c.Request.Context(), m, r, opts, req.Messages, req.TargetTokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := checkNameExists(name); err != nil {
+	c.JSON(http.StatusOK, api.PruneContextResponse{Messages: msgs, Tokens: tokens})
+}
+
+func (s *Server) ContextWindowHandler(c *gin.Context) {
+	var req api.ChatRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if r.Path == "" && r.Modelfile == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
+	if len(req.Messages) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "messages are required"})
 		return
 	}
 
-	var sr io.Reader = strings.NewReader(r.Modelfile)
-	if r.Path != "" && r.Modelfile == "" {
-		f, err := os.Open(r.Path)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+	for i, msg := range req.Messages {
+		if role := strings.ToLower(msg.Role); !slices.Contains(roles, role) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message %d: %s %q: must be one of %s", i, errUnknownRole, msg.Role, strings.Join(roles, ", "))})
 			return
 		}
-		defer f.Close()
 
-		sr = f
+		req.Messages[i].Role = strings.ToLower(msg.Role)
 	}
 
-	f, err := parser.ParseFile(sr)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	r, m, opts, _, err := s.scheduleRunner(c.Request.Context(), name, []Capability{CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", name)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, name, err)
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(resp api.ProgressResponse) {
-			ch <- resp
-		}
-
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
-		quantization := cmp.Or(r.Quantize, r.Quantization)
-		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
-		}
-	}()
+	msgs, err := chatMessages(m, &req)
+	if errors.Is(err, errUnknownFragment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	if r.Stream != nil && !*r.Stream {
-		waitForStream(c, ch)
+	resp, err := contextWindow(c.Request.Context(), m, r.Tokenize, msgs, req.Tools, chatDocuments(req.Documents))
+	var execErr *TemplateExecutionError
+	if errors.As(err, &execErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "template": execErr.Template, "line": execErr.Line, "node": execErr.Node})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	streamResponse(c, ch)
+	resp.NumCtx = opts.NumCtx
+	c.JSON(http.StatusOK, resp)
 }
 
-func (s *Server) DeleteModelHandler(c *gin.Context) {
-	var r api.DeleteRequest
-	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+const (
+	defaultBenchmarkPromptTokens  = 512
+	defaultBenchmarkPredictTokens = 128
+
+	// benchmarkTimeout bounds how long a benchmark may run, excluding loading the model
+	benchmarkTimeout = 2 * time.Minute
+)
+
+// benchmarkText is tokenized and repeated to build benchmark prompts
+const benchmarkText = "The quick brown fox jumps over the lazy dog. "
+
+func (s *Server) BenchmarkHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+
+	var req api.BenchmarkRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
-	} else if err != nil {
+	case err != nil:
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	n := model.ParseName(cmp.Or(r.Model, r.Name))
-	if !n.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+	if req.PromptTokens < 0 || req.PredictTokens < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt_tokens and predict_tokens must not be negative"})
 		return
 	}
 
-	m, err := ParseNamedManifest(n)
+	promptTokens := cmp.Or(req.PromptTokens, defaultBenchmarkPromptTokens)
+	predictTokens := cmp.Or(req.PredictTokens, defaultBenchmarkPredictTokens)
+
+	caps := []Capability{CapabilityCompletion}
+	r, _, opts, _, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if promptTokens+predictTokens > opts.NumCtx {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("prompt_tokens and predict_tokens exceed the context length of %d", opts.NumCtx)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), benchmarkTimeout)
+	defer cancel()
+
+	// start each prompt differently so it isn't served from the runner's prompt cache
+	tokens, err := r.Tokenize(ctx, fmt.Sprintf("Benchmark %d. ", checkpointStart.UnixNano()))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := m.Remove(); err != nil {
+	filler, err := r.Tokenize(ctx, benchmarkText)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
+	} else if len(filler) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build benchmark prompt"})
+		return
 	}
 
-	if err := m.RemoveLayers(); err != nil {
+	for len(tokens) < promptTokens {
+		tokens = append(tokens, filler...)
+	}
+
+	// generate the same output for every run
+	opts.NumPredict = predictTokens
+	opts.Temperature = 0
+	opts.Seed = 0
+
+	var cr llm.CompletionResponse
+	if err := r.Completion(ctx, llm.CompletionRequest{
+		Tokens:  tokens[:promptTokens],
+		Options: opts,
+	}, func(r llm.CompletionResponse) {
+		if r.Done {
+			cr = r
+		}
+	}); errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": fmt.Sprintf("benchmark did not finish within %s", benchmarkTimeout)})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, api.BenchmarkResponse{
+		Model:                 req.Model,
+		PromptEvalCount:       cr.PromptEvalCount,
+		PromptEvalDuration:    cr.PromptEvalDuration,
+		PromptTokensPerSecond: tokensPerSecond(cr.PromptEvalCount, cr.PromptEvalDuration),
+		EvalCount:             cr.EvalCount,
+		EvalDuration:          cr.EvalDuration,
+		TokensPerSecond:       tokensPerSecond(cr.EvalCount, cr.EvalDuration),
+		LoadDuration:          checkpointLoaded.Sub(checkpointStart),
+		TotalDuration:         time.Since(checkpointStart),
+	})
 }
 
-func (s *Server) ShowModelHandler(c *gin.Context) {
-	var req api.ShowRequest
+func tokensPerSecond(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) / d.Seconds()
+}
+
+func (s *Server) SweepHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+
+	var req api.SweepRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
@@ -661,193 +1569,1780 @@ func (s *Server) ShowModelHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Model != "" {
-		// noop
-	} else if req.Name != "" {
-		req.Model = req.Name
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	if req.Format != "" && req.Format != "json" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
+		return
+	} else if req.Prompt == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt is required"})
 		return
 	}
 
-	resp, err := GetModelInfo(req)
+	combos, err := sweepCombinations(req.Grid)
 	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-		case err.Error() == "invalid model name":
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, resp)
-}
-
-func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
-	m, err := GetModel(req.Model)
-	if err != nil {
-		return nil, err
-	}
+	resp := api.SweepResponse{Model: req.Model, Results: make([]api.SweepResult, len(combos))}
 
-	modelDetails := api.ModelDetails{
-		ParentModel:       m.ParentModel,
-		Format:            m.Config.ModelFormat,
-		Family:            m.Config.ModelFamily,
-		Families:          m.Config.ModelFamilies,
-		ParameterSize:     m.Config.ModelType,
-		QuantizationLevel: m.Config.FileType,
-	}
+	var prompt string
+	for i, combo := range combos {
+		result := &resp.Results[i]
+		result.Options = combo
 
-	if req.System != "" {
-		m.System = req.System
-	}
+		// every combination uses the first one's seed so only the grid's
+		// options differ between them
+		requestOpts := api.MergeOptions(req.Options, combo)
+		if _, ok := combo["seed"]; !ok && i > 0 {
+			requestOpts["seed"] = int64(resp.Seed)
+		}
 
-	msgs := make([]api.Message, len(m.Messages))
-	for i, msg := range m.Messages {
-		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
-	}
+		// each combination releases the runner when it's done so the next one
+		// can reload the model if it changes runner options
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		r, m, opts, _, err := s.scheduleRunner(ctx, req.Model, []Capability{CapabilityCompletion}, requestOpts, req.KeepAlive)
+		if err != nil {
+			cancel()
+			if i == 0 {
+				if errors.Is(err, errCapabilityCompletion) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+				} else {
+					handleScheduleError(c, req.Model, err)
+				}
+				return
+			}
 
-	n := model.ParseName(req.Model)
-	if !n.IsValid() {
-		return nil, fmt.Errorf("invalid model name")
-	}
+			result.Error = err.Error()
+			continue
+		}
 
-	manifest, err := ParseNamedManifest(n)
-	if err != nil {
-		return nil, err
-	}
+		seed := resolveSeed(opts)
+		if i == 0 {
+			resp.Seed = seed
 
-	resp := &api.ShowResponse{
-		License:    strings.Join(m.License, "\n"),
-		System:     m.System,
-		Template:   m.Template.String(),
-		Details:    modelDetails,
-		Messages:   msgs,
-		ModifiedAt: manifest.fi.ModTime(),
-	}
+			var msgs []api.Message
+			if system := cmp.Or(req.System, m.System); system != "" {
+				msgs = append(msgs, api.Message{Role: "system", Content: system})
+			}
 
-	var params []string
-	cs := 30
-	for k, v := range m.Options {
-		switch val := v.(type) {
-		case []interface{}:
-			for _, nv := range val {
-				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
+			var b bytes.Buffer
+			if err := m.Template.Execute(&b, template.Values{Messages: append(msgs, api.Message{Role: "user", Content: req.Prompt}), IsFirstTurn: true}); err != nil {
+				cancel()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": newTemplateExecutionError(m, err).Error()})
+				return
 			}
-		default:
-			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
-		}
-	}
-	resp.Parameters = strings.Join(params, "\n")
 
-	for k, v := range req.Options {
-		if _, ok := req.Options[k]; ok {
-			m.Options[k] = v
+			prompt = b.String()
 		}
+
+		var sb strings.Builder
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:  prompt,
+			Format:  req.Format,
+			Options: opts,
+		}, func(cr llm.CompletionResponse) {
+			sb.WriteString(cr.Content)
+			if cr.Done {
+				result.DoneReason = cr.DoneReason
+				result.Metrics = api.Metrics{
+					PromptEvalCount:    cr.PromptEvalCount,
+					PromptEvalDuration: cr.PromptEvalDuration,
+					EvalCount:          cr.EvalCount,
+					EvalDuration:       cr.EvalDuration,
+				}
+			}
+		}); err != nil {
+			result.Error = err.Error()
+		}
+
+		// filters apply to what was generated, even if the completion failed
+		if result.Response, err = s.processor.Apply(sb.String()); err != nil {
+			result.Error = err.Error()
+		}
+
+		cancel()
 	}
 
-	var sb strings.Builder
-	fmt.Fprintln(&sb, "# Modelfile generated by \"ollama show\"")
-	fmt.Fprintln(&sb, "# To build a new Modelfile based on this, replace FROM with:")
-	fmt.Fprintf(&sb, "# FROM %s\n\n", m.ShortName)
-	fmt.Fprint(&sb, m.String())
-	resp.Modelfile = sb.String()
+	resp.TotalDuration = time.Since(checkpointStart)
+	c.JSON(http.StatusOK, resp)
+}
 
-	kvData, err := getKVData(m.ModelPath, req.Verbose)
-	if err != nil {
-		return nil, err
+func (s *Server) PullModelHandler(c *gin.Context) {
+	var req api.PullRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	delete(kvData, "general.name")
-	delete(kvData, "tokenizer.chat_template")
-	resp.ModelInfo = kvData
 
-	if len(m.ProjectorPaths) > 0 {
-		projectorData, err := getKVData(m.ProjectorPaths[0], req.Verbose)
-		if err != nil {
-			return nil, err
+	name := model.ParseName(cmp.Or(req.Model, req.Name))
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+		return
+	}
+
+	if err := checkNameExists(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
 		}
-		resp.ProjectorInfo = projectorData
+
+		regOpts := &registryOptions{
+			Insecure: req.Insecure,
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
 	}
 
-	return resp, nil
+	streamResponse(c, ch)
 }
 
-func getKVData(digest string, verbose bool) (llm.KV, error) {
-	maxArraySize := 0
-	if verbose {
-		maxArraySize = -1
+func (s *Server) PushModelHandler(c *gin.Context) {
+	var req api.PushRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	kvData, err := llm.LoadModel(digest, maxArraySize)
-	if err != nil {
-		return nil, err
+
+	var model string
+	if req.Model != "" {
+		model = req.Model
+	} else if req.Name != "" {
+		model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
 	}
 
-	kv := kvData.KV()
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
 
-	if !verbose {
-		for k := range kv {
-			if t, ok := kv[k].([]any); len(t) > 5 && ok {
-				kv[k] = []any{}
-			}
+		regOpts := &registryOptions{
+			Insecure: req.Insecure,
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		if err := PushModel(ctx, model, regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
 		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
 	}
 
-	return kv, nil
+	streamResponse(c, ch)
 }
 
-func (s *Server) ListModelsHandler(c *gin.Context) {
-	ms, err := Manifests()
+func checkNameExists(name model.Name) error {
+	names, err := Manifests()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return err
+	}
+
+	for n := range names {
+		if strings.EqualFold(n.Filepath(), name.Filepath()) && n != name {
+			return fmt.Errorf("a model with that name already exists")
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) CreateModelHandler(c *gin.Context) {
+	var r api.CreateRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	models := []api.ListModelResponse{}
-	for n, m := range ms {
-		f, err := m.Config.Open()
+	name := model.ParseName(cmp.Or(r.Model, r.Name))
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	if err := checkNameExists(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if r.Path == "" && r.Modelfile == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
+		return
+	}
+
+	var sr io.Reader = strings.NewReader(r.Modelfile)
+	if r.Path != "" && r.Modelfile == "" {
+		f, err := os.Open(r.Path)
 		if err != nil {
-			slog.Warn("bad manifest filepath", "name", n, "error", err)
-			continue
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+			return
 		}
 		defer f.Close()
 
-		var cf ConfigV2
-		if err := json.NewDecoder(f).Decode(&cf); err != nil {
-			slog.Warn("bad manifest config", "name", n, "error", err)
-			continue
+		sr = f
+	}
+
+	f, err := parser.ParseFile(sr)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
 		}
 
-		// tag should never be masked
-		models = append(models, api.ListModelResponse{
-			Model:      n.DisplayShortest(),
-			Name:       n.DisplayShortest(),
-			Size:       m.Size(),
-			Digest:     m.digest,
-			ModifiedAt: m.fi.ModTime(),
-			Details: api.ModelDetails{
-				Format:            cf.ModelFormat,
-				Family:            cf.ModelFamily,
-				Families:          cf.ModelFamilies,
-				ParameterSize:     cf.ModelType,
-				QuantizationLevel: cf.FileType,
-			},
-		})
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		quantization := cmp.Or(r.Quantize, r.Quantization)
+		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if r.Stream != nil && !*r.Stream {
+		waitForStream(c, ch)
+		return
 	}
 
-	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
-		// most recently modified first
-		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
+	streamResponse(c, ch)
+}
+
+func (s *Server) DeleteModelHandler(c *gin.Context) {
+	var r api.DeleteRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(cmp.Or(r.Model, r.Name))
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+		return
+	}
+
+	m, err := ParseNamedManifest(n)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	aliases, err := Aliases(n)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(aliases) > 0 {
+		names := make([]string, len(aliases))
+		for i, alias := range aliases {
+			names[i] = alias.DisplayShortest()
+		}
+
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model %q is the target of the aliases %s, delete them first", cmp.Or(r.Model, r.Name), strings.Join(names, ", "))})
+		return
+	}
+
+	if err := m.Remove(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := m.RemoveLayers(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+func (s *Server) ShowModelHandler(c *gin.Context) {
+	var req api.ShowRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model != "" {
+		// noop
+	} else if req.Name != "" {
+		req.Model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	resp, err := GetModelInfo(req)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) CreateFragmentHandler(c *gin.Context) {
+	var req api.FragmentRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	if err := SetFragment(req.Model, req.Name, req.Content); err != nil {
+		if err.Error() == "invalid model name" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+func (s *Server) DeleteFragmentHandler(c *gin.Context) {
+	var req api.DeleteFragmentRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := DeleteFragment(req.Model, req.Name); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("fragment '%s' not found", req.Name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+}
+
+func (s *Server) ListTemplatesHandler(c *gin.Context) {
+	templates, err := ListTemplates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ListTemplatesResponse{Templates: templates})
+}
+
+func (s *Server) ShowTemplateHandler(c *gin.Context) {
+	name := c.Param("name")
+	t, err := GetTemplate(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template '%s' not found", name)})
+		case errors.Is(err, errInvalidTemplateName):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+func (s *Server) CreateTemplateHandler(c *gin.Context) {
+	var req api.TemplateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	if err := SetTemplate(req.Name, req.Template); err != nil {
+		if errors.Is(err, errInvalidTemplateName) || errors.Is(err, errInvalidTemplate) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+func (s *Server) DeleteTemplateHandler(c *gin.Context) {
+	name := c.Param("name")
+	if err := DeleteTemplate(name); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template '%s' not found", name)})
+		case errors.Is(err, errInvalidTemplateName):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+}
+
+func (s *Server) TemplateLintHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	warnings := []api.TemplateLintWarning{}
+	for _, w := range template.LintTemplate(m.Template) {
+		warnings = append(warnings, api.TemplateLintWarning{Rule: w.Rule, Line: w.Line, Message: w.Message})
+	}
+
+	c.JSON(http.StatusOK, api.TemplateLintResponse{Warnings: warnings})
+}
+
+func (s *Server) UpdateModelTemplateHandler(c *gin.Context) {
+	var req api.UpdateModelTemplateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tmpl, err := template.Parse(req.Template)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	param, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+
+	name := model.ParseName(param)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+		return
+	}
+
+	// requests which have already read the model keep using its old template
+	if err := UpdateTemplate(name, req.Template); err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", param)})
+			return
+		} else if errors.Is(err, errUpdateAlias) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	warnings := []api.TemplateLintWarning{}
+	for _, w := range template.LintTemplate(tmpl) {
+		warnings = append(warnings, api.TemplateLintWarning{Rule: w.Rule, Line: w.Line, Message: w.Message})
+	}
+
+	c.JSON(http.StatusOK, api.TemplateLintResponse{Warnings: warnings})
+}
+
+func (s *Server) ContextStatsHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	// a model may be loaded more than once with different context sizes
+	var runners []llm.LlamaServer
+	s.sched.loadedMu.Lock()
+	for _, runner := range s.sched.loaded {
+		if runner.modelPath == m.ModelPath && runner.llama != nil {
+			runners = append(runners, runner.llama)
+		}
+	}
+	s.sched.loadedMu.Unlock()
+
+	if len(runners) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' is not loaded", name)})
+		return
+	}
+
+	resp := api.ContextStatsResponse{Model: m.ShortName}
+	for _, r := range runners {
+		stats, err := r.ContextStats(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp.KVCacheUsedTokens += stats.KVCacheUsedTokens
+		resp.KVCacheTotalTokens += stats.KVCacheTotalTokens
+		resp.ActiveSessions += stats.ActiveSessions
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) CapabilitiesHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ggml, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	kv := ggml.KV()
+	resp := api.CapabilitiesResponse{
+		Model:             m.ShortName,
+		SupportsImages:    len(m.ProjectorPaths) > 0,
+		SupportsToolCalls: m.CheckCapabilities(CapabilityTools) == nil,
+		MaxContextLength:  int(kv.ContextLength()),
+		ProjectorPaths:    append([]string{}, m.ProjectorPaths...),
+	}
+
+	if chat := kv.ChatTemplate(); chat != "" {
+		if t, err := template.Named(chat); err == nil {
+			resp.PromptFormat = t.Name
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// linkRegexp matches URLs in a model's description
+var linkRegexp = regexp.MustCompile(`https?://[^\s<>()\[\]"'\x60]+`)
+
+// dataLinks returns the URLs on lines of description which mention data, in
+// the order they appear
+func dataLinks(description string) []string {
+	links := []string{}
+	for _, line := range strings.Split(description, "\n") {
+		if !strings.Contains(strings.ToLower(line), "data") {
+			continue
+		}
+
+		for _, link := range linkRegexp.FindAllString(line, -1) {
+			// punctuation ending a sentence isn't part of the link
+			link = strings.TrimRight(link, ".,;:!?")
+			if !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links
+}
+
+func (s *Server) FineTuneDataHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ggml, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	kv := ggml.KV()
+	resp := api.FineTuneDataResponse{Model: m.ShortName}
+	resp.Dataset, _ = kv["general.dataset"].(string)
+	resp.Description, _ = kv["general.dataset.description"].(string)
+	resp.Source, _ = kv["general.dataset.source"].(string)
+
+	description, _ := kv["general.description"].(string)
+	resp.Links = dataLinks(description)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) TemplateValidateHandler(c *gin.Context) {
+	var req api.TemplateValidateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tmpl, err := template.Parse(req.Template)
+	if err != nil {
+		c.JSON(http.StatusOK, api.TemplateValidateResponse{
+			Referenced:   []string{},
+			Unreferenced: slices.Clone(template.KnownFields),
+			ParseError:   newTemplateParseError(err),
+		})
+		return
+	}
+
+	resp := api.TemplateValidateResponse{Referenced: []string{}, Unreferenced: []string{}}
+	referenced, unreferenced := tmpl.Fields()
+	resp.Referenced = append(resp.Referenced, referenced...)
+	resp.Unreferenced = append(resp.Unreferenced, unreferenced...)
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) ChatTemplateTestHandler(c *gin.Context) {
+	var req api.ChatTemplateTestRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	resp := api.ChatTemplateTestResponse{Errors: []string{}, Warnings: []api.TemplateLintWarning{}}
+
+	tmpl := m.Template
+	if req.Template != "" {
+		if tmpl, err = template.Parse(req.Template); err != nil {
+			resp.Errors = append(resp.Errors, err.Error())
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+	}
+
+	for _, w := range template.LintTemplate(tmpl) {
+		resp.Warnings = append(resp.Warnings, api.TemplateLintWarning{Rule: w.Rule, Line: w.Line, Message: w.Message})
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{Messages: req.Messages, Tools: req.Tools, IsFirstTurn: isFirstTurn(req.Messages)}); err != nil {
+		resp.Errors = append(resp.Errors, newTemplateExecutionError(m, err).Error())
+	}
+
+	resp.Rendered = b.String()
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) ListChatExamplesHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	if _, err := GetModel(name); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	examples, err := ListChatExamples(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if examples == nil {
+		examples = []api.ChatExample{}
+	}
+
+	c.JSON(http.StatusOK, api.ListChatExamplesResponse{Examples: examples})
+}
+
+func (s *Server) CreateChatExampleHandler(c *gin.Context) {
+	var req api.ChatExampleRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+	if _, err := GetModel(name); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	example, err := AddChatExample(name, req.Messages)
+	if errors.Is(err, errInvalidChatExample) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, example)
+}
+
+func (s *Server) DeleteChatExampleHandler(c *gin.Context) {
+	name, ok := modelNameParam(c)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	if err := DeleteChatExample(name, id); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("chat example '%s' not found", id)})
+		case err.Error() == "invalid model name":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+}
+
+// newTemplateParseError extracts the line from a template parse error, which
+// are formatted as template: NAME:LINE: MESSAGE
+func newTemplateParseError(err error) *api.TemplateParseError {
+	e := api.TemplateParseError{Message: err.Error()}
+	if parts := strings.SplitN(strings.TrimPrefix(err.Error(), "template: "), ":", 3); len(parts) == 3 {
+		if line, err := strconv.Atoi(parts[1]); err == nil {
+			e.Line = line
+			e.Message = strings.TrimSpace(parts[2])
+		}
+	}
+
+	return &e
+}
+
+func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
+	m, err := GetModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	modelDetails := api.ModelDetails{
+		ParentModel:       m.ParentModel,
+		Format:            m.Config.ModelFormat,
+		Family:            m.Config.ModelFamily,
+		Families:          m.Config.ModelFamilies,
+		ParameterSize:     m.Config.ModelType,
+		QuantizationLevel: m.Config.FileType,
+	}
+
+	if req.System != "" {
+		m.System = req.System
+	}
+
+	msgs := make([]api.Message, len(m.Messages))
+	for i, msg := range m.Messages {
+		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
+	}
+
+	n := model.ParseName(req.Model)
+	if !n.IsValid() {
+		return nil, fmt.Errorf("invalid model name")
+	}
+
+	manifest, err := ParseNamedManifest(n)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.ShowResponse{
+		License:    strings.Join(m.License, "\n"),
+		System:     m.System,
+		Template:   m.Template.String(),
+		Details:    modelDetails,
+		Messages:   msgs,
+		ModifiedAt: manifest.fi.ModTime(),
+	}
+
+	var params []string
+	cs := 30
+	for k, v := range m.Options {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, nv := range val {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
+			}
+		default:
+			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
+		}
+	}
+	resp.Parameters = strings.Join(params, "\n")
+
+	for k, v := range req.Options {
+		if _, ok := req.Options[k]; ok {
+			m.Options[k] = v
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintln(&sb, "# Modelfile generated by \"ollama show\"")
+	fmt.Fprintln(&sb, "# To build a new Modelfile based on this, replace FROM with:")
+	fmt.Fprintf(&sb, "# FROM %s\n\n", m.ShortName)
+	fmt.Fprint(&sb, m.String())
+	resp.Modelfile = sb.String()
+
+	kvData, err := getKVData(m.ModelPath, req.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	delete(kvData, "general.name")
+	delete(kvData, "tokenizer.chat_template")
+	resp.ModelInfo = kvData
+
+	if len(m.ProjectorPaths) > 0 {
+		projectorData, err := getKVData(m.ProjectorPaths[0], req.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		resp.ProjectorInfo = projectorData
+	}
+
+	return resp, nil
+}
+
+func getKVData(digest string, verbose bool) (llm.KV, error) {
+	maxArraySize := 0
+	if verbose {
+		maxArraySize = -1
+	}
+	kvData, err := llm.LoadModel(digest, maxArraySize)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := kvData.KV()
+
+	if !verbose {
+		for k := range kv {
+			if t, ok := kv[k].([]any); len(t) > 5 && ok {
+				kv[k] = []any{}
+			}
+		}
+	}
+
+	return kv, nil
+}
+
+func (s *Server) ListModelsHandler(c *gin.Context) {
+	ms, err := Manifests()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	models := []api.ListModelResponse{}
+	for n, m := range ms {
+		f, err := m.Config.Open()
+		if err != nil {
+			slog.Warn("bad manifest filepath", "name", n, "error", err)
+			continue
+		}
+		defer f.Close()
+
+		var cf ConfigV2
+		if err := json.NewDecoder(f).Decode(&cf); err != nil {
+			slog.Warn("bad manifest config", "name", n, "error", err)
+			continue
+		}
+
+		// tag should never be masked
+		models = append(models, api.ListModelResponse{
+			Model:      n.DisplayShortest(),
+			Name:       n.DisplayShortest(),
+			Size:       m.Size(),
+			Digest:     m.digest,
+			ModifiedAt: m.fi.ModTime(),
+			AliasOf:    aliasOf(m),
+			Details: api.ModelDetails{
+				Format:            cf.ModelFormat,
+				Family:            cf.ModelFamily,
+				Families:          cf.ModelFamilies,
+				ParameterSize:     cf.ModelType,
+				QuantizationLevel: cf.FileType,
+			},
+		})
+	}
+
+	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
+		// most recently modified first
+		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
+	})
+
+	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+}
+
+// aliasOf returns the name of the model m resolves to if it was read through
+// an alias
+func aliasOf(m *Manifest) string {
+	if !m.alias.IsValid() {
+		return ""
+	}
+
+	return m.alias.DisplayShortest()
+}
+
+func (s *Server) CopyModelHandler(c *gin.Context) {
+	var r api.CopyRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	src := model.ParseName(r.Source)
+	if !src.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
+		return
+	}
+
+	dst := model.ParseName(r.Destination)
+	if !dst.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+		return
+	}
+
+	if err := checkNameExists(dst); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	if r.Alias {
+		err = WriteAlias(dst, src)
+	} else {
+		err = CopyModel(src, dst)
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+	} else if errors.Is(err, errCircularAlias) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) ListAliasesHandler(c *gin.Context) {
+	ms, err := Manifests()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	aliases := []api.AliasResponse{}
+	for n, m := range ms {
+		if m.alias.IsValid() {
+			aliases = append(aliases, api.AliasResponse{Alias: n.DisplayShortest(), Target: m.alias.DisplayShortest()})
+		}
+	}
+
+	slices.SortFunc(aliases, func(a, b api.AliasResponse) int {
+		return strings.Compare(a.Alias, b.Alias)
+	})
+
+	c.JSON(http.StatusOK, api.ListAliasesResponse{Aliases: aliases})
+}
+
+func (s *Server) CreateAliasHandler(c *gin.Context) {
+	var r api.AliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alias := model.ParseName(r.Alias)
+	if !alias.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("alias %q is invalid", r.Alias)})
+		return
+	}
+
+	target := model.ParseName(r.Target)
+	if !target.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("target %q is invalid", r.Target)})
+		return
+	}
+
+	if err := checkNameExists(alias); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// an existing alias is replaced but a model isn't
+	if m, err := ParseNamedManifest(alias); err == nil && !m.alias.IsValid() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model %q already exists and isn't an alias", r.Alias)})
+		return
+	}
+
+	if err := WriteAlias(alias, target); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Target)})
+	} else if errors.Is(err, errCircularAlias) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) HeadBlobHandler(c *gin.Context) {
+	path, err := GetBlobsPath(c.Param("digest"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) CreateBlobHandler(c *gin.Context) {
+	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
+		p, err := GetBlobsPath(ib)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
+			delete(intermediateBlobs, c.Param("digest"))
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else {
+			c.Status(http.StatusOK)
+			return
+		}
+	}
+
+	path, err := GetBlobsPath(c.Param("digest"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// noop
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	default:
+		c.Status(http.StatusOK)
+		return
+	}
+
+	layer, err := NewLayer(c.Request.Body, "")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if layer.Digest != c.Param("digest") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+func isLocalIP(ip netip.Addr) bool {
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, iface := range interfaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, a := range addrs {
+				if parsed, _, err := net.ParseCIDR(a.String()); err == nil {
+					if parsed.String() == ip.String() {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func allowedHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+
+	if hostname, err := os.Hostname(); err == nil && host == hostname {
+		return true
+	}
+
+	var tlds = []string{
+		"localhost",
+		"local",
+		"internal",
+	}
+
+	// check if the host is a local TLD
+	for _, tld := range tlds {
+		if strings.HasSuffix(host, "."+tld) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if addr == nil {
+			c.Next()
+			return
+		}
+
+		if addr, err := netip.ParseAddrPort(addr.String()); err == nil && !addr.Addr().IsLoopback() {
+			c.Next()
+			return
+		}
+
+		host, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			host = c.Request.Host
+		}
+
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || isLocalIP(addr) {
+				c.Next()
+				return
+			}
+		}
+
+		if allowedHost(host) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+func (s *Server) GenerateRoutes() http.Handler {
+	config := cors.DefaultConfig()
+	config.AllowWildcard = true
+	config.AllowBrowserExtensions = true
+	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"}
+	openAIProperties := []string{"lang", "package-version", "os", "arch", "runtime", "runtime-version", "async"}
+	for _, prop := range openAIProperties {
+		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
+	}
+	config.AllowOrigins = envconfig.AllowOrigins
+
+	r := gin.Default()
+	r.Use(
+		cors.New(config),
+		allowedHostsMiddleware(s.addr),
+	)
+
+	// every route which runs chat requests checks their webhook signature
+	signed := webhookSignatureMiddleware(envconfig.WebhookSecret)
+
+	r.POST("/api/pull", s.PullModelHandler)
+	r.POST("/api/generate", s.GenerateHandler)
+	r.POST("/api/generate/batch", s.GenerateBatchHandler)
+	r.POST("/api/chat", signed, s.ChatHandler)
+	r.POST("/api/chat/batch", signed, s.ChatBatchHandler)
+	r.POST("/api/chat/export/code", s.ChatExportCodeHandler)
+	r.POST("/api/stop", s.StopHandler)
+	r.GET("/api/requests", s.ListRequestsHandler)
+	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/benchmark", s.BenchmarkHandler)
+	r.POST("/api/sweep", s.SweepHandler)
+	r.POST("/api/create", s.CreateModelHandler)
+	r.POST("/api/push", s.PushModelHandler)
+	r.POST("/api/copy", s.CopyModelHandler)
+	r.GET("/api/aliases", s.ListAliasesHandler)
+	r.POST("/api/aliases", s.CreateAliasHandler)
+	r.DELETE("/api/delete", s.DeleteModelHandler)
+	r.POST("/api/show", s.ShowModelHandler)
+	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
+	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	r.GET("/api/ps", s.ProcessHandler)
+	r.GET("/api/models/:name/template/lint", s.TemplateLintHandler)
+	r.PATCH("/api/models/:name/template", s.UpdateModelTemplateHandler)
+	r.POST("/api/template/validate", s.TemplateValidateHandler)
+	r.GET("/api/models/:name/context-stats", s.ContextStatsHandler)
+	r.GET("/api/models/:name/capabilities", s.CapabilitiesHandler)
+	r.GET("/api/models/:name/fine-tune-data", s.FineTuneDataHandler)
+	r.POST("/api/models/:name/tokens/count", s.TokenCountHandler)
+	r.POST("/api/models/:name/prune-context", s.PruneContextHandler)
+	r.POST("/api/models/:name/context-window", s.ContextWindowHandler)
+	r.POST("/api/models/:name/chat-template/test", s.ChatTemplateTestHandler)
+	r.GET("/api/models/:name/chat-examples", s.ListChatExamplesHandler)
+	r.POST("/api/models/:name/chat-examples", s.CreateChatExampleHandler)
+	r.DELETE("/api/models/:name/chat-examples/:id", s.DeleteChatExampleHandler)
+	r.POST("/api/fragments", s.CreateFragmentHandler)
+	r.DELETE("/api/fragments", s.DeleteFragmentHandler)
+	r.GET("/api/templates", s.ListTemplatesHandler)
+	r.GET("/api/templates/:name", s.ShowTemplateHandler)
+	r.POST("/api/templates", s.CreateTemplateHandler)
+	r.DELETE("/api/templates/:name", s.DeleteTemplateHandler)
+
+	// Compatibility endpoints
+	r.POST("/v1/chat/completions", signed, openai.ChatMiddleware(), s.ChatHandler)
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
+	r.GET("/v1/models", openai.ListMiddleware(), s.ListModelsHandler)
+	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowModelHandler)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r.Handle(method, "/", func(c *gin.Context) {
+			c.String(http.StatusOK, "Ollama is running")
+		})
+
+		r.Handle(method, "/api/tags", s.ListModelsHandler)
+		r.Handle(method, "/api/version", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"version": version.Version})
+		})
+	}
+
+	return modelsRawPath(r)
+}
+
+// modelsRawPath routes requests under /api/models/ on their escaped path, so
+// a model name which escapes '/' as %2F matches the routes' :name. Handlers
+// read the name with modelNameParam. Other routes match the unescaped path
+func modelsRawPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.RawPath; strings.HasPrefix(p, "/api/models/") {
+			r.URL.Path = p
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// modelNameParam returns the unescaped :name parameter of a route under
+// /api/models/. It responds with 400 if the name can't be unescaped
+func modelNameParam(c *gin.Context) (string, bool) {
+	name, err := url.PathUnescape(c.Param("name"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+		return "", false
+	}
+
+	return name, true
+}
+
+// shutdown stops srvr accepting new connections and waits up to timeout, or
+// until ctx is done, for in flight requests to finish. Connections which are
+// still open after that are closed
+func shutdown(ctx context.Context, srvr *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := srvr.Shutdown(ctx); err != nil {
+		srvr.Close()
+		return err
+	}
+
+	return nil
+}
+
+func Serve(ln net.Listener) error {
+	level := slog.LevelInfo
+	if envconfig.Debug {
+		level = slog.LevelDebug
+	}
+
+	slog.Info("server config", "env", envconfig.Values())
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level:     level,
+		AddSource: true,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.SourceKey {
+				source := attr.Value.Any().(*slog.Source)
+				source.File = filepath.Base(source.File)
+			}
+
+			return attr
+		},
+	})
+
+	slog.SetDefault(slog.New(handler))
+
+	if envconfig.Deterministic {
+		slog.Warn("OLLAMA_DETERMINISTIC is set: responses are sampled with a fixed seed and can be reproduced by anyone, don't use it in production")
+	}
+
+	blobsDir, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+	if err := fixBlobs(blobsDir); err != nil {
+		return err
+	}
+
+	if !envconfig.NoPrune {
+		// clean up unused layers and manifests
+		if err := PruneLayers(); err != nil {
+			return err
+		}
+
+		manifestsPath, err := GetManifestPath()
+		if err != nil {
+			return err
+		}
+
+		if err := PruneDirectory(manifestsPath); err != nil {
+			return err
+		}
+	}
+
+	processor, err := LoadResponseProcessor(envconfig.ResponseFilters)
+	if err != nil {
+		return fmt.Errorf("OLLAMA_RESPONSE_FILTERS: %w", err)
+	}
+
+	var metricsLn net.Listener
+	if envconfig.MetricsAddr != "" {
+		if metricsLn, err = net.Listen("tcp", envconfig.MetricsAddr); err != nil {
+			return fmt.Errorf("OLLAMA_METRICS_ADDR: %w", err)
+		}
+	}
+
+	ctx, done := context.WithCancel(context.Background())
+	schedCtx, schedDone := context.WithCancel(ctx)
+	sched := InitScheduler(schedCtx)
+	s := &Server{addr: ln.Addr(), sched: sched, processor: processor}
+
+	http.Handle("/", s.GenerateRoutes())
+
+	if metricsLn != nil {
+		registerSchedulerMetrics(sched)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+
+		slog.Info(fmt.Sprintf("Serving metrics on %s", metricsLn.Addr()))
+		go func() {
+			if err := http.Serve(metricsLn, mux); err != nil {
+				slog.Error("metrics server stopped", "error", err)
+			}
+		}()
+	}
+
+	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	srvr := &http.Server{
+		// Use http.DefaultServeMux so we get net/http/pprof for
+		// free.
+		//
+		// TODO(bmizerany): Decide if we want to make this
+		// configurable so it is not exposed by default, or allow
+		// users to bind it to a different port. This was a quick
+		// and easy way to get pprof, but it may not be the best
+		// way.
+		Handler: nil,
+	}
+
+	// listen for a ctrl+c and stop any loaded llm
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		slog.Info("shutting down, waiting for in flight requests to finish", "timeout", envconfig.ShutdownTimeout)
+
+		// a second signal stops waiting
+		drainCtx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		if err := shutdown(drainCtx, srvr, envconfig.ShutdownTimeout); err != nil {
+			slog.Warn("closing in flight requests", "error", err)
+		}
+		cancel()
+
+		if err := sched.writeCheckpoint(); err != nil {
+			slog.Warn("failed to write runner checkpoint", "error", err)
+		}
+		schedDone()
+		sched.unloadAllRunners()
+		gpu.Cleanup()
+		done()
+	}()
+
+	if err := llm.Init(); err != nil {
+		return fmt.Errorf("unable to initialize llm library %w", err)
+	}
+
+	s.sched.Run(schedCtx)
+
+	// At startup we retrieve GPU information so we can get log messages before loading a model
+	// This will log warnings to the log in case we have problems with detected GPUs
+	gpus := gpu.GetGPUInfo()
+	gpus.LogDetails()
+
+	go func() {
+		if err := s.sched.restoreCheckpoint(schedCtx); err != nil {
+			slog.Warn("failed to restore runner checkpoint", "error", err)
+		}
+
+		if len(envconfig.PreloadModels) > 0 {
+			loaded, failed := s.sched.preloadModels(schedCtx, envconfig.PreloadModels, envconfig.PreloadConcurrency)
+			slog.Info("preloaded models", "loaded", loaded, "failed", failed)
+		}
+	}()
+
+	err = srvr.Serve(ln)
+	// If server is closed from the signal handler, wait for the ctx to be done
+	// otherwise error out quickly
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func waitForStream(c *gin.Context, ch chan interface{}) {
+	c.Header("Content-Type", "application/json")
+	for resp := range ch {
+		switch r := resp.(type) {
+		case api.ProgressResponse:
+			if r.Status == "success" {
+				c.JSON(http.StatusOK, r)
+				return
+			}
+		case gin.H:
+			if errorMsg, ok := r["error"].(string); ok {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+				return
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in progress response"})
+				return
+			}
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+}
+
+func streamResponse(c *gin.Context, ch chan any) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Stream(func(w io.Writer) bool {
+		val, ok := <-ch
+		if !ok {
+			return false
+		}
+
+		bts, err := json.Marshal(val)
+		if err != nil {
+			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+			return false
+		}
+
+		// Delineate chunks with new-line delimiter
+		bts = append(bts, '\n')
+		if _, err := w.Write(bts); err != nil {
+			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+			return false
+		}
+
+		return true
+	})
+}
+
+// wantsEventStream reports whether the client asked for a streamed response as
+// server-sent events, with an Accept header of text/event-stream or ?stream=sse
+func wantsEventStream(c *gin.Context) bool {
+	return c.Query("stream") == "sse" || strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// streamEventResponse writes the values from ch as server-sent events. Each
+// value is a data event with the same JSON streamResponse writes, errors are
+// error events and the metrics of the final response follow it as a metrics
+// event. The stream ends with data: [DONE]
+func streamEventResponse(c *gin.Context, ch chan any) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+
+	write := func(w io.Writer, event string, val any) bool {
+		bts, err := json.Marshal(val)
+		if err != nil {
+			slog.Info(fmt.Sprintf("streamEventResponse: json.Marshal failed with %s", err))
+			return false
+		}
+
+		var b bytes.Buffer
+		if event != "" {
+			fmt.Fprintf(&b, "event: %s\n", event)
+		}
+		fmt.Fprintf(&b, "data: %s\n\n", bts)
+		if _, err := w.Write(b.Bytes()); err != nil {
+			slog.Info(fmt.Sprintf("streamEventResponse: w.Write failed with %s", err))
+			return false
+		}
+
+		return true
+	}
+
+	c.Stream(func(w io.Writer) bool {
+		val, ok := <-ch
+		if !ok {
+			if _, err := io.WriteString(w, "data: [DONE]\n\n"); err != nil {
+				slog.Info(fmt.Sprintf("streamEventResponse: w.Write failed with %s", err))
+			}
+			return false
+		}
+
+		switch r := val.(type) {
+		case gin.H:
+			return write(w, "error", r)
+		case api.GenerateResponse:
+			if !write(w, "", r) {
+				return false
+			}
+			if r.Done {
+				return write(w, "metrics", r.Metrics)
+			}
+			return true
+		case api.ChatResponse:
+			if !write(w, "", r) {
+				return false
+			}
+			if r.Done {
+				return write(w, "metrics", r.Metrics)
+			}
+			return true
+		default:
+			return write(w, "", r)
+		}
+	})
+}
+
+func (s *Server) ProcessHandler(c *gin.Context) {
+	models := []api.ProcessModelResponse{}
+
+	for _, v := range s.sched.loaded {
+		model := v.model
+		modelDetails := api.ModelDetails{
+			Format:            model.Config.ModelFormat,
+			Family:            model.Config.ModelFamily,
+			Families:          model.Config.ModelFamilies,
+			ParameterSize:     model.Config.ModelType,
+			QuantizationLevel: model.Config.FileType,
+		}
+
+		mr := api.ProcessModelResponse{
+			Model:     model.ShortName,
+			Name:      model.ShortName,
+			Size:      int64(v.estimatedTotal),
+			SizeVRAM:  int64(v.estimatedVRAM),
+			SizeRAM:   int64(v.estimatedTotal - min(v.estimatedVRAM, v.estimatedTotal)),
+			GPULayers: v.gpuLayers,
+			Digest:    model.Digest,
+			Details:   modelDetails,
+			ExpiresAt: v.expiresAt,
+		}
+
+		if v.Options != nil {
+			mr.ContextLength = v.NumCtx
+		}
+		// The scheduler waits to set expiresAt, so if a model is loading it's
+		// possible that it will be set to the unix epoch. For those cases, just
+		// calculate the time w/ the sessionDuration instead.
+		var epoch time.Time
+		if v.expiresAt == epoch {
+			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+		}
+
+		models = append(models, mr)
+	}
+
+	slices.SortStableFunc(models, func(i, j api.ProcessModelResponse) int {
+		// longest duration remaining listed first
+		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
 	})
 
-	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
-func (s *Server) CopyModelHandler(c *gin.Context) {
-	var r api.CopyRequest
-	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+func (s *Server) ChatHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+
+	var req api.ChatRequest
+	var err error
+	if c.ContentType() == "multipart/form-data" {
+		err = bindChatMultipart(c.Request, &req)
+	} else {
+		err = c.ShouldBindJSON(&req)
+	}
+
+	if errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -855,545 +3350,685 @@ func (s *Server) CopyModelHandler(c *gin.Context) {
 		return
 	}
 
-	src := model.ParseName(r.Source)
-	if !src.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
-		return
+	// streaming requests can be listed with /api/requests and stopped by ID
+	// with /api/stop, including while they wait for the model to load
+	ctx := c.Request.Context()
+	var requestID string
+	if req.Stream == nil || *req.Stream {
+		var done func()
+		ctx, requestID, done = s.requests.add(ctx, req.Model)
+		defer done()
 	}
 
-	dst := model.ParseName(r.Destination)
-	if !dst.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
-		return
-	}
+	// the runner is released once the timeout cancels ctx
+	ctx, cancel := withTimeout(ctx, req.Timeout)
+	defer cancel()
 
-	if err := checkNameExists(dst); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	run, err := s.prepareChat(ctx, req, requestID, checkpointStart)
+	var bad badRequestError
+	var execErr *TemplateExecutionError
+	var tokenizeErr *TokenizeError
+	if timedOut(ctx, err) {
+		c.JSON(http.StatusOK, chatTimeout(req.Model, requestID))
+		return
+	} else if errors.As(err, &bad) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.As(err, &tokenizeErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "index": tokenizeErr.Index, "role": tokenizeErr.Role})
+		return
+	} else if errors.As(err, &execErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "template": execErr.Template, "line": execErr.Line, "node": execErr.Node})
 		return
-	}
-
-	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
 	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	}
-}
-
-func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		handleScheduleError(c, req.Model, err)
 		return
 	}
 
-	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusOK, run.loadResponse())
 		return
 	}
 
-	c.Status(http.StatusOK)
-}
-
-func (s *Server) CreateBlobHandler(c *gin.Context) {
-	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
-		p, err := GetBlobsPath(ib)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
-			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
-			delete(intermediateBlobs, c.Param("digest"))
-		} else if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		} else {
-			c.Status(http.StatusOK)
-			return
-		}
-	}
-
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+	slog.Debug("chat request", "images", len(run.images), "prompt", run.prompt)
 
-	_, err = os.Stat(path)
-	switch {
-	case errors.Is(err, os.ErrNotExist):
-		// noop
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	default:
-		c.Status(http.StatusOK)
+	if req.Stream != nil && !*req.Stream {
+		var cc chatCollector
+		s.completeChat(ctx, run, cc.add)
+		c.JSON(cc.result(run))
 		return
 	}
 
-	layer, err := NewLayer(c.Request.Body, "")
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		s.completeChat(ctx, run, func(v any) { ch <- v })
+	}()
 
-	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+	if wantsEventStream(c) {
+		streamEventResponse(c, ch)
 		return
 	}
 
-	c.Status(http.StatusCreated)
+	streamResponse(c, ch)
 }
 
-func isLocalIP(ip netip.Addr) bool {
-	if interfaces, err := net.Interfaces(); err == nil {
-		for _, iface := range interfaces {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				continue
-			}
+// badRequestError is an error in a chat request, as opposed to an error in
+// handling it
+type badRequestError struct {
+	error
+}
 
-			for _, a := range addrs {
-				if parsed, _, err := net.ParseCIDR(a.String()); err == nil {
-					if parsed.String() == ip.String() {
-						return true
-					}
-				}
-			}
-		}
-	}
+func (e badRequestError) Unwrap() error {
+	return e.error
+}
 
-	return false
+// chatRun is a chat request whose runner is scheduled and whose prompt is
+// assembled by prepareChat, ready to be completed by completeChat
+type chatRun struct {
+	req       api.ChatRequest
+	requestID string
+
+	r        llm.LlamaServer
+	m        *Model
+	opts     *api.Options
+	warnings []string
+	schema   *jsonschema.Schema
+
+	// history is the chat before fragments are expanded, as it's saved to
+	// the session and dead letter queue
+	sess     *chatSession
+	history  []api.Message
+	tokenize tokenizeFunc
+
+	documents       []api.Document
+	prompt          string
+	images          []llm.ImageData
+	system          string
+	truncatedTokens int
+	phases          *phaseTracker
+
+	requestedSeed int
+	seed          int
+
+	checkpointStart  time.Time
+	checkpointLoaded time.Time
+
+	// trimStream trims each streamed response for trim_response rather than
+	// only the complete response
+	trimStream bool
 }
 
-func allowedHost(host string) bool {
-	if host == "" || host == "localhost" {
-		return true
+// prepareChat schedules a runner for req and assembles its prompt. A request
+// without messages only loads the model. Errors in req itself are returned as
+// a badRequestError
+func (s *Server) prepareChat(ctx context.Context, req api.ChatRequest, requestID string, checkpointStart time.Time) (*chatRun, error) {
+	if err := checkGrammar(req.Format, req.Grammar); err != nil {
+		return nil, badRequestError{err}
 	}
 
-	if hostname, err := os.Hostname(); err == nil && host == hostname {
-		return true
+	var tmpl *template.Template
+	if req.Template != "" {
+		var err error
+		tmpl, err = loadTemplate(req.Template)
+		if errors.Is(err, errUnknownTemplate) || errors.Is(err, errInvalidTemplateName) {
+			return nil, badRequestError{err}
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
-	var tlds = []string{
-		"localhost",
-		"local",
-		"internal",
+	caps := []Capability{CapabilityCompletion}
+	if req.Tools != nil {
+		// a library template replaces the model's template so it decides
+		// whether tools are supported
+		if tmpl == nil {
+			caps = append(caps, CapabilityTools)
+		} else if !slices.Contains(tmpl.Vars(), "tools") {
+			return nil, badRequestError{fmt.Errorf("template %q does not support tools", req.Template)}
+		}
 	}
 
-	// check if the host is a local TLD
-	for _, tld := range tlds {
-		if strings.HasSuffix(host, "."+tld) {
-			return true
+	if len(req.Documents) > 0 {
+		if tmpl == nil {
+			caps = append(caps, CapabilityDocuments)
+		} else if !slices.Contains(tmpl.Vars(), "documents") {
+			return nil, badRequestError{fmt.Errorf("template %q does not support documents", req.Template)}
 		}
 	}
 
-	return false
-}
+	r, m, opts, warnings, err := s.scheduleRunner(ctx, req.Model, caps, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		return nil, badRequestError{fmt.Errorf("%q does not support chat", req.Model)}
+	} else if err != nil {
+		return nil, err
+	}
 
-func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if addr == nil {
-			c.Next()
-			return
-		}
+	if tmpl != nil {
+		// copy the model so the library template doesn't leak into other requests
+		mt := *m
+		mt.Template = tmpl
+		m = &mt
+	}
 
-		if addr, err := netip.ParseAddrPort(addr.String()); err == nil && !addr.Addr().IsLoopback() {
-			c.Next()
-			return
-		}
+	run := &chatRun{
+		requestID:        requestID,
+		r:                r,
+		m:                m,
+		opts:             opts,
+		warnings:         warnings,
+		checkpointStart:  checkpointStart,
+		checkpointLoaded: time.Now(),
+	}
 
-		host, _, err := net.SplitHostPort(c.Request.Host)
-		if err != nil {
-			host = c.Request.Host
-		}
+	s.requests.start(requestID)
+	run.requestedSeed = opts.Seed
+	run.seed = resolveSeed(opts)
 
-		if addr, err := netip.ParseAddr(host); err == nil {
-			if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || isLocalIP(addr) {
-				c.Next()
-				return
-			}
+	if len(opts.ResponseSchema) > 0 {
+		if run.schema, err = compileSchema(opts.ResponseSchema); err != nil {
+			return nil, badRequestError{err}
 		}
 
-		if allowedHost(host) {
-			if c.Request.Method == http.MethodOptions {
-				c.AbortWithStatus(http.StatusNoContent)
-				return
-			}
-
-			c.Next()
-			return
+		// nudge the model toward JSON so the response can be validated,
+		// unless a grammar constrains it already
+		if req.Format == "" && req.Grammar == "" {
+			req.Format = "json"
 		}
+	}
 
-		c.AbortWithStatus(http.StatusForbidden)
+	if len(req.Messages) == 0 {
+		run.req = req
+		return run, nil
 	}
-}
 
-func (s *Server) GenerateRoutes() http.Handler {
-	config := cors.DefaultConfig()
-	config.AllowWildcard = true
-	config.AllowBrowserExtensions = true
-	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"}
-	openAIProperties := []string{"lang", "package-version", "os", "arch", "runtime", "runtime-version", "async"}
-	for _, prop := range openAIProperties {
-		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
+	// requests in a session continue its history
+	if req.SessionID != "" {
+		run.sess, _ = s.sessions.get(req.SessionID, req.Model)
+		req.Messages = run.sess.history(req.Messages)
 	}
-	config.AllowOrigins = envconfig.AllowOrigins
 
-	r := gin.Default()
-	r.Use(
-		cors.New(config),
-		allowedHostsMiddleware(s.addr),
-	)
+	run.history = req.Messages
+	run.tokenize = run.sess.tokenize(r.Tokenize)
 
-	r.POST("/api/pull", s.PullModelHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
-	r.POST("/api/create", s.CreateModelHandler)
-	r.POST("/api/push", s.PushModelHandler)
-	r.POST("/api/copy", s.CopyModelHandler)
-	r.DELETE("/api/delete", s.DeleteModelHandler)
-	r.POST("/api/show", s.ShowModelHandler)
-	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
-	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
-	r.GET("/api/ps", s.ProcessHandler)
+	if temperature, ok, err := scheduledTemperature(req.TemperatureSchedule, run.history); err != nil {
+		return nil, badRequestError{err}
+	} else if ok {
+		opts.Temperature = temperature
+	}
 
-	// Compatibility endpoints
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListModelsHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowModelHandler)
+	req.Messages, err = chatMessages(m, &req)
+	if errors.Is(err, errUnknownFragment) {
+		return nil, badRequestError{err}
+	} else if err != nil {
+		return nil, err
+	}
 
-	for _, method := range []string{http.MethodGet, http.MethodHead} {
-		r.Handle(method, "/", func(c *gin.Context) {
-			c.String(http.StatusOK, "Ollama is running")
-		})
+	if req.Messages, err = trailingAssistant(req.Messages, opts.TrailingAssistant); err != nil {
+		return nil, badRequestError{err}
+	}
 
-		r.Handle(method, "/api/tags", s.ListModelsHandler)
-		r.Handle(method, "/api/version", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"version": version.Version})
-		})
+	var imageWarnings []string
+	if req.Messages, imageWarnings, err = checkImages(req.Messages, opts.ImageErrors); err != nil {
+		return nil, badRequestError{err}
 	}
 
-	return r
-}
+	run.warnings = append(run.warnings, imageWarnings...)
+	run.req = req
 
-func Serve(ln net.Listener) error {
-	level := slog.LevelInfo
-	if envconfig.Debug {
-		level = slog.LevelDebug
+	var summarize SummarizeFunc
+	if opts.SummarizeTruncated {
+		summarize = summarizer(m, r, opts)
 	}
 
-	slog.Info("server config", "env", envconfig.Values())
-	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level:     level,
-		AddSource: true,
-		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
-			if attr.Key == slog.SourceKey {
-				source := attr.Value.Any().(*slog.Source)
-				source.File = filepath.Base(source.File)
-			}
+	run.documents = chatDocuments(req.Documents)
+	// ctx is used so summarize_truncated can be stopped and timed out
+	run.prompt, run.images, run.system, run.truncatedTokens, err = chatPrompt(ctx, m, run.tokenize, opts, req.Messages, req.Tools, run.documents, summarize)
+	if errors.Is(err, errImagePlaceholders) || errors.Is(err, errUnknownRole) || errors.Is(err, errNoMessages) || errors.Is(err, ErrContextConstraintImpossible) || errors.Is(err, errInvalidImage) {
+		return nil, badRequestError{err}
+	} else if err != nil {
+		return nil, err
+	}
 
-			return attr
-		},
-	})
+	if req.Phases && (req.Stream == nil || *req.Stream) {
+		tokens, err := run.tokenize(ctx, run.prompt)
+		if err != nil {
+			return nil, err
+		}
 
-	slog.SetDefault(slog.New(handler))
+		run.phases = &phaseTracker{promptTokens: len(tokens), numPredict: opts.NumPredict}
+	}
 
-	blobsDir, err := GetBlobsPath("")
-	if err != nil {
-		return err
+	return run, nil
+}
+
+// chatTimeout is the response to a chat request which timed out before its
+// completion started
+func chatTimeout(model, requestID string) api.ChatResponse {
+	return api.ChatResponse{
+		Model:      model,
+		CreatedAt:  time.Now().UTC(),
+		Message:    api.Message{Role: "assistant"},
+		Done:       true,
+		DoneReason: "timeout",
+		RequestID:  requestID,
 	}
-	if err := fixBlobs(blobsDir); err != nil {
-		return err
+}
+
+// loadResponse is the response to a chat request without messages, which only
+// loads the model
+func (run *chatRun) loadResponse() api.ChatResponse {
+	return api.ChatResponse{
+		Model:      run.req.Model,
+		CreatedAt:  time.Now().UTC(),
+		Message:    api.Message{Role: "assistant"},
+		Done:       true,
+		DoneReason: "load",
+		RequestID:  run.requestID,
+		Warnings:   run.warnings,
 	}
+}
 
-	if !envconfig.NoPrune {
-		// clean up unused layers and manifests
-		if err := PruneLayers(); err != nil {
-			return err
-		}
+// completeChat completes run and sends its responses and errors with send,
+// returning once the completion is done
+func (s *Server) completeChat(ctx context.Context, run *chatRun, send func(any)) {
+	req, opts := run.req, run.opts
+
+	first := true
+	var raw, filtered, content strings.Builder
+	var invalid bool
+
+	var reasoning *reasoningParser
+	if req.ReasoningSteps {
+		reasoning = &reasoningParser{}
+	}
 
-		manifestsPath, err := GetManifestPath()
-		if err != nil {
-			return err
-		}
+	// filters trim the complete response themselves
+	var trimmer *streamTrimmer
+	if run.trimStream && opts.TrimResponse && s.processor == nil {
+		trimmer = &streamTrimmer{}
+	}
 
-		if err := PruneDirectory(manifestsPath); err != nil {
-			return err
+	// phaseResponse is a response without content in the prompt_eval phase
+	phaseResponse := func() api.ChatResponse {
+		res := api.ChatResponse{
+			Model:     req.Model,
+			CreatedAt: time.Now().UTC(),
+			Message:   api.Message{Role: "assistant"},
+			Phase:     phasePromptEval,
+			Progress:  run.phases.promptEval(),
 		}
-	}
 
-	ctx, done := context.WithCancel(context.Background())
-	schedCtx, schedDone := context.WithCancel(ctx)
-	sched := InitScheduler(schedCtx)
-	s := &Server{addr: ln.Addr(), sched: sched}
+		if first {
+			res.RequestID = run.requestID
+			res.Warnings = run.warnings
+			first = false
+		}
 
-	http.Handle("/", s.GenerateRoutes())
+		return res
+	}
 
-	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
-	srvr := &http.Server{
-		// Use http.DefaultServeMux so we get net/http/pprof for
-		// free.
-		//
-		// TODO(bmizerany): Decide if we want to make this
-		// configurable so it is not exposed by default, or allow
-		// users to bind it to a different port. This was a quick
-		// and easy way to get pprof, but it may not be the best
-		// way.
-		Handler: nil,
+	if run.phases != nil {
+		send(phaseResponse())
 	}
 
-	// listen for a ctrl+c and stop any loaded llm
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-signals
-		srvr.Close()
-		schedDone()
-		sched.unloadAllRunners()
-		gpu.Cleanup()
-		done()
-	}()
+	fn := func(r llm.CompletionResponse) {
+		var progress *api.PhaseProgress
+		if run.phases != nil {
+			var started bool
+			if progress, started = run.phases.generation(r); started {
+				send(phaseResponse())
+			}
+		}
 
-	if err := llm.Init(); err != nil {
-		return fmt.Errorf("unable to initialize llm library %w", err)
-	}
+		raw.WriteString(r.Content)
+
+		// reasoning steps are sent as their own responses and left out of
+		// the message content
+		if reasoning != nil {
+			var steps []api.ReasoningStep
+			steps, r.Content = reasoning.add(r.Content, r.Done)
+			for _, step := range steps {
+				res := api.ChatResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Message:   api.Message{Role: "assistant"},
+					Step:      &step,
+				}
 
-	s.sched.Run(schedCtx)
+				if progress != nil {
+					res.Phase, res.Progress = phaseGeneration, progress
+				}
 
-	// At startup we retrieve GPU information so we can get log messages before loading a model
-	// This will log warnings to the log in case we have problems with detected GPUs
-	gpus := gpu.GetGPUInfo()
-	gpus.LogDetails()
+				if first {
+					res.RequestID = run.requestID
+					res.Warnings = run.warnings
+					first = false
+				}
 
-	err = srvr.Serve(ln)
-	// If server is closed from the signal handler, wait for the ctx to be done
-	// otherwise error out quickly
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
-	}
-	<-ctx.Done()
-	return nil
-}
+				send(res)
+			}
 
-func waitForStream(c *gin.Context, ch chan interface{}) {
-	c.Header("Content-Type", "application/json")
-	for resp := range ch {
-		switch r := resp.(type) {
-		case api.ProgressResponse:
-			if r.Status == "success" {
-				c.JSON(http.StatusOK, r)
+			if r.Content == "" && !r.Done {
 				return
 			}
-		case gin.H:
-			if errorMsg, ok := r["error"].(string); ok {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+		}
+
+		if trimmer != nil {
+			r.Content = trimmer.add(r.Content, r.Done)
+		}
+
+		// filters apply to the complete response, which is sent with the
+		// final response
+		if s.processor != nil {
+			filtered.WriteString(r.Content)
+			if !r.Done && !first {
 				return
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in progress response"})
+			}
+
+			r.Content = ""
+			if r.Done {
+				var err error
+				if r.Content, err = s.processor.Apply(filtered.String()); err != nil {
+					send(gin.H{"error": err.Error()})
+					return
+				}
+
+				if opts.TrimResponse {
+					r.Content = strings.TrimSpace(r.Content)
+				}
+			}
+		}
+
+		// a response cut off by the timeout isn't expected to match the schema
+		content.WriteString(r.Content)
+		if run.schema != nil && r.Done && r.DoneReason != "timeout" {
+			var verr *SchemaValidationError
+			if err := validateResponse(run.schema, content.String()); errors.As(err, &verr) {
+				invalid = true
+				send(gin.H{"error": verr.Error(), "validation_errors": verr.Errors})
 				return
 			}
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
-			return
 		}
-	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
-}
 
-func streamResponse(c *gin.Context, ch chan any) {
-	c.Header("Content-Type", "application/x-ndjson")
-	c.Stream(func(w io.Writer) bool {
-		val, ok := <-ch
-		if !ok {
-			return false
+		res := api.ChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant", Content: r.Content},
+			Done:       r.Done,
+			DoneReason: r.DoneReason,
+			Metrics: api.Metrics{
+				PromptEvalCount:    r.PromptEvalCount,
+				PromptEvalDuration: r.PromptEvalDuration,
+				EvalCount:          r.EvalCount,
+				EvalDuration:       r.EvalDuration,
+				RunnerRSSPeak:      r.RunnerRSSPeak,
+				MemoryEstimateGPU:  r.MemoryEstimateGPU,
+			},
 		}
 
-		bts, err := json.Marshal(val)
-		if err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
-			return false
+		if progress != nil {
+			res.Phase, res.Progress = phaseGeneration, progress
 		}
 
-		// Delineate chunks with new-line delimiter
-		bts = append(bts, '\n')
-		if _, err := w.Write(bts); err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
-			return false
+		if first {
+			res.RequestID = run.requestID
+			res.Warnings = run.warnings
+			first = false
 		}
 
-		return true
-	})
+		if r.Done {
+			res.TotalDuration = time.Since(run.checkpointStart)
+			res.LoadDuration = run.checkpointLoaded.Sub(run.checkpointStart)
+			res.Seed = &run.seed
+			res.TemplateVersion = templateVersion(run.m, "")
+			res.PromptTruncatedCount = run.truncatedTokens
+			if req.IncludeSystem {
+				res.SystemRendered = run.system
+			}
+		}
+
+		send(res)
+	}
+
+	err := s.completion(ctx, run.m, run.r, llm.CompletionRequest{
+		Prompt:  run.prompt,
+		Images:  run.images,
+		Format:  req.Format,
+		Grammar: req.Grammar,
+		Options: opts,
+	}, run.requestedSeed, &run.seed, fn)
+	if timedOut(ctx, err) {
+		// the response ends with what was generated before the timeout.
+		// it isn't saved to the session since it was cut off
+		fn(llm.CompletionResponse{Done: true, DoneReason: "timeout"})
+	} else if err != nil {
+		// requests which the client canceled aren't dead letters
+		if envconfig.DLQPath != "" && ctx.Err() == nil {
+			failed := req
+			failed.Messages = run.history
+			path, derr := writeDeadLetter(envconfig.DLQPath, deadLetter{
+				Request:    failed,
+				Error:      err.Error(),
+				RequestID:  run.requestID,
+				ReceivedAt: run.checkpointStart.UTC(),
+				FailedAt:   time.Now().UTC(),
+			})
+			if derr != nil {
+				slog.Warn("couldn't write dead letter", "error", derr)
+			} else {
+				slog.Info("wrote failed chat request to dead letter queue", "path", path)
+			}
+		}
+
+		send(gin.H{"error": err.Error()})
+	} else if req.SessionID != "" && !invalid {
+		if err := s.sessions.save(ctx, req.SessionID, req.Model, run.tokenize, run.history, run.prompt, raw.String()); err != nil {
+			slog.Warn("couldn't save chat session", "session", req.SessionID, "error", err)
+		}
+	}
 }
 
-func (s *Server) ProcessHandler(c *gin.Context) {
-	models := []api.ProcessModelResponse{}
+// chatCollector collects the responses sent by completeChat into the single
+// response returned when stream is false
+type chatCollector struct {
+	resp    api.ChatResponse
+	content strings.Builder
+	steps   []api.ReasoningStep
+	err     gin.H
+}
 
-	for _, v := range s.sched.loaded {
-		model := v.model
-		modelDetails := api.ModelDetails{
-			Format:            model.Config.ModelFormat,
-			Family:            model.Config.ModelFamily,
-			Families:          model.Config.ModelFamilies,
-			ParameterSize:     model.Config.ModelType,
-			QuantizationLevel: model.Config.FileType,
+func (cc *chatCollector) add(v any) {
+	switch t := v.(type) {
+	case api.ChatResponse:
+		if t.Step != nil {
+			cc.steps = append(cc.steps, *t.Step)
+			return
 		}
 
-		mr := api.ProcessModelResponse{
-			Model:     model.ShortName,
-			Name:      model.ShortName,
-			Size:      int64(v.estimatedTotal),
-			SizeVRAM:  int64(v.estimatedVRAM),
-			Digest:    model.Digest,
-			Details:   modelDetails,
-			ExpiresAt: v.expiresAt,
+		cc.content.WriteString(t.Message.Content)
+		cc.resp = t
+	case gin.H:
+		if cc.err == nil {
+			cc.err = t
 		}
-		// The scheduler waits to set expiresAt, so if a model is loading it's
-		// possible that it will be set to the unix epoch. For those cases, just
-		// calculate the time w/ the sessionDuration instead.
-		var epoch time.Time
-		if v.expiresAt == epoch {
-			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+	}
+}
+
+// result returns the status code and body of the collected response of run,
+// or of its first error
+func (cc *chatCollector) result(run *chatRun) (int, any) {
+	if cc.err != nil {
+		if _, ok := cc.err["validation_errors"]; ok {
+			return http.StatusUnprocessableEntity, cc.err
 		}
 
-		models = append(models, mr)
+		return http.StatusInternalServerError, cc.err
 	}
 
-	slices.SortStableFunc(models, func(i, j api.ProcessModelResponse) int {
-		// longest duration remaining listed first
-		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
-	})
+	// citations are offsets into the trimmed content
+	resp := cc.resp
+	resp.Message.Content = cc.content.String()
+	if run.opts.TrimResponse {
+		resp.Message.Content = strings.TrimSpace(resp.Message.Content)
+	}
 
-	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+	resp.Steps = cc.steps
+	resp.Warnings = run.warnings
+	if toolCalls, ok := run.m.parseToolCalls(cc.content.String()); ok {
+		resp.Message.ToolCalls = toolCalls
+		resp.Message.Content = ""
+	} else if len(run.documents) > 0 {
+		resp.Message.Content, resp.Message.Citations = parseCitations(resp.Message.Content, run.documents)
+	}
+
+	return http.StatusOK, resp
 }
 
-func (s *Server) ChatHandler(c *gin.Context) {
-	checkpointStart := time.Now()
+// checkGrammar checks that grammar, if it's set, is a valid GBNF grammar and
+// that it isn't combined with format
+func checkGrammar(format, grammar string) error {
+	if grammar == "" {
+		return nil
+	}
 
-	var req api.ChatRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
-		return
-	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if format != "" {
+		return errors.New("format and grammar can't both be set")
 	}
 
-	caps := []Capability{CapabilityCompletion}
-	if req.Tools != nil {
-		caps = append(caps, CapabilityTools)
+	return llm.ValidateGrammar(grammar)
+}
+
+// scheduledTemperature returns the temperature that schedule sets for the next
+// response to msgs. The turn is the number of assistant messages in msgs, not
+// counting a partial one being continued. ok is false if no step has started
+func scheduledTemperature(schedule []api.TemperatureStep, msgs []api.Message) (temperature float32, ok bool, _ error) {
+	for i, step := range schedule {
+		if step.Turn < 0 {
+			return 0, false, fmt.Errorf("temperature_schedule %d: turn must not be negative, got %d", i, step.Turn)
+		} else if step.Temperature < 0 {
+			return 0, false, fmt.Errorf("temperature_schedule %d: temperature must not be negative, got %v", i, step.Temperature)
+		}
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
-	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
-		return
-	} else if err != nil {
-		handleScheduleError(c, req.Model, err)
-		return
+	var turn int
+	for i, msg := range msgs {
+		if strings.EqualFold(msg.Role, "assistant") && !(msg.Partial && i == len(msgs)-1) {
+			turn++
+		}
 	}
 
-	checkpointLoaded := time.Now()
+	latest := -1
+	for _, step := range schedule {
+		if step.Turn <= turn && step.Turn > latest {
+			temperature, ok, latest = step.Temperature, true, step.Turn
+		}
+	}
 
-	if len(req.Messages) == 0 {
-		c.JSON(http.StatusOK, api.ChatResponse{
-			Model:      req.Model,
-			CreatedAt:  time.Now().UTC(),
-			Message:    api.Message{Role: "assistant"},
-			Done:       true,
-			DoneReason: "load",
-		})
-		return
+	return temperature, ok, nil
+}
+
+// chatDocuments returns a copy of docs with missing IDs set to the
+// document's index
+func chatDocuments(docs []api.Document) []api.Document {
+	docs = slices.Clone(docs)
+	for i := range docs {
+		if docs[i].ID == "" {
+			docs[i].ID = strconv.Itoa(i)
+		}
 	}
 
-	if req.Messages[0].Role != "system" {
-		req.Messages = append([]api.Message{{Role: "system", Content: m.System}}, req.Messages...)
+	return docs
+}
+
+// chatMessages returns the messages of req with the system messages of model m
+// and req's fragments added
+func chatMessages(m *Model, req *api.ChatRequest) ([]api.Message, error) {
+	msgs := req.Messages
+
+	// an explicitly empty system prompt disables the model's default
+	if !strings.EqualFold(msgs[0].Role, "system") && (req.System == nil || *req.System != "") {
+		system := m.System
+		if req.System != nil {
+			system = *req.System
+		}
+
+		msgs = append([]api.Message{{Role: "system", Content: system}}, msgs...)
 	}
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, req.Messages, req.Tools)
+	// fragments are added after the leading system messages and, like other
+	// system messages, count toward the context window
+	refs, err := expandSystemRefs(req.Model, req.SystemRefs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
-	slog.Debug("chat request", "images", len(images), "prompt", prompt)
+	if len(refs) > 0 {
+		i := slices.IndexFunc(msgs, func(m api.Message) bool { return !strings.EqualFold(m.Role, "system") })
+		if i < 0 {
+			i = len(msgs)
+		}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
-			res := api.ChatResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
-				Done:       r.Done,
-				DoneReason: r.DoneReason,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
-			}
+		// drop empty system messages, e.g. an unset model system prompt, so
+		// they aren't merged with the fragments
+		system := slices.DeleteFunc(slices.Clone(msgs[:i]), func(m api.Message) bool { return m.Content == "" })
+		msgs = slices.Concat(system, refs, msgs[i:])
+	}
 
-			if r.Done {
-				res.TotalDuration = time.Since(checkpointStart)
-				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
-			}
+	// examples follow the system messages, including fragments, and are
+	// truncated like other messages when the chat doesn't fit
+	if req.IncludeExamples {
+		examples, err := chatExampleMessages(req.Model)
+		if err != nil {
+			return nil, err
+		}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		i := slices.IndexFunc(msgs, func(m api.Message) bool { return !strings.EqualFold(m.Role, "system") })
+		if i < 0 {
+			i = len(msgs)
 		}
-	}()
 
-	if req.Stream != nil && !*req.Stream {
-		var resp api.ChatResponse
-		var sb strings.Builder
-		for rr := range ch {
-			switch t := rr.(type) {
-			case api.ChatResponse:
-				sb.WriteString(t.Message.Content)
-				resp = t
-			case gin.H:
-				msg, ok := t["error"].(string)
-				if !ok {
-					msg = "unexpected error format in response"
-				}
+		msgs = slices.Concat(msgs[:i], examples, msgs[i:])
+	}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
-				return
-			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
-				return
-			}
-		}
+	return msgs, nil
+}
 
-		resp.Message.Content = sb.String()
-		if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-			resp.Message.ToolCalls = toolCalls
-			resp.Message.Content = ""
+var (
+	errTrailingAssistant = errors.New("chat ends with an assistant message")
+	errNoMessagesLeft    = errors.New("no messages left after dropping the trailing assistant message")
+)
+
+// trailingAssistant handles the last message of msgs if it's an assistant
+// message which isn't partial, as set by mode, an [api.Options.TrailingAssistant].
+// msgs are returned as is otherwise
+func trailingAssistant(msgs []api.Message, mode string) ([]api.Message, error) {
+	n := len(msgs) - 1
+	if n < 0 || !strings.EqualFold(msgs[n].Role, "assistant") || msgs[n].Partial {
+		return msgs, nil
+	}
+
+	switch mode {
+	case "error":
+		return nil, fmt.Errorf("%w: set partial to continue it", errTrailingAssistant)
+	case "ignore":
+		if n == 0 {
+			return nil, errNoMessagesLeft
 		}
 
-		c.JSON(http.StatusOK, resp)
-		return
+		return msgs[:n], nil
+	case "prefill":
+		msgs = slices.Clone(msgs)
+		msgs[n].Partial = true
 	}
 
-	streamResponse(c, ch)
+	return msgs, nil
 }
 
 func handleScheduleError(c *gin.Context, name string, err error) {
+	var loadErr *llm.LoadError
 	switch {
-	case errors.Is(err, errRequired):
+	case errors.Is(err, errRequired), errors.Is(err, errStopTokens):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
@@ -1401,6 +4036,8 @@ func handleScheduleError(c *gin.Context, name string, err error) {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 	case errors.Is(err, os.ErrNotExist):
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+	case errors.As(err, &loadErr):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "diagnostic": loadErr.LoadDiagnostic})
 	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestAliases(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+
+	for _, name := range []string{"test", "other:7b"} {
+		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	list := func(t *testing.T) []api.AliasResponse {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/aliases", nil)
+		s.ListAliasesHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ListAliasesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Aliases
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		if aliases := list(t); len(aliases) != 0 {
+			t.Errorf("expected no aliases, got %v", aliases)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		for _, r := range []api.AliasRequest{
+			{Alias: "fast", Target: "test"},
+			// an alias of an alias resolves to the model
+			{Alias: "quick", Target: "fast"},
+			{Alias: "big", Target: "other:7b"},
+			// aliases can be pointed at another model
+			{Alias: "big", Target: "test"},
+		} {
+			if w := createRequest(t, s.CreateAliasHandler, r); w.Code != http.StatusOK {
+				t.Fatalf("%v: expected status 200, got %d: %s", r, w.Code, w.Body.String())
+			}
+		}
+
+		if diff := cmp.Diff([]api.AliasResponse{
+			{Alias: "big:latest", Target: "test:latest"},
+			{Alias: "fast:latest", Target: "test:latest"},
+			{Alias: "quick:latest", Target: "test:latest"},
+		}, list(t)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		m, err := GetModel("quick")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.ModelPath != target.ModelPath {
+			t.Errorf("expected model %s, got %s", target.ModelPath, m.ModelPath)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := []struct {
+			req  api.AliasRequest
+			code int
+		}{
+			{api.AliasRequest{Alias: "fast", Target: "missing"}, http.StatusNotFound},
+			{api.AliasRequest{Target: "test"}, http.StatusBadRequest},
+			{api.AliasRequest{Alias: "fast"}, http.StatusBadRequest},
+			// a model can't be replaced with an alias, which also prevents
+			// cycles since aliases resolve to models
+			{api.AliasRequest{Alias: "test", Target: "fast"}, http.StatusConflict},
+			{api.AliasRequest{Alias: "Fast", Target: "test"}, http.StatusBadRequest},
+		}
+
+		for _, tt := range cases {
+			if w := createRequest(t, s.CreateAliasHandler, tt.req); w.Code != tt.code {
+				t.Errorf("%v: expected status %d, got %d: %s", tt.req, tt.code, w.Code, w.Body.String())
+			}
+		}
+
+		if _, err := GetModel("test"); err != nil {
+			t.Errorf("expected model test to be kept, got %v", err)
+		}
+	})
+
+	t.Run("circular", func(t *testing.T) {
+		w := createRequest(t, s.CopyModelHandler, api.CopyRequest{Source: "fast", Destination: "test", Alias: true})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
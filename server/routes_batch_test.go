@@ -0,0 +1,380 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// echoRunner streams each word of the prompt back as a separate token
+type echoRunner struct {
+	mockRunner
+
+	mu       sync.Mutex
+	prompts  []string
+	grammars []string
+}
+
+func (m *echoRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	m.mu.Lock()
+	m.prompts = append(m.prompts, r.Prompt)
+	m.grammars = append(m.grammars, r.Grammar)
+	m.mu.Unlock()
+
+	for _, word := range strings.Fields(r.Prompt) {
+		fn(llm.CompletionResponse{Content: word + " "})
+	}
+
+	fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestGenerateBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock echoRunner
+	s := Server{sched: newMockScheduler(&mock.mockRunner)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `SYSTEM "Be brief."
+TEMPLATE """{{ .System }} {{ .Prompt }}"""`)
+
+	t.Run("interleaved", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:   "test",
+			Prompts: []string{"Why is the sky blue?", "Hello!"},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		responses := make(map[int]string)
+		done := make(map[int]bool)
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.GenerateBatchResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if done[resp.Index] {
+				t.Errorf("unexpected response for prompt %d after it was done", resp.Index)
+			}
+
+			responses[resp.Index] += resp.Response
+			done[resp.Index] = resp.Done
+		}
+
+		if diff := cmp.Diff(responses, map[int]string{
+			0: "Be brief. Why is the sky blue? ",
+			1: "Be brief. Hello! ",
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(done, map[int]bool{0: true, 1: true}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("system override", func(t *testing.T) {
+		mock.prompts = nil
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:   "test",
+			Prompts: []string{"Hello!"},
+			System:  "Be verbose.",
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.prompts, []string{"Be verbose. Hello!"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("no prompts", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{Model: "test"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestChatBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock echoRunner
+	s := Server{sched: newMockScheduler(&mock.mockRunner)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `SYSTEM "Be brief."
+TEMPLATE """{{- range .Messages }}{{ .Content }} {{ end }}"""`)
+
+	batch := func(t *testing.T, req api.ChatBatchRequest) (map[int]string, map[int]string) {
+		t.Helper()
+
+		w := createRequest(t, s.ChatBatchHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		responses := make(map[int]string)
+		errors := make(map[int]string)
+		done := make(map[int]bool)
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp struct {
+				api.ChatBatchResponse
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if done[resp.Index] {
+				t.Errorf("unexpected response for request %d after it was done", resp.Index)
+			}
+
+			if resp.Error != "" {
+				errors[resp.Index] = resp.Error
+				done[resp.Index] = true
+				continue
+			}
+
+			responses[resp.Index] += resp.Message.Content
+			done[resp.Index] = resp.Done
+		}
+
+		for i := range req.Requests {
+			if !done[i] {
+				t.Errorf("expected request %d to be done", i)
+			}
+		}
+
+		return responses, errors
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	t.Run("interleaved", func(t *testing.T) {
+		for _, parallel := range []int{0, 1} {
+			responses, errors := batch(t, api.ChatBatchRequest{
+				Requests: []api.ChatRequest{
+					{Model: "test", Messages: []api.Message{{Role: "user", Content: "Why is the sky blue?"}}},
+					{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+				},
+				Parallel: parallel,
+			})
+
+			if len(errors) > 0 {
+				t.Fatalf("unexpected errors: %v", errors)
+			}
+
+			if diff := cmp.Diff(responses, map[int]string{
+				0: "Be brief. Why is the sky blue? ",
+				1: "Be brief. Hello! ",
+			}); diff != "" {
+				t.Errorf("parallel %d: mismatch (-got +want):\n%s", parallel, diff)
+			}
+		}
+	})
+
+	t.Run("num_ctx", func(t *testing.T) {
+		empty := ""
+		responses, errors := batch(t, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: msgs, System: &empty},
+				{Model: "test", Messages: msgs, System: &empty, Options: map[string]any{"num_ctx": 12}},
+			},
+		})
+
+		if len(errors) > 0 {
+			t.Fatalf("unexpected errors: %v", errors)
+		}
+
+		if diff := cmp.Diff(responses, map[int]string{
+			0: "You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. ",
+			1: "A test. And a thumping good one at that, I'd wager. ",
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		empty := ""
+		responses, errors := batch(t, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+				{Model: "missing", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+				{Model: "test", Messages: []api.Message{{Role: "robot", Content: "Hello!"}}},
+				{Model: "test", Messages: []api.Message{{Role: "assistant", Content: "Hi"}}, System: &empty, Options: map[string]any{"trailing_assistant": "ignore"}},
+			},
+		})
+
+		if diff := cmp.Diff(responses, map[int]string{0: "Be brief. Hello! "}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(errors) != 3 || !strings.Contains(errors[1], "not found") || !strings.Contains(errors[2], "unknown role") || !strings.Contains(errors[3], "no messages left") {
+			t.Errorf("expected errors for requests 1, 2 and 3, got %v", errors)
+		}
+	})
+
+	t.Run("grammar", func(t *testing.T) {
+		mock.grammars = nil
+		grammar := `root ::= "yes" | "no"`
+		responses, errors := batch(t, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Grammar: grammar},
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Grammar: `root ::= "yes`},
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Grammar: grammar, Format: "json"},
+			},
+		})
+
+		if diff := cmp.Diff(responses, map[int]string{0: "Be brief. Hello! "}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(mock.grammars, []string{grammar}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(errors) != 2 || !strings.Contains(errors[2], "format and grammar can't both be set") {
+			t.Errorf("expected errors for requests 1 and 2, got %v", errors)
+		}
+	})
+
+	t.Run("trim_response", func(t *testing.T) {
+		responses, errors := batch(t, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Options: map[string]any{"trim_response": true}},
+			},
+		})
+
+		if len(errors) > 0 {
+			t.Fatalf("unexpected errors: %v", errors)
+		}
+
+		if diff := cmp.Diff(responses, map[int]string{0: "Be brief. Hello!"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("include_system", func(t *testing.T) {
+		w := createRequest(t, s.ChatBatchHandler, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, IncludeSystem: true},
+			},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), `"system_rendered":"Be brief."`) {
+			t.Errorf("expected the rendered system prompt, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("stream false", func(t *testing.T) {
+		createMockModel(t, &s, "documents", `TEMPLATE """{{- range .Documents }}{{ .Text }} {{ end }}{{- range .Messages }}{{ .Content }} {{ end }}"""`)
+
+		stream := false
+		w := createRequest(t, s.ChatBatchHandler, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{
+					Model:     "documents",
+					Messages:  []api.Message{{Role: "user", Content: "Why?"}},
+					Documents: []api.Document{{Text: "<co: 0>Chlorophyll</co: 0>"}},
+					Stream:    &stream,
+					Options:   map[string]any{"trim_response": true},
+				},
+			},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resps []api.ChatBatchResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.ChatBatchResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			resps = append(resps, resp)
+		}
+
+		if len(resps) != 1 {
+			t.Fatalf("expected a single response, got %d", len(resps))
+		}
+
+		if !resps[0].Done || resps[0].Message.Content != "Chlorophyll Why?" {
+			t.Errorf("expected the complete response, got %+v", resps[0])
+		}
+
+		if diff := cmp.Diff(resps[0].Message.Citations, []api.Citation{
+			{Start: 0, End: 11, Text: "Chlorophyll", Documents: []string{"0"}},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, errors := batch(t, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, SessionID: "session"},
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Phases: true},
+				{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, ReasoningSteps: true},
+			},
+		})
+
+		if diff := cmp.Diff(errors, map[int]string{
+			0: "session_id isn't supported in batch requests",
+			1: "phases isn't supported in batch requests",
+			2: "reasoning_steps isn't supported in batch requests",
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("no requests", func(t *testing.T) {
+		w := createRequest(t, s.ChatBatchHandler, api.ChatBatchRequest{})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestBenchmark(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:               true,
+			DoneReason:         "length",
+			PromptEvalCount:    64,
+			PromptEvalDuration: 500 * time.Millisecond,
+			EvalCount:          16,
+			EvalDuration:       2 * time.Second,
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	t.Run("benchmark", func(t *testing.T) {
+		w := createRequest(t, s.BenchmarkHandler, api.BenchmarkRequest{
+			Model:         "test",
+			PromptTokens:  64,
+			PredictTokens: 16,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(mock.CompletionRequest.Tokens) != 64 {
+			t.Errorf("expected 64 prompt tokens, got %d", len(mock.CompletionRequest.Tokens))
+		}
+
+		if mock.CompletionRequest.Options.NumPredict != 16 {
+			t.Errorf("expected num_predict 16, got %d", mock.CompletionRequest.Options.NumPredict)
+		}
+
+		var resp api.BenchmarkResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptTokensPerSecond != 128 {
+			t.Errorf("expected 128 prompt tokens/s, got %v", resp.PromptTokensPerSecond)
+		}
+
+		if resp.TokensPerSecond != 8 {
+			t.Errorf("expected 8 tokens/s, got %v", resp.TokensPerSecond)
+		}
+
+		if resp.EvalCount != 16 || resp.PromptEvalCount != 64 {
+			t.Errorf("unexpected counts %d, %d", resp.PromptEvalCount, resp.EvalCount)
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		w := createRequest(t, s.BenchmarkHandler, api.BenchmarkRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(mock.CompletionRequest.Tokens) != defaultBenchmarkPromptTokens {
+			t.Errorf("expected %d prompt tokens, got %d", defaultBenchmarkPromptTokens, len(mock.CompletionRequest.Tokens))
+		}
+
+		if mock.CompletionRequest.Options.NumPredict != defaultBenchmarkPredictTokens {
+			t.Errorf("expected num_predict %d, got %d", defaultBenchmarkPredictTokens, mock.CompletionRequest.Options.NumPredict)
+		}
+	})
+
+	t.Run("exceeds context", func(t *testing.T) {
+		w := createRequest(t, s.BenchmarkHandler, api.BenchmarkRequest{
+			Model:        "test",
+			PromptTokens: 4096,
+			Options:      map[string]any{"num_ctx": 1024},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		w := createRequest(t, s.BenchmarkHandler, api.BenchmarkRequest{Model: "test", PredictTokens: -1})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.BenchmarkHandler, api.BenchmarkRequest{Model: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -64,6 +65,7 @@ func createRequest(t *testing.T, fn func(*gin.Context), body any) *httptest.Resp
 	}
 
 	c.Request = &http.Request{
+		URL:  &url.URL{},
 		Body: io.NopCloser(&b),
 	}
 
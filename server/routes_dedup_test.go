@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// countingRunner streams a response in two parts, waiting for release between
+// them, and counts its completions
+type countingRunner struct {
+	mockRunner
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (m *countingRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	m.calls.Add(1)
+	fn(llm.CompletionResponse{Content: "Hello"})
+
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	fn(llm.CompletionResponse{Content: " world", Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestChatDedup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_DEDUP", "1")
+	envconfig.LoadConfig()
+	defer func() { envconfig.Dedup = false }()
+
+	var mock countingRunner
+	s := Server{sched: newMockScheduler(&mock.mockRunner)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	// callers returns the number of callers sharing each running completion
+	callers := func() []int {
+		s.completions.mu.Lock()
+		defer s.completions.mu.Unlock()
+
+		var n []int
+		for _, call := range s.completions.calls {
+			call.mu.Lock()
+			n = append(n, call.callers)
+			call.mu.Unlock()
+		}
+		return n
+	}
+
+	waitFor := func(t *testing.T, cond func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	chat := func(reqs ...api.ChatRequest) []api.ChatResponse {
+		responses := make([]api.ChatResponse, len(reqs))
+		var wg sync.WaitGroup
+		for i, req := range reqs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				req.Stream = &stream
+				w := createRequest(t, s.ChatHandler, req)
+				if w.Code != http.StatusOK {
+					t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+					return
+				}
+
+				if err := json.NewDecoder(w.Body).Decode(&responses[i]); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+
+		wg.Wait()
+		return responses
+	}
+
+	req := api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}}
+
+	t.Run("identical", func(t *testing.T) {
+		mock.calls.Store(0)
+		mock.release = make(chan struct{})
+
+		go func() {
+			waitFor(t, func() bool {
+				n := callers()
+				return len(n) == 1 && n[0] == 2
+			})
+			close(mock.release)
+		}()
+
+		responses := chat(req, req)
+		if calls := mock.calls.Load(); calls != 1 {
+			t.Errorf("expected 1 completion, got %d", calls)
+		}
+
+		for _, resp := range responses {
+			if resp.Message.Content != "Hello world" || !resp.Done {
+				t.Errorf("expected complete response, got %+v", resp)
+			}
+		}
+
+		if responses[0].Seed == nil || responses[1].Seed == nil || *responses[0].Seed != *responses[1].Seed {
+			t.Errorf("expected the same seed, got %v and %v", responses[0].Seed, responses[1].Seed)
+		}
+
+		if n := callers(); len(n) != 0 {
+			t.Errorf("expected no running completions, got %v", n)
+		}
+	})
+
+	t.Run("different options", func(t *testing.T) {
+		mock.calls.Store(0)
+		mock.release = make(chan struct{})
+
+		other := req
+		other.Options = map[string]any{"temperature": 0.2}
+
+		go func() {
+			waitFor(t, func() bool { return len(callers()) == 2 })
+			close(mock.release)
+		}()
+
+		chat(req, other)
+		if calls := mock.calls.Load(); calls != 2 {
+			t.Errorf("expected 2 completions, got %d", calls)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		mock.calls.Store(0)
+		mock.release = make(chan struct{})
+
+		var seed int
+		key := "canceled"
+		run := func(ctx context.Context, fn func(llm.CompletionResponse)) error {
+			return mock.Completion(ctx, llm.CompletionRequest{}, fn)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.completions.do(ctx, key, &seed, run, func(llm.CompletionResponse) {})
+		}()
+
+		waitFor(t, func() bool { return len(callers()) == 1 })
+
+		// the completion keeps running while another caller is reading it
+		var content string
+		done := make(chan error, 1)
+		go func() {
+			done <- s.completions.do(context.Background(), key, &seed, run, func(r llm.CompletionResponse) {
+				content += r.Content
+			})
+		}()
+
+		waitFor(t, func() bool {
+			n := callers()
+			return len(n) == 1 && n[0] == 2
+		})
+
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Errorf("expected context canceled, got %v", err)
+		}
+
+		close(mock.release)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if content != "Hello world" {
+			t.Errorf("expected %q, got %q", "Hello world", content)
+		}
+
+		if calls := mock.calls.Load(); calls != 1 {
+			t.Errorf("expected 1 completion, got %d", calls)
+		}
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/types/model"
@@ -105,3 +107,96 @@ func TestDeleteDuplicateLayers(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
 }
+
+func TestDeleteAlias(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	for _, r := range []api.CopyRequest{
+		{Source: "test", Destination: "test:prod", Alias: true},
+		// an alias of an alias resolves to the same model
+		{Source: "test:prod", Destination: "test:stable", Alias: true},
+		// a copy of an alias is a copy of the model
+		{Source: "test:prod", Destination: "test:copy"},
+	} {
+		w = createRequest(t, s.CopyModelHandler, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w = createRequest(t, s.CopyModelHandler, api.CopyRequest{Source: "missing", Destination: "test:missing", Alias: true})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.ListModelsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var list api.ListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	aliases := make(map[string]string)
+	for _, m := range list.Models {
+		aliases[m.Name] = m.AliasOf
+	}
+
+	if diff := cmp.Diff(map[string]string{
+		"test:latest": "",
+		"test:prod":   "test:latest",
+		"test:stable": "test:latest",
+		"test:copy":   "",
+	}, aliases); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	w = createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Name: "test"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, actual %d", w.Code)
+	}
+
+	if expect := `{"error":"model \"test\" is the target of the aliases test:prod, test:stable, delete them first"}`; w.Body.String() != expect {
+		t.Errorf("expected %s, actual %s", expect, w.Body.String())
+	}
+
+	for _, name := range []string{"test:prod", "test:stable"} {
+		w = createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Name: name})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	// the model's blobs are kept for the copy
+	w = createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Name: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "copy"),
+	})
+
+	w = createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Name: "test:copy"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{})
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestChatExamples(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `SYSTEM Be brief.
+TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	withParams := func(fn gin.HandlerFunc, params ...gin.Param) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Params = params
+			fn(c)
+		}
+	}
+
+	name := gin.Param{Key: "name", Value: "test"}
+
+	list := func(t *testing.T) []api.ChatExample {
+		t.Helper()
+
+		w := createRequest(t, withParams(s.ListChatExamplesHandler, name), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ListChatExamplesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Examples
+	}
+
+	add := func(t *testing.T, msgs ...api.Message) api.ChatExample {
+		t.Helper()
+
+		w := createRequest(t, withParams(s.CreateChatExampleHandler, name), api.ChatExampleRequest{Messages: msgs})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var example api.ChatExample
+		if err := json.NewDecoder(w.Body).Decode(&example); err != nil {
+			t.Fatal(err)
+		}
+
+		return example
+	}
+
+	chat := func(t *testing.T, include bool) string {
+		t.Helper()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:           "test",
+			Messages:        []api.Message{{Role: "user", Content: "3+3?"}},
+			IncludeExamples: include,
+			Stream:          &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		return mock.CompletionRequest.Prompt
+	}
+
+	if examples := list(t); len(examples) != 0 {
+		t.Fatalf("expected no examples, got %v", examples)
+	}
+
+	first := add(t, api.Message{Role: "user", Content: "1+1?"}, api.Message{Role: "assistant", Content: "2"})
+	second := add(t, api.Message{Role: "User", Content: "2+2?"}, api.Message{Role: "assistant", Content: "4"})
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("expected unique ids, got %q and %q", first.ID, second.ID)
+	}
+
+	if diff := cmp.Diff([]api.ChatExample{first, second}, list(t)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("include", func(t *testing.T) {
+		expect := "system: Be brief. user: 1+1? assistant: 2 user: 2+2? assistant: 4 user: 3+3? "
+		if prompt := chat(t, true); prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, prompt)
+		}
+
+		expect = "system: Be brief. user: 3+3? "
+		if prompt := chat(t, false); prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, prompt)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := createRequest(t, withParams(s.DeleteChatExampleHandler, name, gin.Param{Key: "id", Value: first.ID}), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, withParams(s.DeleteChatExampleHandler, name, gin.Param{Key: "id", Value: first.ID}), nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff([]api.ChatExample{second}, list(t)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		expect := "system: Be brief. user: 2+2? assistant: 4 user: 3+3? "
+		if prompt := chat(t, true); prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, prompt)
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		for _, msgs := range [][]api.Message{
+			nil,
+			{{Role: "system", Content: "Be brief."}},
+		} {
+			w := createRequest(t, withParams(s.CreateChatExampleHandler, name), api.ChatExampleRequest{Messages: msgs})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("unknown model", func(t *testing.T) {
+		w := createRequest(t, withParams(s.ListChatExamplesHandler, gin.Param{Key: "name", Value: "missing"}), nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
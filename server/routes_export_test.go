@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestChatExportCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+
+	export := func(t *testing.T, req api.ChatExportCodeRequest) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(req); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "http://ollama.example.com:11434/api/chat/export/code", &b)
+		s.ChatExportCodeHandler(c)
+		return w
+	}
+
+	code := func(t *testing.T, req api.ChatExportCodeRequest) string {
+		t.Helper()
+
+		w := export(t, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatExportCodeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Language != req.Language {
+			t.Errorf("expected language %q, got %q", req.Language, resp.Language)
+		}
+
+		return resp.Code
+	}
+
+	stream := false
+	chat := api.ChatRequest{
+		Model: "llama3",
+		Messages: []api.Message{
+			{Role: "system", Content: "You're a pirate."},
+			{Role: "user", Content: "What's the weather?"},
+		},
+		// top_k is the default so it's left out
+		Options:   map[string]any{"temperature": 0.2, "top_k": 40, "stop": []string{"<|end|>"}},
+		KeepAlive: &api.Duration{Duration: 10 * time.Minute},
+	}
+
+	t.Run("curl", func(t *testing.T) {
+		req := chat
+		req.Stream = &stream
+
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "curl"})
+		expect := `curl http://ollama.example.com:11434/api/chat -d '{
+  "model": "llama3",
+  "messages": [
+    {
+      "role": "system",
+      "content": "You'\''re a pirate."
+    },
+    {
+      "role": "user",
+      "content": "What'\''s the weather?"
+    }
+  ],
+  "options": {
+    "stop": [
+      "<|end|>"
+    ],
+    "temperature": 0.2
+  },
+  "keep_alive": "10m0s",
+  "stream": false
+}'
+`
+		if diff := cmp.Diff(got, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("python", func(t *testing.T) {
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: chat, Language: "python"})
+		expect := `from ollama import chat
+
+stream = chat(
+    model="llama3",
+    messages=[
+        {"role": "system", "content": "You're a pirate."},
+        {"role": "user", "content": "What's the weather?"},
+    ],
+    options={"stop": ["<|end|>"], "temperature": 0.2},
+    keep_alive="10m0s",
+    stream=True,
+)
+
+for chunk in stream:
+    print(chunk["message"]["content"], end="", flush=True)
+`
+		if diff := cmp.Diff(got, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("go", func(t *testing.T) {
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: chat, Language: "go"})
+		if _, err := parser.ParseFile(token.NewFileSet(), "main.go", got, 0); err != nil {
+			t.Fatalf("expected valid Go, got %v:\n%s", err, got)
+		}
+
+		for _, s := range []string{
+			`{Role: "user", Content: "What's the weather?"}`,
+			`"temperature": 0.2`,
+			`"stop":        []string{"<|end|>"}`,
+			`KeepAlive: &api.Duration{Duration: 10 * time.Minute}`,
+		} {
+			if !strings.Contains(got, s) {
+				t.Errorf("expected code to contain %q:\n%s", s, got)
+			}
+		}
+
+		if strings.Contains(got, "top_k") || strings.Contains(got, "Stream") {
+			t.Errorf("expected default parameters to be left out:\n%s", got)
+		}
+	})
+
+	t.Run("go images", func(t *testing.T) {
+		req := chat
+		req.Messages = []api.Message{{Role: "user", Content: "What's in this image?", Images: []api.ImageData{[]byte("image")}}}
+		req.Stream = &stream
+
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "go"})
+		if _, err := parser.ParseFile(token.NewFileSet(), "main.go", got, 0); err != nil {
+			t.Fatalf("expected valid Go, got %v:\n%s", err, got)
+		}
+
+		for _, s := range []string{`"images":["aW1hZ2U="]`, `"encoding/json"`, `Stream:    &stream`} {
+			if !strings.Contains(got, s) {
+				t.Errorf("expected code to contain %q:\n%s", s, got)
+			}
+		}
+	})
+
+	t.Run("go documents", func(t *testing.T) {
+		req := chat
+		req.Documents = []api.Document{{Title: "Weather", Text: "It's sunny."}}
+
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "go"})
+		if _, err := parser.ParseFile(token.NewFileSet(), "main.go", got, 0); err != nil {
+			t.Fatalf("expected valid Go, got %v:\n%s", err, got)
+		}
+
+		for _, s := range []string{`var documents []api.Document`, `"title":"Weather"`, `Documents: documents`} {
+			if !strings.Contains(got, s) {
+				t.Errorf("expected code to contain %q:\n%s", s, got)
+			}
+		}
+
+		if w := export(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "python"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		req := chat
+		req.Messages = append(slices.Clone(chat.Messages), api.Message{Role: "assistant", Content: "Arr,", Partial: true})
+		req.Grammar = `root ::= "yes" | "no"`
+		req.Timeout = &api.Duration{Duration: 30 * time.Second}
+		req.SessionID = "voyage"
+		req.Phases = true
+		req.ReasoningSteps = true
+		req.TemperatureSchedule = []api.TemperatureStep{{Turn: 0, Temperature: 0.2}, {Turn: 3, Temperature: 0.8}}
+		req.IncludeSystem = true
+		req.IncludeExamples = true
+
+		curl := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "curl"})
+		for _, s := range []string{
+			`"partial": true`,
+			`"grammar": "root ::= \"yes\" | \"no\""`,
+			`"timeout": "30s"`,
+			`"session_id": "voyage"`,
+			`"phases": true`,
+			`"reasoning_steps": true`,
+			`"temperature_schedule": [`,
+			`"include_system": true`,
+			`"include_examples": true`,
+		} {
+			if !strings.Contains(curl, s) {
+				t.Errorf("expected curl command to contain %q:\n%s", s, curl)
+			}
+		}
+
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "go"})
+		if _, err := parser.ParseFile(token.NewFileSet(), "main.go", got, 0); err != nil {
+			t.Fatalf("expected valid Go, got %v:\n%s", err, got)
+		}
+
+		for _, s := range []string{
+			`"partial":true`,
+			`Grammar:`,
+			`Timeout:             &api.Duration{Duration: 30 * time.Second}`,
+			`SessionID:           "voyage"`,
+			`Phases:              true`,
+			`ReasoningSteps:      true`,
+			`TemperatureSchedule: []api.TemperatureStep{{Turn: 0, Temperature: 0.2}, {Turn: 3, Temperature: 0.8}}`,
+			`IncludeSystem:       true`,
+			`IncludeExamples:     true`,
+		} {
+			if !strings.Contains(got, s) {
+				t.Errorf("expected code to contain %q:\n%s", s, got)
+			}
+		}
+
+		w := export(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "python"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "grammar, timeout, session_id, phases, reasoning_steps, temperature_schedule, include_system, include_examples") {
+			t.Errorf("expected the unsupported fields to be listed, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("python partial", func(t *testing.T) {
+		req := chat
+		req.Messages = []api.Message{{Role: "user", Content: "Speak like a pirate."}, {Role: "assistant", Content: "Arr,", Partial: true}}
+
+		got := code(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "python"})
+		if !strings.Contains(got, `{"role": "assistant", "content": "Arr,", "partial": True},`) {
+			t.Errorf("expected the partial message:\n%s", got)
+		}
+	})
+
+	t.Run("python unsupported", func(t *testing.T) {
+		req := chat
+		req.SystemRefs = []string{"disclaimer"}
+		if w := export(t, api.ChatExportCodeRequest{ChatRequest: req, Language: "python"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("unknown language", func(t *testing.T) {
+		if w := export(t, api.ChatExportCodeRequest{ChatRequest: chat, Language: "rust"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		if w := export(t, api.ChatExportCodeRequest{Language: "curl"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
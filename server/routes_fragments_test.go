@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestFragments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	for _, req := range []api.FragmentRequest{
+		{Name: "disclaimer", Content: "This is not legal advice."},
+		{Name: "persona", Content: "You are a lawyer."},
+		{Name: "persona", Model: "test", Content: "You are a paralegal."},
+	} {
+		if w := createRequest(t, s.CreateFragmentHandler, req); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	chat := func(t *testing.T, req api.ChatRequest) int {
+		t.Helper()
+		req.Stream = &stream
+		w := createRequest(t, s.ChatHandler, req)
+		return w.Code
+	}
+
+	t.Run("expand", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model:      "test",
+			Messages:   []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Can I sue?"}},
+			SystemRefs: []string{"persona", "disclaimer"},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		expect := "system: Be brief.\n\nYou are a paralegal.\n\nThis is not legal advice. user: Can I sue? "
+		if mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("global", func(t *testing.T) {
+		createMockModel(t, &s, "other", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+		code := chat(t, api.ChatRequest{
+			Model:      "other",
+			Messages:   []api.Message{{Role: "user", Content: "Can I sue?"}},
+			SystemRefs: []string{"persona"},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		expect := "system: You are a lawyer. user: Can I sue? "
+		if mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Hi!"},
+				{Role: "user", Content: "Can I sue?"},
+			},
+			SystemRefs: []string{"disclaimer"},
+			Options:    map[string]any{"num_ctx": 11},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		expect := "system: This is not legal advice. user: Can I sue? "
+		if mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model:      "test",
+			Messages:   []api.Message{{Role: "user", Content: "Can I sue?"}},
+			SystemRefs: []string{"missing"},
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if w := createRequest(t, s.DeleteFragmentHandler, api.DeleteFragmentRequest{Name: "disclaimer"}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if w := createRequest(t, s.DeleteFragmentHandler, api.DeleteFragmentRequest{Name: "disclaimer"}); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+
+		code := chat(t, api.ChatRequest{
+			Model:      "test",
+			Messages:   []api.Message{{Role: "user", Content: "Can I sue?"}},
+			SystemRefs: []string{"disclaimer"},
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("missing name", func(t *testing.T) {
+		if w := createRequest(t, s.CreateFragmentHandler, api.FragmentRequest{Content: "hello"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,2189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestSeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	// replay sends the request again with the seed from the first response and
+	// checks the runner receives an identical completion request
+	replay := func(t *testing.T, seed *int, send func(options map[string]any) *int) {
+		t.Helper()
+
+		if seed == nil {
+			t.Fatal("expected seed in final response")
+		}
+
+		if *seed < 0 {
+			t.Fatalf("expected resolved seed, got %d", *seed)
+		}
+
+		if mock.CompletionRequest.Options.Seed != *seed {
+			t.Errorf("expected runner seed %d, got %d", *seed, mock.CompletionRequest.Options.Seed)
+		}
+
+		first := mock.CompletionRequest
+		if got := send(map[string]any{"seed": *seed}); got == nil || *got != *seed {
+			t.Errorf("expected seed %d, got %v", *seed, got)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest, first); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	}
+
+	t.Run("generate", func(t *testing.T) {
+		send := func(options map[string]any) *int {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Stream:  &stream,
+				Options: options,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.GenerateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Response != "Hi!" {
+				t.Errorf("expected response %q, got %q", "Hi!", resp.Response)
+			}
+
+			return resp.Seed
+		}
+
+		replay(t, send(nil), send)
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		send := func(options map[string]any) *int {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+				Stream:   &stream,
+				Options:  options,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Message.Content != "Hi!" {
+				t.Errorf("expected content %q, got %q", "Hi!", resp.Message.Content)
+			}
+
+			return resp.Seed
+		}
+
+		replay(t, send(nil), send)
+	})
+
+	t.Run("explicit seed", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Options: map[string]any{"seed": 42},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed == nil || *resp.Seed != 42 {
+			t.Errorf("expected seed 42, got %v", resp.Seed)
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		// cleanups run last in first out, so the config is reloaded after the
+		// environment is restored
+		t.Cleanup(envconfig.LoadConfig)
+		t.Setenv("OLLAMA_DETERMINISTIC", "1")
+		envconfig.LoadConfig()
+
+		send := func(options map[string]any) *int {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Stream:  &stream,
+				Options: options,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.GenerateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			return resp.Seed
+		}
+
+		for range 2 {
+			if seed := send(nil); seed == nil || *seed != deterministicSeed {
+				t.Errorf("expected seed %d, got %v", deterministicSeed, seed)
+			}
+		}
+
+		if seed := send(map[string]any{"seed": 7}); seed == nil || *seed != 7 {
+			t.Errorf("expected seed 7, got %v", seed)
+		}
+	})
+}
+
+func TestGenerateTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """<|user|>{{ .Prompt }}"""`)
+
+	t.Run("tokens", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Tokens: []int{0, 0},
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Tokens, []int{0, 0}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Prompt != "" {
+			t.Errorf("expected no prompt, got %q", mock.CompletionRequest.Prompt)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi!" {
+			t.Errorf("expected response %q, got %q", "Hi!", resp.Response)
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		req  api.GenerateRequest
+	}{
+		{"out of vocabulary", api.GenerateRequest{Model: "test", Tokens: []int{0, 1}}},
+		{"negative", api.GenerateRequest{Model: "test", Tokens: []int{-1}}},
+		{"with prompt", api.GenerateRequest{Model: "test", Tokens: []int{0}, Prompt: "Hello!"}},
+		{"with context", api.GenerateRequest{Model: "test", Tokens: []int{0}, Context: []int{0}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Stream = &stream
+			w := createRequest(t, s.GenerateHandler, tt.req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStopTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	dlq := filepath.Join(t.TempDir(), "dlq")
+	t.Setenv("OLLAMA_DLQ_PATH", dlq)
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	// the mock model's vocabulary has a single token
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	chat := func(stopTokens []int) *httptest.ResponseRecorder {
+		return createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Options:  map[string]any{"stop_tokens": stopTokens},
+			Stream:   &stream,
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		w := chat([]int{0})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Options.StopTokens, []int{0}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("out of vocabulary", func(t *testing.T) {
+		mock.CompletionRequest = llm.CompletionRequest{}
+		w := chat([]int{0, 1})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"stop_tokens: invalid token 1: the vocabulary has 1 tokens"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Options != nil {
+			t.Error("expected no completion")
+		}
+
+		// the request never reached the runner so it isn't a dead letter
+		if files, _ := filepath.Glob(filepath.Join(dlq, "*.ndjson")); len(files) > 0 {
+			t.Errorf("expected no dead letters, got %v", files)
+		}
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"stop_tokens": []int{-1}},
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestTemplateVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	generate := func(t *testing.T, req api.GenerateRequest) string {
+		t.Helper()
+
+		req.Model = "test"
+		req.Stream = &stream
+		w := createRequest(t, s.GenerateHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.TemplateVersion
+	}
+
+	chat := func(t *testing.T) string {
+		t.Helper()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.TemplateVersion
+	}
+
+	createMockModel(t, &s, "test", `TEMPLATE """<|user|>{{ .Prompt }}"""`)
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(m.TemplateDigest, "sha256:") {
+		t.Fatalf("expected template digest, got %q", m.TemplateDigest)
+	}
+
+	if v := generate(t, api.GenerateRequest{Prompt: "Hello!"}); v != m.TemplateDigest {
+		t.Errorf("expected template version %q, got %q", m.TemplateDigest, v)
+	}
+
+	if v := chat(t); v != m.TemplateDigest {
+		t.Errorf("expected template version %q, got %q", m.TemplateDigest, v)
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		if v := generate(t, api.GenerateRequest{Prompt: "Hello!", Raw: true}); v != "" {
+			t.Errorf("expected no template version, got %q", v)
+		}
+	})
+
+	t.Run("template override", func(t *testing.T) {
+		override := "<|prompt|>{{ .Prompt }}"
+		expect := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(override)))
+		if v := generate(t, api.GenerateRequest{Prompt: "Hello!", Template: override}); v != expect {
+			t.Errorf("expected template version %q, got %q", expect, v)
+		}
+	})
+
+	t.Run("template edit", func(t *testing.T) {
+		createMockModel(t, &s, "test", `TEMPLATE """<|human|>{{ .Prompt }}"""`)
+
+		v := generate(t, api.GenerateRequest{Prompt: "Hello!"})
+		if v == "" || v == m.TemplateDigest {
+			t.Errorf("expected a new template version, got %q", v)
+		}
+
+		if c := chat(t); c != v {
+			t.Errorf("expected template version %q, got %q", v, c)
+		}
+	})
+}
+
+func TestChatResponseSchema(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	schema := map[string]any{
+		"type":     "object",
+		"required": []string{"name"},
+		"properties": map[string]any{
+			"name": map[string]any{"type": "string"},
+		},
+	}
+
+	chat := func(t *testing.T, content string, schema any, stream *bool) *httptest.ResponseRecorder {
+		t.Helper()
+
+		mock.CompletionResponse.Content = content
+		return createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   stream,
+			Options:  map[string]any{"response_schema": schema},
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		w := chat(t, `{"name": "ollama"}`, schema, &stream)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != `{"name": "ollama"}` {
+			t.Errorf("unexpected content %q", resp.Message.Content)
+		}
+
+		if mock.CompletionRequest.Format != "json" {
+			t.Errorf("expected json format, got %q", mock.CompletionRequest.Format)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := chat(t, `{"name": 1}`, schema, &stream)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status 422, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp struct {
+			Error            string   `json:"error"`
+			ValidationErrors []string `json:"validation_errors"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.ValidationErrors) != 1 || !strings.HasPrefix(resp.ValidationErrors[0], "/name: ") {
+			t.Errorf("unexpected validation errors %v", resp.ValidationErrors)
+		}
+	})
+
+	t.Run("not json", func(t *testing.T) {
+		w := chat(t, "Hi!", schema, &stream)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status 422, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		w := chat(t, `{}`, schema, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), `"validation_errors":["/: missing properties: 'name'"]`) {
+			t.Errorf("expected validation errors, got %s", w.Body.String())
+		}
+
+		if strings.Contains(w.Body.String(), `"done":true`) {
+			t.Errorf("expected invalid response to be replaced, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		w := chat(t, `{}`, map[string]any{"type": 1}, &stream)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestGenerateTools(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    `[{"name": "get_weather", "arguments": {"location": "Toronto"}}]`,
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "tools", `TEMPLATE """{{ if .Tools }}[TOOLS]{{ json .Tools }}[/TOOLS]{{ end }}{{ range .Messages }}{{ .Content }}{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}{{ end }}"""`)
+	createMockModel(t, &s, "no-tools", `TEMPLATE """{{ .Prompt }}"""`)
+
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[{"type": "function", "function": {"name": "get_weather", "description": "Get the weather"}}]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tool calls", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "tools",
+			Prompt: "What's the weather?",
+			Tools:  tools,
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.HasPrefix(mock.CompletionRequest.Prompt, `[TOOLS][{"type":"function","function":{"name":"get_weather"`) {
+			t.Errorf("expected tools in prompt, got %q", mock.CompletionRequest.Prompt)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Name != "get_weather" {
+			t.Fatalf("unexpected tool calls %v", resp.ToolCalls)
+		}
+
+		if diff := cmp.Diff(resp.ToolCalls[0].Function.Arguments, map[string]any{"location": "Toronto"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.Response != "" {
+			t.Errorf("expected empty response, got %q", resp.Response)
+		}
+	})
+
+	t.Run("no tools", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "tools",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Prompt != "Hello!" {
+			t.Errorf("expected prompt %q, got %q", "Hello!", mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "no-tools",
+			Prompt: "Hello!",
+			Tools:  tools,
+			Stream: &stream,
+		})
+		if w.Code == http.StatusOK {
+			t.Fatalf("expected error, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "tools",
+			Prompt: "Hello!",
+			Raw:    true,
+			Tools:  tools,
+			Stream: &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestMemoryUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:           "Hi!",
+			Done:              true,
+			DoneReason:        "stop",
+			RunnerRSSPeak:     512 << 20,
+			MemoryEstimateGPU: 4 << 30,
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	check := func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp["runner_rss_peak"] != float64(512<<20) {
+			t.Errorf("expected runner_rss_peak %d, got %v", 512<<20, resp["runner_rss_peak"])
+		}
+
+		if resp["memory_estimate_gpu"] != float64(4<<30) {
+			t.Errorf("expected memory_estimate_gpu %d, got %v", 4<<30, resp["memory_estimate_gpu"])
+		}
+	}
+
+	t.Run("generate", func(t *testing.T) {
+		check(t, createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		}))
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		check(t, createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		}))
+	})
+}
+
+func TestChatSmallerNumCtx(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `PARAMETER num_ctx 4096
+TEMPLATE """{{ range .Messages }}{{ .Content }} {{ end }}"""`)
+
+	msgs := []api.Message{
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	cases := []struct {
+		name    string
+		options map[string]any
+		expect  string
+	}{
+		{"loaded context", nil, " You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. "},
+		{"smaller context", map[string]any{"num_ctx": 12}, " A test. And a thumping good one at that, I'd wager. "},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: msgs,
+				Stream:   &stream,
+				Options:  tt.options,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatSystemOverride(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `SYSTEM You're a pirate.
+TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	empty := ""
+	custom := "You're a ninja."
+
+	cases := []struct {
+		name     string
+		system   *string
+		messages []api.Message
+		expect   string
+	}{
+		{"default", nil, []api.Message{{Role: "user", Content: "Hello!"}}, "system: You're a pirate. user: Hello! "},
+		{"empty", &empty, []api.Message{{Role: "user", Content: "Hello!"}}, "user: Hello! "},
+		{"custom", &custom, []api.Message{{Role: "user", Content: "Hello!"}}, "system: You're a ninja. user: Hello! "},
+		{"system message", &custom, []api.Message{{Role: "system", Content: "You're a cowboy."}, {Role: "user", Content: "Hello!"}}, "system: You're a cowboy. user: Hello! "},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: tt.messages,
+				System:   tt.system,
+				Stream:   &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatMessagesSystemRole(t *testing.T) {
+	// roles are lowercased when decoded from JSON but not when a request is
+	// built in Go, so the model's system prompt is left out for any case
+	m := Model{System: "You're a pirate."}
+	msgs, err := chatMessages(&m, &api.ChatRequest{
+		Messages: []api.Message{{Role: "System", Content: "You're a cowboy."}, {Role: "user", Content: "Hello!"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]api.Message{{Role: "System", Content: "You're a cowboy."}, {Role: "user", Content: "Hello!"}}, msgs); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestChatIncludeSystem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `SYSTEM You're a pirate.
+TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	for _, tt := range []struct {
+		name    string
+		include bool
+		expect  string
+	}{
+		{"included", true, "You're a pirate.\n\nBe brief."},
+		{"not included", false, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:         "test",
+				Messages:      []api.Message{{Role: "user", Content: "Hello!"}, {Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi!"}},
+				IncludeSystem: tt.include,
+				Stream:        &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.SystemRendered != tt.expect {
+				t.Errorf("expected system %q, got %q", tt.expect, resp.SystemRendered)
+			}
+		})
+	}
+}
+
+func TestChatTrailingAssistant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	cases := []struct {
+		name     string
+		mode     string
+		messages []api.Message
+		code     int
+		expect   string
+	}{
+		{"unset", "", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi"}}, http.StatusOK, "system:  user: Hello! assistant: Hi "},
+		{"error", "error", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi"}}, http.StatusBadRequest, ""},
+		{"ignore", "ignore", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi"}}, http.StatusOK, "system:  user: Hello! "},
+		{"prefill", "prefill", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi"}}, http.StatusOK, "system:  user: Hello! assistant: Hi"},
+		{"partial", "error", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi", Partial: true}}, http.StatusOK, "system:  user: Hello! assistant: Hi"},
+		{"user last", "error", []api.Message{{Role: "assistant", Content: "Hi"}, {Role: "user", Content: "Hello!"}}, http.StatusOK, "system:  assistant: Hi user: Hello! "},
+		{"invalid", "drop", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi"}}, http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.CompletionRequest = llm.CompletionRequest{}
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: tt.messages,
+				Options:  map[string]any{"trailing_assistant": tt.mode},
+				Stream:   &stream,
+			})
+			if w.Code != tt.code {
+				t.Fatalf("expected status %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("ignore only message", func(t *testing.T) {
+		empty := ""
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "assistant", Content: "Hi"}},
+			System:   &empty,
+			Options:  map[string]any{"trailing_assistant": "ignore"},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), "no messages left") {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+}
+
+func TestGenerateSuffix(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "a, b):\n    c = a + b\n    ",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "fim", `TEMPLATE """{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
+{{- else }}{{ .Prompt }}
+{{- end }}"""`)
+	createMockModel(t, &s, "no-fim", `TEMPLATE """{{ .Prompt }}"""`)
+
+	t.Run("suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "fim",
+			Prompt: "def add(",
+			Suffix: "return c",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<PRE> def add( <SUF>return c <MID>"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("no suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "fim",
+			Prompt: "def add(",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "def add("); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "no-fim",
+			Prompt: "def add(",
+			Suffix: "return c",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"\"no-fim\" does not support insert"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestChatReasoningSteps(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "<think>Add 2 and 2.\n\nCheck the sum.</think>\nThe answer is 4.",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	chat := func(t *testing.T, steps bool, stream *bool) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:          "test",
+			Messages:       []api.Message{{Role: "user", Content: "What's 2+2?"}},
+			Stream:         stream,
+			ReasoningSteps: steps,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		return w
+	}
+
+	expect := []api.ReasoningStep{{Index: 0, Content: "Add 2 and 2."}, {Index: 1, Content: "Check the sum."}}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		var resp api.ChatResponse
+		if err := json.NewDecoder(chat(t, true, &stream).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "The answer is 4." {
+			t.Errorf("unexpected content %q", resp.Message.Content)
+		}
+
+		if diff := cmp.Diff(expect, resp.Steps); diff != "" {
+			t.Errorf("steps mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		var steps []api.ReasoningStep
+		var content string
+		dec := json.NewDecoder(chat(t, true, nil).Body)
+		for dec.More() {
+			var resp api.ChatResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Step != nil {
+				if resp.Message.Content != "" || resp.Done {
+					t.Errorf("expected step events to have no content, got %+v", resp)
+				}
+
+				steps = append(steps, *resp.Step)
+			}
+
+			content += resp.Message.Content
+		}
+
+		if content != "The answer is 4." {
+			t.Errorf("unexpected content %q", content)
+		}
+
+		if diff := cmp.Diff(expect, steps); diff != "" {
+			t.Errorf("steps mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var resp api.ChatResponse
+		if err := json.NewDecoder(chat(t, false, &stream).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != mock.CompletionResponse.Content {
+			t.Errorf("unexpected content %q", resp.Message.Content)
+		}
+
+		if resp.Steps != nil {
+			t.Errorf("expected no steps, got %v", resp.Steps)
+		}
+	})
+}
+
+func TestGenerateWarnings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	expect := []string{"mirostat 3 ignored (must be 0, 1 or 2)"}
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Options: map[string]any{"mirostat": 3},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(expect, resp.Warnings); diff != "" {
+			t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Options.Mirostat != 0 {
+			t.Errorf("expected mirostat to be disabled, got %d", mock.CompletionRequest.Options.Mirostat)
+		}
+	})
+
+	t.Run("chat streaming", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Options:  map[string]any{"mirostat": 3},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(expect, resp.Warnings); diff != "" {
+			t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no warnings", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if strings.Contains(w.Body.String(), "warnings") {
+			t.Errorf("expected no warnings, got %s", w.Body.String())
+		}
+	})
+}
+
+func TestResponseProcessor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "<think>Greet them.</think>Hello, darn it!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{
+		sched: newMockScheduler(&mock),
+		processor: &ResponseProcessor{Filters: []ResponseFilter{
+			StripThinkingTagsFilter{},
+			RegexReplacementFilter{Pattern: regexp.MustCompile("darn"), Replacement: "****"},
+		}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hello, **** it!" {
+			t.Errorf("unexpected response %q", resp.Response)
+		}
+	})
+
+	t.Run("chat streaming", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var content string
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var resp api.ChatResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			content += resp.Message.Content
+		}
+
+		if content != "Hello, **** it!" {
+			t.Errorf("unexpected content %q", content)
+		}
+	})
+
+	t.Run("generate batch", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{Model: "test", Prompts: []string{"Hello!"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		responses := make(map[int]string)
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var resp api.GenerateBatchResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			responses[resp.Index] += resp.Response
+		}
+
+		if diff := cmp.Diff(responses, map[int]string{0: "Hello, **** it!"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("chat batch", func(t *testing.T) {
+		w := createRequest(t, s.ChatBatchHandler, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var content string
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var resp api.ChatBatchResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			content += resp.Message.Content
+		}
+
+		if content != "Hello, **** it!" {
+			t.Errorf("unexpected content %q", content)
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		w := createRequest(t, s.SweepHandler, api.SweepRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Grid:   map[string][]any{"temperature": {0.2, 0.8}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.SweepResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, result := range resp.Results {
+			if result.Response != "Hello, **** it!" {
+				t.Errorf("unexpected response %q for %v", result.Response, result.Options)
+			}
+		}
+	})
+}
+
+func TestChatDeadLetter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	dlq := filepath.Join(t.TempDir(), "dlq")
+	t.Setenv("OLLAMA_DLQ_PATH", dlq)
+	envconfig.LoadConfig()
+
+	mock := mockRunner{CompletionError: errors.New("llama runner process has terminated: signal: aborted")}
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	req := api.ChatRequest{
+		Model:    "test",
+		Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		Stream:   &stream,
+		Options:  map[string]any{"temperature": 0.5},
+	}
+
+	start := time.Now().UTC()
+	w := createRequest(t, s.ChatHandler, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+
+	files, err := filepath.Glob(filepath.Join(dlq, "*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(files))
+	}
+
+	bts, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l deadLetter
+	if err := json.Unmarshal(bts, &l); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(req, l.Request); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if l.Error != mock.CompletionError.Error() {
+		t.Errorf("expected error %q, got %q", mock.CompletionError, l.Error)
+	}
+
+	if l.ReceivedAt.Before(start.Truncate(time.Second)) || l.FailedAt.Before(l.ReceivedAt) {
+		t.Errorf("unexpected timestamps: received %s, failed %s", l.ReceivedAt, l.FailedAt)
+	}
+
+	if expect := "ollama run test --conversation " + files[0]; l.Replay != expect {
+		t.Errorf("expected replay %q, got %q", expect, l.Replay)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_DLQ_PATH", "")
+		envconfig.LoadConfig()
+
+		w := createRequest(t, s.ChatHandler, req)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if files, _ := filepath.Glob(filepath.Join(dlq, "*.ndjson")); len(files) != 1 {
+			t.Errorf("expected no new dead letters, got %d", len(files))
+		}
+	})
+}
+
+func TestChatTemperatureSchedule(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `PARAMETER temperature 0.7
+TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	schedule := []api.TemperatureStep{{Turn: 0, Temperature: 1.0}, {Turn: 3, Temperature: 0.5}, {Turn: 5, Temperature: 0.1}}
+
+	// turns returns a chat with n assistant messages
+	turns := func(n int) []api.Message {
+		var msgs []api.Message
+		for range n {
+			msgs = append(msgs, api.Message{Role: "user", Content: "Next?"}, api.Message{Role: "assistant", Content: "Done."})
+		}
+
+		return append(msgs, api.Message{Role: "user", Content: "Next?"})
+	}
+
+	cases := []struct {
+		name     string
+		schedule []api.TemperatureStep
+		msgs     []api.Message
+		expect   float32
+	}{
+		{"no schedule", nil, turns(4), 0.7},
+		{"first turn", schedule, turns(0), 1.0},
+		{"between steps", schedule, turns(4), 0.5},
+		{"last step", schedule, turns(9), 0.1},
+		{"not started", []api.TemperatureStep{{Turn: 2, Temperature: 0.2}}, turns(1), 0.7},
+		{"unordered", []api.TemperatureStep{{Turn: 5, Temperature: 0.1}, {Turn: 0, Temperature: 1.0}}, turns(6), 0.1},
+		{"partial", schedule, append(turns(2), api.Message{Role: "assistant", Content: "Let me", Partial: true}), 1.0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:               "test",
+				Messages:            tt.msgs,
+				TemperatureSchedule: tt.schedule,
+				Stream:              &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if got := mock.CompletionRequest.Options.Temperature; got != tt.expect {
+				t.Errorf("expected temperature %v, got %v", tt.expect, got)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, schedule := range [][]api.TemperatureStep{{{Turn: -1, Temperature: 1}}, {{Turn: 0, Temperature: -0.5}}} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:               "test",
+				Messages:            turns(0),
+				TemperatureSchedule: schedule,
+				Stream:              &stream,
+			})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestStreamEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:         "Hi!",
+			Done:            true,
+			DoneReason:      "stop",
+			PromptEvalCount: 3,
+			EvalCount:       2,
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	// events splits body into its events, checking the terminal [DONE]
+	events := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		t.Helper()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("expected content type text/event-stream, got %q", ct)
+		}
+
+		events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+		if len(events) != 3 {
+			t.Fatalf("expected 3 events, got %q", events)
+		}
+
+		if events[2] != "data: [DONE]" {
+			t.Errorf("expected [DONE], got %q", events[2])
+		}
+
+		var metrics api.Metrics
+		data, ok := strings.CutPrefix(events[1], "event: metrics\ndata: ")
+		if !ok {
+			t.Fatalf("expected metrics event, got %q", events[1])
+		}
+
+		if err := json.Unmarshal([]byte(data), &metrics); err != nil {
+			t.Fatal(err)
+		}
+
+		if metrics.PromptEvalCount != 3 || metrics.EvalCount != 2 {
+			t.Errorf("expected 3 prompt and 2 eval tokens, got %d and %d", metrics.PromptEvalCount, metrics.EvalCount)
+		}
+
+		return events
+	}
+
+	t.Run("chat accept header", func(t *testing.T) {
+		w := createRequest(t, func(c *gin.Context) {
+			c.Request.Header = http.Header{"Accept": {"text/event-stream"}}
+			s.ChatHandler(c)
+		}, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		})
+
+		var resp api.ChatResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events(t, w)[0], "data: ")), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Hi!" || !resp.Done {
+			t.Errorf("expected the final response, got %+v", resp)
+		}
+	})
+
+	t.Run("generate query", func(t *testing.T) {
+		w := createRequest(t, func(c *gin.Context) {
+			c.Request.URL.RawQuery = "stream=sse"
+			s.GenerateHandler(c)
+		}, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+		})
+
+		var resp api.GenerateResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events(t, w)[0], "data: ")), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi!" || !resp.Done {
+			t.Errorf("expected the final response, got %+v", resp)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+		})
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("expected content type application/x-ndjson, got %q", ct)
+		}
+	})
+}
+
+func TestLoadDiagnostic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	diagnostic := api.LoadDiagnostic{
+		Reason:          llm.LoadFailureOutOfMemory,
+		RequiredMemory:  8 << 30,
+		AvailableMemory: 4 << 30,
+		Suggestion:      "reduce num_ctx",
+	}
+
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.errCh <- &llm.LoadError{LoadDiagnostic: diagnostic, Err: errors.New("model requires more system memory (8 GiB) than is available (4 GiB)")}
+	}
+
+	w := createRequest(t, s.ChatHandler, api.ChatRequest{
+		Model:    "test",
+		Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		Stream:   &stream,
+	})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp api.StatusError
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := "model requires more system memory (8 GiB) than is available (4 GiB)"; resp.ErrorMessage != expect {
+		t.Errorf("expected error %q, got %q", expect, resp.ErrorMessage)
+	}
+
+	if diff := cmp.Diff(&diagnostic, resp.Diagnostic); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPhases(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock echoRunner
+	s := Server{sched: newMockScheduler(&mock.mockRunner)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	type phase struct {
+		Phase    string
+		Progress *api.PhaseProgress
+		Content  string
+		Done     bool
+	}
+
+	// the echo runner generates the 3 tokens of the prompt after it's processed
+	expect := func(total int) []phase {
+		return []phase{
+			{"prompt_eval", &api.PhaseProgress{Completed: 0, Total: 3}, "", false},
+			{"prompt_eval", &api.PhaseProgress{Completed: 3, Total: 3}, "", false},
+			{"generation", &api.PhaseProgress{Completed: 1, Total: total}, "one ", false},
+			{"generation", &api.PhaseProgress{Completed: 2, Total: total}, "two ", false},
+			{"generation", &api.PhaseProgress{Completed: 3, Total: total}, "three ", false},
+			{"generation", &api.PhaseProgress{Completed: 3, Total: total}, "", true},
+		}
+	}
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "one two three",
+			Phases:  true,
+			Options: map[string]any{"num_predict": 10},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var got []phase
+		dec := json.NewDecoder(w.Body)
+		for i := 0; dec.More(); i++ {
+			var resp api.GenerateResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if i == 0 && resp.RequestID == "" {
+				t.Error("expected the first response to have a request ID")
+			}
+
+			got = append(got, phase{resp.Phase, resp.Progress, resp.Response, resp.Done})
+		}
+
+		if diff := cmp.Diff(expect(10), got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "one two three"}},
+			Phases:   true,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var got []phase
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var resp api.ChatResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, phase{resp.Phase, resp.Progress, resp.Message.Content, resp.Done})
+		}
+
+		// num_predict defaults to -1, so the tokens to generate are unknown
+		if diff := cmp.Diff(expect(0), got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not streaming", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "one two three",
+			Stream: &stream,
+			Phases: true,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "one two three " || resp.Phase != "" || resp.Progress != nil {
+			t.Errorf("expected the response without phases, got %+v", resp)
+		}
+	})
+}
+
+func TestGrammar(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{CompletionResponse: llm.CompletionResponse{Content: "stop", Done: true, DoneReason: "stop"}}
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	grammar := `root ::= "start" | "stop"`
+
+	t.Run("generate", func(t *testing.T) {
+		mock.CompletionRequest = llm.CompletionRequest{}
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Start or stop?", Grammar: grammar, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Grammar != grammar || mock.CompletionRequest.Format != "" {
+			t.Errorf("expected the grammar to be sent to the runner, got %+v", mock.CompletionRequest)
+		}
+	})
+
+	t.Run("chat with schema", func(t *testing.T) {
+		// the grammar produces JSON strings which match the schema
+		grammar := `root ::= "\"" ("start" | "stop") "\""`
+		mock.CompletionRequest = llm.CompletionRequest{}
+		mock.CompletionResponse.Content = `"stop"`
+		defer func() { mock.CompletionResponse.Content = "stop" }()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Start or stop?"}},
+			Grammar:  grammar,
+			Stream:   &stream,
+			Options:  map[string]any{"response_schema": map[string]any{"type": "string"}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// the grammar replaces the json format a schema otherwise adds
+		if mock.CompletionRequest.Grammar != grammar || mock.CompletionRequest.Format != "" {
+			t.Errorf("expected the grammar to be sent to the runner, got %+v", mock.CompletionRequest)
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		for name, expect := range map[string]struct {
+			format, grammar, err string
+		}{
+			"with format": {"json", grammar, "format and grammar can't both be set"},
+			"invalid":     {"", `root ::= "start`, "invalid grammar: line 1, column 10: unterminated string"},
+			"no root":     {"", `verb ::= "start"`, "invalid grammar: missing root rule"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				for _, w := range []*httptest.ResponseRecorder{
+					createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Start or stop?", Format: expect.format, Grammar: expect.grammar}),
+					createRequest(t, s.ChatHandler, api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Start or stop?"}}, Format: expect.format, Grammar: expect.grammar}),
+				} {
+					if w.Code != http.StatusBadRequest {
+						t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+					}
+
+					var resp map[string]string
+					if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+						t.Fatal(err)
+					}
+
+					if resp["error"] != expect.err {
+						t.Errorf("expected error %q, got %q", expect.err, resp["error"])
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestImageErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ range .Messages }}{{ .Content }} {{ end }}"""`)
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := api.ImageData(b.Bytes())
+	corrupt := api.ImageData("not an image")
+
+	// check sends images under policy and checks the images which reach the
+	// runner are valid and numbered contiguously
+	check := func(t *testing.T, w *httptest.ResponseRecorder, policy string, warnings []string) {
+		t.Helper()
+
+		if policy == "fail" {
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if !strings.Contains(w.Body.String(), "invalid image") {
+				t.Errorf("expected invalid image error, got %s", w.Body.String())
+			}
+			return
+		}
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "image 1 skipped") {
+			t.Errorf("expected a warning for image 1, got %v", warnings)
+		}
+
+		images := mock.CompletionRequest.Images
+		if len(images) != 2 {
+			t.Fatalf("expected 2 images, got %d", len(images))
+		}
+
+		for i, image := range images {
+			if image.ID != i || !bytes.Equal(image.Data, valid) {
+				t.Errorf("image %d: expected valid image with ID %d, got ID %d", i, i, image.ID)
+			}
+		}
+
+		if !strings.Contains(mock.CompletionRequest.Prompt, "[img-1]") || strings.Contains(mock.CompletionRequest.Prompt, "[img-2]") {
+			t.Errorf("expected [img-0] and [img-1] in prompt, got %q", mock.CompletionRequest.Prompt)
+		}
+	}
+
+	for _, policy := range []string{"skip", "fail"} {
+		t.Run("generate "+policy, func(t *testing.T) {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "What's in these images?",
+				Images:  []api.ImageData{valid, corrupt, valid},
+				Stream:  &stream,
+				Options: map[string]any{"image_errors": policy},
+			})
+
+			var resp api.GenerateResponse
+			if w.Code == http.StatusOK {
+				if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check(t, w, policy, resp.Warnings)
+		})
+
+		t.Run("chat "+policy, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "[img] and [img] and [img]", Images: []api.ImageData{valid, corrupt, valid}},
+				},
+				Stream:  &stream,
+				Options: map[string]any{"image_errors": policy},
+			})
+
+			var resp api.ChatResponse
+			if w.Code == http.StatusOK {
+				if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check(t, w, policy, resp.Warnings)
+		})
+	}
+}
+
+func TestChatMultipart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ range .Messages }}{{ .Content }} {{ end }}"""`)
+
+	// send writes parts, in order, to a multipart chat request
+	send := func(t *testing.T, parts ...[2]string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for _, p := range parts {
+			if err := mw.WriteField(p[0], p[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", &b)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		s.ChatHandler(c)
+		return w
+	}
+
+	request := `{"model": "test", "stream": false, "messages": [{"role": "user", "content": "[img] or [img]?", "images": ["cat", "dog"]}, {"role": "assistant", "content": "a dog"}, {"role": "user", "content": "again?", "images": ["cat"]}]}`
+
+	t.Run("images", func(t *testing.T) {
+		// images may be sent before the request
+		w := send(t, [2]string{"dog", "dog image"}, [2]string{"request", request}, [2]string{"cat", "cat image"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Hi!" {
+			t.Errorf("expected content %q, got %q", "Hi!", resp.Message.Content)
+		}
+
+		expect := []llm.ImageData{
+			{ID: 0, Data: []byte("cat image")},
+			{ID: 1, Data: []byte("dog image")},
+			{ID: 2, Data: []byte("cat image")},
+		}
+
+		if diff := cmp.Diff(expect, mock.CompletionRequest.Images); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if expect := "[img-0] or [img-1]? a dog [img-2] again?"; !strings.Contains(mock.CompletionRequest.Prompt, expect) {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	cases := []struct {
+		name  string
+		parts [][2]string
+		error string
+	}{
+		{"missing request", [][2]string{{"cat", "cat image"}}, `missing "request" part`},
+		{"missing image", [][2]string{{"request", request}, {"cat", "cat image"}}, `message 0: image part "dog" not found`},
+		{"base64 image", [][2]string{{"request", `{"model": "test", "messages": [{"role": "user", "content": "hi", "images": [1]}]}`}}, "message 0: images must be the names of parts"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(t, tt.parts...)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+			}
+
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(resp.Error, tt.error) {
+				t.Errorf("expected error %q, got %q", tt.error, resp.Error)
+			}
+		})
+	}
+}
+
+func TestTrimResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    " \n Hi! \n\n",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{ .Prompt }}"""`)
+
+	// send returns the concatenated responses to a generate and a chat request
+	send := func(t *testing.T, streamed bool, options map[string]any) (generate, chat string) {
+		t.Helper()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &streamed,
+			Options: options,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		for dec := json.NewDecoder(w.Body); dec.More(); {
+			var resp api.GenerateResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			generate += resp.Response
+		}
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &streamed,
+			Options:  options,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		for dec := json.NewDecoder(w.Body); dec.More(); {
+			var resp api.ChatResponse
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			chat += resp.Message.Content
+		}
+
+		return generate, chat
+	}
+
+	trim := map[string]any{"trim_response": true}
+
+	cases := []struct {
+		name      string
+		streamed  bool
+		options   map[string]any
+		processor *ResponseProcessor
+		expect    string
+	}{
+		{name: "unset", expect: " \n Hi! \n\n"},
+		{name: "trimmed", options: trim, expect: "Hi!"},
+		{name: "streamed", streamed: true, options: trim, expect: " \n Hi! \n\n"},
+		{name: "streamed with filters", streamed: true, options: trim, processor: &ResponseProcessor{}, expect: "Hi!"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s.processor = tt.processor
+			t.Cleanup(func() { s.processor = nil })
+
+			generate, chat := send(t, tt.streamed, tt.options)
+			if generate != tt.expect {
+				t.Errorf("expected generate response %q, got %q", tt.expect, generate)
+			}
+
+			if chat != tt.expect {
+				t.Errorf("expected chat content %q, got %q", tt.expect, chat)
+			}
+		})
+	}
+}
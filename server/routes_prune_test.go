@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestPruneContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{CompletionResponse: llm.CompletionResponse{Content: " Short summary. ", Done: true, DoneReason: "stop"}}
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	// each message is 1 token for the role and 1 per word
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "one two three four"},
+		{Role: "assistant", Content: "five six seven eight"},
+		{Role: "user", Content: "nine ten eleven twelve"},
+		{Role: "assistant", Content: "a b c d"},
+		{Role: "user", Content: "latest question here"},
+	}
+
+	summary := api.Message{Role: "system", Content: "Summary of the earlier conversation:\nShort summary."}
+
+	prune := func(t *testing.T, req api.PruneContextRequest) api.PruneContextResponse {
+		t.Helper()
+
+		mock.CompletionRequest = llm.CompletionRequest{}
+		w := createRequest(t, func(c *gin.Context) {
+			c.Params = gin.Params{{Key: "name", Value: "test"}}
+			s.PruneContextHandler(c)
+		}, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.PruneContextResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	t.Run("fits", func(t *testing.T) {
+		resp := prune(t, api.PruneContextRequest{Messages: msgs, TargetTokens: 27})
+		if diff := cmp.Diff(msgs, resp.Messages); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.Tokens != 27 {
+			t.Errorf("expected 27 tokens, got %d", resp.Tokens)
+		}
+
+		if mock.CompletionRequest.Prompt != "" {
+			t.Errorf("expected no summary, got prompt %q", mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("summarized", func(t *testing.T) {
+		resp := prune(t, api.PruneContextRequest{Messages: msgs, TargetTokens: 20})
+		if diff := cmp.Diff([]api.Message{msgs[0], summary, msgs[4], msgs[5]}, resp.Messages); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the summary is rendered together with the system message before it
+		if resp.Tokens != 19 {
+			t.Errorf("expected 19 tokens, got %d", resp.Tokens)
+		}
+
+		// the second batch summarizes the first summary with the next message
+		prompt := mock.CompletionRequest.Prompt
+		if !strings.Contains(prompt, "system: Summary of the earlier conversation:\nShort summary.\n\nuser: nine ten eleven twelve") {
+			t.Errorf("expected the previous summary to be summarized again, got %q", prompt)
+		}
+
+		if mock.CompletionRequest.Options.NumPredict != 10 {
+			t.Errorf("expected the summary to be limited to 10 tokens, got %d", mock.CompletionRequest.Options.NumPredict)
+		}
+	})
+
+	t.Run("too small", func(t *testing.T) {
+		resp := prune(t, api.PruneContextRequest{Messages: msgs, TargetTokens: 5})
+		if diff := cmp.Diff([]api.Message{msgs[0], summary, msgs[5]}, resp.Messages); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.Tokens != 14 {
+			t.Errorf("expected 14 tokens, got %d", resp.Tokens)
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		for _, req := range []api.PruneContextRequest{
+			{TargetTokens: 20},
+			{Messages: msgs},
+			{Messages: []api.Message{{Role: "narrator", Content: "Once upon a time"}}, TargetTokens: 20},
+		} {
+			w := createRequest(t, s.PruneContextHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+	})
+}
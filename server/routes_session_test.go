@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// tokenizeRecorder records the text it's asked to tokenize
+type tokenizeRecorder struct {
+	mockRunner
+	tokenized []string
+}
+
+func (m *tokenizeRecorder) Tokenize(ctx context.Context, s string) ([]int, error) {
+	m.tokenized = append(m.tokenized, s)
+	return tokenize(ctx, s)
+}
+
+func TestChatSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mock := tokenizeRecorder{mockRunner: mockRunner{CompletionResponse: llm.CompletionResponse{Content: "Hi there!", Done: true, DoneReason: "stop"}}}
+	s := Server{sched: newMockScheduler(&mock.mockRunner)}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		req.successCh <- &runnerRef{llama: &mock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}assistant: """`)
+	createMockModel(t, &s, "other", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}assistant: """`)
+
+	chat := func(t *testing.T, model, session string, msgs ...api.Message) string {
+		t.Helper()
+
+		mock.tokenized = nil
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: model, SessionID: session, Messages: msgs, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		return mock.CompletionRequest.Prompt
+	}
+
+	hello := api.Message{Role: "user", Content: "Hello!"}
+	howAreYou := api.Message{Role: "user", Content: "How are you?"}
+	reply := api.Message{Role: "assistant", Content: "Hi there!"}
+
+	t.Run("new messages", func(t *testing.T) {
+		chat(t, "test", "new", hello)
+
+		prompt := chat(t, "test", "new", howAreYou)
+		if expect := "system:  user: Hello! assistant: Hi there! user: How are you? assistant: "; prompt != expect {
+			t.Errorf("expected %q, got %q", expect, prompt)
+		}
+
+		// only the text after the previous prompt and response is tokenized
+		if len(mock.tokenized) == 0 {
+			t.Error("expected the prompt to be tokenized")
+		}
+
+		for _, s := range mock.tokenized {
+			if strings.Contains(s, "Hello!") {
+				t.Errorf("expected the session's prompt not to be tokenized again, got %q", s)
+			}
+		}
+	})
+
+	t.Run("full history", func(t *testing.T) {
+		chat(t, "test", "full", hello)
+
+		prompt := chat(t, "test", "full", hello, reply, howAreYou)
+		if expect := "system:  user: Hello! assistant: Hi there! user: How are you? assistant: "; prompt != expect {
+			t.Errorf("expected %q, got %q", expect, prompt)
+		}
+	})
+
+	t.Run("other model", func(t *testing.T) {
+		chat(t, "test", "model", hello)
+
+		prompt := chat(t, "other", "model", howAreYou)
+		if expect := "system:  user: How are you? assistant: "; prompt != expect {
+			t.Errorf("expected %q, got %q", expect, prompt)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ttl := sessionTTL
+		sessionTTL = -time.Second
+		defer func() { sessionTTL = ttl }()
+
+		chat(t, "test", "expired", hello)
+
+		prompt := chat(t, "test", "expired", howAreYou)
+		if expect := "system:  user: How are you? assistant: "; prompt != expect {
+			t.Errorf("expected %q, got %q", expect, prompt)
+		}
+	})
+
+	t.Run("no session", func(t *testing.T) {
+		chat(t, "test", "", hello)
+
+		prompt := chat(t, "test", "", howAreYou)
+		if expect := "system:  user: How are you? assistant: "; prompt != expect {
+			t.Errorf("expected %q, got %q", expect, prompt)
+		}
+	})
+}
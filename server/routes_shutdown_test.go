@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// releasingRunner streams one response then blocks until it's released or the
+// request is canceled
+type releasingRunner struct {
+	mockRunner
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *releasingRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "Hi"})
+	close(m.started)
+
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	fn(llm.CompletionResponse{Content: "!", Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	// start serves the routes and sends a generate request, returning once the
+	// runner has started streaming the response
+	start := func(t *testing.T, runner *releasingRunner) (*http.Server, string, <-chan error) {
+		t.Helper()
+
+		s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+			req.successCh <- &runnerRef{llama: runner}
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srvr := &http.Server{Handler: s.GenerateRoutes()}
+		go srvr.Serve(ln)
+
+		url := "http://" + ln.Addr().String()
+
+		bts, err := json.Marshal(api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			resp, err := http.Post(url+"/api/generate", "application/json", bytes.NewReader(bts))
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			if !strings.Contains(string(body), `"done":true`) {
+				errCh <- errors.New("response didn't finish: " + string(body))
+				return
+			}
+
+			errCh <- nil
+		}()
+
+		select {
+		case <-runner.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for completion to start")
+		}
+
+		return srvr, url, errCh
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		runner := releasingRunner{started: make(chan struct{}), release: make(chan struct{})}
+		srvr, url, errCh := start(t, &runner)
+
+		shutdownCh := make(chan error, 1)
+		go func() {
+			shutdownCh <- shutdown(context.Background(), srvr, 5*time.Second)
+		}()
+
+		// wait for the listener to close
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get(url + "/api/version")
+			if err != nil {
+				break
+			}
+			resp.Body.Close()
+
+			if time.Now().After(deadline) {
+				t.Fatal("expected new requests to be rejected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		select {
+		case err := <-shutdownCh:
+			t.Fatalf("expected shutdown to wait for the in flight request, got %v", err)
+		default:
+		}
+
+		close(runner.release)
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("expected in flight request to finish, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for in flight request")
+		}
+
+		select {
+		case err := <-shutdownCh:
+			if err != nil {
+				t.Errorf("expected shutdown to succeed, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for shutdown")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		runner := releasingRunner{started: make(chan struct{}), release: make(chan struct{})}
+		srvr, _, errCh := start(t, &runner)
+
+		if err := shutdown(context.Background(), srvr, 100*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected shutdown to time out, got %v", err)
+		}
+
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Error("expected in flight request to be closed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for in flight request to close")
+		}
+	})
+}
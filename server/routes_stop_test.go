@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// blockingRunner streams one response then blocks until the request is canceled
+type blockingRunner struct {
+	mockRunner
+	started chan struct{}
+}
+
+func (m *blockingRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "Hi"})
+	close(m.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStop(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	activeRequestID := func(t *testing.T) string {
+		t.Helper()
+
+		reqs := s.requests.list()
+		if len(reqs) != 1 {
+			t.Fatalf("expected 1 active request, got %d", len(reqs))
+		}
+
+		return reqs[0].RequestID
+	}
+
+	for _, tt := range []struct {
+		name    string
+		handler func(*gin.Context)
+		body    any
+		decode  func(*testing.T, string) string
+	}{
+		{
+			name:    "generate",
+			handler: s.GenerateHandler,
+			body:    api.GenerateRequest{Model: "test", Prompt: "Hello!"},
+			decode: func(t *testing.T, line string) string {
+				var resp api.GenerateResponse
+				if err := json.Unmarshal([]byte(line), &resp); err != nil {
+					t.Fatal(err)
+				}
+				return resp.RequestID
+			},
+		},
+		{
+			name:    "chat",
+			handler: s.ChatHandler,
+			body:    api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			decode: func(t *testing.T, line string) string {
+				var resp api.ChatResponse
+				if err := json.Unmarshal([]byte(line), &resp); err != nil {
+					t.Fatal(err)
+				}
+				return resp.RequestID
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := blockingRunner{started: make(chan struct{})}
+			s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{llama: &runner}
+			}
+
+			done := make(chan string)
+			go func() {
+				w := createRequest(t, tt.handler, tt.body)
+				done <- w.Body.String()
+			}()
+
+			select {
+			case <-runner.started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for completion to start")
+			}
+
+			id := activeRequestID(t)
+
+			w := createRequest(t, s.StopHandler, api.StopRequest{RequestID: id})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var body string
+			select {
+			case body = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for request to stop")
+			}
+
+			scanner := bufio.NewScanner(strings.NewReader(body))
+			if !scanner.Scan() {
+				t.Fatal("expected a response")
+			}
+
+			if got := tt.decode(t, scanner.Text()); got != id {
+				t.Errorf("expected request id %q in first response, got %q", id, got)
+			}
+
+			if !strings.Contains(body, context.Canceled.Error()) {
+				t.Errorf("expected the stream to end with a cancellation error, got %q", body)
+			}
+
+			w = createRequest(t, s.StopHandler, api.StopRequest{RequestID: id})
+			if w.Code != http.StatusNotFound {
+				t.Errorf("expected status 404 for a finished request, got %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("unknown request", func(t *testing.T) {
+		w := createRequest(t, s.StopHandler, api.StopRequest{RequestID: "unknown"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing request id", func(t *testing.T) {
+		w := createRequest(t, s.StopHandler, api.StopRequest{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("not streaming", func(t *testing.T) {
+		mock.CompletionResponse = llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: "stop"}
+		s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+			req.successCh <- &runnerRef{llama: &mock}
+		}
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.RequestID != "" {
+			t.Errorf("expected no request id, got %q", resp.RequestID)
+		}
+	})
+}
+
+func TestListRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	list := func(t *testing.T) []api.ActiveRequest {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/requests", nil)
+		s.ListRequestsHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ListRequestsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Requests
+	}
+
+	// waitFor polls the listed requests until they have the given statuses
+	waitFor := func(t *testing.T, statuses ...string) []api.ActiveRequest {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			reqs := list(t)
+			got := make([]string, len(reqs))
+			for i, r := range reqs {
+				got[i] = r.Status
+			}
+
+			if slices.Equal(got, statuses) {
+				return reqs
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected requests with status %v, got %v", statuses, got)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		if reqs := list(t); len(reqs) != 0 {
+			t.Errorf("expected no requests, got %v", reqs)
+		}
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		// the model never finishes loading so the request stays queued
+		loading := make(chan struct{})
+		s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+			close(loading)
+			<-req.ctx.Done()
+		}
+
+		submitted := time.Now()
+		done := make(chan int)
+		go func() {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}})
+			done <- w.Code
+		}()
+
+		<-loading
+		reqs := waitFor(t, "queued")
+		if reqs[0].Model != "test" {
+			t.Errorf("expected model test, got %q", reqs[0].Model)
+		}
+
+		if reqs[0].SubmittedAt.Before(submitted.Add(-time.Second)) || reqs[0].SubmittedAt.After(time.Now()) {
+			t.Errorf("unexpected submission time %v", reqs[0].SubmittedAt)
+		}
+
+		if w := createRequest(t, s.StopHandler, api.StopRequest{RequestID: reqs[0].RequestID}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		select {
+		case code := <-done:
+			if code != 499 {
+				t.Errorf("expected status 499, got %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for request to stop")
+		}
+
+		waitFor(t)
+	})
+
+	t.Run("running", func(t *testing.T) {
+		runner := blockingRunner{started: make(chan struct{})}
+		s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+			req.successCh <- &runnerRef{llama: &runner}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+			close(done)
+		}()
+
+		<-runner.started
+		reqs := waitFor(t, "running")
+
+		if w := createRequest(t, s.StopHandler, api.StopRequest{RequestID: reqs[0].RequestID}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for request to stop")
+		}
+
+		waitFor(t)
+	})
+}
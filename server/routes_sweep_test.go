@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestSweep(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{CompletionResponse: llm.CompletionResponse{Content: "Blue.", Done: true, DoneReason: "stop", EvalCount: 2}}
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	t.Run("grid", func(t *testing.T) {
+		w := createRequest(t, s.SweepHandler, api.SweepRequest{
+			Model:   "test",
+			Prompt:  "Why is the sky blue?",
+			System:  "Be brief.",
+			Grid:    map[string][]any{"temperature": {0.2, 0.8}, "top_k": {10, 40}},
+			Options: map[string]any{"seed": 7, "temperature": 0.5},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.SweepResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed != 7 {
+			t.Errorf("expected seed 7, got %d", resp.Seed)
+		}
+
+		var combos []map[string]any
+		for _, result := range resp.Results {
+			if result.Response != "Blue." || result.DoneReason != "stop" || result.EvalCount != 2 || result.Error != "" {
+				t.Errorf("unexpected result %+v", result)
+			}
+
+			combos = append(combos, result.Options)
+		}
+
+		if diff := cmp.Diff([]map[string]any{
+			{"temperature": 0.2, "top_k": float64(10)},
+			{"temperature": 0.2, "top_k": float64(40)},
+			{"temperature": 0.8, "top_k": float64(10)},
+			{"temperature": 0.8, "top_k": float64(40)},
+		}, combos); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the last combination's options reach the runner
+		if opts := mock.CompletionRequest.Options; opts.Temperature != 0.8 || opts.TopK != 40 || opts.Seed != 7 {
+			t.Errorf("unexpected options: temperature %v, top_k %d, seed %d", opts.Temperature, opts.TopK, opts.Seed)
+		}
+
+		if expect := "system: Be brief. user: Why is the sky blue? "; mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("random seed", func(t *testing.T) {
+		w := createRequest(t, s.SweepHandler, api.SweepRequest{
+			Model:  "test",
+			Prompt: "Why is the sky blue?",
+			Grid:   map[string][]any{"temperature": {0.2, 0.8}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.SweepResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the first combination's random seed is reused
+		if resp.Seed < 0 || mock.CompletionRequest.Options.Seed != resp.Seed {
+			t.Errorf("expected seed %d to be reused, got %d", resp.Seed, mock.CompletionRequest.Options.Seed)
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		large := make([]any, 6)
+		for i := range large {
+			large[i] = float64(i)
+		}
+
+		for name, req := range map[string]api.SweepRequest{
+			"no grid":        {Model: "test", Prompt: "Hi"},
+			"no prompt":      {Model: "test", Grid: map[string][]any{"temperature": {0.2}}},
+			"empty values":   {Model: "test", Prompt: "Hi", Grid: map[string][]any{"temperature": {}}},
+			"unknown option": {Model: "test", Prompt: "Hi", Grid: map[string][]any{"temprature": {0.2}}},
+			"wrong type":     {Model: "test", Prompt: "Hi", Grid: map[string][]any{"top_k": {"many"}}},
+			"too large":      {Model: "test", Prompt: "Hi", Grid: map[string][]any{"top_k": large, "seed": large}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := createRequest(t, s.SweepHandler, req)
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.SweepHandler, api.SweepRequest{Model: "missing", Prompt: "Hi", Grid: map[string][]any{"temperature": {0.2}}})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestTemplates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_TEMPLATES", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	list := func(t *testing.T) []api.ListTemplateResponse {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/templates", nil)
+		s.ListTemplatesHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ListTemplatesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Templates
+	}
+
+	remove := func(t *testing.T, name string) int {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodDelete, "/api/templates/"+name, nil)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.DeleteTemplateHandler(c)
+		return w.Code
+	}
+
+	show := func(t *testing.T, name string) (*api.ShowTemplateResponse, int) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/templates/"+name, nil)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.ShowTemplateHandler(c)
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+
+		var resp api.ShowTemplateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return &resp, w.Code
+	}
+
+	chat := func(t *testing.T, req api.ChatRequest) int {
+		t.Helper()
+		req.Stream = &stream
+		w := createRequest(t, s.ChatHandler, req)
+		return w.Code
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		if templates := list(t); len(templates) != 0 {
+			t.Errorf("expected no templates, got %v", templates)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		for _, req := range []api.TemplateRequest{
+			{Name: "rag", Template: `{{- range .Messages }}<{{ .Role }}>{{ .Content }}</{{ .Role }}>{{ end }}`},
+			{Name: "plain", Template: `{{ .Prompt }}`},
+		} {
+			if w := createRequest(t, s.CreateTemplateHandler, req); w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(envconfig.TemplatesDir, "rag.gotmpl")); err != nil {
+			t.Fatal(err)
+		}
+
+		templates := list(t)
+		if len(templates) != 2 || templates[0].Name != "plain" || templates[1].Name != "rag" {
+			t.Fatalf("expected templates plain and rag, got %v", templates)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: "rag",
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if expect := "<system></system><user>Hello!</user>"; mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+
+		// the model's own template is still used without a template name
+		code = chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if expect := "system:  user: Hello! "; mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		before := list(t)[1]
+
+		req := api.TemplateRequest{Name: "rag", Template: `{{- range .Messages }}[{{ .Role }}] {{ .Content }}{{ end }}`}
+		if w := createRequest(t, s.CreateTemplateHandler, req); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if after := list(t)[1]; after.Digest == before.Digest {
+			t.Errorf("expected digest to change, got %s", after.Digest)
+		}
+
+		code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: "rag",
+		})
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if expect := "[system] [user] Hello!"; mock.CompletionRequest.Prompt != expect {
+			t.Errorf("expected prompt %q, got %q", expect, mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("show", func(t *testing.T) {
+		resp, code := show(t, "rag")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if expect := `{{- range .Messages }}[{{ .Role }}] {{ .Content }}{{ end }}`; resp.Template != expect {
+			t.Errorf("expected template %q, got %q", expect, resp.Template)
+		}
+
+		if listed := list(t)[1]; resp.ListTemplateResponse != listed {
+			t.Errorf("expected %v, got %v", listed, resp.ListTemplateResponse)
+		}
+
+		if _, code := show(t, "missing"); code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", code)
+		}
+
+		if _, code := show(t, "..%2fescape"); code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("tools", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: "rag",
+			Tools:    []api.Tool{{Type: "function"}},
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, req := range []api.TemplateRequest{
+			{Template: `{{ .Prompt }}`},
+			{Name: "../escape", Template: `{{ .Prompt }}`},
+			{Name: "broken", Template: `{{ .Prompt `},
+		} {
+			if w := createRequest(t, s.CreateTemplateHandler, req); w.Code != http.StatusBadRequest {
+				t.Errorf("%q: expected status 400, got %d", req.Name, w.Code)
+			}
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: "missing",
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if code := remove(t, "rag"); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if code := remove(t, "rag"); code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", code)
+		}
+
+		if code := remove(t, "..%2fescape"); code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+
+		if templates := list(t); len(templates) != 1 || templates[0].Name != "plain" {
+			t.Errorf("expected only template plain, got %v", templates)
+		}
+
+		code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: "rag",
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+}
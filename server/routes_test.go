@@ -14,7 +14,9 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -315,6 +317,61 @@ func Test_Routes(t *testing.T) {
 				}
 			},
 		},
+		{
+			Name:   "Template Lint Handler",
+			Method: http.MethodGet,
+			Path:   "/api/models/library%2Flint:latest/template/lint",
+			Setup: func(t *testing.T, req *http.Request) {
+				r := strings.NewReader(fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"<|user|>\n{{ .Prompt }}{{ .Response }}\"\"\"", createTestFile(t, "ollama-model")))
+				modelfile, err := parser.ParseFile(r)
+				require.NoError(t, err)
+				err = CreateModel(context.TODO(), model.ParseName("lint"), "", "", modelfile, func(api.ProgressResponse) {})
+				require.NoError(t, err)
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				var lintResp api.TemplateLintResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&lintResp))
+				require.Len(t, lintResp.Warnings, 1)
+				assert.Equal(t, "unterminated-user-turn", lintResp.Warnings[0].Rule)
+				assert.Equal(t, 2, lintResp.Warnings[0].Line)
+			},
+		},
+		{
+			Name:   "Template Lint Handler Missing Model",
+			Method: http.MethodGet,
+			Path:   "/api/models/missing/template/lint",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			},
+		},
+		{
+			Name:   "Capabilities Handler Escaped Name",
+			Method: http.MethodGet,
+			// every route under /api/models/ takes a name which escapes '/' as %2F
+			Path: "/api/models/library%2Flint:latest/capabilities",
+			Expected: func(t *testing.T, resp *http.Response) {
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				var capsResp api.CapabilitiesResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&capsResp))
+				assert.Equal(t, "lint:latest", capsResp.Model)
+			},
+		},
+		{
+			Name:   "Update Template Handler Escaped Name",
+			Method: http.MethodPatch,
+			Path:   "/api/models/library%2Flint:latest/template",
+			Setup: func(t *testing.T, req *http.Request) {
+				jsonData, err := json.Marshal(api.UpdateModelTemplateRequest{Template: "{{ .Prompt }}"})
+				require.NoError(t, err)
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			},
+		},
 		{
 			Name:   "Embed Handler Invalid Input",
 			Method: http.MethodPost,
@@ -527,3 +584,689 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestModelOptionsNumCtxFraction(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+	createMockModel(t, &s, "fraction", "")
+	createMockModel(t, &s, "fraction-num-ctx", "PARAMETER num_ctx 1024")
+
+	cases := []struct {
+		name    string
+		model   string
+		opts    map[string]any
+		numCtx  int
+		wantErr bool
+	}{
+		{"default", "fraction", nil, 2048, false},
+		{"fraction", "fraction", map[string]any{"num_ctx_fraction": 0.125}, 1024, false},
+		{"full", "fraction", map[string]any{"num_ctx_fraction": 1.0}, 8192, false},
+		{"rounded", "fraction", map[string]any{"num_ctx_fraction": 0.3}, 2458, false},
+		{"request num_ctx", "fraction", map[string]any{"num_ctx": float64(4096), "num_ctx_fraction": 0.5}, 4096, false},
+		{"model num_ctx", "fraction-num-ctx", map[string]any{"num_ctx_fraction": 0.5}, 1024, false},
+		{"too large", "fraction", map[string]any{"num_ctx_fraction": 1.5}, 0, true},
+		{"negative", "fraction", map[string]any{"num_ctx_fraction": -0.5}, 0, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := GetModel(tt.model)
+			require.NoError(t, err)
+
+			opts, _, err := modelOptions(m, tt.opts)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.numCtx, opts.NumCtx)
+		})
+	}
+}
+
+func TestModelOptionsSeed(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+	createMockModel(t, &s, "seed", "")
+
+	m, err := GetModel("seed")
+	require.NoError(t, err)
+
+	opts, _, err := modelOptions(m, nil)
+	require.NoError(t, err)
+	assert.Equal(t, -1, opts.Seed)
+
+	opts, _, err = modelOptions(m, map[string]any{"seed": float64(0)})
+	require.NoError(t, err)
+	assert.Equal(t, 0, opts.Seed)
+
+	opts, _, err = modelOptions(m, map[string]any{"seed": float64(maxSeed)})
+	require.NoError(t, err)
+	assert.Equal(t, maxSeed, int64(opts.Seed))
+
+	_, _, err = modelOptions(m, map[string]any{"seed": float64(maxSeed + 1)})
+	require.Error(t, err)
+}
+
+func TestModelOptionsNumCache(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+	createMockModel(t, &s, "cache", "PARAMETER num_cache 1024")
+
+	m, err := GetModel("cache")
+	require.NoError(t, err)
+
+	opts, _, err := modelOptions(m, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1024, opts.NumCache)
+	assert.Equal(t, 1024, opts.NumCtx)
+
+	opts, _, err = modelOptions(m, map[string]any{"num_ctx": float64(512)})
+	require.NoError(t, err)
+	assert.Equal(t, 512, opts.NumCtx)
+
+	_, _, err = modelOptions(m, map[string]any{"num_cache": float64(-1)})
+	require.Error(t, err)
+}
+
+func TestModelOptionsWarnings(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+	createMockModel(t, &s, "warnings", "PARAMETER num_cache 4096")
+
+	m, err := GetModel("warnings")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		opts     map[string]any
+		warnings []string
+		check    func(t *testing.T, opts api.Options)
+	}{
+		{
+			name: "none",
+			opts: map[string]any{"temperature": 0.5, "num_gpu": float64(2), "mirostat": float64(2), "mirostat_tau": 4.0},
+		},
+		{
+			name:     "num_gpu",
+			opts:     map[string]any{"num_gpu": float64(99)},
+			warnings: []string{"num_gpu clamped to 2 (model has 2 layers)"},
+			check: func(t *testing.T, opts api.Options) {
+				assert.Equal(t, 2, opts.NumGPU)
+			},
+		},
+		{
+			name:     "num_ctx",
+			opts:     map[string]any{"num_ctx": float64(8192)},
+			warnings: []string{"num_ctx clamped to 4096 (num_cache is 4096)"},
+			check: func(t *testing.T, opts api.Options) {
+				assert.Equal(t, 4096, opts.NumCtx)
+			},
+		},
+		{
+			name:     "num_ctx_fraction",
+			opts:     map[string]any{"num_ctx": float64(1024), "num_ctx_fraction": 0.5},
+			warnings: []string{"num_ctx_fraction ignored because num_ctx is set to 1024"},
+		},
+		{
+			name:     "mirostat disabled",
+			opts:     map[string]any{"mirostat_eta": 0.2, "mirostat_tau": 4.0},
+			warnings: []string{"mirostat_tau ignored because mirostat is disabled", "mirostat_eta ignored because mirostat is disabled"},
+		},
+		{
+			name:     "mirostat invalid",
+			opts:     map[string]any{"mirostat": float64(3)},
+			warnings: []string{"mirostat 3 ignored (must be 0, 1 or 2)"},
+			check: func(t *testing.T, opts api.Options) {
+				assert.Equal(t, 0, opts.Mirostat)
+			},
+		},
+		{
+			name:     "logit_bias",
+			opts:     map[string]any{"logit_bias": map[string]any{"7": 250.0, "3": -5.5, "12": float64(-101)}},
+			warnings: []string{"logit_bias for token 7 clamped to 100", "logit_bias for token 12 clamped to -100"},
+			check: func(t *testing.T, opts api.Options) {
+				assert.Equal(t, map[int]float32{3: -5.5, 7: 100, 12: -100}, opts.LogitBias)
+			},
+		},
+		{
+			name:     "unknown",
+			opts:     map[string]any{"temprature": 0.5, "top_kk": float64(1)},
+			warnings: []string{`unknown option "temprature" ignored`, `unknown option "top_kk" ignored`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, warnings, err := modelOptions(m, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.warnings, warnings)
+
+			if tt.check != nil {
+				tt.check(t, opts)
+			}
+		})
+	}
+}
+
+func TestProcessHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{sched: InitScheduler(context.TODO())}
+	s.sched.loaded["test"] = &runnerRef{
+		model:          &Model{ShortName: "test:latest"},
+		estimatedTotal: 5000,
+		estimatedVRAM:  3000,
+		gpuLayers:      20,
+		Options:        &api.Options{Runner: api.Runner{NumCtx: 8192}},
+		expiresAt:      time.Now().Add(time.Minute),
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/ps", nil)
+	s.ProcessHandler(c)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp api.ProcessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Models, 1)
+
+	m := resp.Models[0]
+	assert.Equal(t, "test:latest", m.Name)
+	assert.Equal(t, int64(5000), m.Size)
+	assert.Equal(t, int64(3000), m.SizeVRAM)
+	assert.Equal(t, int64(2000), m.SizeRAM)
+	assert.Equal(t, 20, m.GPULayers)
+	assert.Equal(t, 8192, m.ContextLength)
+}
+
+func TestContextStatsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	s := Server{sched: InitScheduler(context.TODO())}
+	createMockModel(t, &s, "test", "")
+	createMockModel(t, &s, "other", "SYSTEM other")
+
+	m, err := GetModel("test")
+	require.NoError(t, err)
+
+	contextStats := func(t *testing.T, name string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/models/"+name+"/context-stats", nil)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.ContextStatsHandler(c)
+		return w
+	}
+
+	t.Run("not loaded", func(t *testing.T) {
+		w := contextStats(t, "test")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "not loaded")
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := contextStats(t, "missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "not found")
+	})
+
+	// the same model loaded with two context sizes, and another model
+	s.sched.loaded["a"] = &runnerRef{
+		model:     m,
+		modelPath: m.ModelPath,
+		llama:     &mockLlm{contextStats: llm.ContextStats{KVCacheUsedTokens: 100, KVCacheTotalTokens: 2048, ActiveSessions: 1}},
+	}
+	s.sched.loaded["b"] = &runnerRef{
+		model:     m,
+		modelPath: m.ModelPath,
+		llama:     &mockLlm{contextStats: llm.ContextStats{KVCacheUsedTokens: 300, KVCacheTotalTokens: 8192, ActiveSessions: 2}},
+	}
+	s.sched.loaded["c"] = &runnerRef{
+		model:     &Model{ShortName: "other:latest"},
+		modelPath: "other",
+		llama:     &mockLlm{contextStats: llm.ContextStats{KVCacheUsedTokens: 1000, KVCacheTotalTokens: 1000, ActiveSessions: 4}},
+	}
+
+	t.Run("loaded", func(t *testing.T) {
+		w := contextStats(t, "test")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.ContextStatsResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, api.ContextStatsResponse{
+			Model:              "test:latest",
+			KVCacheUsedTokens:  400,
+			KVCacheTotalTokens: 10240,
+			ActiveSessions:     3,
+		}, resp)
+	})
+
+	t.Run("kv cache metric", func(t *testing.T) {
+		assert.Equal(t, 1400, s.sched.kvCacheTokensUsed(context.TODO()))
+	})
+
+	t.Run("runner error", func(t *testing.T) {
+		s.sched.loaded["b"].llama.(*mockLlm).contextStatsErr = fmt.Errorf("server not ready: loading model")
+		w := contextStats(t, "test")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		// the metric leaves out runners which can't report their cache
+		assert.Equal(t, 1100, s.sched.kvCacheTokensUsed(context.TODO()))
+	})
+}
+
+func TestCapabilitiesHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+
+	chatml := "{% if messages[0]['role'] == 'system' %}{% set system_message = messages[0]['content'] %}{% endif %}{% if system_message is defined %}{{ system_message }}{% endif %}{% for message in messages %}{% set content = message['content'] %}{% if message['role'] == 'user' %}{{ '<|im_start|>user\\n' + content + '<|im_end|>\\n<|im_start|>assistant\\n' }}{% elif message['role'] == 'assistant' %}{{ content + '<|im_end|>' + '\\n' }}{% endif %}{% endfor %}"
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name: "vision",
+		Modelfile: fmt.Sprintf(
+			"FROM %s\nFROM %s",
+			createBinFile(t, llm.KV{"general.architecture": "llama", "llama.context_length": uint32(4096), "tokenizer.chat_template": chatml}, nil),
+			createBinFile(t, llm.KV{"general.architecture": "clip"}, nil),
+		),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name: "tools",
+		Modelfile: fmt.Sprintf(
+			"FROM %s\nTEMPLATE \"{{ if .Tools }}{{ json .Tools }}{{ end }}{{ .Prompt }}\"",
+			createBinFile(t, llm.KV{"general.architecture": "llama", "llama.context_length": uint32(8192)}, nil),
+		),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	capabilities := func(t *testing.T, name string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/models/"+name+"/capabilities", nil)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.CapabilitiesHandler(c)
+		return w
+	}
+
+	t.Run("vision", func(t *testing.T) {
+		w := capabilities(t, "vision")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.CapabilitiesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "vision:latest", resp.Model)
+		assert.True(t, resp.SupportsImages)
+		assert.False(t, resp.SupportsToolCalls)
+		assert.Equal(t, "chatml", resp.PromptFormat)
+		assert.Equal(t, 4096, resp.MaxContextLength)
+		assert.Len(t, resp.ProjectorPaths, 1)
+	})
+
+	t.Run("tools", func(t *testing.T) {
+		w := capabilities(t, "tools")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.CapabilitiesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.False(t, resp.SupportsImages)
+		assert.True(t, resp.SupportsToolCalls)
+		assert.Empty(t, resp.PromptFormat)
+		assert.Equal(t, 8192, resp.MaxContextLength)
+		assert.NotNil(t, resp.ProjectorPaths)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := capabilities(t, "missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestFineTuneDataHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name: "tuned",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":        "llama",
+			"general.dataset":             "alpaca-cleaned",
+			"general.dataset.description": "Cleaned instructions from the Alpaca dataset",
+			"general.dataset.source":      "https://huggingface.co/datasets/yahma/alpaca-cleaned",
+			"general.description":         "A chat model.\nFine-tuned on data from https://huggingface.co/datasets/yahma/alpaca-cleaned.\nLicense: https://example.com/license",
+		}, nil)),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "base",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "llama"}, nil)),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	fineTuneData := func(t *testing.T, name string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/models/"+name+"/fine-tune-data", nil)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.FineTuneDataHandler(c)
+		return w
+	}
+
+	t.Run("dataset", func(t *testing.T) {
+		w := fineTuneData(t, "tuned")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.FineTuneDataResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, api.FineTuneDataResponse{
+			Model:       "tuned:latest",
+			Dataset:     "alpaca-cleaned",
+			Description: "Cleaned instructions from the Alpaca dataset",
+			Source:      "https://huggingface.co/datasets/yahma/alpaca-cleaned",
+			Links:       []string{"https://huggingface.co/datasets/yahma/alpaca-cleaned"},
+		}, resp)
+	})
+
+	t.Run("no dataset", func(t *testing.T) {
+		w := fineTuneData(t, "base")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.FineTuneDataResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, api.FineTuneDataResponse{Model: "base:latest", Links: []string{}}, resp)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := fineTuneData(t, "missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestTemplateValidateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	cases := []struct {
+		name     string
+		template string
+		expect   api.TemplateValidateResponse
+	}{
+		{
+			name:     "messages",
+			template: "{{ if .System }}{{ .System }}{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}",
+			expect: api.TemplateValidateResponse{
+				Referenced:   []string{"System", "Messages"},
+				Unreferenced: []string{"Prompt", "Response", "Tools"},
+			},
+		},
+		{
+			name:     "no fields",
+			template: "hello",
+			expect: api.TemplateValidateResponse{
+				Referenced:   []string{},
+				Unreferenced: []string{"System", "Prompt", "Response", "Messages", "Tools"},
+			},
+		},
+		{
+			name:     "parse error",
+			template: "{{ .Prompt }}\n{{ if .System }}\n{{ .System }",
+			expect: api.TemplateValidateResponse{
+				Referenced:   []string{},
+				Unreferenced: []string{"System", "Prompt", "Response", "Messages", "Tools"},
+				ParseError:   &api.TemplateParseError{Line: 3, Message: `unexpected "}" in operand`},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.TemplateValidateHandler, api.TemplateValidateRequest{Template: tt.template})
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var resp api.TemplateValidateResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, tt.expect, resp)
+		})
+	}
+}
+
+func TestChatTemplateTestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	render := func(t *testing.T, name string, req api.ChatTemplateTestRequest) *httptest.ResponseRecorder {
+		t.Helper()
+
+		return createRequest(t, func(c *gin.Context) {
+			c.Params = gin.Params{{Key: "name", Value: name}}
+			s.ChatTemplateTestHandler(c)
+		}, req)
+	}
+
+	msgs := []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi!"}}
+
+	var tool api.Tool
+	tool.Type = "function"
+	tool.Function.Name = "get_weather"
+
+	cases := []struct {
+		name   string
+		req    api.ChatTemplateTestRequest
+		expect api.ChatTemplateTestResponse
+	}{
+		{
+			name: "model template",
+			req:  api.ChatTemplateTestRequest{Messages: msgs},
+			expect: api.ChatTemplateTestResponse{
+				Rendered: "user: Hello! assistant: Hi! ",
+				Errors:   []string{},
+				Warnings: []api.TemplateLintWarning{},
+			},
+		},
+		{
+			name: "tools",
+			req: api.ChatTemplateTestRequest{
+				Template: "{{ range .Tools }}[{{ .Function.Name }}]{{ end }}{{ range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}",
+				Messages: msgs,
+				Tools:    []api.Tool{tool},
+			},
+			expect: api.ChatTemplateTestResponse{
+				Rendered: "[get_weather]<user>Hello!<assistant>Hi!",
+				Errors:   []string{},
+				Warnings: []api.TemplateLintWarning{},
+			},
+		},
+		{
+			name: "parse error",
+			req:  api.ChatTemplateTestRequest{Template: "{{ .Prompt ", Messages: msgs},
+			expect: api.ChatTemplateTestResponse{
+				Errors:   []string{`template: :1: unclosed action`},
+				Warnings: []api.TemplateLintWarning{},
+			},
+		},
+		{
+			name: "execution error",
+			req:  api.ChatTemplateTestRequest{Template: "{{ range .Messages }}{{ .Role }}{{ .Missing }}{{ end }}", Messages: msgs},
+			expect: api.ChatTemplateTestResponse{
+				Rendered: "user",
+				Errors:   []string{`template test:latest: line 1: executing <.Missing>: can't evaluate field Missing in type *api.Message`},
+				Warnings: []api.TemplateLintWarning{},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := render(t, "test", tt.req)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var resp api.ChatTemplateTestResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, tt.expect, resp)
+		})
+	}
+
+	t.Run("lint", func(t *testing.T) {
+		w := render(t, "test", api.ChatTemplateTestRequest{Template: "[INST] {{ .Prompt }}", Messages: msgs})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.ChatTemplateTestResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Warnings, 1)
+		assert.Equal(t, "unterminated-user-turn", resp.Warnings[0].Rule)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := render(t, "missing", api.ChatTemplateTestRequest{Messages: msgs})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestUpdateModelTemplateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", `TEMPLATE """{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""`)
+
+	update := func(t *testing.T, name, tmpl string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var b bytes.Buffer
+		require.NoError(t, json.NewEncoder(&b).Encode(api.UpdateModelTemplateRequest{Template: tmpl}))
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPatch, "/api/models/"+name+"/template", &b)
+		c.Params = gin.Params{{Key: "name", Value: name}}
+		s.UpdateModelTemplateHandler(c)
+		return w
+	}
+
+	before, err := GetModel("test")
+	require.NoError(t, err)
+
+	w := update(t, "test", "[INST] {{ .Prompt }}")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp api.TemplateLintResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Warnings, 1)
+	assert.Equal(t, "unterminated-user-turn", resp.Warnings[0].Rule)
+
+	w = update(t, "test", `{{- range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	after, err := GetModel("test")
+	require.NoError(t, err)
+
+	t.Run("in flight", func(t *testing.T) {
+		// a request which read the model before the update keeps its template
+		assert.Equal(t, `{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`, before.Template.String())
+		assert.Equal(t, `{{- range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}`, after.Template.String())
+	})
+
+	t.Run("runner not reloaded", func(t *testing.T) {
+		assert.Equal(t, before.ModelPath, after.ModelPath)
+
+		opts := api.DefaultOptions()
+		runner := &runnerRef{model: before, Options: &opts, numParallel: 1}
+		assert.False(t, runner.optionsChanged(&LlmRequest{model: after, opts: opts}))
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "<system><user>Hello!", mock.CompletionRequest.Prompt)
+	})
+
+	t.Run("show", func(t *testing.T) {
+		w := createRequest(t, s.ShowModelHandler, api.ShowRequest{Name: "test"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.ShowResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, `{{- range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}`, resp.Template)
+	})
+
+	t.Run("parse error", func(t *testing.T) {
+		w := update(t, "test", "{{ .Prompt ")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := update(t, "missing", "{{ .Prompt }}")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		require.NoError(t, WriteAlias(model.ParseName("fast"), model.ParseName("test")))
+
+		w := update(t, "fast", "{{ .Prompt }}")
+		require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "update the template of test:latest instead")
+
+		// the alias still resolves to the model, which keeps its template
+		m, err := ParseNamedManifest(model.ParseName("fast"))
+		require.NoError(t, err)
+		assert.Equal(t, "test:latest", aliasOf(m))
+
+		after, err := GetModel("test")
+		require.NoError(t, err)
+		assert.Equal(t, `{{- range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}`, after.Template.String())
+	})
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	// load registers the runner like the scheduler does, so the request's
+	// slot is released when its context is done
+	load := func(runner llm.LlamaServer) func(*LlmRequest, *llm.GGML, gpu.GpuInfoList, int) {
+		return func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+			ref := &runnerRef{
+				llama:           runner,
+				model:           req.model,
+				modelPath:       req.model.ModelPath,
+				loadedKey:       req.loadedKey(),
+				Options:         &req.opts,
+				sessionDuration: time.Minute,
+				refCount:        1,
+			}
+
+			s.sched.loadedMu.Lock()
+			s.sched.loaded[ref.loadedKey] = ref
+			s.sched.loadedMu.Unlock()
+
+			go func() {
+				<-req.ctx.Done()
+				s.sched.finishedReqCh <- req
+			}()
+
+			req.successCh <- ref
+		}
+	}
+
+	// released waits for the runner's requests to finish and unloads it
+	released := func(t *testing.T) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.sched.loadedMu.Lock()
+			var refs uint
+			for _, ref := range s.sched.loaded {
+				ref.refMu.Lock()
+				refs += ref.refCount
+				ref.refMu.Unlock()
+			}
+			s.sched.loadedMu.Unlock()
+
+			if refs == 0 {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the runner to be released, got %d requests", refs)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		s.sched.loadedMu.Lock()
+		clear(s.sched.loaded)
+		s.sched.loadedMu.Unlock()
+	}
+
+	timeout := &api.Duration{Duration: 50 * time.Millisecond}
+
+	t.Run("generate", func(t *testing.T) {
+		runner := blockingRunner{started: make(chan struct{})}
+		s.sched.loadFn = load(&runner)
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Timeout: timeout})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resps []api.GenerateResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.GenerateResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			resps = append(resps, resp)
+		}
+
+		if len(resps) != 2 {
+			t.Fatalf("expected 2 responses, got %d", len(resps))
+		}
+
+		if resps[0].Response != "Hi" {
+			t.Errorf("expected the partial response, got %q", resps[0].Response)
+		}
+
+		if last := resps[1]; !last.Done || last.DoneReason != "timeout" {
+			t.Errorf("expected done with reason timeout, got %v %q", last.Done, last.DoneReason)
+		}
+
+		released(t)
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		runner := blockingRunner{started: make(chan struct{})}
+		s.sched.loadFn = load(&runner)
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+			Timeout:  timeout,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Hi" {
+			t.Errorf("expected the partial response, got %q", resp.Message.Content)
+		}
+
+		if !resp.Done || resp.DoneReason != "timeout" {
+			t.Errorf("expected done with reason timeout, got %v %q", resp.Done, resp.DoneReason)
+		}
+
+		released(t)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		runner := blockingRunner{started: make(chan struct{})}
+		s.sched.loadFn = load(&runner)
+
+		w := createRequest(t, s.ChatBatchHandler, api.ChatBatchRequest{
+			Requests: []api.ChatRequest{{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+				Timeout:  timeout,
+			}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resps []api.ChatBatchResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.ChatBatchResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			resps = append(resps, resp)
+		}
+
+		if len(resps) != 2 {
+			t.Fatalf("expected 2 responses, got %d", len(resps))
+		}
+
+		if resps[0].Message.Content != "Hi" {
+			t.Errorf("expected the partial response, got %q", resps[0].Message.Content)
+		}
+
+		if last := resps[1]; !last.Done || last.DoneReason != "timeout" {
+			t.Errorf("expected done with reason timeout, got %v %q", last.Done, last.DoneReason)
+		}
+
+		released(t)
+	})
+
+	t.Run("summarize", func(t *testing.T) {
+		createMockModel(t, &s, "summarize", `TEMPLATE """{{- range .Messages }}{{ .Content }} {{ end }}"""`)
+
+		// summarizing the truncated messages blocks until the timeout
+		runner := blockingRunner{started: make(chan struct{})}
+		s.sched.loadFn = load(&runner)
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "summarize",
+			Messages: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			Options: map[string]any{"num_ctx": 12, "summarize_truncated": true},
+			Stream:  &stream,
+			Timeout: timeout,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.Done || resp.DoneReason != "timeout" {
+			t.Errorf("expected done with reason timeout, got %v %q", resp.Done, resp.DoneReason)
+		}
+
+		released(t)
+	})
+
+	t.Run("no timeout", func(t *testing.T) {
+		mock.CompletionResponse = llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: "stop"}
+		s.sched.loadFn = load(&mock)
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), `"done_reason":"stop"`) {
+			t.Errorf("expected done reason stop, got %s", w.Body.String())
+		}
+
+		released(t)
+	})
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+type mockRunner struct {
+	llm.LlamaServer
+
+	// CompletionRequest is only valid until the next call to Completion
+	llm.CompletionRequest
+	llm.CompletionResponse
+
+	// CompletionError, if set, is returned by Completion instead of a response
+	CompletionError error
+}
+
+func (m *mockRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	m.CompletionRequest = r
+	if m.CompletionError != nil {
+		return m.CompletionError
+	}
+
+	fn(m.CompletionResponse)
+	return nil
+}
+
+func (mockRunner) Tokenize(ctx context.Context, s string) ([]int, error) {
+	return tokenize(ctx, s)
+}
+
+// newMockScheduler returns a scheduler which hands out mock for every request
+func newMockScheduler(mock *mockRunner) *Scheduler {
+	return &Scheduler{
+		pendingReqCh:  make(chan *LlmRequest, 1),
+		finishedReqCh: make(chan *LlmRequest, 1),
+		expiredCh:     make(chan *runnerRef, 1),
+		unloadedCh:    make(chan any, 1),
+		loaded:        make(map[string]*runnerRef),
+		getGpuFn:      gpu.GetGPUInfo,
+		getCpuFn:      gpu.GetCPUInfo,
+		reschedDelay:  250 * time.Millisecond,
+		loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+			req.successCh <- &runnerRef{llama: mock}
+		},
+	}
+}
+
+// createMockModel creates a model named name backed by a minimal llama GGUF file
+func createMockModel(t *testing.T, s *Server, name string, modelfile string) {
+	t.Helper()
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Model: name,
+		Modelfile: fmt.Sprintf("FROM %s\n%s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, nil), modelfile),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	t.Run("empty input", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Tokens == nil || len(resp.Tokens) != 0 {
+			t.Errorf("expected empty tokens, got %v", resp.Tokens)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "test",
+			Input: []string{"one two three", "", "four", "five six"},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := [][]int{{0, 1, 2}, {}, {0}, {0, 1}}
+		if diff := cmp.Diff(resp.Tokens, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("batch too large", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "test",
+			Input: make([]string, maxTokenizeBatch+1),
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "missing",
+			Input: []string{"hello"},
+		})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestTokenCount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var mock mockRunner
+	s := Server{sched: newMockScheduler(&mock)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	createMockModel(t, &s, "test", "")
+
+	handler := func(name string) func(*gin.Context) {
+		return func(c *gin.Context) {
+			c.Params = gin.Params{{Key: "name", Value: name}}
+			s.TokenCountHandler(c)
+		}
+	}
+
+	t.Run("messages", func(t *testing.T) {
+		w := createRequest(t, handler("test"), api.TokenCountRequest{
+			Messages: []api.Message{
+				{Role: "system", Content: "you are a helpful assistant"},
+				{Role: "user", Content: "why is the sky blue"},
+				{Role: "Assistant", Content: "because of rayleigh scattering"},
+				{Role: "user", Content: "and the grass"},
+			},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenCountResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := api.TokenCountResponse{
+			Total:  17,
+			ByRole: map[string]int{"system": 5, "user": 8, "assistant": 4},
+		}
+		if diff := cmp.Diff(resp, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("empty messages", func(t *testing.T) {
+		w := createRequest(t, handler("missing"), api.TokenCountRequest{})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenCountResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Total != 0 || resp.ByRole == nil || len(resp.ByRole) != 0 {
+			t.Errorf("expected empty counts, got %+v", resp)
+		}
+	})
+
+	t.Run("unknown role", func(t *testing.T) {
+		w := createRequest(t, handler("test"), api.TokenCountRequest{
+			Messages: []api.Message{{Role: "narrator", Content: "once upon a time"}},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, handler("missing"), api.TokenCountRequest{
+			Messages: []api.Message{{Role: "user", Content: "hello"}},
+		})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
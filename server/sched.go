@@ -17,6 +17,7 @@ import (
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
 )
 
 type LlmRequest struct {
@@ -30,6 +31,13 @@ type LlmRequest struct {
 	schedAttempts   uint
 }
 
+// loadedKey identifies the runner which can serve req. A model loaded with a
+// different context size is a separate runner so requests alternating between
+// context sizes don't reload the model each time
+func (req *LlmRequest) loadedKey() string {
+	return fmt.Sprintf("%s:%d", req.model.ModelPath, req.origNumCtx)
+}
+
 type Scheduler struct {
 	pendingReqCh  chan *LlmRequest
 	finishedReqCh chan *LlmRequest
@@ -85,8 +93,10 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
-		successCh:       make(chan *runnerRef),
-		errCh:           make(chan error, 1),
+		// buffered so the scheduler doesn't block if the request is canceled
+		// while it's handed a runner
+		successCh: make(chan *runnerRef, 1),
+		errCh:     make(chan error, 1),
 	}
 
 	select {
@@ -134,11 +144,27 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				slog.Warn("multimodal models don't support parallel requests yet")
 			}
 
+			if numParallel > 0 {
+				numParallel = limitParallel(pending, numParallel)
+			}
+
 			for {
 				var runnerToExpire *runnerRef
 				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
+				runner := s.loaded[pending.loadedKey()]
 				loadedCount := len(s.loaded)
+				if runner == nil {
+					runner = s.findLargerRunner(pending)
+				}
+
+				if runner == nil {
+					for _, r := range s.loaded {
+						if r.modelPath == pending.model.ModelPath && r.Options != nil {
+							slog.Info("loading model with a new context size", "model", pending.model.ModelPath, "num_ctx", pending.origNumCtx, "loaded_num_ctx", r.Options.NumCtx/r.numParallel)
+							break
+						}
+					}
+				}
 				s.loadedMu.Unlock()
 				if runner != nil {
 					if runner.needsReload(ctx, pending) {
@@ -192,7 +218,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 					if len(gpus) == 1 && gpus[0].Library == "cpu" {
 						// simplifying assumption of defaultParallel when in CPU mode
 						if numParallel <= 0 {
-							numParallel = defaultParallel
+							numParallel = limitParallel(pending, defaultParallel)
 						}
 
 						pending.opts.NumCtx = pending.origNumCtx * numParallel
@@ -306,7 +332,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			return
 		case finished := <-s.finishedReqCh:
 			s.loadedMu.Lock()
-			runner := s.loaded[finished.model.ModelPath]
+			runner := s.loaded[finished.loadedKey()]
 			s.loadedMu.Unlock()
 			if runner == nil {
 				slog.Error("finished request signal received after model unloaded", "modelPath", finished.model.ModelPath)
@@ -363,7 +389,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			slog.Debug("got lock to unload", "modelPath", runner.modelPath)
 			finished := runner.waitForVRAMRecovery()
 			runner.unload()
-			delete(s.loaded, runner.modelPath)
+			delete(s.loaded, runner.loadedKey)
 			s.loadedMu.Unlock()
 			slog.Debug("runner released", "modelPath", runner.modelPath)
 			runner.refMu.Unlock()
@@ -375,6 +401,42 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 	}
 }
 
+// findLargerRunner returns a loaded runner for req's model with a larger context
+// than req asks for, if there is one, and points req at it. A smaller num_ctx
+// is used to truncate the prompt so the model doesn't need to be loaded again.
+// The runner with the smallest context is preferred. loadedMu must be held
+func (s *Scheduler) findLargerRunner(req *LlmRequest) *runnerRef {
+	var runner *runnerRef
+	var numCtx int
+	for _, r := range s.loaded {
+		if r.modelPath != req.model.ModelPath || r.Options == nil || r.numParallel < 1 {
+			continue
+		}
+
+		n := r.Options.NumCtx / r.numParallel
+		if n <= req.origNumCtx || (runner != nil && n >= numCtx) {
+			continue
+		}
+
+		// the runner must be usable apart from its context size
+		larger := *req
+		larger.opts.NumCtx = n
+		if r.optionsChanged(&larger) {
+			continue
+		}
+
+		runner, numCtx = r, n
+	}
+
+	if runner != nil {
+		slog.Debug("using loaded model with a larger context size", "model", req.model.ModelPath, "num_ctx", req.origNumCtx, "loaded_num_ctx", numCtx)
+		req.origNumCtx = numCtx
+		req.opts.NumCtx = numCtx
+	}
+
+	return runner
+}
+
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
 // Updates session duration, and resets expiration timer
@@ -405,13 +467,19 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
+	if req.model.Template != nil {
+		for _, w := range template.LintTemplate(req.model.Template) {
+			slog.Warn("template may be incorrect", "model", req.model.ShortName, "rule", w.Rule, "line", w.Line, "message", w.Message)
+		}
+	}
+
 	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
 		// check for model compatibility
-		if errors.Is(llm.ErrUnsupportedFormat, err) || strings.Contains(err.Error(), "failed to load model") {
-			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
+		if errors.Is(err, llm.ErrUnsupportedFormat) || strings.Contains(err.Error(), "failed to load model") {
+			err = fmt.Errorf("%w: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
 		req.errCh <- err
@@ -420,12 +488,14 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	runner := &runnerRef{
 		model:           req.model,
 		modelPath:       req.model.ModelPath,
+		loadedKey:       req.loadedKey(),
 		llama:           llama,
 		Options:         &req.opts,
 		sessionDuration: sessionDuration,
 		gpus:            gpus,
 		estimatedVRAM:   llama.EstimatedVRAM(),
 		estimatedTotal:  llama.EstimatedTotal(),
+		gpuLayers:       llama.GPULayers(),
 		loading:         true,
 		refCount:        1,
 	}
@@ -433,7 +503,7 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	runner.refMu.Lock()
 
 	s.loadedMu.Lock()
-	s.loaded[req.model.ModelPath] = runner
+	s.loaded[runner.loadedKey] = runner
 	slog.Info("loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
 
@@ -533,6 +603,7 @@ type runnerRef struct {
 	gpus           gpu.GpuInfoList // Recorded at time of provisioning
 	estimatedVRAM  uint64
 	estimatedTotal uint64
+	gpuLayers      int
 
 	sessionDuration time.Duration
 	expireTimer     *time.Timer
@@ -540,6 +611,7 @@ type runnerRef struct {
 
 	model       *Model
 	modelPath   string
+	loadedKey   string
 	numParallel int
 	*api.Options
 }
@@ -573,6 +645,17 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 		return true
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if runner.optionsChanged(req) || runner.llama.Ping(ctx) != nil {
+		return true
+	}
+
+	return false
+}
+
+// optionsChanged reports whether req needs a runner loaded differently from runner
+func (runner *runnerRef) optionsChanged(req *LlmRequest) bool {
 	// Don't reload runner if num_gpu=-1 was provided
 	optsExisting := runner.Options.Runner
 	optsNew := req.opts.Runner
@@ -584,16 +667,9 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
+	return !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
-		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
-		runner.llama.Ping(ctx) != nil {
-		return true
-	}
-
-	return false
+		!reflect.DeepEqual(optsExisting, optsNew) // have the runner options changed?
 }
 
 // Free memory reporting on GPUs can lag for a while even after the runner
@@ -678,7 +754,7 @@ func pickBestFitGPUs(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numP
 	var numParallelToTry []int
 	if *numParallel <= 0 {
 		// If no specific parallel setting was provided, try larger then smaller, always end with 1
-		numParallelToTry = append(numParallelToTry, defaultParallel, 1)
+		numParallelToTry = append(numParallelToTry, limitParallel(req, defaultParallel), 1)
 	} else {
 		numParallelToTry = []int{*numParallel}
 	}
@@ -723,6 +799,22 @@ func pickBestFitGPUs(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numP
 	return nil
 }
 
+// limitParallel reduces numParallel so the KV cache of the requested context
+// size for every parallel request fits in the model's num_cache limit
+func limitParallel(req *LlmRequest, numParallel int) int {
+	if req.opts.NumCache <= 0 || req.origNumCtx <= 0 {
+		return numParallel
+	}
+
+	limit := max(1, req.opts.NumCache/req.origNumCtx)
+	if numParallel > limit {
+		slog.Debug("limiting parallel requests to fit num_cache", "model", req.model.ModelPath, "num_cache", req.opts.NumCache, "num_ctx", req.origNumCtx, "parallel", limit)
+		return limit
+	}
+
+	return numParallel
+}
+
 // findRunnerToUnload finds a runner to unload to make room for a new model
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
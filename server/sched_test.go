@@ -86,7 +86,7 @@ func TestLoad(t *testing.T) {
 		t.Fatalf("unexpected success %v", resp)
 	}
 	s.loadedMu.Lock()
-	runner := s.loaded["dummy_model_path"]
+	runner := s.loaded[req.loadedKey()]
 	s.loadedMu.Unlock()
 	require.NotNil(t, runner)
 	require.Equal(t, uint(0), runner.refCount)
@@ -325,6 +325,228 @@ func TestRequests(t *testing.T) {
 	s.loadedMu.Unlock()
 }
 
+func TestRequestsNumCtx(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+
+	// Same model with different context sizes
+	scenario1a := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1a.req.opts.NumCtx = 2048
+	scenario1b := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1b.req.model = scenario1a.req.model
+	scenario1b.ggml = scenario1a.ggml
+	scenario1b.req.opts.NumCtx = 4096
+	scenario1c := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1c.req.model = scenario1a.req.model
+	scenario1c.ggml = scenario1a.ggml
+	scenario1c.req.opts.NumCtx = 2048
+	scenario1d := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1d.req.model = scenario1a.req.model
+	scenario1d.ggml = scenario1a.ggml
+	scenario1d.req.opts.NumCtx = 8192
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.getCpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "cpu"}
+		g.TotalMemory = 32 * format.GigaByte
+		g.FreeMemory = 26 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.Run(ctx)
+
+	envconfig.MaxRunners = 2
+	defer func() { envconfig.MaxRunners = 0 }()
+
+	expect := func(scenario *bundle, srv *mockLlm, loaded int) {
+		t.Helper()
+		select {
+		case resp := <-scenario.req.successCh:
+			require.Equal(t, resp.llama, srv)
+			require.Equal(t, scenario.req.origNumCtx, resp.Options.NumCtx/resp.numParallel)
+			require.Empty(t, s.pendingReqCh)
+			require.Empty(t, scenario.req.errCh)
+		case err := <-scenario.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		s.loadedMu.Lock()
+		require.Len(t, s.loaded, loaded)
+		s.loadedMu.Unlock()
+	}
+
+	s.newServerFn = scenario1a.newServer
+	slog.Info("scenario1a")
+	s.pendingReqCh <- scenario1a.req
+	expect(scenario1a, scenario1a.srv, 1)
+
+	// A new context size loads another runner alongside the first
+	s.newServerFn = scenario1b.newServer
+	slog.Info("scenario1b")
+	s.pendingReqCh <- scenario1b.req
+	expect(scenario1b, scenario1b.srv, 2)
+
+	// Returning to the first context size reuses its runner
+	s.newServerFn = scenario1c.newServer
+	slog.Info("scenario1c")
+	s.pendingReqCh <- scenario1c.req
+	expect(scenario1c, scenario1a.srv, 2)
+
+	// Without room for another runner the idle runners are unloaded
+	envconfig.MaxRunners = 1
+	scenario1a.ctxDone()
+	scenario1b.ctxDone()
+	scenario1c.ctxDone()
+	s.newServerFn = scenario1d.newServer
+	slog.Info("scenario1d")
+	s.pendingReqCh <- scenario1d.req
+	expect(scenario1d, scenario1d.srv, 1)
+	require.True(t, scenario1a.srv.closeCalled)
+	require.True(t, scenario1b.srv.closeCalled)
+}
+
+func TestRequestsNumCache(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+
+	// A small model limited to two parallel requests' worth of KV cache
+	scenario1a := newScenario(t, ctx, "ollama-model-1a", 10)
+	scenario1a.req.opts.NumCtx = 2048
+	scenario1a.req.opts.NumCache = 5000
+	// A large model without a limit
+	scenario1b := newScenario(t, ctx, "ollama-model-1b", 10)
+	scenario1b.req.opts.NumCtx = 2048
+	// A context larger than the limit still gets one request
+	scenario1c := newScenario(t, ctx, "ollama-model-1c", 10)
+	scenario1c.req.opts.NumCtx = 8192
+	scenario1c.req.opts.NumCache = 4096
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.Run(ctx)
+
+	envconfig.MaxRunners = 3
+	envconfig.NumParallel = 4
+	defer func() {
+		envconfig.MaxRunners = 0
+		envconfig.NumParallel = 0
+	}()
+
+	for _, tt := range []struct {
+		scenario    *bundle
+		numParallel int
+	}{
+		{scenario1a, 2},
+		{scenario1b, 4},
+		{scenario1c, 1},
+	} {
+		s.newServerFn = tt.scenario.newServer
+		s.pendingReqCh <- tt.scenario.req
+		select {
+		case resp := <-tt.scenario.req.successCh:
+			require.Equal(t, resp.llama, tt.scenario.srv)
+			require.Equal(t, tt.numParallel, resp.numParallel)
+			require.Equal(t, tt.scenario.req.origNumCtx*tt.numParallel, resp.Options.NumCtx)
+		case err := <-tt.scenario.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestRequestsSmallerNumCtx(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+
+	scenario1a := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1a.req.opts.NumCtx = 4096
+	scenario1b := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1b.req.model = scenario1a.req.model
+	scenario1b.ggml = scenario1a.ggml
+	scenario1b.req.opts.NumCtx = 1024
+	scenario1c := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1c.req.model = scenario1a.req.model
+	scenario1c.ggml = scenario1a.ggml
+	scenario1c.req.opts.NumCtx = 1024
+	scenario1c.req.opts.NumGPU = 0
+	scenario1d := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1d.req.model = scenario1a.req.model
+	scenario1d.ggml = scenario1a.ggml
+	scenario1d.req.opts.NumCtx = 8192
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.getCpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "cpu"}
+		g.TotalMemory = 32 * format.GigaByte
+		g.FreeMemory = 26 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.Run(ctx)
+
+	envconfig.MaxRunners = 3
+	defer func() { envconfig.MaxRunners = 0 }()
+
+	expect := func(scenario *bundle, srv *mockLlm, numCtx, loaded int) {
+		t.Helper()
+		select {
+		case resp := <-scenario.req.successCh:
+			require.Equal(t, resp.llama, srv)
+			require.Equal(t, numCtx, resp.Options.NumCtx/resp.numParallel)
+			require.Empty(t, s.pendingReqCh)
+			require.Empty(t, scenario.req.errCh)
+		case err := <-scenario.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		s.loadedMu.Lock()
+		require.Len(t, s.loaded, loaded)
+		s.loadedMu.Unlock()
+	}
+
+	s.newServerFn = scenario1a.newServer
+	slog.Info("scenario1a")
+	s.pendingReqCh <- scenario1a.req
+	expect(scenario1a, scenario1a.srv, 4096, 1)
+
+	// A smaller context size uses the loaded runner
+	s.newServerFn = scenario1b.newServer
+	slog.Info("scenario1b")
+	s.pendingReqCh <- scenario1b.req
+	expect(scenario1b, scenario1a.srv, 4096, 1)
+	require.False(t, scenario1a.srv.closeCalled)
+
+	// A runner loaded with other options isn't used
+	s.newServerFn = scenario1c.newServer
+	slog.Info("scenario1c")
+	s.pendingReqCh <- scenario1c.req
+	expect(scenario1c, scenario1c.srv, 1024, 2)
+
+	// A larger context size loads the model again
+	s.newServerFn = scenario1d.newServer
+	slog.Info("scenario1d")
+	s.pendingReqCh <- scenario1d.req
+	expect(scenario1d, scenario1d.srv, 8192, 3)
+}
+
 func TestGetRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -653,6 +875,9 @@ type mockLlm struct {
 	estimatedVRAM      uint64
 	estimatedTotal     uint64
 	estimatedVRAMByGPU map[string]uint64
+	gpuLayers          int
+	contextStats       llm.ContextStats
+	contextStatsErr    error
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
@@ -675,4 +900,8 @@ func (s *mockLlm) Close() error {
 }
 func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
+func (s *mockLlm) GPULayers() int                         { return s.gpuLayers }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) ContextStats(ctx context.Context) (llm.ContextStats, error) {
+	return s.contextStats, s.contextStatsErr
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// SchemaValidationError is returned when a response doesn't match the
+// response_schema option
+type SchemaValidationError struct {
+	// Errors describes each part of the response which failed validation,
+	// prefixed with its JSON pointer, e.g. /name: expected string
+	Errors []string
+}
+
+func (e *SchemaValidationError) Error() string {
+	return "response does not match schema: " + strings.Join(e.Errors, "; ")
+}
+
+func compileSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("response_schema.json", bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("invalid response_schema: %w", err)
+	}
+
+	schema, err := c.Compile("response_schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("invalid response_schema: %w", err)
+	}
+
+	return schema, nil
+}
+
+// validateResponse checks the complete response content against schema,
+// returning a *SchemaValidationError if it doesn't match
+func validateResponse(schema *jsonschema.Schema, content string) error {
+	var v any
+	if err := json.Unmarshal([]byte(content), &v); err != nil {
+		return &SchemaValidationError{Errors: []string{"response is not valid JSON: " + err.Error()}}
+	}
+
+	err := schema.Validate(v)
+	if ve, ok := err.(*jsonschema.ValidationError); ok {
+		var errs []string
+		var walk func(*jsonschema.ValidationError)
+		walk = func(ve *jsonschema.ValidationError) {
+			if len(ve.Causes) == 0 {
+				loc := ve.InstanceLocation
+				if loc == "" {
+					loc = "/"
+				}
+
+				errs = append(errs, loc+": "+ve.Message)
+				return
+			}
+
+			for _, cause := range ve.Causes {
+				walk(cause)
+			}
+		}
+
+		walk(ve)
+		return &SchemaValidationError{Errors: errs}
+	}
+
+	return err
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// sessionTTL is how long a chat session is kept after its last request
+var sessionTTL = 30 * time.Minute
+
+// chatSession is the state of a chat kept between requests with the same
+// session ID so the history doesn't have to be resent or retokenized
+type chatSession struct {
+	model string
+
+	// messages are the messages of the chat so far, ending with the model's
+	// last response
+	messages []api.Message
+
+	// prompt is the last prompt followed by the model's response and tokens
+	// are its tokens
+	prompt string
+	tokens []int
+
+	expires time.Time
+}
+
+// sessionStore holds chat sessions in memory. The zero value is ready to use
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*chatSession
+}
+
+// get returns the unexpired session with id for model
+func (s *sessionStore) get(id, model string) (*chatSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	sess, ok := s.sessions[id]
+	if !ok || sess.model != model {
+		return nil, false
+	}
+
+	return sess, true
+}
+
+// put stores sess as the session with id, replacing any previous session
+func (s *sessionStore) put(id string, sess *chatSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*chatSession)
+	}
+
+	s.expire()
+	sess.expires = time.Now().Add(sessionTTL)
+	s.sessions[id] = sess
+}
+
+// expire removes expired sessions. s.mu must be held
+func (s *sessionStore) expire() {
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// history returns the messages of a request in the session: msgs are added
+// to the session's messages unless msgs already start with them, in which
+// case the full history was resent
+func (sess *chatSession) history(msgs []api.Message) []api.Message {
+	if sess == nil {
+		return msgs
+	}
+
+	if len(msgs) >= len(sess.messages) && slices.EqualFunc(sess.messages, msgs[:len(sess.messages)], equalMessages) {
+		return msgs
+	}
+
+	return append(slices.Clone(sess.messages), msgs...)
+}
+
+// equalMessages reports whether a and b have the same role, content and images
+func equalMessages(a, b api.Message) bool {
+	return strings.EqualFold(a.Role, b.Role) && a.Content == b.Content && slices.EqualFunc(a.Images, b.Images, func(a, b api.ImageData) bool {
+		return slices.Equal(a, b)
+	})
+}
+
+// tokenize returns a tokenizeFunc which reuses the session's tokens for
+// prompts starting with the session's prompt, so only the rest is tokenized
+func (sess *chatSession) tokenize(tokenize tokenizeFunc) tokenizeFunc {
+	if sess == nil || sess.prompt == "" {
+		return tokenize
+	}
+
+	return func(ctx context.Context, s string) ([]int, error) {
+		rest, ok := strings.CutPrefix(s, sess.prompt)
+		if !ok {
+			return tokenize(ctx, s)
+		}
+
+		tokens, err := tokenize(ctx, rest)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(slices.Clone(sess.tokens), tokens...), nil
+	}
+}
+
+// save stores msgs followed by the model's response to prompt as the session
+// with id. tokenize should be the tokenizer the prompt was assembled with
+func (s *sessionStore) save(ctx context.Context, id, model string, tokenize tokenizeFunc, msgs []api.Message, prompt, response string) error {
+	tokens, err := tokenize(ctx, prompt+response)
+	if err != nil {
+		return err
+	}
+
+	msgs = slices.Clone(msgs)
+	if n := len(msgs); n > 0 && msgs[n-1].Role == "assistant" && msgs[n-1].Partial {
+		// the response continues the partial message
+		msgs[n-1].Content += response
+		msgs[n-1].Partial = false
+	} else {
+		msgs = append(msgs, api.Message{Role: "assistant", Content: response})
+	}
+
+	s.put(id, &chatSession{model: model, messages: msgs, prompt: prompt + response, tokens: tokens})
+	return nil
+}
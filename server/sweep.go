@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+)
+
+// maxSweepCombinations bounds the number of responses a sweep generates
+const maxSweepCombinations = 32
+
+// sweepCombinations returns every combination of the option values in grid,
+// with the values of the last option, ordered by name, changing fastest
+func sweepCombinations(grid map[string][]any) ([]map[string]any, error) {
+	if len(grid) == 0 {
+		return nil, errors.New("grid is required")
+	}
+
+	keys := make([]string, 0, len(grid))
+	for key := range grid {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	n := 1
+	for _, key := range keys {
+		if !optionNames()[key] {
+			return nil, fmt.Errorf("grid: unknown option %q", key)
+		} else if len(grid[key]) == 0 {
+			return nil, fmt.Errorf("grid: option %q has no values", key)
+		}
+
+		for _, v := range grid[key] {
+			var opts api.Options
+			if err := opts.FromMap(map[string]any{key: v}); err != nil {
+				return nil, fmt.Errorf("grid: %w", err)
+			}
+		}
+
+		if n *= len(grid[key]); n > maxSweepCombinations {
+			return nil, fmt.Errorf("grid has more than %d combinations", maxSweepCombinations)
+		}
+	}
+
+	combos := make([]map[string]any, n)
+	for i := range combos {
+		combo := make(map[string]any, len(keys))
+		j := i
+		for k := len(keys) - 1; k >= 0; k-- {
+			values := grid[keys[k]]
+			combo[keys[k]] = values[j%len(values)]
+			j /= len(values)
+		}
+
+		combos[i] = combo
+	}
+
+	return combos, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/template"
+)
+
+var (
+	errUnknownTemplate     = errors.New("unknown template")
+	errInvalidTemplateName = errors.New("invalid template name")
+	errInvalidTemplate     = errors.New("invalid template")
+)
+
+// templateExt is the extension of template files in the template library
+const templateExt = ".gotmpl"
+
+var templateNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// templatesMu guards writes to the template library
+var templatesMu sync.Mutex
+
+func templatePath(name string) (string, error) {
+	if !templateNamePattern.MatchString(name) {
+		return "", errInvalidTemplateName
+	}
+
+	return filepath.Join(envconfig.TemplatesDir, name+templateExt), nil
+}
+
+// ListTemplates returns the templates in the template library sorted by name
+func ListTemplates() ([]api.ListTemplateResponse, error) {
+	entries, err := os.ReadDir(envconfig.TemplatesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []api.ListTemplateResponse{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	templates := []api.ListTemplateResponse{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), templateExt)
+		if !ok || e.IsDir() || !templateNamePattern.MatchString(name) {
+			continue
+		}
+
+		t, err := GetTemplate(name)
+		if err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, t.ListTemplateResponse)
+	}
+
+	slices.SortFunc(templates, func(a, b api.ListTemplateResponse) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return templates, nil
+}
+
+// GetTemplate returns the named template from the template library with its
+// source. It returns os.ErrNotExist if the template doesn't exist
+func GetTemplate(name string) (*api.ShowTemplateResponse, error) {
+	p, err := templatePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ShowTemplateResponse{
+		ListTemplateResponse: api.ListTemplateResponse{
+			Name:       name,
+			ModifiedAt: fi.ModTime(),
+			Size:       fi.Size(),
+			Digest:     fmt.Sprintf("sha256:%x", sha256.Sum256(bts)),
+		},
+		Template: string(bts),
+	}, nil
+}
+
+// SetTemplate adds a template to the template library. An existing template
+// with the same name is replaced
+func SetTemplate(name, s string) error {
+	p, err := templatePath(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := template.Parse(s); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidTemplate, err)
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+
+	if err := os.MkdirAll(envconfig.TemplatesDir, 0o755); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(envconfig.TemplatesDir, name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.WriteString(s); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), p)
+}
+
+// DeleteTemplate removes a template from the template library. It returns
+// os.ErrNotExist if the template doesn't exist
+func DeleteTemplate(name string) error {
+	p, err := templatePath(name)
+	if err != nil {
+		return err
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+
+	return os.Remove(p)
+}
+
+// loadTemplate parses the named template from the template library
+func loadTemplate(name string) (*template.Template, error) {
+	p, err := templatePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w %q", errUnknownTemplate, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return template.Parse(string(bts))
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+)
+
+// streamTrimmer trims whitespace from the start and end of a streamed
+// response, like strings.TrimSpace, so the chunks it returns add up to the
+// trimmed response. Whitespace which may end the response is held back until
+// more text follows it
+type streamTrimmer struct {
+	started bool
+	pending string
+}
+
+// add returns the part of chunk, and of the whitespace held back before it,
+// which is sent. done is set for the last chunk of the response
+func (t *streamTrimmer) add(chunk string, done bool) string {
+	if !t.started {
+		chunk = strings.TrimLeftFunc(chunk, unicode.IsSpace)
+		t.started = chunk != ""
+	}
+
+	s := t.pending + chunk
+	trimmed := strings.TrimRightFunc(s, unicode.IsSpace)
+	t.pending = ""
+	if !done {
+		t.pending = s[len(trimmed):]
+	}
+
+	return trimmed
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/md5"
 	"errors"
@@ -12,10 +13,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/format"
 	"golang.org/x/sync/errgroup"
@@ -29,6 +32,16 @@ type blobUpload struct {
 	Total     int64
 	Completed atomic.Int64
 
+	// Transferred is the number of bytes sent to the upstream, which is less
+	// than Completed if parts are compressed
+	Transferred atomic.Int64
+
+	// encoding is the content encoding parts are compressed with, if the
+	// upstream advertised support for one. uncompressed is set once the
+	// upstream rejects it
+	encoding     string
+	uncompressed atomic.Bool
+
 	Parts []blobUploadPart
 
 	nextURL chan *url.URL
@@ -37,6 +50,8 @@ type blobUpload struct {
 
 	file *os.File
 
+	// mu guards done and err, which Run sets while Wait polls them
+	mu         sync.Mutex
 	done       bool
 	err        error
 	references atomic.Int32
@@ -83,7 +98,8 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 	// ref: https://distribution.github.io/distribution/spec/api/#cross-repository-blob-mount
 	if resp.StatusCode == http.StatusCreated {
 		b.Completed.Store(b.Total)
-		b.done = true
+		b.Transferred.Store(b.Total)
+		b.finish(nil)
 		return nil
 	}
 
@@ -106,7 +122,12 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 		offset += size
 	}
 
-	slog.Info(fmt.Sprintf("uploading %s in %d %s part(s)", b.Digest[7:19], len(b.Parts), format.HumanBytes(b.Parts[0].Size)))
+	b.encoding = negotiateEncoding(resp.Header.Get("Accept-Encoding"))
+	if b.encoding != "" {
+		slog.Info(fmt.Sprintf("uploading %s in %d %s part(s) with %s compression", b.Digest[7:19], len(b.Parts), format.HumanBytes(b.Parts[0].Size), b.encoding))
+	} else {
+		slog.Info(fmt.Sprintf("uploading %s in %d %s part(s)", b.Digest[7:19], len(b.Parts), format.HumanBytes(b.Parts[0].Size)))
+	}
 
 	requestURL, err = url.Parse(location)
 	if err != nil {
@@ -126,13 +147,13 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 
 	p, err := GetBlobsPath(b.Digest)
 	if err != nil {
-		b.err = err
+		b.finish(err)
 		return
 	}
 
 	b.file, err = os.Open(p)
 	if err != nil {
-		b.err = err
+		b.finish(err)
 		return
 	}
 	defer b.file.Close()
@@ -169,7 +190,7 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	}
 
 	if err := g.Wait(); err != nil {
-		b.err = err
+		b.finish(err)
 		return
 	}
 
@@ -205,8 +226,22 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 		break
 	}
 
-	b.err = err
+	b.finish(err)
+}
+
+// finish marks the upload done, failed if err is set
+func (b *blobUpload) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.done = true
+	b.err = err
+}
+
+// result reports whether the upload is done and its error, if it failed
+func (b *blobUpload) result() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done, b.err
 }
 
 func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *url.URL, part *blobUploadPart, opts *registryOptions) error {
@@ -214,19 +249,43 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	headers.Set("Content-Type", "application/octet-stream")
 	headers.Set("Content-Length", fmt.Sprintf("%d", part.Size))
 
+	// parts are only compressed when sent to the registry, which decompresses
+	// them, and not to redirect URLs. Content-Range and the md5 checksum are
+	// always over the uncompressed bytes
+	var encoding string
 	if method == http.MethodPatch {
 		headers.Set("X-Redirect-Uploads", "1")
 		headers.Set("Content-Range", fmt.Sprintf("%d-%d", part.Offset, part.Offset+part.Size-1))
+
+		if !b.uncompressed.Load() {
+			encoding = b.encoding
+		}
 	}
 
 	sr := io.NewSectionReader(b.file, part.Offset, part.Size)
 
 	md5sum := md5.New()
-	w := &progressWriter{blobUpload: b}
+	w := &progressWriter{n: &b.Completed}
+	t := &progressWriter{n: &b.Transferred}
+	rollback := func() {
+		w.Rollback()
+		t.Rollback()
+	}
+
+	var body io.Reader = io.TeeReader(sr, io.MultiWriter(w, md5sum))
+	if encoding != "" {
+		// the compressed size isn't known ahead of time
+		headers.Del("Content-Length")
+		headers.Set("Content-Encoding", encoding)
+
+		cr := compressReader(body, encoding)
+		defer cr.Close()
+		body = cr
+	}
 
-	resp, err := makeRequest(ctx, method, requestURL, headers, io.TeeReader(sr, io.MultiWriter(w, md5sum)), opts)
+	resp, err := makeRequest(ctx, method, requestURL, headers, io.TeeReader(body, t), opts)
 	if err != nil {
-		w.Rollback()
+		rollback()
 		return err
 	}
 	defer resp.Body.Close()
@@ -238,13 +297,20 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 
 	nextURL, err := url.Parse(location)
 	if err != nil {
-		w.Rollback()
+		rollback()
 		return err
 	}
 
 	switch {
+	case resp.StatusCode == http.StatusUnsupportedMediaType && encoding != "":
+		rollback()
+		if b.uncompressed.CompareAndSwap(false, true) {
+			slog.Info(fmt.Sprintf("%s upstream rejected %s compression, uploading uncompressed", b.Digest[7:19], encoding))
+		}
+
+		return b.uploadPart(ctx, method, requestURL, part, opts)
 	case resp.StatusCode == http.StatusTemporaryRedirect:
-		w.Rollback()
+		rollback()
 		b.nextURL <- nextURL
 
 		redirectURL, err := resp.Location()
@@ -273,7 +339,7 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 		return fmt.Errorf("%w: %w", errMaxRetriesExceeded, err)
 
 	case resp.StatusCode == http.StatusUnauthorized:
-		w.Rollback()
+		rollback()
 		challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
 		token, err := getAuthorizationToken(ctx, challenge)
 		if err != nil {
@@ -283,7 +349,7 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 		opts.Token = token
 		fallthrough
 	case resp.StatusCode >= http.StatusBadRequest:
-		w.Rollback()
+		rollback()
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
 			return err
@@ -323,14 +389,15 @@ func (b *blobUpload) Wait(ctx context.Context, fn func(api.ProgressResponse)) er
 		}
 
 		fn(api.ProgressResponse{
-			Status:    fmt.Sprintf("pushing %s", b.Digest[7:19]),
-			Digest:    b.Digest,
-			Total:     b.Total,
-			Completed: b.Completed.Load(),
+			Status:      fmt.Sprintf("pushing %s", b.Digest[7:19]),
+			Digest:      b.Digest,
+			Total:       b.Total,
+			Completed:   b.Completed.Load(),
+			Transferred: b.Transferred.Load(),
 		})
 
-		if b.done || b.err != nil {
-			return b.err
+		if done, err := b.result(); done {
+			return err
 		}
 	}
 }
@@ -343,23 +410,79 @@ type blobUploadPart struct {
 	hash.Hash
 }
 
+// progressWriter adds the number of bytes written to n
 type progressWriter struct {
 	written int64
-	*blobUpload
+	n       *atomic.Int64
 }
 
 func (p *progressWriter) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.written += int64(n)
-	p.Completed.Add(int64(n))
+	p.n.Add(int64(n))
 	return n, nil
 }
 
 func (p *progressWriter) Rollback() {
-	p.Completed.Add(-p.written)
+	p.n.Add(-p.written)
 	p.written = 0
 }
 
+// negotiateEncoding returns the content encoding to compress parts with given
+// the encodings the upstream accepts, preferring zstd. An empty string means
+// parts are uploaded uncompressed
+func negotiateEncoding(accept string) string {
+	var encoding string
+	for _, s := range strings.Split(accept, ",") {
+		s, params, _ := strings.Cut(strings.TrimSpace(s), ";")
+		if strings.TrimSpace(params) == "q=0" {
+			continue
+		}
+
+		switch strings.ToLower(s) {
+		case "zstd":
+			return "zstd"
+		case "gzip":
+			encoding = "gzip"
+		}
+	}
+
+	return encoding
+}
+
+// compressReader returns a reader of r compressed with encoding. Closing it
+// stops the compression
+func compressReader(r io.Reader, encoding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var zw io.WriteCloser
+		switch encoding {
+		case "zstd":
+			// parts are already uploaded concurrently
+			enc, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			zw = enc
+		case "gzip":
+			zw = gzip.NewWriter(pw)
+		default:
+			pw.CloseWithError(fmt.Errorf("unsupported encoding %q", encoding))
+			return
+		}
+
+		_, err := io.Copy(zw, r)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
 func uploadBlob(ctx context.Context, mp ModelPath, layer *Layer, opts *registryOptions, fn func(api.ProgressResponse)) error {
 	requestURL := mp.BaseURL()
 	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "blobs", layer.Digest)
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestUploadBlobCompression(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	cases := []struct {
+		name     string
+		accept   string
+		reject   bool
+		encoding string
+	}{
+		{"zstd", "gzip, zstd", false, "zstd"},
+		{"gzip", "gzip", false, "gzip"},
+		{"unsupported", "br", false, ""},
+		{"none", "", false, ""},
+		{"disabled", "zstd;q=0, gzip", false, "gzip"},
+		{"rejected", "zstd", true, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// blobs are shared by digest so each case uploads a different one
+			data := bytes.Repeat([]byte(fmt.Sprintf("%s ", tt.name)), 1<<16)
+			layer, err := NewLayer(bytes.NewReader(data), "application/vnd.ollama.image.model")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var received bytes.Buffer
+			var encodings []string
+			var digest string
+
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodHead:
+					w.WriteHeader(http.StatusNotFound)
+				case http.MethodPost:
+					if tt.accept != "" {
+						w.Header().Set("Accept-Encoding", tt.accept)
+					}
+					w.Header().Set("Location", srv.URL+"/v2/library/test/blobs/uploads/1")
+					w.WriteHeader(http.StatusAccepted)
+				case http.MethodPatch:
+					encoding := r.Header.Get("Content-Encoding")
+					if tt.reject && encoding != "" {
+						w.WriteHeader(http.StatusUnsupportedMediaType)
+						return
+					}
+
+					var body io.Reader = r.Body
+					switch encoding {
+					case "zstd":
+						zr, err := zstd.NewReader(r.Body)
+						if err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+						defer zr.Close()
+						body = zr
+					case "gzip":
+						zr, err := gzip.NewReader(r.Body)
+						if err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+						body = zr
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					encodings = append(encodings, encoding)
+					if _, err := io.Copy(&received, body); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+
+					w.Header().Set("Location", srv.URL+"/v2/library/test/blobs/uploads/1")
+					w.WriteHeader(http.StatusAccepted)
+				case http.MethodPut:
+					digest = r.URL.Query().Get("digest")
+					w.WriteHeader(http.StatusCreated)
+				}
+			}))
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mp := ModelPath{ProtocolScheme: "http", Registry: u.Host, Namespace: "library", Repository: "test", Tag: "latest"}
+
+			var last api.ProgressResponse
+			if err := uploadBlob(context.Background(), mp, layer, &registryOptions{}, func(r api.ProgressResponse) {
+				last = r
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(received.Bytes(), data) {
+				t.Errorf("expected %d bytes uploaded, got %d", len(data), received.Len())
+			}
+
+			if digest != layer.Digest {
+				t.Errorf("expected digest %s, got %s", layer.Digest, digest)
+			}
+
+			if len(encodings) != 1 || encodings[0] != tt.encoding {
+				t.Errorf("expected encoding %q, got %q", tt.encoding, encodings)
+			}
+
+			if last.Total != int64(len(data)) || last.Completed != last.Total {
+				t.Errorf("expected %d bytes completed, got %d of %d", len(data), last.Completed, last.Total)
+			}
+
+			if tt.encoding != "" && last.Transferred >= last.Completed {
+				t.Errorf("expected fewer bytes transferred than completed, got %d of %d", last.Transferred, last.Completed)
+			} else if tt.encoding == "" && last.Transferred != last.Completed {
+				t.Errorf("expected %d bytes transferred, got %d", last.Completed, last.Transferred)
+			}
+		})
+	}
+}
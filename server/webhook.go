@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookSignatureHeader is the header which signs a webhook-delivered
+// request. Its value is sha256= followed by the hex encoded HMAC-SHA256 of the
+// request body, keyed with OLLAMA_WEBHOOK_SECRET
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookSignatureMiddleware rejects requests without a valid signature in
+// webhookSignatureHeader. Requests are passed through if secret is empty
+func webhookSignatureMiddleware(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret == "" {
+			c.Next()
+			return
+		}
+
+		signature := c.GetHeader(webhookSignatureHeader)
+		if signature == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing " + webhookSignatureHeader + " header"})
+			return
+		}
+
+		digest, ok := strings.CutPrefix(signature, "sha256=")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": webhookSignatureHeader + " must be sha256= followed by the hex encoded HMAC-SHA256 of the request body"})
+			return
+		}
+
+		expected, err := hex.DecodeString(digest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": webhookSignatureHeader + " must be sha256= followed by the hex encoded HMAC-SHA256 of the request body"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the handler reads the body again
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		// hmac.Equal takes the same time wherever the signatures differ
+		if !hmac.Equal(expected, mac.Sum(nil)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid " + webhookSignatureHeader + ": the signature doesn't match the request body"})
+			return
+		}
+
+		c.Next()
+	}
+}
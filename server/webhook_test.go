@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestWebhookSignatureMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body := `{"model":"test","messages":[{"role":"user","content":"Hello!"}]}`
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	serve := func(t *testing.T, secret, signature string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		r := gin.New()
+		r.POST("/api/chat", webhookSignatureMiddleware(secret), func(c *gin.Context) {
+			// the handler still reads the whole body
+			bts, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.String(http.StatusOK, string(bts))
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body))
+		if signature != "" {
+			req.Header.Set(webhookSignatureHeader, signature)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		w := serve(t, "s3cret", sign("s3cret", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if w.Body.String() != body {
+			t.Errorf("expected body %q, got %q", body, w.Body.String())
+		}
+	})
+
+	t.Run("no secret", func(t *testing.T) {
+		if w := serve(t, "", ""); w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	cases := []struct {
+		name      string
+		signature string
+		expect    string
+	}{
+		{"missing", "", `{"error":"missing X-Webhook-Signature header"}`},
+		{"wrong secret", sign("guess", body), `{"error":"invalid X-Webhook-Signature: the signature doesn't match the request body"}`},
+		{"other body", sign("s3cret", body+" "), `{"error":"invalid X-Webhook-Signature: the signature doesn't match the request body"}`},
+		{"no prefix", strings.TrimPrefix(sign("s3cret", body), "sha256="), `{"error":"X-Webhook-Signature must be sha256= followed by the hex encoded HMAC-SHA256 of the request body"}`},
+		{"not hex", "sha256=xyz", `{"error":"X-Webhook-Signature must be sha256= followed by the hex encoded HMAC-SHA256 of the request body"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, "s3cret", tt.signature)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status 401, got %d", w.Code)
+			}
+
+			if w.Body.String() != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhookSignatureRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_WEBHOOK_SECRET", "s3cret")
+	envconfig.LoadConfig()
+
+	s := &Server{}
+	router := s.GenerateRoutes()
+
+	cases := []struct {
+		path string
+		body string
+	}{
+		{"/api/chat", `{"model":"test","messages":[{"role":"user","content":"Hello!"}]}`},
+		{"/api/chat/batch", `{"requests":[{"model":"test","messages":[{"role":"user","content":"Hello!"}]}]}`},
+		{"/v1/chat/completions", `{"model":"test","messages":[{"role":"user","content":"Hello!"}]}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status 401, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package template
+
+import (
+	"slices"
+	"strings"
+	"text/template/parse"
+)
+
+// LintWarning describes a likely mistake in a template
+type LintWarning struct {
+	// Rule identifies the pattern that was matched
+	Rule string `json:"rule"`
+
+	// Line is the line in the template where the pattern was found
+	Line int `json:"line"`
+
+	Message string `json:"message"`
+}
+
+const (
+	LintPromptInAssistantTurn = "prompt-in-assistant-turn"
+	LintUnterminatedUserTurn  = "unterminated-user-turn"
+	LintResponseInPrompt      = "response-in-prompt"
+)
+
+// LintTemplate inspects t for common authoring mistakes. It returns nil if
+// none are found
+func LintTemplate(t *Template) []LintWarning {
+	l := linter{raw: t.raw}
+	l.walk(t.Tree.Root, lintScope{})
+
+	// the user turn should be followed by some text, e.g. an end of turn marker
+	// or the start of the assistant turn, before the response. templates with
+	// no text before the prompt are raw or completion templates and are ignored
+	if l.prompt != nil && !l.textAfterPrompt && l.textBeforePrompt {
+		l.warn(LintUnterminatedUserTurn, l.prompt, "{{ .Prompt }} is not followed by any text so the user turn is never terminated")
+	}
+
+	slices.SortStableFunc(l.warnings, func(a, b LintWarning) int {
+		return a.Line - b.Line
+	})
+
+	return l.warnings
+}
+
+type lintScope struct {
+	// prompt is set inside {{ if .Prompt }}
+	prompt bool
+	// messages is set inside {{ range .Messages }}
+	messages bool
+	// assistant is set inside a branch for assistant messages,
+	// e.g. {{ if eq .Role "assistant" }}
+	assistant bool
+}
+
+type linter struct {
+	raw      string
+	warnings []LintWarning
+
+	// response is set once {{ .Response }} has been seen
+	response bool
+
+	// prompt is the last {{ .Prompt }} action seen
+	prompt           parse.Node
+	textBeforePrompt bool
+	textAfterPrompt  bool
+}
+
+func (l *linter) warn(rule string, n parse.Node, msg string) {
+	line := 1
+	if pos := int(n.Position()); pos <= len(l.raw) {
+		line += strings.Count(l.raw[:pos], "\n")
+	}
+
+	l.warnings = append(l.warnings, LintWarning{Rule: rule, Line: line, Message: msg})
+}
+
+func (l *linter) walk(n parse.Node, scope lintScope) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			l.walk(c, scope)
+		}
+	case *parse.TextNode:
+		if strings.TrimSpace(string(n.Text)) != "" {
+			if l.prompt == nil {
+				l.textBeforePrompt = true
+			} else if !l.response {
+				l.textAfterPrompt = true
+			}
+		}
+	case *parse.ActionNode:
+		ids := Identifiers(n.Pipe)
+		if slices.Contains(ids, "Prompt") {
+			switch {
+			case scope.assistant:
+				l.warn(LintPromptInAssistantTurn, n, "{{ .Prompt }} is used for assistant messages; use {{ .Content }} instead")
+			case l.response:
+				l.warn(LintPromptInAssistantTurn, n, "{{ .Prompt }} is used after {{ .Response }}, in the assistant turn")
+			case !scope.messages:
+				l.prompt = n
+				l.textAfterPrompt = false
+			}
+		}
+
+		if slices.Contains(ids, "Response") && !scope.messages {
+			l.response = true
+		}
+	case *parse.IfNode:
+		ids := Identifiers(n.Pipe)
+		if scope.prompt && slices.Contains(ids, "Response") {
+			l.warn(LintResponseInPrompt, n, "{{ if .Response }} is nested in {{ if .Prompt }} so the response is dropped when there is no prompt")
+		}
+
+		inner := scope
+		inner.prompt = inner.prompt || slices.Contains(ids, "Prompt")
+		inner.assistant = inner.assistant || (scope.messages && isRole(n.Pipe, "assistant"))
+		l.walk(n.List, inner)
+		if n.ElseList != nil {
+			// the else branch of {{ if .Prompt }} runs when there is no prompt
+			inner.prompt = scope.prompt
+			inner.assistant = scope.assistant
+			l.walk(n.ElseList, inner)
+		}
+	case *parse.RangeNode:
+		inner := scope
+		inner.messages = inner.messages || slices.Contains(Identifiers(n.Pipe), "Messages")
+		l.walk(n.List, inner)
+		if n.ElseList != nil {
+			l.walk(n.ElseList, scope)
+		}
+	case *parse.WithNode:
+		l.walk(n.List, scope)
+		if n.ElseList != nil {
+			l.walk(n.ElseList, scope)
+		}
+	}
+}
+
+// isRole reports whether pipe compares the message role to role,
+// e.g. {{ if eq .Role "assistant" }}
+func isRole(pipe *parse.PipeNode, role string) bool {
+	for _, c := range pipe.Cmds {
+		if len(c.Args) < 3 {
+			continue
+		}
+
+		if id, ok := c.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "eq" {
+			continue
+		}
+
+		if !slices.Contains(Identifiers(c.Args[1]), "Role") {
+			continue
+		}
+
+		for _, a := range c.Args[2:] {
+			if s, ok := a.(*parse.StringNode); ok && s.Text == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
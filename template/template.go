@@ -81,6 +81,9 @@ var DefaultTemplate, _ = Parse("{{ .Prompt }}")
 type Template struct {
 	*template.Template
 	raw string
+
+	// implicitResponse is set if Parse appended {{ .Response }} to the template
+	implicitResponse bool
 }
 
 // response is a template node that can be added to templates that don't already have one
@@ -121,6 +124,7 @@ func Parse(s string) (*Template, error) {
 	if vars := t.Vars(); !slices.Contains(vars, "messages") && !slices.Contains(vars, "response") {
 		// touch up the template and append {{ .Response }}
 		tmpl.Tree.Root.Nodes = append(tmpl.Tree.Root.Nodes, &response)
+		t.implicitResponse = true
 	}
 
 	return &t, nil
@@ -148,10 +152,44 @@ func (t *Template) Vars() []string {
 	return vars
 }
 
+// KnownFields are the top level fields available to templates
+var KnownFields = []string{"System", "Prompt", "Response", "Messages", "Tools"}
+
+// Fields returns the KnownFields the template references, as written, and the
+// ones it doesn't reference
+func (t *Template) Fields() (referenced, unreferenced []string) {
+	vars := t.Vars()
+	for _, f := range KnownFields {
+		name := strings.ToLower(f)
+		if slices.Contains(vars, name) && !(name == "response" && t.implicitResponse) {
+			referenced = append(referenced, f)
+		} else {
+			unreferenced = append(unreferenced, f)
+		}
+	}
+
+	return referenced, unreferenced
+}
+
 type Values struct {
 	Messages []api.Message
 	Tools    []api.Tool
 
+	// Documents are the documents a response can be grounded in. Only
+	// templates that use .Messages receive them
+	Documents []api.Document
+
+	// IsFirstTurn is set when no response has been rendered yet, so templates
+	// can include content such as few-shot examples on the first turn only.
+	// Only templates that use .Messages receive it
+	IsFirstTurn bool
+
+	// Prompt and Suffix are set for fill-in-the-middle requests, in which case
+	// Messages and Tools are ignored. Templates of models which support them
+	// arrange .Prompt and .Suffix around their fill-in-the-middle tokens
+	Prompt string
+	Suffix string
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -202,13 +240,56 @@ func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
 	return nil
 }
 
+// partialPlaceholder stands in for the content of a partial assistant message while
+// the template is executed. It marks where the rendered prompt is cut.
+const partialPlaceholder = "\x00partial\x00"
+
+var errPartialNotRendered = errors.New("template does not render the partial assistant message")
+
 func (t *Template) Execute(w io.Writer, v Values) error {
+	if v.Suffix != "" {
+		return t.Template.Execute(w, map[string]any{
+			"Prompt":   v.Prompt,
+			"Suffix":   v.Suffix,
+			"Response": "",
+		})
+	}
+
+	n := len(v.Messages)
+	if n == 0 || v.Messages[n-1].Role != "assistant" || !v.Messages[n-1].Partial {
+		return t.execute(w, v, false)
+	}
+
+	// a partial assistant message is rendered as the beginning of the response.
+	// anything the template writes after its content, such as the end of turn
+	// delimiter, is cut so the model continues the message
+	partial := v.Messages[n-1]
+	v.Messages = append(slices.Clone(v.Messages[:n-1]), api.Message{Role: "assistant", Content: partialPlaceholder})
+
+	var b bytes.Buffer
+	if err := t.execute(&b, v, true); err != nil {
+		return err
+	}
+
+	prefix, _, ok := strings.Cut(b.String(), partialPlaceholder)
+	if !ok {
+		return errPartialNotRendered
+	}
+
+	_, err := io.WriteString(w, prefix+partial.Content)
+	return err
+}
+
+func (t *Template) execute(w io.Writer, v Values, partial bool) error {
 	system, messages := collate(v.Messages)
 	if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
 		return t.Template.Execute(w, map[string]any{
-			"System":   system,
-			"Messages": messages,
-			"Tools":    v.Tools,
+			"System":      system,
+			"Messages":    messages,
+			"Tools":       v.Tools,
+			"HasTools":    len(v.Tools) > 0,
+			"Documents":   v.Documents,
+			"IsFirstTurn": v.IsFirstTurn,
 		})
 	}
 
@@ -251,6 +332,20 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 		}
 	}
 
+	if partial {
+		// render the trailing response in full; it's cut by the caller
+		if err := t.Template.Execute(&b, map[string]any{
+			"System":   system,
+			"Prompt":   prompt,
+			"Response": response,
+		}); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(w, &b)
+		return err
+	}
+
 	var cut bool
 	nodes := deleteNode(t.Template.Root.Copy(), func(n parse.Node) bool {
 		if field, ok := n.(*parse.FieldNode); ok && slices.Contains(field.Ident, "Response") {
@@ -282,15 +377,7 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 	var collated []*api.Message
 	for i := range msgs {
 		msg := msgs[i]
-		for range msg.Images {
-			imageTag := fmt.Sprintf("[img-%d]", n)
-			if !strings.Contains(msg.Content, "[img]") {
-				msg.Content = strings.TrimSpace("[img] " + msg.Content)
-			}
-
-			msg.Content = strings.Replace(msg.Content, "[img]", imageTag, 1)
-			n++
-		}
+		msg.Content = tag(msg.Content, "img", len(msg.Images), &n)
 
 		if msg.Role == "system" {
 			system = append(system, msg.Content)
@@ -306,6 +393,34 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 	return strings.Join(system, "\n\n"), collated
 }
 
+// tag replaces the [kind] placeholders in content, left to right, with tags
+// numbered from *n for count images. Tags for those without a
+// placeholder are added to the start of content in order, which is all of
+// them for a message without text
+func tag(content, kind string, count int, n *int) string {
+	placeholder := "[" + kind + "]"
+	placeholders := strings.Count(content, placeholder)
+
+	var prefix []string
+	for range count {
+		t := fmt.Sprintf("[%s-%d]", kind, *n)
+		if placeholders > 0 {
+			content = strings.Replace(content, placeholder, t, 1)
+			placeholders--
+		} else {
+			prefix = append(prefix, t)
+		}
+
+		*n++
+	}
+
+	if len(prefix) == 0 {
+		return content
+	}
+
+	return strings.TrimSpace(strings.Join(prefix, " ") + " " + content)
+}
+
 // Identifiers walks the node tree returning any identifiers it finds along the way
 func Identifiers(n parse.Node) []string {
 	switch n := n.(type) {
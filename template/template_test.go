@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
@@ -12,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
 )
@@ -295,6 +298,63 @@ Hello human!<|im_end|>
 What is your name?<|im_end|>
 <|im_start|>assistant
 `,
+		},
+		{
+			"mistral partial",
+			[]template{
+				{"no response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] `},
+				{"response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
+				{"messages", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
+{{- end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+					{Role: "assistant", Content: "My name is", Partial: true},
+				},
+			},
+			`[INST] Hello friend![/INST] Hello human![INST] What is your name?[/INST] My name is`,
+		},
+		{
+			"chatml partial",
+			[]template{
+				{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant!"},
+					{Role: "user", Content: "Write a haiku."},
+					{Role: "assistant", Content: "Autumn moonlight -\na worm digs", Partial: true},
+				},
+			},
+			`<|im_start|>system
+You are a helpful assistant!<|im_end|>
+<|im_start|>user
+Write a haiku.<|im_end|>
+<|im_start|>assistant
+Autumn moonlight -
+a worm digs`,
 		},
 		{
 			"moondream",
@@ -359,3 +419,205 @@ Answer: `,
 		})
 	}
 }
+
+func TestExecutePartialNotRendered(t *testing.T) {
+	tmpl, err := Parse(`{{ range .Messages }}{{ if eq .Role "user" }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{
+		Messages: []api.Message{
+			{Role: "user", Content: "What is your name?"},
+			{Role: "assistant", Content: "My name is", Partial: true},
+		},
+	}); !errors.Is(err, errPartialNotRendered) {
+		t.Fatalf("expected %v, got %v", errPartialNotRendered, err)
+	}
+}
+
+func TestExecuteHasTools(t *testing.T) {
+	tmpl, err := Parse(`{{ if .HasTools }}You can call these tools: {{ range .Tools }}{{ .Function.Name }} {{ end }}
+{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tool api.Tool
+	tool.Type = "function"
+	tool.Function.Name = "get_weather"
+
+	cases := []struct {
+		name   string
+		tools  []api.Tool
+		expect string
+	}{
+		{"without tools", nil, "What's the weather?"},
+		{"empty tools", []api.Tool{}, "What's the weather?"},
+		{"with tools", []api.Tool{tool}, "You can call these tools: get_weather \nWhat's the weather?"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{
+				Messages: []api.Message{{Role: "user", Content: "What's the weather?"}},
+				Tools:    tt.tools,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExecuteWithSuffix(t *testing.T) {
+	tmpl, err := Parse(`{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
+{{- else }}{{ .Prompt }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		values Values
+		expect string
+	}{
+		{"suffix", Values{Prompt: "def add(", Suffix: "return c"}, "<PRE> def add( <SUF>return c <MID>"},
+		{"no suffix", Values{Messages: []api.Message{{Role: "user", Content: "def add("}}}, "def add("},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	cases := []struct {
+		template     string
+		referenced   []string
+		unreferenced []string
+	}{
+		{"{{ .Prompt }}", []string{"Prompt"}, []string{"System", "Response", "Messages", "Tools"}},
+		{"{{ .System }} {{ .Prompt }} {{ .Response }}", []string{"System", "Prompt", "Response"}, []string{"Messages", "Tools"}},
+		{"{{ range .Messages }}{{ .Content }}{{ end }}", []string{"Messages"}, []string{"System", "Prompt", "Response", "Tools"}},
+		{"{{ if .Tools }}{{ json .Tools }}{{ end }}{{ range .Messages }}{{ if eq .Role \"system\" }}{{ $.System }}{{ end }}{{ end }}", []string{"System", "Messages", "Tools"}, []string{"Prompt", "Response"}},
+		{"{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}{{ end }}", []string{"Messages"}, []string{"System", "Prompt", "Response", "Tools"}},
+		{"hello", nil, []string{"System", "Prompt", "Response", "Messages", "Tools"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			referenced, unreferenced := tmpl.Fields()
+			if diff := cmp.Diff(referenced, tt.referenced); diff != "" {
+				t.Errorf("referenced mismatch (-got +want):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(unreferenced, tt.unreferenced); diff != "" {
+				t.Errorf("unreferenced mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLintTemplate(t *testing.T) {
+	t.Run("builtin", func(t *testing.T) {
+		matches, err := fs.Glob(templatesFS, "*.gotmpl")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, match := range matches {
+			bts, err := fs.ReadFile(templatesFS, match)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tmpl, err := Parse(string(bts))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if warnings := LintTemplate(tmpl); len(warnings) > 0 {
+				t.Errorf("%s: unexpected warnings %v", match, warnings)
+			}
+		}
+	})
+
+	cases := []struct {
+		name     string
+		template string
+		expected []LintWarning
+	}{
+		{"raw", `{{ .Prompt }}`, nil},
+		{"messages", `{{- range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`, nil},
+		{
+			"prompt after response",
+			`[INST] {{ .Prompt }} [/INST]
+{{ .Response }} {{ .Prompt }}`,
+			[]LintWarning{{Rule: LintPromptInAssistantTurn, Line: 2}},
+		},
+		{
+			"prompt in assistant message",
+			`{{- range .Messages }}
+{{- if eq .Role "user" }}USER: {{ .Content }}
+{{ else if eq .Role "assistant" }}ASSISTANT: {{ $.Prompt }}
+{{ end }}
+{{- end }}ASSISTANT: `,
+			[]LintWarning{{Rule: LintPromptInAssistantTurn, Line: 3}},
+		},
+		{
+			"unterminated user turn",
+			`<|user|>
+{{ .Prompt }}{{ .Response }}`,
+			[]LintWarning{{Rule: LintUnterminatedUserTurn, Line: 2}},
+		},
+		{
+			"response in prompt",
+			`{{ if .Prompt }}USER: {{ .Prompt }}
+ASSISTANT: {{ if .Response }}{{ .Response }}{{ end }}{{ end }}`,
+			[]LintWarning{{Rule: LintResponseInPrompt, Line: 2}},
+		},
+		{
+			"response in prompt else",
+			`{{ if .Prompt }}USER: {{ .Prompt }}
+ASSISTANT: {{ else }}{{ if .Response }}{{ .Response }}{{ end }}{{ end }}`,
+			nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(LintTemplate(tmpl), tt.expected, cmpopts.IgnoreFields(LintWarning{}, "Message")); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}